@@ -1,23 +1,41 @@
 package main
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
 )
 
 var (
 	version = "<unknown>"
 )
 
+// Prefix of the environment variables used to override the config file values.
+const envPrefix = "SNAPVAULT"
+
 // Define a config struct to hold all the configuration settings for our application.
 // We will read in these configuration settings from a config file when the
-// application starts.
+// application starts. Every field can be overridden with an environment variable,
+// named after the JSON path of the field (e.g. SNAPVAULT_DB_DSN).
 type config struct {
-	Address string `json:"address"`
-	Port    int    `json:"port"`
-	Env     string `json:"env"`
-	Db      struct {
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Env      string `json:"env"`
+	LogLevel string `json:"log_level"`
+	Db       struct {
 		Dsn          string `json:"dsn"`
 		MaxOpenConns int    `json:"max_open_conns"`
 		MaxIdleConns int    `json:"max_idle_conns"`
@@ -28,6 +46,12 @@ type config struct {
 		PerIp   bool    `json:"per_ip"`
 		Rps     float64 `json:"rps"`
 		Burst   int     `json:"burst"`
+		// Stricter limits of the registration, activation resend and key
+		// recovery endpoints, per IP and per email. Zero disables them.
+		Strict struct {
+			PerMinute float64 `json:"per_minute"`
+			Burst     int     `json:"burst"`
+		} `json:"strict"`
 	} `json:"rate-limit"`
 	Metrics struct {
 		MetricsEndpoint string `json:"metrics-endpoint"`
@@ -40,20 +64,76 @@ type config struct {
 		Sender   string `json:"sender"`
 	} `json:"smtp"`
 	Storage struct {
-		Root     string `json:"root"`
-		MaxSpace int64  `json:"max_space"`
+		Root               string `json:"root"`
+		MaxSpace           int64  `json:"max_space"`
+		MaxGalleryImages   int    `json:"max_gallery_images"`
+		MaxSelection       int    `json:"max_download_selection"`
+		ArchiveFileMode    string `json:"archive_file_mode"`
+		ArchiveCompression string `json:"archive_compression"`
+		ArchiveWorkers     int    `json:"archive_workers"`
+		ArchiveRate        int    `json:"archive_rate"`
+		ShardDirs          bool   `json:"shard_dirs"`
+		PathTemplate       string `json:"path_template"`
 	} `json:"storage"`
 	Cors struct {
 		TrustedOrigins []string `json:"trusted_origins"`
+		AllowedMethods []string `json:"allowed_methods"`
+		AllowedHeaders []string `json:"allowed_headers"`
+		MaxAge         int      `json:"max_age"`
 	} `json:"cors"`
+	Limits struct {
+		MaxJSONBody    int64    `json:"max_json_body"`
+		MaxImageBody   int64    `json:"max_image_body"`
+		RequestTimeout int      `json:"request_timeout"`
+		ImageTypes     []string `json:"image_types"`
+		MaxImageWidth  int      `json:"max_image_width"`
+		MaxImageHeight int      `json:"max_image_height"`
+	} `json:"limits"`
+	Auth struct {
+		ActivityInterval int    `json:"activity_interval"`
+		KeyCookie        string `json:"key_cookie"`
+		KeyQueryParam    string `json:"key_query_param"`
+		LockoutAttempts  int    `json:"lockout_attempts"`
+		LockoutWindow    int    `json:"lockout_window"`
+		SigningSecret    string `json:"signing_secret"`
+		MaxSignedTTL     int    `json:"max_signed_url_ttl"`
+		MaxKeys          int    `json:"max_keys"`
+		MaxKeysWithMain  bool   `json:"max_keys_include_main"`
+	} `json:"auth"`
+	Search struct {
+		Required []string `json:"required"`
+	} `json:"search"`
+	Pagination struct {
+		DefaultPageSize int `json:"default_page_size"`
+	} `json:"pagination"`
+	Views struct {
+		ExcludeOwner bool `json:"exclude_owner"`
+	} `json:"views"`
+	Tokens struct {
+		CleanupInterval int `json:"cleanup_interval"`
+		ActivationTTL   int `json:"activation_ttl"`
+		RecoveryTTL     int `json:"recovery_ttl"`
+	} `json:"tokens"`
+	Idempotency struct {
+		TTL   int `json:"ttl"`
+		Lease int `json:"lease"`
+	} `json:"idempotency"`
+	Background struct {
+		Workers   int `json:"workers"`
+		QueueSize int `json:"queue_size"`
+	} `json:"background"`
 	PublicHostname string `json:"public_hostname"`
 	DisplayVersion bool   `json:"-"` // not from config file
+	ConfigPath     string `json:"-"` // not from config file
+	AutoMigrate    bool   `json:"-"` // not from config file
 }
 
 // Erase sensitive information and JSON-format the configs. Useful
-// to print the config.
-func (c *config) Expose() string {
+// to print the config. The receiver is a copy, so the erased fields
+// are still available to the caller.
+func (c config) Expose() string {
 	c.Smtp.Password = ""
+	c.Auth.SigningSecret = ""
 	cfgBytes, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
 		panic(err)
@@ -61,25 +141,445 @@ func (c *config) Expose() string {
 	return string(cfgBytes)
 }
 
+const (
+	// Default maximum number of images in a single gallery.
+	defaultMaxGalleryImages = 1000
+	// Default maximum number of images downloaded with a single selection.
+	defaultMaxSelection = 100
+	// Default maximum number of gallery archives streamed concurrently.
+	defaultArchiveWorkers = 20
+	// Default interval between the deletions of expired tokens (minutes).
+	defaultTokensCleanup = 60
+	// Default lifetimes of activation and key recovery tokens (minutes), and
+	// the maximum one accepted (30 days).
+	defaultActivationTTL = 24 * 60
+	defaultRecoveryTTL   = 3 * 60
+	maxTokenTTL          = 30 * 24 * 60
+	// Default validity of idempotency keys (hours) and of the keys
+	// of requests still in progress (minutes).
+	defaultIdempotencyTTL   = 24
+	defaultIdempotencyLease = 10
+	// Default number of background tasks (e.g. emails) run concurrently
+	// and of the tasks waiting for a free worker.
+	defaultBackgroundWorkers = 10
+	defaultBackgroundQueue   = 100
+	// Default maximum size of JSON bodies (1MB) and of images (50MB).
+	defaultMaxJSONBody  = 1024 * 1024
+	defaultMaxImageBody = 1024 * 1024 * 50
+	// Default timeout of requests (seconds), streamed downloads excluded.
+	defaultRequestTimeout = 20
+	// Default failed password attempts allowed in the lockout window (minutes).
+	defaultLockoutAttempts = 5
+	defaultLockoutWindow   = 15
+	// Default strict rate limit of the endpoints sending emails (requests
+	// per minute per IP and per email) and its burst.
+	defaultStrictPerMinute = 5
+	defaultStrictBurst     = 3
+	// Default maximum number of auth keys of a user.
+	defaultMaxKeys = 50
+	// Default maximum validity of signed URLs (minutes), one week.
+	defaultMaxSignedTTL = 7 * 24 * 60
+	// Minimum length of the secret used to sign URLs.
+	minSigningSecretLen = 32
+)
+
+// Default methods and headers allowed in CORS preflight responses.
+var (
+	defaultCorsMethods = []string{"OPTIONS", "GET", "POST", "PUT", "PATCH", "DELETE"}
+	defaultCorsHeaders = []string{"Authorization", "Content-Type", "Idempotency-Key"}
+)
+
 // Parse command line flags and read in the config file at the provided path.
 func parseConfig() (config, error) {
-	var cfg config
-
 	version := flag.Bool("version", false, "Display version and exit")
 	configPath := flag.String("config", "./conf/api.dev.json", "Path to config file")
+	autoMigrate := flag.Bool("auto-migrate", false, "Apply the embedded database migrations before serving")
 	flag.Parse()
 
-	configBytes, err := os.ReadFile(*configPath)
+	// The config file is optional when all the required values are provided via
+	// environment variables. However, if a path is explicitly provided, the file
+	// must exist.
+	cfg, err := loadConfig(*configPath, isFlagSet("config"))
 	if err != nil {
 		return config{}, err
 	}
-	err = json.Unmarshal(configBytes, &cfg)
-	if err != nil {
+
+	// These are not from the config file.
+	cfg.DisplayVersion = *version
+	cfg.ConfigPath = *configPath
+	cfg.AutoMigrate = *autoMigrate
+
+	return cfg, nil
+}
+
+// Read the config file at the provided path, falling back to the defaults if the
+// file doesn't exist and it is not required, then apply the environment variables.
+// It is used at startup and when the config is reloaded.
+func loadConfig(path string, required bool) (config, error) {
+	var cfg config
+
+	// Defaults for optional values, overwritten if present in the
+	// config file or in the environment.
+	cfg.RateLimit.Strict.PerMinute = defaultStrictPerMinute
+	cfg.RateLimit.Strict.Burst = defaultStrictBurst
+	cfg.Storage.MaxGalleryImages = defaultMaxGalleryImages
+	cfg.Storage.PathTemplate = store.DefaultPathTemplate
+	cfg.Storage.MaxSelection = defaultMaxSelection
+	cfg.Storage.ArchiveWorkers = defaultArchiveWorkers
+	cfg.Tokens.CleanupInterval = defaultTokensCleanup
+	cfg.Tokens.ActivationTTL = defaultActivationTTL
+	cfg.Tokens.RecoveryTTL = defaultRecoveryTTL
+	cfg.Idempotency.TTL = defaultIdempotencyTTL
+	cfg.Idempotency.Lease = defaultIdempotencyLease
+	cfg.Background.Workers = defaultBackgroundWorkers
+	cfg.Background.QueueSize = defaultBackgroundQueue
+	cfg.Limits.MaxJSONBody = defaultMaxJSONBody
+	cfg.Limits.MaxImageBody = defaultMaxImageBody
+	cfg.Limits.RequestTimeout = defaultRequestTimeout
+	cfg.Auth.LockoutAttempts = defaultLockoutAttempts
+	cfg.Auth.LockoutWindow = defaultLockoutWindow
+	cfg.Auth.MaxSignedTTL = defaultMaxSignedTTL
+	cfg.Auth.MaxKeys = defaultMaxKeys
+	cfg.Cors.AllowedMethods = defaultCorsMethods
+	cfg.Cors.AllowedHeaders = defaultCorsHeaders
+
+	configBytes, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !required:
+	case err != nil:
 		return config{}, err
+	default:
+		err = json.Unmarshal(configBytes, &cfg)
+		if err != nil {
+			return config{}, err
+		}
 	}
 
-	// This is not from the config file.
-	cfg.DisplayVersion = *version
+	// Environment variables take precedence over the config file.
+	err = applyEnv(reflect.ValueOf(&cfg).Elem(), envPrefix)
+	if err != nil {
+		return config{}, err
+	}
 
 	return cfg, nil
 }
+
+// Validate the semantic of the config values, so that a misconfiguration is caught at
+// startup instead of surfacing later as a confusing runtime error. All the problems
+// found are reported at once.
+func (c config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port <= 65535, "port: must be in the range 1-65535, got %d", c.Port)
+	check(c.Db.Dsn != "", "db.dsn: must be provided")
+	_, err := c.logLevel()
+	check(err == nil, "log_level: must be one of debug, info, warn, error, got '%s'", c.LogLevel)
+	check(c.Storage.MaxSpace >= 0, "storage.max_space: must not be negative, got %d", c.Storage.MaxSpace)
+	check(c.Storage.MaxGalleryImages >= 0, "storage.max_gallery_images: must not be negative, got %d", c.Storage.MaxGalleryImages)
+	check(c.Storage.MaxSelection >= 0, "storage.max_download_selection: must not be negative, got %d", c.Storage.MaxSelection)
+	check(c.Storage.ArchiveWorkers > 0, "storage.archive_workers: must be positive, got %d", c.Storage.ArchiveWorkers)
+	check(c.Storage.ArchiveRate >= 0, "storage.archive_rate: must not be negative, got %d", c.Storage.ArchiveRate)
+	check(c.Tokens.CleanupInterval >= 0, "tokens.cleanup_interval: must not be negative, got %d", c.Tokens.CleanupInterval)
+	check(
+		c.Tokens.ActivationTTL > 0 && c.Tokens.ActivationTTL <= maxTokenTTL,
+		"tokens.activation_ttl: must be between 1 and %d minutes, got %d", maxTokenTTL, c.Tokens.ActivationTTL,
+	)
+	check(
+		c.Tokens.RecoveryTTL > 0 && c.Tokens.RecoveryTTL <= maxTokenTTL,
+		"tokens.recovery_ttl: must be between 1 and %d minutes, got %d", maxTokenTTL, c.Tokens.RecoveryTTL,
+	)
+	check(c.Idempotency.TTL > 0, "idempotency.ttl: must be positive, got %d", c.Idempotency.TTL)
+	check(c.Idempotency.Lease > 0, "idempotency.lease: must be positive, got %d", c.Idempotency.Lease)
+	check(c.Background.Workers > 0, "background.workers: must be positive, got %d", c.Background.Workers)
+	check(c.Background.QueueSize >= 0, "background.queue_size: must not be negative, got %d", c.Background.QueueSize)
+	check(c.Auth.ActivityInterval >= 0, "auth.activity_interval: must not be negative, got %d", c.Auth.ActivityInterval)
+	check(c.Auth.LockoutAttempts >= 0, "auth.lockout_attempts: must not be negative, got %d", c.Auth.LockoutAttempts)
+	check(c.Auth.SigningSecret == "" || len(c.Auth.SigningSecret) >= minSigningSecretLen, "auth.signing_secret: must be at least %d characters long", minSigningSecretLen)
+	check(c.Auth.MaxKeys >= 0, "auth.max_keys: must not be negative, got %d", c.Auth.MaxKeys)
+	check(c.Auth.MaxSignedTTL > 0, "auth.max_signed_url_ttl: must be positive, got %d", c.Auth.MaxSignedTTL)
+	if c.Auth.LockoutAttempts > 0 {
+		check(c.Auth.LockoutWindow > 0, "auth.lockout_window: must be positive when lockout is enabled, got %d", c.Auth.LockoutWindow)
+	}
+
+	if c.Storage.ArchiveFileMode != "" {
+		_, err := c.archiveFileMode()
+		check(err == nil, "storage.archive_file_mode: must be an octal permission (e.g. 0644), got '%s'", c.Storage.ArchiveFileMode)
+	}
+	_, _, err = c.archiveCompression()
+	check(
+		err == nil,
+		"storage.archive_compression: must be 'default', 'none', 'auto' or a level from 1 to 9, got '%s'", c.Storage.ArchiveCompression,
+	)
+
+	check(
+		c.Pagination.DefaultPageSize >= 0,
+		"pagination.default_page_size: must not be negative, got %d", c.Pagination.DefaultPageSize,
+	)
+	check(c.Limits.RequestTimeout >= 0, "limits.request_timeout: must not be negative, got %d", c.Limits.RequestTimeout)
+	check(c.Limits.MaxImageWidth >= 0, "limits.max_image_width: must not be negative, got %d", c.Limits.MaxImageWidth)
+	check(c.Limits.MaxImageHeight >= 0, "limits.max_image_height: must not be negative, got %d", c.Limits.MaxImageHeight)
+	for _, t := range c.Limits.ImageTypes {
+		check(strings.HasPrefix(t, "image/"), "limits.image_types: '%s' is not an image MIME type", t)
+	}
+	check(c.Limits.MaxJSONBody > 0, "limits.max_json_body: must be positive, got %d", c.Limits.MaxJSONBody)
+	check(
+		c.Limits.MaxImageBody >= c.Limits.MaxJSONBody,
+		"limits.max_image_body: must not be less than limits.max_json_body, got %d", c.Limits.MaxImageBody,
+	)
+
+	// The storage root must be an existing and writable directory.
+	if c.Storage.Root == "" {
+		problems = append(problems, "storage.root: must be provided")
+	} else if err := checkWritableDir(c.Storage.Root); err != nil {
+		problems = append(problems, fmt.Sprintf("storage.root: %v", err))
+	}
+	if _, err := store.ParsePathTemplate(c.Storage.PathTemplate); err != nil {
+		problems = append(problems, fmt.Sprintf("storage.path_template: %v", err))
+	}
+
+	if c.RateLimit.Enabled {
+		check(c.RateLimit.Rps > 0, "rate-limit.rps: must be positive when rate limiting is enabled, got %v", c.RateLimit.Rps)
+		check(c.RateLimit.Burst > 0, "rate-limit.burst: must be positive when rate limiting is enabled, got %d", c.RateLimit.Burst)
+	}
+	check(c.RateLimit.Strict.PerMinute >= 0, "rate-limit.strict.per_minute: must not be negative, got %v", c.RateLimit.Strict.PerMinute)
+	if c.RateLimit.Strict.PerMinute > 0 {
+		check(c.RateLimit.Strict.Burst > 0, "rate-limit.strict.burst: must be positive when strict limits are enabled, got %d", c.RateLimit.Strict.Burst)
+	}
+
+	check(
+		strings.HasPrefix(c.Metrics.MetricsEndpoint, "/"),
+		"metrics.metrics-endpoint: must start with '/', got '%s'", c.Metrics.MetricsEndpoint,
+	)
+
+	// Trusted origins are compared with the Origin header, so they must be in the
+	// form scheme://host[:port], without paths. The host could start with the '*.'
+	// wildcard, matching any subdomain.
+	for _, origin := range c.Cors.TrustedOrigins {
+		u, err := url.Parse(origin)
+		valid := err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && (u.Path == "" || u.Path == "/")
+		if valid {
+			host := strings.TrimPrefix(u.Host, "*.")
+			valid = host != "" && !strings.Contains(host, "*")
+		}
+		check(valid, "cors.trusted_origins: '%s' is not a valid origin (expected scheme://host[:port] or scheme://*.host[:port])", origin)
+	}
+
+	// Methods and headers are sent as they are in the preflight responses.
+	for _, method := range c.Cors.AllowedMethods {
+		check(isHTTPMethod(method), "cors.allowed_methods: '%s' is not an HTTP method", method)
+	}
+	for _, header := range c.Cors.AllowedHeaders {
+		check(headerNameRX.MatchString(header), "cors.allowed_headers: '%s' is not a valid header name", header)
+	}
+	check(c.Cors.MaxAge >= 0, "cors.max_age: must not be negative, got %d", c.Cors.MaxAge)
+
+	for _, endpoint := range c.Search.Required {
+		check(isSearchEndpoint(endpoint), "search.required: unknown listing endpoint '%s'", endpoint)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// Valid HTTP header names, as defined by RFC 7230 (tokens).
+var headerNameRX = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// Report whether the provided value is one of the standard HTTP methods (case-sensitive).
+func isHTTPMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// Names of the listing endpoints supporting the search.required config.
+const (
+	searchPublicGalleries     = "public_galleries"
+	searchGalleries           = "galleries"
+	searchPublicImages        = "public_images"
+	searchPublicGalleryImages = "public_gallery_images"
+	searchGalleryImages       = "gallery_images"
+	searchImages              = "images"
+	searchMoveTargets         = "move_targets"
+)
+
+// Report whether the provided name is one of the listing endpoints above.
+func isSearchEndpoint(name string) bool {
+	for _, e := range []string{
+		searchPublicGalleries, searchGalleries, searchPublicImages,
+		searchPublicGalleryImages, searchGalleryImages, searchImages, searchMoveTargets,
+	} {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether the listing endpoint requires a non-empty search term. By default
+// an empty search matches all the records.
+func (c config) searchRequired(endpoint string) bool {
+	for _, e := range c.Search.Required {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the provided path is an existing directory where files can be created.
+func checkWritableDir(path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", path)
+	}
+	file, err := os.CreateTemp(path, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("'%s' is not writable: %v", path, err)
+	}
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
+
+// Report whether the flag with the provided name was explicitly set.
+func isFlagSet(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// Walk the config struct recursively and override each field with the value of the
+// corresponding environment variable, if set. The name of the variable is derived
+// from the JSON tags of the field and of its parents, uppercased and joined with
+// underscores (e.g. 'rate-limit' -> 'rps' becomes SNAPVAULT_RATE_LIMIT_RPS). Slices
+// of strings are read as comma separated lists.
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(strings.ReplaceAll(tag, "-", "_"))
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			err := applyEnv(field, name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			var b bool
+			b, err = strconv.ParseBool(value)
+			field.SetBool(b)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			var n int64
+			n, err = strconv.ParseInt(value, 10, 64)
+			field.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			var n uint64
+			n, err = strconv.ParseUint(value, 10, 64)
+			field.SetUint(n)
+		case reflect.Float32, reflect.Float64:
+			var f float64
+			f, err = strconv.ParseFloat(value, 64)
+			field.SetFloat(f)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("env var %s: unsupported type %s", name, field.Type())
+			}
+			var values []string
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					values = append(values, s)
+				}
+			}
+			field.Set(reflect.ValueOf(values))
+		default:
+			return fmt.Errorf("env var %s: unsupported type %s", name, field.Type())
+		}
+		if err != nil {
+			return fmt.Errorf("env var %s: invalid value '%s'", name, value)
+		}
+	}
+	return nil
+}
+
+// Parse the gzip compression level of the gallery archives. Besides the levels from
+// 1 (best speed) to 9 (best compression), 'none' disables the compression and 'auto'
+// disables it only for galleries made mostly of already compressed images, using the
+// default level otherwise. An empty value means the default level.
+func (c config) archiveCompression() (level int, auto bool, err error) {
+	switch c.Storage.ArchiveCompression {
+	case "", "default":
+		return gzip.DefaultCompression, false, nil
+	case "none":
+		return gzip.NoCompression, false, nil
+	case "auto":
+		return gzip.DefaultCompression, true, nil
+	}
+	level, err = strconv.Atoi(c.Storage.ArchiveCompression)
+	if err != nil {
+		return 0, false, err
+	}
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return 0, false, fmt.Errorf("invalid compression level %d", level)
+	}
+	return level, false, nil
+}
+
+// Parse the octal file mode of the gallery archive entries. An empty
+// value results in a zero mode, that is, the service default.
+func (c config) archiveFileMode() (os.FileMode, error) {
+	if c.Storage.ArchiveFileMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(c.Storage.ArchiveFileMode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid permission bits %o", mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Parse the minimum level of the logs. An empty value results in the
+// debug level in the dev environment and in the info level otherwise.
+func (c config) logLevel() (zapcore.Level, error) {
+	if c.LogLevel == "" {
+		if c.Env == "dev" {
+			return zapcore.DebugLevel, nil
+		}
+		return zapcore.InfoLevel, nil
+	}
+	return zapcore.ParseLevel(c.LogLevel)
+}
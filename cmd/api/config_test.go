@@ -0,0 +1,172 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Environment variables override the defaults, named after the JSON path of the fields.
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("SNAPVAULT_RATE_LIMIT_RPS", "2.5")
+	t.Setenv("SNAPVAULT_RATE_LIMIT_ENABLED", "true")
+	t.Setenv("SNAPVAULT_TOKENS_RECOVERY_TTL", "30")
+	t.Setenv("SNAPVAULT_DB_DSN", "postgres://localhost/test")
+	t.Setenv("SNAPVAULT_CORS_TRUSTED_ORIGINS", "https://a.example.com, ,https://b.example.com")
+
+	cfg, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RateLimit.Rps != 2.5 || !cfg.RateLimit.Enabled {
+		t.Fatalf("rate limit not overridden: %+v", cfg.RateLimit)
+	}
+	if cfg.Tokens.RecoveryTTL != 30 {
+		t.Fatalf("expected recovery TTL 30, got %d", cfg.Tokens.RecoveryTTL)
+	}
+	if cfg.Db.Dsn != "postgres://localhost/test" {
+		t.Fatalf("unexpected dsn %q", cfg.Db.Dsn)
+	}
+	if strings.Join(cfg.Cors.TrustedOrigins, " ") != "https://a.example.com https://b.example.com" {
+		t.Fatalf("unexpected trusted origins %q", cfg.Cors.TrustedOrigins)
+	}
+	// Values not in the environment keep their defaults.
+	if cfg.Tokens.ActivationTTL != defaultActivationTTL {
+		t.Fatalf("expected default activation TTL, got %d", cfg.Tokens.ActivationTTL)
+	}
+}
+
+// Malformed values of the environment variables are reported.
+func TestApplyEnvInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"SNAPVAULT_RATE_LIMIT_RPS", "fast"},
+		{"SNAPVAULT_RATE_LIMIT_ENABLED", "yes please"},
+		{"SNAPVAULT_TOKENS_RECOVERY_TTL", "30m"},
+		{"SNAPVAULT_PORT", "4000.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			_, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"), false)
+			if err == nil || !strings.Contains(err.Error(), tt.name) {
+				t.Fatalf("expected an error about %s, got %v", tt.name, err)
+			}
+		})
+	}
+}
+
+// Return a valid config, with the defaults and the required values.
+func validConfig(t *testing.T) config {
+	t.Helper()
+	cfg, err := loadConfig(filepath.Join(t.TempDir(), "missing.json"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Port = 4000
+	cfg.Db.Dsn = "postgres://localhost/test"
+	cfg.Storage.Root = t.TempDir()
+	cfg.Metrics.MetricsEndpoint = "/metrics"
+	return cfg
+}
+
+// Invalid values are rejected, and all the problems of a config are reported at once.
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *config)
+		want   []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *config) {},
+		},
+		{
+			name: "negative limits",
+			modify: func(c *config) {
+				c.Storage.MaxSpace = -1
+				c.Storage.MaxGalleryImages = -1
+				c.Limits.RequestTimeout = -1
+				c.Auth.MaxKeys = -1
+			},
+			want: []string{"storage.max_space", "storage.max_gallery_images", "limits.request_timeout", "auth.max_keys"},
+		},
+		{
+			name:   "unknown log level",
+			modify: func(c *config) { c.LogLevel = "verbose" },
+			want:   []string{"log_level"},
+		},
+		{
+			name:   "bad archive compression",
+			modify: func(c *config) { c.Storage.ArchiveCompression = "11" },
+			want:   []string{"storage.archive_compression"},
+		},
+		{
+			name:   "bad archive file mode",
+			modify: func(c *config) { c.Storage.ArchiveFileMode = "0999" },
+			want:   []string{"storage.archive_file_mode"},
+		},
+		{
+			name:   "bad path template",
+			modify: func(c *config) { c.Storage.PathTemplate = "../{name}_{rand}" },
+			want:   []string{"storage.path_template"},
+		},
+		{
+			name: "bad token ttls",
+			modify: func(c *config) {
+				c.Tokens.ActivationTTL = 0
+				c.Tokens.RecoveryTTL = maxTokenTTL + 1
+			},
+			want: []string{"tokens.activation_ttl", "tokens.recovery_ttl"},
+		},
+		{
+			name: "bad cors lists",
+			modify: func(c *config) {
+				c.Cors.AllowedMethods = []string{"GET", "FETCH"}
+				c.Cors.AllowedHeaders = []string{"X-Request-Id", "Bad Header"}
+				c.Cors.MaxAge = -1
+			},
+			want: []string{"cors.allowed_methods", "cors.allowed_headers", "cors.max_age"},
+		},
+		{
+			name: "all the problems",
+			modify: func(c *config) {
+				c.Storage.MaxSelection = -1
+				c.LogLevel = "verbose"
+				c.Storage.ArchiveCompression = "fast"
+				c.Storage.ArchiveFileMode = "rw-r--r--"
+			},
+			want: []string{"storage.max_download_selection", "log_level", "storage.archive_compression", "storage.archive_file_mode"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			tt.modify(&cfg)
+			err := cfg.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("expected a valid config, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			// Each problem is reported on its own line.
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tt.want)+1 {
+				t.Fatalf("expected %d problems, got:\n%v", len(tt.want), err)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), "- "+w+":") {
+					t.Errorf("problem with %s not reported:\n%v", w, err)
+				}
+			}
+		})
+	}
+}
@@ -1,33 +1,50 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
-)
 
-const (
-	maxBytesBody = 1048576
+	"github.com/anBertoli/snap-vault/pkg/filters"
+	"github.com/anBertoli/snap-vault/pkg/idempotency"
+	"github.com/anBertoli/snap-vault/pkg/validator"
 )
 
+// Returned when the body of a request has not the expected content type.
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
 // The readJSON helper is used to decode the request body into the target destination.
-func readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+// The size of the body is limited by the configuration. The request must declare a JSON
+// content type, otherwise an error wrapping errUnsupportedMediaType is returned.
+func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	maxBytesBody := app.config.Limits.MaxJSONBody
+
+	// Parameters like the charset are allowed, but the media type must be JSON.
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return fmt.Errorf("%w: the Content-Type header must be application/json", errUnsupportedMediaType)
+	}
 
-	// Limit the size of the request body to 1MB.
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytesBody))
+	// Limit the size of the request body.
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytesBody)
 
 	// Read all the request body in memory as raw bytes. The body cannot be empty.
 	jsonBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		switch {
-		// Body > 1MB in size.
-		case err.Error() == "http: request body too large":
+		// Body larger than the limit.
+		case isBodyTooLarge(err):
 			return fmt.Errorf("body must not be larger than %d bytes", maxBytesBody)
 		default:
 			return err
@@ -38,11 +55,19 @@ func readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 		return errors.New("body must not be empty")
 	}
 
-	// Try to unmarshal the bytes into the destination. If there is an error
-	// during un-marshaling, try to return an informative error, otherwise
-	// the destination will store the decoded JSON values.
-	err = json.Unmarshal(jsonBytes, dst)
+	// Try to decode the bytes into the destination. Fields not present in the
+	// destination are rejected. If there is an error during decoding, try to
+	// return an informative error, otherwise the destination will store the
+	// decoded JSON values.
+	dec := json.NewDecoder(bytes.NewReader(jsonBytes))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(dst)
 	if err == nil {
+		// The body must contain a single JSON value, without trailing data.
+		err = dec.Decode(&struct{}{})
+		if err != io.EOF {
+			return errors.New("body must only contain a single JSON value")
+		}
 		return nil
 	}
 
@@ -69,6 +94,17 @@ func readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 		}
 		return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
 
+	// The decoder returns an untyped error for syntax errors at the end of the body.
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body contains badly-formed JSON")
+
+	// If the JSON contains a field which cannot be mapped to the destination the
+	// decoder returns an error in the form 'json: unknown field "<name>"'. There
+	// isn't a distinct error type for this, so the field name is extracted.
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return fmt.Errorf("body contains unknown field %s", fieldName)
+
 	// A json.InvalidUnmarshalError error will be returned if we pass a nil pointer
 	// to json.Unmarshal(). We catch this and panic, rather than returning an error,
 	// because this is a developer error that must not happen.
@@ -81,6 +117,36 @@ func readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	}
 }
 
+// Report whether the error was returned by a http.MaxBytesReader because the limit was exceeded.
+func isBodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// The bodyReader wraps a request body and records the first error encountered
+// reading it (io.EOF excluded). It is useful when the body is consumed by
+// another layer, to tell apart failures of the client (e.g. a connection
+// closed mid-upload) from internal ones. Reads fail as soon as the context of
+// the request is done, so an abandoned upload isn't consumed any further.
+type bodyReader struct {
+	ctx context.Context
+	r   io.Reader
+	err error
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	if err := br.ctx.Err(); err != nil {
+		if br.err == nil {
+			br.err = err
+		}
+		return 0, err
+	}
+	n, err := br.r.Read(p)
+	if err != nil && err != io.EOF && br.err == nil {
+		br.err = err
+	}
+	return n, err
+}
+
 // Extract a numeric value from the URL params provided by the router.
 func readUrlIntParam(r *http.Request, param string) (int64, error) {
 	params := mux.Vars(r)
@@ -115,6 +181,140 @@ func readInt(qs url.Values, key string, defaultValue int) int {
 	return i
 }
 
+// Extract a boolean value for a given key from the query string. If no key exists, or the
+// value is not a valid boolean, the function will default to the provided value.
+func readBool(qs url.Values, key string, defaultValue bool) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return defaultValue
+	}
+	return b
+}
+
+// Extract a comma-separated list of values for a given key from the query string.
+// Empty elements are discarded. If no key exists this will return a nil slice.
+func readCSV(qs url.Values, key string) []string {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// Build the filtering and pagination input of a listing from the query string, from the
+// page, page_size, sort, search and search_field keys. Missing values are taken from the
+// provided defaults of the listing, except the page size, configured globally if set in
+// the pagination.default_page_size config value. The search is read only if the listing
+// has searchable columns.
+func (app *application) readFilter(qs url.Values, defaults filters.Defaults) filters.Input {
+	pageSize := defaults.PageSize
+	if app.config.Pagination.DefaultPageSize > 0 {
+		pageSize = app.config.Pagination.DefaultPageSize
+	}
+	filter := filters.Input{
+		Page:         readInt(qs, "page", 1),
+		PageSize:     readInt(qs, "page_size", pageSize),
+		SortCol:      readString(qs, "sort", defaults.Sort),
+		SortSafeList: defaults.SortSafeList,
+	}
+	if len(defaults.SearchSafeList) > 0 {
+		filter.Search = readString(qs, "search", "")
+		filter.SearchCol = readString(qs, "search_field", defaults.SearchCol)
+		filter.SearchColumnSafeList = defaults.SearchSafeList
+	}
+	return filter
+}
+
+// Extract the optional creation time range of a listing from the query string, from the
+// created_from and created_to keys. Values must be RFC 3339 timestamps, otherwise a
+// validation error is returned.
+func readDateRange(qs url.Values, filter *filters.Input) error {
+	v := validator.New()
+	for _, param := range []struct {
+		key string
+		dst **time.Time
+	}{
+		{"created_from", &filter.CreatedFrom},
+		{"created_to", &filter.CreatedTo},
+	} {
+		s := qs.Get(param.key)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			v.AddError(param.key, "must be a RFC 3339 timestamp")
+			continue
+		}
+		*param.dst = &t
+	}
+	if !v.Ok() {
+		return v
+	}
+	return nil
+}
+
+// Extract the published status filter from the query string. The value could be 'true',
+// 'false' or 'all' (the default), the latter is returned as a nil pointer, meaning that
+// no filtering is applied. Other values result in a validation error.
+func readPublished(qs url.Values, key string) (*bool, error) {
+	switch qs.Get(key) {
+	case "", "all":
+		return nil, nil
+	case "true":
+		published := true
+		return &published, nil
+	case "false":
+		published := false
+		return &published, nil
+	default:
+		v := validator.New()
+		v.AddError(key, "must be one of true, false or all")
+		return nil, v
+	}
+}
+
+// The nullableString type distinguishes, in a JSON body, between an omitted field (Set
+// is false), an explicit null (Set is true and Value is nil) and a string value.
+type nullableString struct {
+	Set   bool
+	Value *string
+}
+
+func (ns *nullableString) UnmarshalJSON(data []byte) error {
+	ns.Set = true
+	if string(data) == "null" {
+		ns.Value = nil
+		return nil
+	}
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	ns.Value = &s
+	return nil
+}
+
+// Return the value as a pointer-to-pointer, nil if the field was omitted.
+func (ns nullableString) Ptr() **string {
+	if !ns.Set {
+		return nil
+	}
+	return &ns.Value
+}
+
 const (
 	dataMode       = "data"
 	attachmentMode = "attachment"
@@ -139,3 +339,13 @@ func readMode(qs url.Values, key string, defaultValue string) string {
 	}
 	return s
 }
+
+// Return the context of the request carrying the key of the Idempotency-Key header,
+// if present. Retrying a request with the same key doesn't create the resource twice.
+func idempotencyContext(r *http.Request) context.Context {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return r.Context()
+	}
+	return idempotency.ContextSetKey(r.Context(), key)
+}
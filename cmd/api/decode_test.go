@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type readJSONInput struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+// Decode the body with the readJSON helper, limiting the body to 64 bytes.
+func readTestJSON(body, contentType string) (readJSONInput, error) {
+	app := &application{}
+	app.config.Limits.MaxJSONBody = 64
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	var input readJSONInput
+	err := app.readJSON(httptest.NewRecorder(), r, &input)
+	return input, err
+}
+
+// Bodies are rejected with an informative error if they are not a single JSON object
+// matching the destination, or if they are not declared as JSON.
+func TestReadJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		err         string
+	}{
+		{name: "valid", body: `{"name":"Ann","age":30}`, contentType: "application/json"},
+		{name: "charset", body: `{"name":"Ann","age":30}`, contentType: "application/json; charset=utf-8"},
+		{name: "missing content type", body: `{"name":"Ann"}`, err: "Content-Type header must be application/json"},
+		{name: "wrong content type", body: `{"name":"Ann"}`, contentType: "text/plain", err: "Content-Type header must be application/json"},
+		{name: "empty", contentType: "application/json", err: "body must not be empty"},
+		{name: "oversize", body: `{"name":"` + strings.Repeat("a", 64) + `"}`, contentType: "application/json", err: "body must not be larger than 64 bytes"},
+		{name: "type mismatch", body: `{"age":"thirty"}`, contentType: "application/json", err: `incorrect JSON type for field "age"`},
+		{name: "wrong top level type", body: `["Ann"]`, contentType: "application/json", err: "incorrect JSON type (at character 1)"},
+		{name: "badly-formed", body: `{"name":}`, contentType: "application/json", err: "badly-formed JSON (at character 9)"},
+		{name: "truncated", body: `{"name":"Ann"`, contentType: "application/json", err: "body contains badly-formed JSON"},
+		{name: "unknown field", body: `{"nickname":"Ann"}`, contentType: "application/json", err: `unknown field "nickname"`},
+		{name: "trailing data", body: `{"name":"Ann"} trailing`, contentType: "application/json", err: "single JSON value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input, err := readTestJSON(tt.body, tt.contentType)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				if input.Name != "Ann" || input.Age != 30 {
+					t.Fatalf("unexpected decoded input %+v", input)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// Only the content type problems are reported as unsupported media type.
+func TestReadJSONUnsupportedMediaType(t *testing.T) {
+	_, err := readTestJSON(`{"name":"Ann"}`, "application/xml")
+	if !errors.Is(err, errUnsupportedMediaType) {
+		t.Fatalf("expected errUnsupportedMediaType, got %v", err)
+	}
+	_, err = readTestJSON(`{"name":`, "application/json")
+	if errors.Is(err, errUnsupportedMediaType) {
+		t.Fatalf("unexpected errUnsupportedMediaType for a malformed body: %v", err)
+	}
+}
+
+// The errors of the decoding are sent with the 415 or 400 status codes.
+func TestReadJSONStatus(t *testing.T) {
+	ts, _ := newMockServer(t, func(cfg *config) {
+		cfg.RateLimit.Strict.PerMinute = 0
+	})
+
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		status      int
+		code        string
+	}{
+		{name: "missing content type", body: `{"name":"Ann"}`, status: http.StatusUnsupportedMediaType, code: "unsupported_media_type"},
+		{name: "wrong content type", body: `{"name":"Ann"}`, contentType: "text/plain", status: http.StatusUnsupportedMediaType, code: "unsupported_media_type"},
+		{name: "unknown field", body: `{"nickname":"Ann"}`, contentType: "application/json", status: http.StatusBadRequest, code: "malformed_body"},
+		{name: "empty", contentType: "application/json", status: http.StatusBadRequest, code: "malformed_body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := ts.do(t, http.MethodPost, "/v1/users/register", "", strings.NewReader(tt.body), tt.contentType)
+			if status != tt.status || !strings.Contains(string(body), `"code": "`+tt.code+`"`) {
+				t.Fatalf("expected status %d and code %s, got %d: %s", tt.status, tt.code, status, body)
+			}
+		})
+	}
+}
+
+// The body must hold exactly one JSON object with known fields, trailing whitespace
+// aside: more values or leftover data after the first one are rejected.
+func TestReadJSONSingleValue(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{name: "trailing whitespace", body: "{\"name\":\"Ann\",\"age\":30}\n\t "},
+		{name: "two objects", body: `{"name":"Ann","age":30}{"name":"Bob"}`, err: "single JSON value"},
+		{name: "two objects on lines", body: "{\"name\":\"Ann\",\"age\":30}\n{\"name\":\"Bob\"}\n", err: "single JSON value"},
+		{name: "object and array", body: `{"name":"Ann","age":30} []`, err: "single JSON value"},
+		{name: "object and number", body: `{"name":"Ann","age":30} 1`, err: "single JSON value"},
+		{name: "unknown field among known", body: `{"name":"Ann","age":30,"admin":true}`, err: `unknown field "admin"`},
+		{name: "unknown object field", body: `{"name":"Ann","meta":{"age":30}}`, err: `unknown field "meta"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input, err := readTestJSON(tt.body, "application/json")
+			if tt.err == "" {
+				if err != nil || input.Name != "Ann" || input.Age != 30 {
+					t.Fatalf("expected the input to be decoded, got %+v and %v", input, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
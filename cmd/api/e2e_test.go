@@ -0,0 +1,370 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Register a user, activate it with the token sent via email, create a gallery and
+// upload an image, then download it and check the content is unchanged.
+func TestRegisterActivateUploadDownload(t *testing.T) {
+	ts := newTestServer(t, nil)
+	email := fmt.Sprintf("e2e-%d@example.com", time.Now().UnixNano())
+
+	var registered struct {
+		Keys struct {
+			AuthKey string `json:"auth_key"`
+		} `json:"keys"`
+	}
+	status := ts.doJSON(t, http.MethodPost, "/v1/users/register", "", map[string]string{
+		"name":     "End To End",
+		"email":    email,
+		"password": "pa55word-e2e",
+	}, &registered)
+	if status != http.StatusOK {
+		t.Fatalf("register: got status %d", status)
+	}
+	key := registered.Keys.AuthKey
+
+	// The key can't be used before the activation.
+	status = ts.doJSON(t, http.MethodGet, "/v1/users/me", key, nil, nil)
+	if status == http.StatusOK {
+		t.Fatalf("me before activation: got status %d", status)
+	}
+
+	mail := ts.mailer.waitFor(t, email)
+	token, _ := mail.Data["activationToken"].(string)
+	if mail.Template != "user_welcome.gohtml" || token == "" {
+		t.Fatalf("unexpected activation mail: %+v", mail)
+	}
+	status = ts.doJSON(t, http.MethodGet, "/v1/users/activate?token="+token, "", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("activate: got status %d", status)
+	}
+
+	var created struct {
+		Gallery struct {
+			ID int64 `json:"id"`
+		} `json:"gallery"`
+	}
+	status = ts.doJSON(t, http.MethodPost, "/v1/galleries", key, map[string]interface{}{
+		"title":       "e2e gallery",
+		"description": "created by the end-to-end tests",
+	}, &created)
+	if status != http.StatusOK {
+		t.Fatalf("create gallery: got status %d", status)
+	}
+
+	content := testPNG(t)
+	status, body := ts.do(t, http.MethodPost, fmt.Sprintf("/v1/galleries/%d/images?title=pixel", created.Gallery.ID),
+		key, bytes.NewReader(content), "image/png")
+	if status != http.StatusOK {
+		t.Fatalf("upload: got status %d: %s", status, body)
+	}
+	var uploaded struct {
+		Image struct {
+			ID int64 `json:"id"`
+		} `json:"image"`
+	}
+	err := json.Unmarshal(body, &uploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body = ts.do(t, http.MethodGet, fmt.Sprintf("/v1/galleries/images/%d?mode=attachment", uploaded.Image.ID), key, nil, "")
+	if status != http.StatusOK {
+		t.Fatalf("download: got status %d", status)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatalf("downloaded content differs from the uploaded one")
+	}
+}
+
+// Request a new activation token, which replaces the one sent at registration, and
+// activate the user with it. Once active, no more tokens can be requested.
+func TestResendActivation(t *testing.T) {
+	ts := newTestServer(t, nil)
+	email := fmt.Sprintf("e2e-resend-%d@example.com", time.Now().UnixNano())
+	credentials := map[string]string{
+		"email":    email,
+		"password": "pa55word-e2e",
+	}
+
+	var registered struct {
+		Keys struct {
+			AuthKey string `json:"auth_key"`
+		} `json:"keys"`
+	}
+	status := ts.doJSON(t, http.MethodPost, "/v1/users/register", "", map[string]string{
+		"name":     "End To End",
+		"email":    email,
+		"password": "pa55word-e2e",
+	}, &registered)
+	if status != http.StatusOK {
+		t.Fatalf("register: got status %d", status)
+	}
+	oldToken, _ := ts.mailer.waitFor(t, email).Data["activationToken"].(string)
+
+	status = ts.doJSON(t, http.MethodPost, "/v1/users/activate", "", credentials, nil)
+	if status != http.StatusOK {
+		t.Fatalf("resend: got status %d", status)
+	}
+	mail := ts.mailer.waitFor(t, email)
+	token, _ := mail.Data["activationToken"].(string)
+	if mail.Template != "user_welcome.gohtml" || token == "" || token == oldToken {
+		t.Fatalf("unexpected activation mail: %+v", mail)
+	}
+
+	// The token sent at registration is not valid anymore.
+	status = ts.doJSON(t, http.MethodGet, "/v1/users/activate?token="+oldToken, "", nil, nil)
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("activate with the old token: got status %d", status)
+	}
+	status = ts.doJSON(t, http.MethodGet, "/v1/users/activate?token="+token, "", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("activate: got status %d", status)
+	}
+	status = ts.doJSON(t, http.MethodGet, "/v1/users/me", registered.Keys.AuthKey, nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("me after activation: got status %d", status)
+	}
+
+	var res struct {
+		Code string `json:"code"`
+	}
+	status = ts.doJSON(t, http.MethodPost, "/v1/users/activate", "", credentials, &res)
+	if status != http.StatusConflict || res.Code != "user_already_active" {
+		t.Fatalf("resend after activation: got status %d and code %q", status, res.Code)
+	}
+}
+
+// Requests without a key to endpoints requiring authentication are rejected
+// with the unauthenticated error.
+func TestUnauthenticatedRequest(t *testing.T) {
+	ts := newTestServer(t, nil)
+
+	var res struct {
+		Code string `json:"code"`
+	}
+	status := ts.doJSON(t, http.MethodGet, "/v1/users/me", "", nil, &res)
+	if status != http.StatusUnauthorized || res.Code != "unauthenticated" {
+		t.Fatalf("got status %d and code %q", status, res.Code)
+	}
+}
+
+// The strict limits of the registration endpoint trigger before the general rate
+// limiter, which allows many more requests.
+func TestRegistrationStrictRateLimit(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config) {
+		cfg.RateLimit.Enabled = true
+		cfg.RateLimit.Rps = 100
+		cfg.RateLimit.Burst = 100
+		cfg.RateLimit.Strict.PerMinute = 1
+		cfg.RateLimit.Strict.Burst = 2
+	})
+
+	// Invalid inputs, so no user is created.
+	for i := 0; i < 2; i++ {
+		status := ts.doJSON(t, http.MethodPost, "/v1/users/register", "", map[string]string{}, nil)
+		if status != http.StatusUnprocessableEntity {
+			t.Fatalf("request %d: got status %d", i, status)
+		}
+	}
+	var res struct {
+		Code string `json:"code"`
+	}
+	status := ts.doJSON(t, http.MethodPost, "/v1/users/register", "", map[string]string{}, &res)
+	if status != http.StatusTooManyRequests || res.Code != "rate_limit_exceeded" {
+		t.Fatalf("got status %d and code %q", status, res.Code)
+	}
+}
+
+// The views and the downloads of a public gallery are counted in the background,
+// the ones of the owner are excluded if configured so.
+func TestPublicGalleryViews(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config) {
+		cfg.Views.ExcludeOwner = true
+	})
+	key := ts.newUser(t, "e2e-views")
+	galleryID := ts.newGallery(t, key, true)
+	path := fmt.Sprintf("/v1/public/galleries/%d", galleryID)
+
+	for i := 0; i < 3; i++ {
+		status, body := ts.do(t, http.MethodGet, path, "", nil, "")
+		if status != http.StatusOK {
+			t.Fatalf("public get: got status %d: %s", status, body)
+		}
+	}
+	status, body := ts.do(t, http.MethodGet, path+"?mode=attachment", "", nil, "")
+	if status != http.StatusOK {
+		t.Fatalf("public download: got status %d: %s", status, body)
+	}
+	status, body = ts.do(t, http.MethodGet, path, key, nil, "")
+	if status != http.StatusOK {
+		t.Fatalf("public get of the owner: got status %d: %s", status, body)
+	}
+	ts.app.bgTasks.Wait()
+
+	var res struct {
+		Gallery struct {
+			ViewCount     int64 `json:"view_count"`
+			DownloadCount int64 `json:"download_count"`
+		} `json:"gallery"`
+	}
+	status = ts.doJSON(t, http.MethodGet, path, "", nil, &res)
+	if status != http.StatusOK {
+		t.Fatalf("public get: got status %d", status)
+	}
+	if res.Gallery.ViewCount != 3 || res.Gallery.DownloadCount != 1 {
+		t.Fatalf("expected 3 views and 1 download, got %+v", res.Gallery)
+	}
+}
+
+// A selection of images of a gallery is downloaded as an archive, while images of
+// other galleries and selections over the limit are rejected.
+func TestDownloadSelection(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config) {
+		cfg.Storage.MaxSelection = 2
+	})
+	key := ts.newUser(t, "e2e-selection")
+	galleryID := ts.newGallery(t, key, false)
+	otherID := ts.newGallery(t, key, false)
+	content := testPNG(t)
+	first := ts.uploadImage(t, key, galleryID, "first", content)
+	ts.uploadImage(t, key, galleryID, "second", content)
+	third := ts.uploadImage(t, key, galleryID, "third", content)
+	foreign := ts.uploadImage(t, key, otherID, "foreign", content)
+
+	path := fmt.Sprintf("/v1/galleries/%d/images/download", galleryID)
+	selection := func(ids ...int64) *bytes.Reader {
+		js, err := json.Marshal(map[string][]int64{"images": ids})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.NewReader(js)
+	}
+
+	status, body := ts.do(t, http.MethodPost, path, key, selection(first, third), "application/json")
+	if status != http.StatusOK {
+		t.Fatalf("download: got status %d: %s", status, body)
+	}
+	names := archiveNames(t, body)
+	if strings.Join(names, " ") != "first third" {
+		t.Fatalf("expected the selected images, got %v", names)
+	}
+
+	status, body = ts.do(t, http.MethodPost, path, key, selection(first, foreign), "application/json")
+	if status != http.StatusForbidden {
+		t.Fatalf("image of another gallery: got status %d: %s", status, body)
+	}
+	status, body = ts.do(t, http.MethodPost, path, key, selection(first, third, foreign), "application/json")
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("selection over the limit: got status %d: %s", status, body)
+	}
+}
+
+// Return the names of the entries of a gzipped tar archive.
+func archiveNames(t *testing.T, archive []byte) []string {
+	t.Helper()
+	gzipReader, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	var names []string
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+}
+
+// Encode a small PNG image.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Creations repeated with the same idempotency key return the resource of the first
+// request, while distinct keys create distinct resources. Keys are scoped per user.
+func TestIdempotencyKeys(t *testing.T) {
+	ts := newTestServer(t, nil)
+	key := ts.newUser(t, "e2e-idempotency")
+	otherKey := ts.newUser(t, "e2e-idempotency")
+
+	create := func(authKey, path, idempotencyKey string, body []byte, contentType string) int64 {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+authKey)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d", path, res.StatusCode)
+		}
+		var created map[string]struct {
+			ID int64 `json:"id"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, resource := range created {
+			return resource.ID
+		}
+		t.Fatalf("%s: no resource in the response", path)
+		return 0
+	}
+
+	gallery := []byte(`{"title": "idempotent gallery"}`)
+	first := create(key, "/v1/galleries", "gallery-1", gallery, "application/json")
+	if again := create(key, "/v1/galleries", "gallery-1", gallery, "application/json"); again != first {
+		t.Fatalf("repeated key: expected gallery %d, got %d", first, again)
+	}
+	if second := create(key, "/v1/galleries", "gallery-2", gallery, "application/json"); second == first {
+		t.Fatalf("distinct keys created the same gallery %d", first)
+	}
+	if other := create(otherKey, "/v1/galleries", "gallery-1", gallery, "application/json"); other == first {
+		t.Fatalf("the key of another user returned gallery %d", first)
+	}
+
+	path := fmt.Sprintf("/v1/galleries/%d/images?title=idempotent", first)
+	content := testPNG(t)
+	imageID := create(key, path, "image-1", content, "image/png")
+	if again := create(key, path, "image-1", content, "image/png"); again != imageID {
+		t.Fatalf("repeated key: expected image %d, got %d", imageID, again)
+	}
+	if second := create(key, path, "image-2", content, "image/png"); second == imageID {
+		t.Fatalf("distinct keys created the same image %d", imageID)
+	}
+}
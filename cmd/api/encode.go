@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/anBertoli/snap-vault/pkg/tracing"
 )
@@ -20,7 +25,7 @@ func (app *application) sendJSON(w http.ResponseWriter, r *http.Request, status
 	trace := tracing.TraceFromRequestCtx(r)
 	trace.HttpCode = status
 
-	err := writeJSON(w, status, data, headers)
+	err := writeJSON(w, status, data, headers, app.config.Env == "dev")
 	if err != nil {
 		app.logger.Errorw("sending json", "id", trace.ID, "err", err)
 		trace.HttpCode = http.StatusInternalServerError
@@ -33,13 +38,23 @@ func (app *application) sendJSON(w http.ResponseWriter, r *http.Request, status
 func (app *application) sendJSONError(w http.ResponseWriter, r *http.Request, resp errResponse) {
 	trace := tracing.TraceFromRequestCtx(r)
 	trace.HttpCode = resp.status
-	trace.PublicErr = resp.message
 	trace.PrivateErr = resp.err
 
-	err := writeJSON(w, resp.status, env{
+	// Field-level errors are always nested under details.fields. The error field
+	// is kept for backward compatibility: it holds the flat map of the field-level
+	// errors if present, the message otherwise.
+	data := env{
 		"status_code": resp.status,
+		"code":        resp.code,
+		"message":     resp.message,
 		"error":       resp.message,
-	}, nil)
+	}
+	if resp.details != nil {
+		data["details"] = env{"fields": resp.details}
+		data["error"] = resp.details
+	}
+	trace.PublicErr = data["error"]
+	err := writeJSON(w, resp.status, data, nil, app.config.Env == "dev")
 
 	if err != nil {
 		app.logger.Errorw("sending json", "id", trace.ID, "err", err)
@@ -48,25 +63,34 @@ func (app *application) sendJSONError(w http.ResponseWriter, r *http.Request, re
 	}
 }
 
-// The errResponse struct groups the public message to be provided to the
-// client, the HTTP status code and the internal error to be logged.
+// The errResponse struct groups the public code, message and optional field-level
+// errors (field name -> problem) to be provided to the client, the HTTP status code
+// and the internal error to be logged.
 type errResponse struct {
-	message interface{}
+	code    string
+	message string
+	details map[string]string
 	status  int
 	err     error
 }
 
 // The writeJSON() helper writes the data to the response writer along with provided
-// headers. The data is JSON-formatted before being sent.
-func writeJSON(w http.ResponseWriter, status int, data env, headers http.Header) error {
-
-	// Encode the data to JSON. Avoid indentation and newline in case of performance
-	// issues, otherwise it makes the output easier to read for clients.
-	js, err := json.MarshalIndent(data, "", "  ")
+// headers. The data is JSON-formatted before being sent, indented if requested.
+func writeJSON(w http.ResponseWriter, status int, data env, headers http.Header, indent bool) error {
+
+	// Encode the data to JSON. Indentation makes the output easier to read, but it
+	// has a cost, so it is used only in development. The data is encoded in a buffer
+	// and not directly in the response, this way an encoding error could still be
+	// reported with the appropriate status code. The encoder appends a newline.
+	var js bytes.Buffer
+	encoder := json.NewEncoder(&js)
+	if indent {
+		encoder.SetIndent("", "  ")
+	}
+	err := encoder.Encode(data)
 	if err != nil {
 		return err
 	}
-	js = append(js, '\n')
 
 	// Add the headers to the response.
 	for key, value := range headers {
@@ -77,7 +101,7 @@ func writeJSON(w http.ResponseWriter, status int, data env, headers http.Header)
 	// status code and JSON response.
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	_, err = w.Write(js)
+	_, err = w.Write(js.Bytes())
 	return err
 }
 
@@ -102,13 +126,14 @@ func (app *application) streamBytes(w http.ResponseWriter, r *http.Request, stat
 		}()
 	}
 
-	// Write the status code and the headers to the response.
-	w.WriteHeader(status)
-
+	// Write the headers and the status code to the response. Headers must be set
+	// before calling WriteHeader, otherwise they are silently discarded.
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
 
+	w.WriteHeader(status)
+
 	_, err := io.Copy(w, reader)
 	if err != nil {
 		var netErr *net.OpError
@@ -129,3 +154,85 @@ func (app *application) streamBytes(w http.ResponseWriter, r *http.Request, stat
 		trace.PrivateErr = err
 	}
 }
+
+// The serveContent helper sends the content of a seekable resource along with the provided
+// headers, after recording some tracing data. It relies on http.ServeContent, so Range,
+// If-Range and conditional requests (based on the modification time and on the Etag
+// header, if provided) are handled. The content is closed before returning.
+func (app *application) serveContent(w http.ResponseWriter, r *http.Request, name string, modTime time.Time, content io.ReadSeekCloser, headers http.Header) {
+	trace := tracing.TraceFromRequestCtx(r)
+	defer func() {
+		err := content.Close()
+		if err != nil {
+			app.logger.Errorw("error closing read seek closer", "id", trace.ID, "err", err)
+		}
+	}()
+
+	for key, value := range headers {
+		w.Header()[key] = value
+	}
+
+	// The status code is chosen by http.ServeContent (200, 206, 304, 412, 416...),
+	// record it so that it is available for logging and metrics.
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	http.ServeContent(sw, r, name, modTime, content)
+	trace.HttpCode = sw.status
+}
+
+// The statusWriter wraps a http.ResponseWriter and records the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Build the value of a Content-Disposition header for an attachment. File names are user
+// provided, so they could contain quotes, CR/LF or non-ASCII characters: a sanitized ASCII
+// version is sent in the 'filename' parameter, for old clients, while the full UTF-8 name
+// is percent-encoded in the 'filename*' parameter as specified by RFC 5987 (RFC 6266).
+func attachmentDisposition(filename string) string {
+	var (
+		ascii   strings.Builder
+		encoded strings.Builder
+	)
+	for _, r := range filename {
+		if unicode.IsControl(r) {
+			continue
+		}
+		switch {
+		case r > unicode.MaxASCII:
+			ascii.WriteByte('_')
+		case r == '"' || r == '\\':
+			ascii.WriteByte('\\')
+			ascii.WriteRune(r)
+		default:
+			ascii.WriteRune(r)
+		}
+	}
+	for _, c := range []byte(filename) {
+		switch {
+		case c < 0x20 || c == 0x7f:
+			continue
+		case isAttrChar(c):
+			encoded.WriteByte(c)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, ascii.String(), encoded.String())
+}
+
+// Report whether the byte is an 'attr-char' of RFC 5987, that is, it can be used
+// in an extended parameter value without being percent-encoded.
+func isAttrChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+	}
+}
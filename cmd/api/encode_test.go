@@ -0,0 +1,64 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"testing"
+)
+
+// The file names are quoted and escaped in the 'filename' parameter and percent-encoded
+// in the 'filename*' one, so that the header can always be parsed back.
+func TestAttachmentDisposition(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		header   string
+		parsed   string
+	}{
+		{
+			name:     "plain",
+			filename: "photo.png",
+			header:   `attachment; filename="photo.png"; filename*=UTF-8''photo.png`,
+			parsed:   "photo.png",
+		},
+		{
+			name:     "quotes and backslashes",
+			filename: `say "hi" \o/.png`,
+			header:   `attachment; filename="say \"hi\" \\o/.png"; filename*=UTF-8''say%20%22hi%22%20%5Co%2F.png`,
+			parsed:   `say "hi" \o/.png`,
+		},
+		{
+			name:     "newlines",
+			filename: "a.png\r\nSet-Cookie: session=1",
+			header:   `attachment; filename="a.pngSet-Cookie: session=1"; filename*=UTF-8''a.pngSet-Cookie%3A%20session%3D1`,
+			parsed:   "a.pngSet-Cookie: session=1",
+		},
+		{
+			name:     "non ASCII",
+			filename: "café 日本.jpg",
+			header:   `attachment; filename="caf_ __.jpg"; filename*=UTF-8''caf%C3%A9%20%E6%97%A5%E6%9C%AC.jpg`,
+			parsed:   "café 日本.jpg",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := attachmentDisposition(tt.filename)
+			if header != tt.header {
+				t.Fatalf("expected\n%s\ngot\n%s", tt.header, header)
+			}
+			if strings.ContainsAny(header, "\r\n") {
+				t.Fatalf("header contains a line break: %q", header)
+			}
+
+			// The 'filename*' parameter takes precedence and is decoded.
+			disposition, params, err := mime.ParseMediaType(header)
+			if err != nil {
+				t.Fatalf("parsing %q: %v", header, err)
+			}
+			if disposition != "attachment" || params["filename"] != tt.parsed {
+				t.Fatalf("expected attachment %q, got %s %q", tt.parsed, disposition, params["filename"])
+			}
+		})
+	}
+}
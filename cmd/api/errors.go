@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/idempotency"
 	"github.com/anBertoli/snap-vault/pkg/store"
 	"github.com/anBertoli/snap-vault/pkg/validator"
 	"github.com/anBertoli/snap-vault/services/galleries"
@@ -41,12 +42,26 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, er
 		app.editConflictResponse(w, r)
 	case errors.Is(err, store.ErrForbidden):
 		app.forbiddenResponse(w, r)
+	case errors.Is(err, store.ErrEmptyBytes):
+		app.emptyBytesResponse(w, r)
+	case errors.Is(err, store.ErrStorageUnavailable):
+		app.storageUnavailableResponse(w, r, err)
+	case errors.Is(err, store.ErrInvalidFileName):
+		app.invalidFileNameResponse(w, r)
 
 	// Users service errors.
 	case errors.Is(err, users.ErrMainKeysEdit):
 		app.notEditableKeysResponse(w, r)
 	case errors.Is(err, users.ErrAlreadyActive):
 		app.userAlreadyActiveResponse(w, r)
+	case errors.Is(err, users.ErrAccountLocked):
+		app.accountLockedResponse(w, r)
+	case errors.Is(err, users.ErrTooManyKeys):
+		app.tooManyKeysResponse(w, r)
+
+	// Idempotency errors.
+	case errors.Is(err, idempotency.ErrInProgress):
+		app.idempotencyInProgressResponse(w, r)
 
 	// Galleries service errors.
 	case errors.Is(err, galleries.ErrBusy):
@@ -55,6 +70,12 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, er
 	// Images service errors.
 	case errors.Is(err, images.ErrMaxSpaceReached):
 		app.maxSpaceReachedResponse(w, r)
+	case errors.Is(err, images.ErrGalleryFull):
+		app.galleryFullResponse(w, r)
+	case errors.Is(err, images.ErrInvalidSignature):
+		app.invalidSignatureResponse(w, r)
+	case errors.Is(err, images.ErrSignatureExpired):
+		app.signatureExpiredResponse(w, r)
 
 	// Default to 500 errors.
 	default:
@@ -64,9 +85,12 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, er
 
 // These are generic responses given back to the user. The functions below use the
 // sendJSONError method of the application struct, with a specific constant error.
+// Each response has a stable machine-readable code, clients should rely on it
+// instead of the message.
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	app.sendJSONError(w, r, errResponse{
+		code:    "internal_error",
 		message: "the server encountered a problem and could not process your request",
 		status:  http.StatusInternalServerError,
 		err:     err,
@@ -76,6 +100,7 @@ func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Reque
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("the requested resource could not be found")
 	app.sendJSONError(w, r, errResponse{
+		code:    "record_not_found",
 		message: err.Error(),
 		status:  http.StatusNotFound,
 		err:     err,
@@ -85,6 +110,7 @@ func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request)
 func (app *application) forbiddenResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("you don't have rights to perform this action")
 	app.sendJSONError(w, r, errResponse{
+		code:    "forbidden",
 		message: err.Error(),
 		status:  http.StatusForbidden,
 		err:     err,
@@ -94,6 +120,7 @@ func (app *application) forbiddenResponse(w http.ResponseWriter, r *http.Request
 func (app *application) unauthenticatedResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("you must be authenticated to access this resource")
 	app.sendJSONError(w, r, errResponse{
+		code:    "unauthenticated",
 		message: err.Error(),
 		status:  http.StatusUnauthorized,
 		err:     err,
@@ -103,26 +130,49 @@ func (app *application) unauthenticatedResponse(w http.ResponseWriter, r *http.R
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("unable to update the resource due to a conflict, please try again")
 	app.sendJSONError(w, r, errResponse{
+		code:    "edit_conflict",
 		message: err.Error(),
 		status:  http.StatusConflict,
 		err:     err,
 	})
 }
 
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request) {
+	err := errors.New("too many failed attempts, retry later")
+	app.sendJSONError(w, r, errResponse{
+		code:    "account_locked",
+		message: err.Error(),
+		status:  http.StatusTooManyRequests,
+		err:     err,
+	})
+}
+
 func (app *application) tooBusyResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("the server is currently too busy to process your request")
 	app.sendJSONError(w, r, errResponse{
+		code:    "server_busy",
 		message: err.Error(),
 		status:  http.StatusTooManyRequests,
 		err:     err,
 	})
 }
 
+func (app *application) requestTimeoutResponse(w http.ResponseWriter, r *http.Request) {
+	err := errors.New("the server took too long to process your request, try again later")
+	app.sendJSONError(w, r, errResponse{
+		code:    "request_timeout",
+		message: err.Error(),
+		status:  http.StatusServiceUnavailable,
+		err:     err,
+	})
+}
+
 // Errors responses used by the router. The sendJSONError method is used again.
 
 func (app *application) routeNotFoundHandler(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("the requested API endpoint doesn't exist")
 	app.sendJSONError(w, r, errResponse{
+		code:    "route_not_found",
 		message: err.Error(),
 		status:  http.StatusNotFound,
 		err:     err,
@@ -132,6 +182,7 @@ func (app *application) routeNotFoundHandler(w http.ResponseWriter, r *http.Requ
 func (app *application) methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
 	err := fmt.Errorf("the %s method is not supported for this endpoint", r.Method)
 	app.sendJSONError(w, r, errResponse{
+		code:    "method_not_allowed",
 		message: err.Error(),
 		status:  http.StatusMethodNotAllowed,
 		err:     err,
@@ -143,16 +194,92 @@ func (app *application) methodNotAllowedHandler(w http.ResponseWriter, r *http.R
 // method is used again.
 
 func (app *application) malformedJSONResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errUnsupportedMediaType) {
+		app.unsupportedMediaTypeResponse(w, r, err)
+		return
+	}
 	app.sendJSONError(w, r, errResponse{
+		code:    "malformed_body",
 		message: err.Error(),
 		status:  http.StatusBadRequest,
 		err:     err,
 	})
 }
 
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.sendJSONError(w, r, errResponse{
+		code:    "unsupported_media_type",
+		message: err.Error(),
+		status:  http.StatusUnsupportedMediaType,
+		err:     err,
+	})
+}
+
+func (app *application) unreadableBodyResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.sendJSONError(w, r, errResponse{
+		code:    "unreadable_body",
+		message: "unable to read the request body",
+		status:  http.StatusBadRequest,
+		err:     err,
+	})
+}
+
+func (app *application) uploadInterruptedResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.sendJSONError(w, r, errResponse{
+		code:    "upload_interrupted",
+		message: "the upload was interrupted before the image was complete, nothing was saved",
+		status:  http.StatusBadRequest,
+		err:     err,
+	})
+}
+
+func (app *application) bodyTooLargeResponse(w http.ResponseWriter, r *http.Request, limit int64) {
+	err := fmt.Errorf("body must not be larger than %d bytes", limit)
+	app.sendJSONError(w, r, errResponse{
+		code:    "body_too_large",
+		message: err.Error(),
+		status:  http.StatusRequestEntityTooLarge,
+		err:     err,
+	})
+}
+
+func (app *application) emptyBytesResponse(w http.ResponseWriter, r *http.Request) {
+	err := errors.New("the image must not be empty")
+	app.sendJSONError(w, r, errResponse{
+		code:    "empty_image",
+		message: err.Error(),
+		status:  http.StatusBadRequest,
+		err:     err,
+	})
+}
+
+func (app *application) invalidFileNameResponse(w http.ResponseWriter, r *http.Request) {
+	err := errors.New("the title must contain characters usable in a file name")
+	app.sendJSONError(w, r, errResponse{
+		code:    "invalid_file_name",
+		message: err.Error(),
+		status:  http.StatusUnprocessableEntity,
+		err:     err,
+	})
+}
+
+func (app *application) storageUnavailableResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if app.storageUnavailable != nil {
+		app.storageUnavailable.Inc()
+	}
+	app.sendJSONError(w, r, errResponse{
+		code:    "storage_unavailable",
+		message: "the server is unable to store the content, retry later",
+		status:  http.StatusInsufficientStorage,
+		err:     err,
+	})
+}
+
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors validator.Validator) {
 	app.sendJSONError(w, r, errResponse{
-		message: errors,
+		code:    "validation_failed",
+		message: "one or more fields are invalid",
+		details: errors,
 		status:  http.StatusUnprocessableEntity,
 		err:     errors,
 	})
@@ -160,7 +287,9 @@ func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.
 
 func (app *application) emailTakenResponse(w http.ResponseWriter, r *http.Request) {
 	app.sendJSONError(w, r, errResponse{
-		message: map[string]string{"email": "a user with this email address already exists"},
+		code:    "email_taken",
+		message: "a user with this email address already exists",
+		details: map[string]string{"email": "a user with this email address already exists"},
 		status:  http.StatusUnprocessableEntity,
 		err:     store.ErrDuplicateEmail,
 	})
@@ -169,6 +298,7 @@ func (app *application) emailTakenResponse(w http.ResponseWriter, r *http.Reques
 func (app *application) notEditableKeysResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("main keys cannot be edited or deleted")
 	app.sendJSONError(w, r, errResponse{
+		code:    "keys_not_editable",
 		message: err.Error(),
 		status:  http.StatusForbidden,
 		err:     err,
@@ -178,6 +308,7 @@ func (app *application) notEditableKeysResponse(w http.ResponseWriter, r *http.R
 func (app *application) userAlreadyActiveResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("user already active")
 	app.sendJSONError(w, r, errResponse{
+		code:    "user_already_active",
 		message: err.Error(),
 		status:  http.StatusConflict,
 		err:     err,
@@ -187,6 +318,7 @@ func (app *application) userAlreadyActiveResponse(w http.ResponseWriter, r *http
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("your user account must be activated to access this resource")
 	app.sendJSONError(w, r, errResponse{
+		code:    "account_not_activated",
 		message: err.Error(),
 		status:  http.StatusForbidden,
 		err:     err,
@@ -196,6 +328,7 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 func (app *application) wrongPermissionsResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("you don't have the right permission to perform this action")
 	app.sendJSONError(w, r, errResponse{
+		code:    "missing_permission",
 		message: err.Error(),
 		status:  http.StatusForbidden,
 		err:     err,
@@ -206,6 +339,7 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	w.Header().Set("WWW-Authenticate", "Bearer")
 	err := errors.New("the provided authentication token is invalid")
 	app.sendJSONError(w, r, errResponse{
+		code:    "invalid_token",
 		message: err.Error(),
 		status:  http.StatusUnauthorized,
 		err:     err,
@@ -215,6 +349,7 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("rate limit exceeded")
 	app.sendJSONError(w, r, errResponse{
+		code:    "rate_limit_exceeded",
 		message: err.Error(),
 		status:  http.StatusTooManyRequests,
 		err:     err,
@@ -224,8 +359,59 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 func (app *application) maxSpaceReachedResponse(w http.ResponseWriter, r *http.Request) {
 	err := errors.New("max space reached, delete some images and retry")
 	app.sendJSONError(w, r, errResponse{
+		code:    "max_space_reached",
 		message: err.Error(),
 		status:  http.StatusNotAcceptable,
 		err:     err,
 	})
 }
+
+func (app *application) galleryFullResponse(w http.ResponseWriter, r *http.Request) {
+	err := errors.New("the gallery reached the maximum number of images, use another gallery")
+	app.sendJSONError(w, r, errResponse{
+		code:    "gallery_full",
+		message: err.Error(),
+		status:  http.StatusConflict,
+		err:     err,
+	})
+}
+
+func (app *application) invalidSignatureResponse(w http.ResponseWriter, r *http.Request) {
+	err := errors.New("the signature of the URL is invalid")
+	app.sendJSONError(w, r, errResponse{
+		code:    "invalid_signature",
+		message: err.Error(),
+		status:  http.StatusForbidden,
+		err:     err,
+	})
+}
+
+func (app *application) signatureExpiredResponse(w http.ResponseWriter, r *http.Request) {
+	err := errors.New("the signed URL is expired")
+	app.sendJSONError(w, r, errResponse{
+		code:    "signature_expired",
+		message: err.Error(),
+		status:  http.StatusForbidden,
+		err:     err,
+	})
+}
+
+func (app *application) idempotencyInProgressResponse(w http.ResponseWriter, r *http.Request) {
+	err := errors.New("a request with the same idempotency key is in progress, retry later")
+	app.sendJSONError(w, r, errResponse{
+		code:    "idempotency_key_in_progress",
+		message: err.Error(),
+		status:  http.StatusConflict,
+		err:     err,
+	})
+}
+
+func (app *application) tooManyKeysResponse(w http.ResponseWriter, r *http.Request) {
+	err := errors.New("the maximum number of keys was reached, delete some keys and retry")
+	app.sendJSONError(w, r, errResponse{
+		code:    "too_many_keys",
+		message: err.Error(),
+		status:  http.StatusForbidden,
+		err:     err,
+	})
+}
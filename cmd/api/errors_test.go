@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/idempotency"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/validator"
+	"github.com/anBertoli/snap-vault/services/galleries"
+	"github.com/anBertoli/snap-vault/services/images"
+	"github.com/anBertoli/snap-vault/services/users"
+)
+
+// Each known error, also when wrapped, is sent with its status and code, while the
+// unknown ones are internal errors.
+func TestErrorResponseCodes(t *testing.T) {
+	v := validator.New()
+	v.AddError("title", "must be provided")
+
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{v, http.StatusUnprocessableEntity, "validation_failed"},
+		{auth.ErrUnauthenticated, http.StatusUnauthorized, "unauthenticated"},
+		{auth.ErrNotActivated, http.StatusForbidden, "account_not_activated"},
+		{auth.ErrNoPermission, http.StatusForbidden, "missing_permission"},
+		{store.ErrDuplicateEmail, http.StatusUnprocessableEntity, "email_taken"},
+		{store.ErrRecordNotFound, http.StatusNotFound, "record_not_found"},
+		{store.ErrEditConflict, http.StatusConflict, "edit_conflict"},
+		{store.ErrForbidden, http.StatusForbidden, "forbidden"},
+		{store.ErrEmptyBytes, http.StatusBadRequest, "empty_image"},
+		{store.ErrStorageUnavailable, http.StatusInsufficientStorage, "storage_unavailable"},
+		{store.ErrInvalidFileName, http.StatusUnprocessableEntity, "invalid_file_name"},
+		{users.ErrMainKeysEdit, http.StatusForbidden, "keys_not_editable"},
+		{users.ErrAlreadyActive, http.StatusConflict, "user_already_active"},
+		{users.ErrAccountLocked, http.StatusTooManyRequests, "account_locked"},
+		{users.ErrTooManyKeys, http.StatusForbidden, "too_many_keys"},
+		{idempotency.ErrInProgress, http.StatusConflict, "idempotency_key_in_progress"},
+		{galleries.ErrBusy, http.StatusTooManyRequests, "server_busy"},
+		{images.ErrMaxSpaceReached, http.StatusNotAcceptable, "max_space_reached"},
+		{images.ErrGalleryFull, http.StatusConflict, "gallery_full"},
+		{images.ErrInvalidSignature, http.StatusForbidden, "invalid_signature"},
+		{images.ErrSignatureExpired, http.StatusForbidden, "signature_expired"},
+		{errors.New("unexpected"), http.StatusInternalServerError, "internal_error"},
+	}
+
+	app := &application{logger: zap.NewNop().Sugar()}
+	for _, tt := range tests {
+		for _, err := range []error{tt.err, fmt.Errorf("wrapped: %w", tt.err)} {
+			rec := httptest.NewRecorder()
+			app.errorResponse(rec, httptest.NewRequest(http.MethodGet, "/", nil), err)
+
+			var res struct {
+				StatusCode int    `json:"status_code"`
+				Code       string `json:"code"`
+				Message    string `json:"message"`
+			}
+			decodeErr := json.Unmarshal(rec.Body.Bytes(), &res)
+			if decodeErr != nil {
+				t.Fatalf("%v: decoding %q: %v", err, rec.Body, decodeErr)
+			}
+			if rec.Code != tt.status || res.StatusCode != tt.status || res.Code != tt.code || res.Message == "" {
+				t.Errorf("%v: expected %d %s, got %d %s", err, tt.status, tt.code, rec.Code, rec.Body)
+			}
+		}
+	}
+}
+
+// Validation failures are sent with the field errors nested under details.fields,
+// sorted by field so that the responses are stable.
+func TestFailedValidationResponse(t *testing.T) {
+	ts, _ := newMockServer(t, func(cfg *config) {
+		cfg.RateLimit.Strict.PerMinute = 0
+	})
+
+	input := `{"name":"","email":"not an email","password":"short"}`
+	status, body := ts.do(t, http.MethodPost, "/v1/users/register", "", strings.NewReader(input), "application/json")
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d: %s", status, body)
+	}
+
+	var res struct {
+		StatusCode int    `json:"status_code"`
+		Code       string `json:"code"`
+		Message    string `json:"message"`
+		Details    struct {
+			Fields map[string]string `json:"fields"`
+		} `json:"details"`
+		Error map[string]string `json:"error"`
+	}
+	err := json.Unmarshal(body, &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]string{
+		"name":     "must be provided",
+		"email":    "must be a valid email address",
+		"password": "must be at least 8 bytes long",
+	}
+	if res.StatusCode != http.StatusUnprocessableEntity || res.Code != "validation_failed" || res.Message == "" {
+		t.Fatalf("unexpected response: %s", body)
+	}
+	if !reflect.DeepEqual(res.Details.Fields, fields) || !reflect.DeepEqual(res.Error, fields) {
+		t.Fatalf("unexpected field errors: %s", body)
+	}
+
+	// The fields are sorted and the response is the same for the same input.
+	email := strings.Index(string(body), `"email"`)
+	name := strings.Index(string(body), `"name"`)
+	password := strings.Index(string(body), `"password"`)
+	if !(email < name && name < password) {
+		t.Fatalf("fields not sorted: %s", body)
+	}
+	for i := 0; i < 5; i++ {
+		_, again := ts.do(t, http.MethodPost, "/v1/users/register", "", strings.NewReader(input), "application/json")
+		if string(again) != string(body) {
+			t.Fatalf("expected the same response, got\n%s\nand\n%s", body, again)
+		}
+	}
+}
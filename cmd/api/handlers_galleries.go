@@ -4,22 +4,22 @@ import (
 	"fmt"
 	"net/http"
 
-	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/services/galleries"
 )
 
 // List public galleries. Filtering and pagination is supported and specified via
 // query parameters.
 func (app *application) listPublicGalleriesHandler(w http.ResponseWriter, r *http.Request) {
 	queryString := r.URL.Query()
-	filter := filters.Input{
-		Page:                 readInt(queryString, "page", 1),
-		PageSize:             readInt(queryString, "page_size", 20),
-		SortCol:              readString(queryString, "sort", "id"),
-		SortSafeList:         []string{"id", "filter", "created_at", "-id", "-filter", "-created_at"},
-		Search:               readString(queryString, "search", ""),
-		SearchCol:            readString(queryString, "search_field", "title"),
-		SearchColumnSafeList: []string{"title", "description"},
+	filter := app.readFilter(queryString, galleries.ListDefaults)
+	filter.SearchRequired = app.config.searchRequired(searchPublicGalleries)
+	filter.CountOnly = readBool(queryString, "count_only", false)
+
+	err := readDateRange(queryString, &filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
 	}
 
 	galleries, metadata, err := app.galleries.ListAllPublic(r.Context(), filter)
@@ -28,29 +28,48 @@ func (app *application) listPublicGalleriesHandler(w http.ResponseWriter, r *htt
 		return
 	}
 
+	// Only the pagination metadata is sent if just the count was requested.
+	if filter.CountOnly {
+		app.sendJSON(w, r, http.StatusOK, env{"filter": metadata}, nil)
+		return
+	}
+
 	app.sendJSON(w, r, http.StatusOK, env{"galleries": galleries, "filter": metadata}, nil)
 }
 
 // List galleries owned by the authenticated user. Filtering and pagination is supported and
-// specified via query parameters.
+// specified via query parameters, the optional published parameter (true, false or all)
+// filters the galleries by their published status.
 func (app *application) listGalleriesHandler(w http.ResponseWriter, r *http.Request) {
 	queryString := r.URL.Query()
-	filter := filters.Input{
-		Page:                 readInt(queryString, "page", 1),
-		PageSize:             readInt(queryString, "page_size", 20),
-		SortCol:              readString(queryString, "sort", "id"),
-		SortSafeList:         []string{"id", "filter", "created_at", "-id", "-filter", "-created_at"},
-		Search:               readString(queryString, "search", ""),
-		SearchCol:            readString(queryString, "search_field", "title"),
-		SearchColumnSafeList: []string{"title", "description"},
+	filter := app.readFilter(queryString, galleries.ListDefaults)
+	filter.SearchRequired = app.config.searchRequired(searchGalleries)
+	filter.CountOnly = readBool(queryString, "count_only", false)
+
+	err := readDateRange(queryString, &filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	published, err := readPublished(queryString, "published")
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
 	}
 
-	galleries, metadata, err := app.galleries.ListAllOwned(r.Context(), filter)
+	galleries, metadata, err := app.galleries.ListAllOwned(r.Context(), filter, published)
 	if err != nil {
 		app.errorResponse(w, r, err)
 		return
 	}
 
+	// Only the pagination metadata is sent if just the count was requested.
+	if filter.CountOnly {
+		app.sendJSON(w, r, http.StatusOK, env{"filter": metadata}, nil)
+		return
+	}
+
 	app.sendJSON(w, r, http.StatusOK, env{"galleries": galleries, "filter": metadata}, nil)
 }
 
@@ -76,8 +95,9 @@ func (app *application) getPublicGalleryHandler(w http.ResponseWriter, r *http.R
 			app.errorResponse(w, r, err)
 			return
 		}
+		app.countGalleryView(r, gallery, true)
 		app.streamBytes(w, r, http.StatusOK, readCloser, http.Header{
-			"Content-Disposition": []string{fmt.Sprintf("attachment; filename=\"gallery_%s.tar.gz\"", gallery.Title)},
+			"Content-Disposition": []string{attachmentDisposition(fmt.Sprintf("gallery_%s.tar.gz", gallery.Title))},
 		})
 	case dataMode:
 		gallery, err := app.galleries.Get(r.Context(), true, galleryID)
@@ -85,6 +105,7 @@ func (app *application) getPublicGalleryHandler(w http.ResponseWriter, r *http.R
 			app.errorResponse(w, r, err)
 			return
 		}
+		app.countGalleryView(r, gallery, false)
 		app.sendJSON(w, r, http.StatusOK, env{"gallery": gallery}, nil)
 	}
 }
@@ -112,7 +133,7 @@ func (app *application) getGalleryHandler(w http.ResponseWriter, r *http.Request
 			return
 		}
 		app.streamBytes(w, r, http.StatusOK, readCloser, http.Header{
-			"Content-Disposition": []string{fmt.Sprintf("attachment; filename=\"gallery_%s.tar.gz\"", gallery.Title)},
+			"Content-Disposition": []string{attachmentDisposition(fmt.Sprintf("gallery_%s.tar.gz", gallery.Title))},
 		})
 	case dataMode:
 		gallery, err := app.galleries.Get(r.Context(), false, galleryID)
@@ -124,6 +145,64 @@ func (app *application) getGalleryHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// Download the images of a public gallery selected in the JSON-formatted body as a
+// tar archive.
+func (app *application) downloadPublicImagesHandler(w http.ResponseWriter, r *http.Request) {
+	app.downloadSelection(w, r, true)
+}
+
+// Download the images of a gallery owned by the authenticated user selected in the
+// JSON-formatted body as a tar archive.
+func (app *application) downloadImagesHandler(w http.ResponseWriter, r *http.Request) {
+	app.downloadSelection(w, r, false)
+}
+
+// Helper shared by the handlers above, the body contains the list of the IDs of the
+// images to be included in the archive.
+func (app *application) downloadSelection(w http.ResponseWriter, r *http.Request, public bool) {
+	galleryID, err := readUrlIntParam(r, "gallery-id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Images []int64 `json:"images"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.malformedJSONResponse(w, r, err)
+		return
+	}
+
+	gallery, readCloser, err := app.galleries.DownloadSelection(r.Context(), public, galleryID, input.Images)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+	app.streamBytes(w, r, http.StatusOK, readCloser, http.Header{
+		"Content-Disposition": []string{attachmentDisposition(fmt.Sprintf("gallery_%s.tar.gz", gallery.Title))},
+	})
+}
+
+// Retrieve the aggregate statistics of a gallery of the authenticated user, that is, the
+// number of images, their total size in bytes and the time of the last update.
+func (app *application) getGalleryStatsHandler(w http.ResponseWriter, r *http.Request) {
+	galleryID, err := readUrlIntParam(r, "id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	stats, err := app.galleries.Stats(r.Context(), galleryID)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	app.sendJSON(w, r, http.StatusOK, env{"stats": stats}, nil)
+}
+
 // Create a new gallery reading the mandatory data from the JSON-formatted body.
 func (app *application) createGalleriesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
@@ -132,13 +211,13 @@ func (app *application) createGalleriesHandler(w http.ResponseWriter, r *http.Re
 		Published   bool   `json:"published"`
 	}
 
-	err := readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.malformedJSONResponse(w, r, err)
 		return
 	}
 
-	gallery, err := app.galleries.Insert(r.Context(), store.Gallery{
+	gallery, err := app.galleries.Insert(idempotencyContext(r), store.Gallery{
 		Title:       input.Title,
 		Description: input.Description,
 		Published:   input.Published,
@@ -152,15 +231,19 @@ func (app *application) createGalleriesHandler(w http.ResponseWriter, r *http.Re
 }
 
 // Update an existing gallery reading the data to be used from the JSON-formatted body.
-// The gallery to be updated is specified in the URL parameters.
+// The gallery to be updated is specified in the URL parameters. A null or missing
+// cover_image_id clears the cover image of the gallery. If the version of the gallery is
+// provided the update fails with a conflict when the gallery was modified in the meantime.
 func (app *application) updateGalleryHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title       string `json:"title"`
-		Description string `json:"description"`
-		Published   bool   `json:"published"`
+		Version      int    `json:"version"`
+		Title        string `json:"title"`
+		Description  string `json:"description"`
+		Published    bool   `json:"published"`
+		CoverImageID *int64 `json:"cover_image_id"`
 	}
 
-	err := readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.malformedJSONResponse(w, r, err)
 		return
@@ -172,10 +255,12 @@ func (app *application) updateGalleryHandler(w http.ResponseWriter, r *http.Requ
 	}
 
 	gallery, err := app.galleries.Update(r.Context(), store.Gallery{
-		ID:          id,
-		Title:       input.Title,
-		Description: input.Description,
-		Published:   input.Published,
+		ID:           id,
+		Version:      input.Version,
+		Title:        input.Title,
+		Description:  input.Description,
+		Published:    input.Published,
+		CoverImageID: input.CoverImageID,
 	})
 	if err != nil {
 		app.errorResponse(w, r, err)
@@ -201,3 +286,16 @@ func (app *application) deleteGalleryHandler(w http.ResponseWriter, r *http.Requ
 
 	app.sendJSON(w, r, http.StatusOK, env{"deleted_gallery_id": id}, nil)
 }
+
+// Count a view (or a download) of a public gallery in the background, so the response is
+// not delayed. Only the values of the request context are used (e.g. the auth key), the
+// store doesn't depend on it, so the context being cancelled after the response is fine.
+func (app *application) countGalleryView(r *http.Request, gallery store.Gallery, download bool) {
+	ctx := r.Context()
+	app.background(func() {
+		err := app.galleries.CountView(ctx, gallery, download)
+		if err != nil {
+			app.logger.Errorw("counting gallery view", "gallery_id", gallery.ID, "err", err)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/anBertoli/snap-vault/pkg/filters"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/services/galleries"
+)
+
+// The galleries service recording the filter of the public listing, other methods
+// are not implemented.
+type filterGalleries struct {
+	galleries.Service
+	filter filters.Input
+}
+
+func (fg *filterGalleries) ListAllPublic(ctx context.Context, filter filters.Input) ([]store.Gallery, filters.Meta, error) {
+	fg.filter = filter
+	return nil, filters.Meta{}, nil
+}
+
+// The configured default page size is used when the page_size parameter is omitted,
+// otherwise the one of the listing is used.
+func TestListDefaultPageSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured int
+		query      string
+		pageSize   int
+	}{
+		{name: "configured", configured: 7, pageSize: 7},
+		{name: "requested", configured: 7, query: "?page_size=3", pageSize: 3},
+		{name: "invalid requested", configured: 7, query: "?page_size=many", pageSize: 7},
+		{name: "not configured", pageSize: galleries.ListDefaults.PageSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &filterGalleries{}
+			app := &application{galleries: svc}
+			app.config.Pagination.DefaultPageSize = tt.configured
+
+			rec := httptest.NewRecorder()
+			app.listPublicGalleriesHandler(rec, httptest.NewRequest(http.MethodGet, "/v1/public/galleries"+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+			}
+			if svc.filter.PageSize != tt.pageSize {
+				t.Fatalf("expected page size %d, got %d", tt.pageSize, svc.filter.PageSize)
+			}
+			if svc.filter.Page != 1 || svc.filter.SortCol != galleries.ListDefaults.Sort {
+				t.Fatalf("expected the default page and sort, got %+v", svc.filter)
+			}
+		})
+	}
+}
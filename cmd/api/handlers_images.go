@@ -1,25 +1,40 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
 
 	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/tracing"
+	"github.com/anBertoli/snap-vault/pkg/validator"
+	"github.com/anBertoli/snap-vault/services/galleries"
+	"github.com/anBertoli/snap-vault/services/images"
 )
 
 // List public images. Filtering and pagination is supported and specified via
 // query parameters.
 func (app *application) listPublicImagesHandler(w http.ResponseWriter, r *http.Request) {
 	queryString := r.URL.Query()
-	filter := filters.Input{
-		Page:                 readInt(queryString, "page", 1),
-		PageSize:             readInt(queryString, "page_size", 20),
-		SortCol:              readString(queryString, "sort", "id"),
-		SortSafeList:         []string{"id", "title", "created_at", "-id", "-title", "-created_at"},
-		Search:               readString(queryString, "search", ""),
-		SearchCol:            readString(queryString, "search_field", "title"),
-		SearchColumnSafeList: []string{"title", "caption"},
+	filter := app.readFilter(queryString, images.ListDefaults)
+	filter.SearchRequired = app.config.searchRequired(searchPublicImages)
+	filter.CountOnly = readBool(queryString, "count_only", false)
+
+	err := readDateRange(queryString, &filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
 	}
 
 	images, metadata, err := app.images.ListAllPublic(r.Context(), filter)
@@ -28,6 +43,12 @@ func (app *application) listPublicImagesHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	// Only the pagination metadata is sent if just the count was requested.
+	if filter.CountOnly {
+		app.sendJSON(w, r, http.StatusOK, env{"filter": metadata}, nil)
+		return
+	}
+
 	app.sendJSON(w, r, http.StatusOK, env{"images": images, "filter": metadata}, nil)
 }
 
@@ -35,15 +56,92 @@ func (app *application) listPublicImagesHandler(w http.ResponseWriter, r *http.R
 // is supported and specified via query parameters, while the gallery ID is specified
 // in the URL parameters.
 func (app *application) listGalleryImagesHandler(w http.ResponseWriter, r *http.Request) {
+	queryString := r.URL.Query()
+	filter := app.readFilter(queryString, images.ListDefaults)
+	filter.SearchRequired = app.config.searchRequired(searchGalleryImages)
+	filter.CountOnly = readBool(queryString, "count_only", false)
+
+	err := readDateRange(queryString, &filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	galleryID, err := readUrlIntParam(r, "gallery-id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	images, metadata, err := app.images.ListForGallery(r.Context(), false, galleryID, filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	// Only the pagination metadata is sent if just the count was requested.
+	if filter.CountOnly {
+		app.sendJSON(w, r, http.StatusOK, env{"filter": metadata}, nil)
+		return
+	}
+
+	app.sendJSON(w, r, http.StatusOK, env{"images": images, "filter": metadata}, nil)
+}
+
+// List all the images owned by the authenticated user, across all his galleries. Filtering
+// and pagination is supported and specified via query parameters.
+func (app *application) listOwnedImagesHandler(w http.ResponseWriter, r *http.Request) {
+	queryString := r.URL.Query()
+	filter := app.readFilter(queryString, images.ListDefaults)
+	filter.SearchRequired = app.config.searchRequired(searchImages)
+	filter.CountOnly = readBool(queryString, "count_only", false)
+
+	err := readDateRange(queryString, &filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	images, metadata, err := app.images.ListAllOwned(r.Context(), filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	// Only the pagination metadata is sent if just the count was requested.
+	if filter.CountOnly {
+		app.sendJSON(w, r, http.StatusOK, env{"filter": metadata}, nil)
+		return
+	}
+
+	app.sendJSON(w, r, http.StatusOK, env{"images": images, "filter": metadata}, nil)
+}
+
+// Number of images fetched from the storage at each iteration of the export.
+const exportPageSize = 100
+
+// Export all the images of a gallery owned by the authenticated user as newline-delimited
+// JSON, one record per line. The storage is paginated and each page is written (and
+// flushed) directly to the response, so the whole listing is never held in memory.
+// Filtering is supported and specified via query parameters, while the gallery ID is
+// specified in the URL parameters.
+func (app *application) exportGalleryImagesHandler(w http.ResponseWriter, r *http.Request) {
 	queryString := r.URL.Query()
 	filter := filters.Input{
-		Page:                 readInt(queryString, "page", 1),
-		PageSize:             readInt(queryString, "page_size", 20),
-		SortCol:              readString(queryString, "sort", "id"),
-		SortSafeList:         []string{"id", "title", "created_at", "-id", "-title", "-created_at"},
+		Page:                 1,
+		PageSize:             exportPageSize,
+		SortCol:              readString(queryString, "sort", images.ListDefaults.Sort),
+		SortSafeList:         images.ListDefaults.SortSafeList,
 		Search:               readString(queryString, "search", ""),
-		SearchCol:            readString(queryString, "search_field", "title"),
-		SearchColumnSafeList: []string{"title", "caption"},
+		SearchCol:            readString(queryString, "search_field", images.ListDefaults.SearchCol),
+		SearchColumnSafeList: images.ListDefaults.SearchSafeList,
+		SearchRequired:       app.config.searchRequired(searchGalleryImages),
+	}
+
+	err := readDateRange(queryString, &filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
 	}
 
 	galleryID, err := readUrlIntParam(r, "gallery-id")
@@ -52,27 +150,168 @@ func (app *application) listGalleryImagesHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
+	// Fetch the first page before writing anything, so that authentication,
+	// validation and storage errors are reported with a proper response.
 	images, metadata, err := app.images.ListForGallery(r.Context(), false, galleryID, filter)
 	if err != nil {
 		app.errorResponse(w, r, err)
 		return
 	}
 
-	app.sendJSON(w, r, http.StatusOK, env{"images": images, "filter": metadata}, nil)
+	trace := tracing.TraceFromRequestCtx(r)
+	trace.HttpCode = http.StatusOK
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	for {
+		for _, image := range images {
+			err := encoder.Encode(image)
+			if err != nil {
+				app.logger.Errorw("writing images export", "id", trace.ID, "err", err)
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if metadata.CurrentPage >= metadata.LastPage {
+			return
+		}
+
+		// Headers are already sent, the only way to signal an error to the client
+		// is to abort the response, so the export is not silently truncated.
+		filter.Page++
+		images, metadata, err = app.images.ListForGallery(r.Context(), false, galleryID, filter)
+		if err != nil {
+			app.logger.Errorw("listing images export", "id", trace.ID, "err", err)
+			trace.PrivateErr = err
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+const (
+	// Maximum number of URLs of a single sitemap, as mandated by the protocol.
+	sitemapMaxURLs = 50000
+	// Number of images fetched from the storage at each iteration.
+	sitemapPageSize = 1000
+)
+
+// Return the sitemap index of the public images, for search engines and crawlers. A sitemap
+// holds at most 50000 URLs, so the images are split in more sitemaps, each one listed in
+// the index with the 'after' cursor of its first image. Responses are cacheable to limit
+// the load generated by crawlers.
+func (app *application) publicImagesSitemapIndexHandler(w http.ResponseWriter, r *http.Request) {
+	cursors, err := app.images.ListPublicPageCursors(r.Context(), sitemapMaxURLs)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	type sitemap struct {
+		Loc string `xml:"loc"`
+	}
+	index := struct {
+		XMLName  xml.Name  `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+		Sitemaps []sitemap `xml:"sitemap"`
+	}{}
+	for _, after := range cursors {
+		index.Sitemaps = append(index.Sitemaps, sitemap{
+			Loc: fmt.Sprintf("%s/v1/public/images/sitemap-page.xml?after=%d", app.config.PublicHostname, after),
+		})
+	}
+	body, err := xml.MarshalIndent(index, "", "  ")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	tracing.TraceFromRequestCtx(r).HttpCode = http.StatusOK
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, xml.Header)
+	_, _ = w.Write(body)
+	_, _ = io.WriteString(w, "\n")
+}
+
+// Stream a sitemap listing the URLs of the public images, for search engines and crawlers.
+// Images are fetched with keyset pagination so memory usage is bounded. A sitemap holds
+// at most 50000 URLs, starting after the image with the ID of the 'after' query parameter:
+// the sitemaps covering all the images are listed by the sitemap index. Responses are
+// cacheable to limit the load generated by crawlers.
+func (app *application) publicImagesSitemapHandler(w http.ResponseWriter, r *http.Request) {
+	afterID := int64(readInt(r.URL.Query(), "after", 0))
+
+	// Fetch the first page before writing anything, so that errors
+	// can still be reported with a proper response.
+	page, err := app.images.ListPublicAfter(r.Context(), afterID, sitemapPageSize)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	trace := tracing.TraceFromRequestCtx(r)
+	trace.HttpCode = http.StatusOK
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.WriteHeader(http.StatusOK)
+
+	type sitemapURL struct {
+		Loc     string `xml:"loc"`
+		LastMod string `xml:"lastmod"`
+	}
+
+	_, _ = io.WriteString(w, xml.Header+`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">`+"\n")
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+
+	var written int
+	for len(page) > 0 && written < sitemapMaxURLs {
+		for _, image := range page {
+			if written == sitemapMaxURLs {
+				break
+			}
+			err := encoder.EncodeElement(sitemapURL{
+				Loc:     fmt.Sprintf("%s/v1/public/images/%d?mode=view", app.config.PublicHostname, image.ID),
+				LastMod: image.UpdatedAt.UTC().Format(time.RFC3339),
+			}, xml.StartElement{Name: xml.Name{Local: "url"}})
+			if err != nil {
+				app.logger.Errorw("writing sitemap", "id", trace.ID, "err", err)
+				return
+			}
+			written++
+			afterID = image.ID
+		}
+
+		// Headers are already sent, the only way to signal an error to the
+		// client is to abort the response, leaving the XML document truncated.
+		page, err = app.images.ListPublicAfter(r.Context(), afterID, sitemapPageSize)
+		if err != nil {
+			app.logger.Errorw("listing sitemap images", "id", trace.ID, "err", err)
+			trace.PrivateErr = err
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	_, _ = io.WriteString(w, "\n</urlset>\n")
 }
 
 // List images of a public gallery. Filtering and pagination is supported and specified via
 // query parameters, while the gallery ID is specified in the URL parameters.
 func (app *application) listPublicGalleryImagesHandler(w http.ResponseWriter, r *http.Request) {
 	queryString := r.URL.Query()
-	filter := filters.Input{
-		Page:                 readInt(queryString, "page", 1),
-		PageSize:             readInt(queryString, "page_size", 20),
-		SortCol:              readString(queryString, "sort", "id"),
-		SortSafeList:         []string{"id", "title", "created_at", "-id", "-title", "-created_at"},
-		Search:               readString(queryString, "search", ""),
-		SearchCol:            readString(queryString, "search_field", "title"),
-		SearchColumnSafeList: []string{"title", "caption"},
+	filter := app.readFilter(queryString, images.ListDefaults)
+	filter.SearchRequired = app.config.searchRequired(searchPublicGalleryImages)
+	filter.CountOnly = readBool(queryString, "count_only", false)
+
+	err := readDateRange(queryString, &filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
 	}
 
 	galleryID, err := readUrlIntParam(r, "gallery-id")
@@ -87,9 +326,51 @@ func (app *application) listPublicGalleryImagesHandler(w http.ResponseWriter, r
 		return
 	}
 
+	// Only the pagination metadata is sent if just the count was requested.
+	if filter.CountOnly {
+		app.sendJSON(w, r, http.StatusOK, env{"filter": metadata}, nil)
+		return
+	}
+
 	app.sendJSON(w, r, http.StatusOK, env{"images": images, "filter": metadata}, nil)
 }
 
+// List the galleries owned by the authenticated user where an image could be moved to, that is,
+// all of them except the current one. Filtering and pagination is supported and specified via
+// query parameters, while the image ID is specified in the URL parameters.
+func (app *application) listImageMoveTargetsHandler(w http.ResponseWriter, r *http.Request) {
+	queryString := r.URL.Query()
+	filter := app.readFilter(queryString, galleries.ListDefaults)
+	filter.SearchRequired = app.config.searchRequired(searchMoveTargets)
+	filter.CountOnly = readBool(queryString, "count_only", false)
+
+	err := readDateRange(queryString, &filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	imageID, err := readUrlIntParam(r, "image-id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	galleries, metadata, err := app.images.ListMoveTargets(r.Context(), imageID, filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	// Only the pagination metadata is sent if just the count was requested.
+	if filter.CountOnly {
+		app.sendJSON(w, r, http.StatusOK, env{"filter": metadata}, nil)
+		return
+	}
+
+	app.sendJSON(w, r, http.StatusOK, env{"galleries": galleries, "filter": metadata}, nil)
+}
+
 // Get a public image. The response mode is specified via the query string,
 // while the image ID is specified in the URL parameters.
 func (app *application) getPublicImageHandler(w http.ResponseWriter, r *http.Request) {
@@ -109,25 +390,25 @@ func (app *application) getPublicImageHandler(w http.ResponseWriter, r *http.Req
 			app.errorResponse(w, r, err)
 			return
 		}
+		app.countImageView(r, image)
 		app.sendJSON(w, r, http.StatusOK, env{"image": image}, nil)
 	case viewMode:
-		image, readCloser, err := app.images.Download(r.Context(), true, imageID)
+		image, content, err := app.images.Download(r.Context(), true, imageID)
 		if err != nil {
 			app.errorResponse(w, r, err)
 			return
 		}
-		app.streamBytes(w, r, http.StatusOK, readCloser, http.Header{
-			"Content-Type": []string{image.ContentType},
-		})
+		app.countImageView(r, image)
+		app.streamImage(w, r, image, content, http.Header{})
 	case attachmentMode:
-		image, readCloser, err := app.images.Download(r.Context(), true, imageID)
+		image, content, err := app.images.Download(r.Context(), true, imageID)
 		if err != nil {
 			app.errorResponse(w, r, err)
 			return
 		}
-		app.streamBytes(w, r, http.StatusOK, readCloser, http.Header{
-			"Content-Disposition": []string{fmt.Sprintf("attachment; filename=\"%s\"", image.Title)},
-			"Content-Type":        []string{image.ContentType},
+		app.countImageView(r, image)
+		app.streamImage(w, r, image, content, http.Header{
+			"Content-Disposition": []string{attachmentDisposition(image.Title)},
 		})
 	}
 }
@@ -153,28 +434,131 @@ func (app *application) getImageHandler(w http.ResponseWriter, r *http.Request)
 		}
 		app.sendJSON(w, r, http.StatusOK, env{"image": image}, nil)
 	case viewMode:
-		image, readCloser, err := app.images.Download(r.Context(), false, imageID)
+		image, content, err := app.images.Download(r.Context(), false, imageID)
 		if err != nil {
 			app.errorResponse(w, r, err)
 			return
 		}
-		app.streamBytes(w, r, http.StatusOK, readCloser, http.Header{
-			"Content-Type": []string{image.ContentType},
-		})
+		app.streamImage(w, r, image, content, http.Header{})
 	case attachmentMode:
-		image, readCloser, err := app.images.Download(r.Context(), false, imageID)
+		image, content, err := app.images.Download(r.Context(), false, imageID)
 		if err != nil {
 			app.errorResponse(w, r, err)
 			return
 		}
-		app.streamBytes(w, r, http.StatusOK, readCloser, http.Header{
-			"Content-Disposition": []string{fmt.Sprintf("attachment; filename=\"%s\"", image.Title)},
-			"Content-Type":        []string{image.ContentType},
+		app.streamImage(w, r, image, content, http.Header{
+			"Content-Disposition": []string{attachmentDisposition(image.Title)},
 		})
 	}
 }
 
-const maxBodyBytes = 1024 * 1024 * 50
+// Create a signed URL to share an image of a gallery owned by the authenticated user. The
+// validity of the URL in seconds is read from the JSON-formatted body.
+func (app *application) signImageURLHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TTL int64 `json:"ttl"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.malformedJSONResponse(w, r, err)
+		return
+	}
+
+	imageID, err := readUrlIntParam(r, "image-id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Out of range values are rejected before the conversion to a duration, since
+	// the multiplication could overflow and wrap around into the allowed range.
+	maxTTL := int64(app.config.Auth.MaxSignedTTL) * 60
+	if input.TTL < 1 || input.TTL > maxTTL {
+		v := validator.New()
+		v.Check(input.TTL >= 1, "ttl", "must be at least one second")
+		v.Check(input.TTL <= maxTTL, "ttl", fmt.Sprintf("must not be more than %d seconds", maxTTL))
+		app.failedValidationResponse(w, r, v)
+		return
+	}
+
+	path, expires, err := app.images.SignURL(r.Context(), imageID, time.Duration(input.TTL)*time.Second)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	app.sendJSON(w, r, http.StatusCreated, env{"signed_url": env{"url": path, "expires_at": expires}}, nil)
+}
+
+// Get an image shared with a signed URL, no auth key is needed. The expiration time and the
+// signature are read from the query string, the response mode can be specified as well
+// (only view and attachment modes are supported).
+func (app *application) getSharedImageHandler(w http.ResponseWriter, r *http.Request) {
+	imageMode := readMode(r.URL.Query(), "mode", viewMode)
+	imageID, err := readUrlIntParam(r, "image-id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		app.invalidSignatureResponse(w, r)
+		return
+	}
+
+	image, content, err := app.images.DownloadSigned(r.Context(), imageID, expires, r.URL.Query().Get("signature"))
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	headers := http.Header{}
+	if imageMode == attachmentMode {
+		headers.Set("Content-Disposition", attachmentDisposition(image.Title))
+	}
+	app.streamImage(w, r, image, content, headers)
+}
+
+// Stream the image bytes to the client along with the provided headers and the image
+// entity tag. Partial (Range) and conditional requests are supported, e.g. if the client
+// already holds the current version of the image a 304 response without body is sent.
+//
+// The content type stored at upload time is not trusted blindly, since it was detected
+// from the first bytes only: the stored bytes are sniffed again and served as a generic
+// binary stream if they are not an image. Browsers are told not to sniff the content.
+func (app *application) streamImage(w http.ResponseWriter, r *http.Request, image store.Image, content io.ReadSeekCloser, headers http.Header) {
+	contentType, err := sniffImageType(content)
+	if err != nil {
+		_ = content.Close()
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers.Set("Content-Type", contentType)
+	headers.Set("X-Content-Type-Options", "nosniff")
+	headers.Set("Etag", image.ETag())
+	app.serveContent(w, r, image.Title, image.UpdatedAt, content, headers)
+}
+
+// Detect the MIME type of an image from its first bytes, then rewind the content. If the
+// bytes are not recognized as an image, the generic application/octet-stream is returned.
+func sniffImageType(content io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(content, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	_, err = content.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	contentType := mimetype.Detect(buf[:n]).String()
+	if !strings.HasPrefix(contentType, "image/") {
+		return "application/octet-stream", nil
+	}
+	return contentType, nil
+}
 
 // Upload a new image for an existing gallery. The gallery ID is specified in the URL parameters,
 // the title must be specified in the query string. The caption field could be set using
@@ -188,29 +572,97 @@ func (app *application) createImageHandler(w http.ResponseWriter, r *http.Reques
 
 	title := r.URL.Query().Get("title")
 
-	reader := http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	reader, ok := app.readImageBody(w, r)
+	if !ok {
+		return
+	}
 
-	image, err := app.images.Insert(r.Context(), reader, store.Image{
+	image, err := app.images.Insert(idempotencyContext(r), reader, store.Image{
 		GalleryID: galleryID,
 		Title:     title,
 	})
 	if err != nil {
-		app.errorResponse(w, r, err)
+		app.imageUploadErrorResponse(w, r, reader, err)
 		return
 	}
 
 	app.sendJSON(w, r, http.StatusOK, env{"image": image}, nil)
 }
 
+// Replace the content of an existing image, keeping its ID, position and metadata. The
+// image ID is specified in the URL parameters and the new bytes are read from the body,
+// as when uploading a new image.
+func (app *application) replaceImageContentHandler(w http.ResponseWriter, r *http.Request) {
+	imageID, err := readUrlIntParam(r, "image-id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	reader, ok := app.readImageBody(w, r)
+	if !ok {
+		return
+	}
+
+	image, _, err := app.images.Replace(r.Context(), reader, store.Image{ID: imageID})
+	if err != nil {
+		app.imageUploadErrorResponse(w, r, reader, err)
+		return
+	}
+
+	app.sendJSON(w, r, http.StatusOK, env{"image": image}, nil)
+}
+
+// Return a reader of the image uploaded in the request body, limited in size by the
+// configuration. The actual type of the image is detected from its bytes, but a declared
+// content type that cannot be an image is rejected upfront. If false is returned the
+// error response was already sent.
+func (app *application) readImageBody(w http.ResponseWriter, r *http.Request) (*bodyReader, bool) {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || (!strings.HasPrefix(mediaType, "image/") && mediaType != "application/octet-stream") {
+			app.unsupportedMediaTypeResponse(w, r, fmt.Errorf("%w: the Content-Type header must be an image type", errUnsupportedMediaType))
+			return nil, false
+		}
+	}
+
+	// Keep track of errors reading the body, so that an upload interrupted by the
+	// client is reported as such and not as an internal error.
+	maxImageBody := app.config.Limits.MaxImageBody
+	if r.ContentLength > maxImageBody {
+		app.bodyTooLargeResponse(w, r, maxImageBody)
+		return nil, false
+	}
+	return &bodyReader{ctx: r.Context(), r: http.MaxBytesReader(w, r.Body, maxImageBody)}, true
+}
+
+// Send the error response of a failed image upload, distinguishing errors
+// reading the body from the errors of the images service. In all the cases
+// the partial file is removed by the store and no image is created.
+func (app *application) imageUploadErrorResponse(w http.ResponseWriter, r *http.Request, reader *bodyReader, err error) {
+	switch {
+	case isBodyTooLarge(reader.err):
+		app.bodyTooLargeResponse(w, r, app.config.Limits.MaxImageBody)
+	case errors.Is(reader.err, io.ErrUnexpectedEOF), errors.Is(reader.err, context.Canceled):
+		app.uploadInterruptedResponse(w, r, err)
+	case reader.err != nil:
+		app.unreadableBodyResponse(w, r, err)
+	default:
+		app.errorResponse(w, r, err)
+	}
+}
+
 // Edit the fields of an existing image, reading the data from the JSON-formatted body.
-// The image ID is specified in the URL parameters.
+// The image ID is specified in the URL parameters. If the version of the image is provided
+// the edit fails with a conflict when the image was modified in the meantime.
 func (app *application) editImageHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title   string `json:"title"`
-		Caption string `json:"caption"`
+		Version int     `json:"version"`
+		Title   string  `json:"title"`
+		Caption *string `json:"caption"`
 	}
 
-	err := readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.malformedJSONResponse(w, r, err)
 		return
@@ -224,6 +676,7 @@ func (app *application) editImageHandler(w http.ResponseWriter, r *http.Request)
 
 	image, err := app.images.Update(r.Context(), store.Image{
 		ID:      imageID,
+		Version: input.Version,
 		Title:   input.Title,
 		Caption: input.Caption,
 	})
@@ -235,6 +688,70 @@ func (app *application) editImageHandler(w http.ResponseWriter, r *http.Request)
 	app.sendJSON(w, r, http.StatusOK, env{"image": image}, nil)
 }
 
+// Partially update an existing image of a gallery owned by the authenticated user. Omitted
+// fields are left unchanged, while the caption could be cleared with an explicit null.
+// The image ID is specified in the URL parameters.
+func (app *application) patchImageHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Version *int           `json:"version"`
+		Title   *string        `json:"title"`
+		Caption nullableString `json:"caption"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.malformedJSONResponse(w, r, err)
+		return
+	}
+
+	imageID, err := readUrlIntParam(r, "image-id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	image, err := app.images.Patch(r.Context(), imageID, images.Patch{
+		Version: input.Version,
+		Title:   input.Title,
+		Caption: input.Caption.Ptr(),
+	})
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	app.sendJSON(w, r, http.StatusOK, env{"image": image}, nil)
+}
+
+// Set the display order of the images of a gallery owned by the authenticated user. The
+// gallery ID is specified in the URL parameters, the body lists all the image IDs of the
+// gallery in the desired order.
+func (app *application) reorderImagesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ImageIDs []int64 `json:"image_ids"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.malformedJSONResponse(w, r, err)
+		return
+	}
+
+	galleryID, err := readUrlIntParam(r, "gallery-id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.images.Reorder(r.Context(), galleryID, input.ImageIDs)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	app.sendJSON(w, r, http.StatusOK, env{"gallery_id": galleryID, "image_ids": input.ImageIDs}, nil)
+}
+
 // Delete an existing image og a gallery owned by the authenticated user.
 // The image ID is specified in the URL parameters.
 func (app *application) deleteImageHandler(w http.ResponseWriter, r *http.Request) {
@@ -252,3 +769,14 @@ func (app *application) deleteImageHandler(w http.ResponseWriter, r *http.Reques
 
 	app.sendJSON(w, r, http.StatusOK, env{"deleted_image_id": imageID}, nil)
 }
+
+// Count a view of a public image in the background, see countGalleryView.
+func (app *application) countImageView(r *http.Request, image store.Image) {
+	ctx := r.Context()
+	app.background(func() {
+		err := app.images.CountView(ctx, image)
+		if err != nil {
+			app.logger.Errorw("counting image view", "image_id", image.ID, "err", err)
+		}
+	})
+}
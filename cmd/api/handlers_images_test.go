@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/services/images"
+)
+
+// The images service returning fixed page cursors, other methods are not implemented.
+type cursorsImages struct {
+	images.Service
+	cursors  []int64
+	pageSize int
+}
+
+func (ci *cursorsImages) ListPublicPageCursors(ctx context.Context, pageSize int) ([]int64, error) {
+	ci.pageSize = pageSize
+	return ci.cursors, nil
+}
+
+// The sitemap index lists a sitemap for each page of public images.
+func TestPublicImagesSitemapIndex(t *testing.T) {
+	svc := &cursorsImages{cursors: []int64{0, 50123, 100456}}
+	app := &application{images: svc}
+	app.config.PublicHostname = "https://example.com"
+
+	rec := httptest.NewRecorder()
+	app.publicImagesSitemapIndexHandler(rec, httptest.NewRequest(http.MethodGet, "/v1/public/images/sitemap.xml", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	if svc.pageSize != sitemapMaxURLs {
+		t.Fatalf("pages of %d images requested, expected %d", svc.pageSize, sitemapMaxURLs)
+	}
+
+	var index struct {
+		XMLName  xml.Name `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+		Sitemaps []struct {
+			Loc string `xml:"loc"`
+		} `xml:"sitemap"`
+	}
+	err := xml.Unmarshal(rec.Body.Bytes(), &index)
+	if err != nil {
+		t.Fatalf("decoding index %q: %v", rec.Body.String(), err)
+	}
+	expected := []string{
+		"https://example.com/v1/public/images/sitemap-page.xml?after=0",
+		"https://example.com/v1/public/images/sitemap-page.xml?after=50123",
+		"https://example.com/v1/public/images/sitemap-page.xml?after=100456",
+	}
+	if len(index.Sitemaps) != len(expected) {
+		t.Fatalf("expected %d sitemaps, got %d", len(expected), len(index.Sitemaps))
+	}
+	for i, sitemap := range index.Sitemaps {
+		if sitemap.Loc != expected[i] {
+			t.Errorf("sitemap %d: expected %s, got %s", i, expected[i], sitemap.Loc)
+		}
+	}
+}
+
+// An upload interrupted by the client is reported as such, and neither the partial
+// file nor the record of the image is left.
+func TestCreateImageInterrupted(t *testing.T) {
+	ts, mock := newMockServer(t, nil)
+	mock.Set(store.User{ID: 1, Email: "upload@example.com", Activated: true})
+	mock.Set(store.Keys{ID: 1, UserID: 1})
+	mock.Set([]string{store.PermissionMain})
+	mock.Set(store.Gallery{ID: 1, UserID: 1, Title: "Uploads"})
+
+	// A valid image, truncated before its end.
+	content := testPNG(t)
+	truncated := content[:len(content)-12]
+
+	// The handler is called directly, since the client would
+	// fail before receiving the response to a truncated body.
+	body := io.MultiReader(bytes.NewReader(truncated), iotest.ErrReader(io.ErrUnexpectedEOF))
+	req := httptest.NewRequest(http.MethodPost, "/v1/galleries/1/images?title=partial.png", body)
+	req.Header.Set("Authorization", "Bearer upload-key")
+	req.Header.Set("Content-Type", "image/png")
+	rec := httptest.NewRecorder()
+	ts.Config.Handler.ServeHTTP(rec, req)
+
+	var res struct {
+		Code string `json:"code"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest || res.Code != "upload_interrupted" {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	err = filepath.Walk(mock.Root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			t.Errorf("unexpected file left: %s", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range mock.Queries {
+		if strings.Contains(query, "INTO images") || strings.Contains(query, "UPDATE stats") {
+			t.Errorf("unexpected write: %s", query)
+		}
+	}
+}
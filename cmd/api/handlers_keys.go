@@ -2,18 +2,34 @@ package main
 
 import (
 	"net/http"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/services/users"
 )
 
 // List the user keys. Only requests authenticated with main keys will
-// obtain the complete list of keys.
+// obtain the complete list of keys. Pagination is supported and specified
+// via query parameters. An optional comma-separated 'target' permissions
+// set makes the listing report, per key, the difference from that set.
 func (app *application) listUserKeysHandler(w http.ResponseWriter, r *http.Request) {
-	keys, err := app.users.ListUserKeys(r.Context())
+	queryString := r.URL.Query()
+	filter := app.readFilter(queryString, users.KeysListDefaults)
+
+	var target store.Permissions
+	if queryString.Has("target") {
+		target = store.Permissions(readCSV(queryString, "target"))
+		if target == nil {
+			target = store.Permissions{}
+		}
+	}
+
+	keys, metadata, err := app.users.ListUserKeys(r.Context(), filter, target)
 	if err != nil {
 		app.errorResponse(w, r, err)
 		return
 	}
 
-	app.sendJSON(w, r, http.StatusOK, env{"keys": keys}, nil)
+	app.sendJSON(w, r, http.StatusOK, env{"keys": keys, "filter": metadata}, nil)
 }
 
 // Add a new auth key for the user. Permissions are read from the JSON-formatted body.
@@ -22,7 +38,7 @@ func (app *application) addUserKeyHandler(w http.ResponseWriter, r *http.Request
 		Permissions []string `json:"permissions"`
 	}
 
-	err := readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.malformedJSONResponse(w, r, err)
 		return
@@ -49,7 +65,7 @@ func (app *application) editKeyPermissionsHandler(w http.ResponseWriter, r *http
 		app.notFoundResponse(w, r)
 		return
 	}
-	err = readJSON(w, r, &input)
+	err = app.readJSON(w, r, &input)
 	if err != nil {
 		app.malformedJSONResponse(w, r, err)
 		return
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"errors"
+	"io"
 	"net/http"
 
+	"github.com/gorilla/mux"
+
+	"github.com/anBertoli/snap-vault/pkg/mailer"
 	"github.com/anBertoli/snap-vault/pkg/store"
 )
 
@@ -18,10 +23,50 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 	app.sendJSON(w, r, http.StatusOK, env, nil)
 }
 
-// Documentation handler that list all editable permissions.
+// Documentation handler that list all editable permissions. By default the flat list of
+// the codes is returned, with format=grouped the permissions are described and grouped
+// by resource.
 func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	if readString(r.URL.Query(), "format", "flat") == "grouped" {
+		app.sendJSON(w, r, http.StatusOK, env{"permissions": store.PermissionGroups()}, nil)
+		return
+	}
 	env := env{
 		"permissions": store.EditablePermissions,
 	}
 	app.sendJSON(w, r, http.StatusOK, env, nil)
 }
+
+// Development handler that renders the named email template (e.g. user_welcome) with
+// sample data and returns the HTML body, so templates can be previewed without sending
+// emails. The route is registered only in the dev environment.
+func (app *application) emailPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["template"]
+
+	// The lifetime reported is the one of the token sent with the template.
+	tokenTTL := app.config.Tokens.ActivationTTL
+	if name == "recover_key" {
+		tokenTTL = app.config.Tokens.RecoveryTTL
+	}
+
+	email, err := mailer.Render(name+".gohtml", map[string]interface{}{
+		"userID":          1,
+		"name":            "Jane Doe",
+		"hostName":        app.config.PublicHostname,
+		"activationToken": "SAMPLEACTIVATIONTOKEN",
+		"recoverToken":    "SAMPLERECOVERTOKEN",
+		"tokenTTL":        formatTTL(tokenTTL),
+	})
+	if errors.Is(err, mailer.ErrTemplateNotFound) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, email.HTMLBody)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// The email templates are rendered with sample data in dev mode, while in other
+// environments the preview endpoint doesn't exist.
+func TestEmailPreview(t *testing.T) {
+	ts, _ := newMockServer(t, nil)
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"user_welcome", "/v1/users/activate?token=SAMPLEACTIVATIONTOKEN"},
+		{"recover_key", "/v1/users/recover-key?token=SAMPLERECOVERTOKEN"},
+	}
+	for _, tt := range tests {
+		res, err := ts.Client().Get(ts.URL + "/v1/dev/email-preview/" + tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+			t.Fatalf("%s: got status %d and content type %q", tt.template, res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		if !strings.Contains(string(body), tt.want) {
+			t.Fatalf("%s: expected %q in the preview:\n%s", tt.template, tt.want, body)
+		}
+	}
+	status, _ := ts.do(t, http.MethodGet, "/v1/dev/email-preview/missing", "", nil, "")
+	if status != http.StatusNotFound {
+		t.Fatalf("missing template: got status %d", status)
+	}
+
+	prod, _ := newMockServer(t, func(cfg *config) {
+		cfg.Env = "production"
+	})
+	for _, tt := range tests {
+		status, _ := prod.do(t, http.MethodGet, "/v1/dev/email-preview/"+tt.template, "", nil, "")
+		if status != http.StatusNotFound {
+			t.Fatalf("%s in production: got status %d", tt.template, status)
+		}
+	}
+}
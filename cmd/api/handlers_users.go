@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 
+	"github.com/anBertoli/snap-vault/pkg/store"
 	"github.com/anBertoli/snap-vault/pkg/tracing"
+	"github.com/anBertoli/snap-vault/services/users"
 )
 
 // Register a new user into the system. The user must be activated before using
@@ -16,7 +19,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		Password string `json:"password"`
 	}
 
-	err := readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.malformedJSONResponse(w, r, err)
 		return
@@ -37,6 +40,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 			"hostName":        app.config.PublicHostname,
 			"userID":          user.ID,
 			"name":            user.Name,
+			"tokenTTL":        formatTTL(app.config.Tokens.ActivationTTL),
 		}
 		err = app.mailer.Send(user.Email, "user_welcome.gohtml", mailData)
 		if err != nil {
@@ -74,7 +78,7 @@ func (app *application) regenerateActivationTokenHandler(w http.ResponseWriter,
 		Password string `json:"password"`
 	}
 
-	err := readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.malformedJSONResponse(w, r, err)
 		return
@@ -95,6 +99,7 @@ func (app *application) regenerateActivationTokenHandler(w http.ResponseWriter,
 			"hostName":        app.config.PublicHostname,
 			"userID":          user.ID,
 			"name":            user.Name,
+			"tokenTTL":        formatTTL(app.config.Tokens.ActivationTTL),
 		}
 		err = app.mailer.Send(user.Email, "user_welcome.gohtml", mailData)
 		if err != nil {
@@ -117,7 +122,7 @@ func (app *application) genKeyRecoveryTokenHandler(w http.ResponseWriter, r *htt
 		Password string `json:"password"`
 	}
 
-	err := readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.malformedJSONResponse(w, r, err)
 		return
@@ -136,6 +141,7 @@ func (app *application) genKeyRecoveryTokenHandler(w http.ResponseWriter, r *htt
 		mailData := map[string]interface{}{
 			"recoverToken": plainToken,
 			"hostName":     app.config.PublicHostname,
+			"tokenTTL":     formatTTL(app.config.Tokens.RecoveryTTL),
 		}
 		err = app.mailer.Send(input.Email, "recover_key.gohtml", mailData)
 		if err != nil {
@@ -179,7 +185,8 @@ func (app *application) getUserAccountHandler(w http.ResponseWriter, r *http.Req
 	}, nil)
 }
 
-// Retrieve usage statistics about the user authenticated.
+// Retrieve usage statistics about the user authenticated. The storage quota and the
+// remaining space are included, so clients don't have to know the configured limit.
 func (app *application) getUserStatsHandler(w http.ResponseWriter, r *http.Request) {
 	stats, err := app.users.GetStats(r.Context())
 	if err != nil {
@@ -187,5 +194,76 @@ func (app *application) getUserStatsHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	app.sendJSON(w, r, http.StatusOK, env{"stats": stats}, nil)
+	// The space in use could exceed the quota (e.g. if the quota was lowered),
+	// the remaining bytes never go below zero.
+	remaining := app.config.Storage.MaxSpace - stats.Space
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	app.sendJSON(w, r, http.StatusOK, env{"stats": struct {
+		store.Stats
+		MaxBytes       int64 `json:"max_bytes"`
+		BytesRemaining int64 `json:"bytes_remaining"`
+	}{
+		Stats:          stats,
+		MaxBytes:       app.config.Storage.MaxSpace,
+		BytesRemaining: remaining,
+	}}, nil)
+}
+
+// Retrieve the audit log of the user authenticated, that is, the list of the security-relevant
+// actions performed on the account. Filtering and pagination is supported and specified via
+// query parameters.
+func (app *application) listUserAuditHandler(w http.ResponseWriter, r *http.Request) {
+	queryString := r.URL.Query()
+	filter := app.readFilter(queryString, users.AuditListDefaults)
+
+	entries, metadata, err := app.users.ListAudit(r.Context(), filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	app.sendJSON(w, r, http.StatusOK, env{"audit": entries, "filter": metadata}, nil)
+}
+
+// List all the users, for administration. The endpoint requires an auth key with the admin
+// permission. Listing supports pagination, sorting and the search on name or email.
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	queryString := r.URL.Query()
+	filter := app.readFilter(queryString, users.ListDefaults)
+	filter.CountOnly = readBool(queryString, "count_only", false)
+
+	err := readDateRange(queryString, &filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	allUsers, metadata, err := app.users.ListAll(r.Context(), filter)
+	if err != nil {
+		app.errorResponse(w, r, err)
+		return
+	}
+
+	// Only the pagination metadata is sent if just the count was requested.
+	if filter.CountOnly {
+		app.sendJSON(w, r, http.StatusOK, env{"filter": metadata}, nil)
+		return
+	}
+
+	app.sendJSON(w, r, http.StatusOK, env{"users": allUsers, "filter": metadata}, nil)
+}
+
+// Format a lifetime expressed in minutes to be read in emails, e.g. "3 hours".
+func formatTTL(minutes int) string {
+	value, unit := minutes, "minute"
+	if minutes%60 == 0 {
+		value, unit = minutes/60, "hour"
+	}
+	if value != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", value, unit)
 }
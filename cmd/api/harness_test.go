@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+// An email captured by the testMailer instead of being sent.
+type sentMail struct {
+	Recipient string
+	Template  string
+	Data      map[string]interface{}
+}
+
+// The testMailer satisfies the emailSender interface, emails are not sent but
+// made available to the tests (e.g. to read the activation token).
+type testMailer struct {
+	sent chan sentMail
+}
+
+func (m *testMailer) Send(recipient, templateFile string, data interface{}) error {
+	mailData, _ := data.(map[string]interface{})
+	m.sent <- sentMail{Recipient: recipient, Template: templateFile, Data: mailData}
+	return nil
+}
+
+// Wait for the next email sent to the recipient, emails sent to other
+// recipients in the meantime are discarded.
+func (m *testMailer) waitFor(t *testing.T, recipient string) sentMail {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case mail := <-m.sent:
+			if mail.Recipient == recipient {
+				return mail
+			}
+		case <-timeout:
+			t.Fatalf("no email sent to %s", recipient)
+		}
+	}
+}
+
+// The testServer runs the complete application, with the full middleware chain and
+// the decorated services, against the test database and a capturing mailer.
+type testServer struct {
+	*httptest.Server
+	app    *application
+	mailer *testMailer
+}
+
+// Start a test server, skipping the test if the test database is not configured. The
+// config starts from the defaults and can be adjusted with the configure function (it
+// can be nil). Images are stored in a temporary directory removed with the test.
+func newTestServer(t *testing.T, configure func(cfg *config)) *testServer {
+	t.Helper()
+	dsn := storetest.DSN(t)
+	cfg := testConfig(t, dsn, configure)
+
+	err := migrateDB(dsn)
+	if err != nil {
+		t.Fatalf("migrating test database: %v", err)
+	}
+	db, err := openDB(cfg)
+	if err != nil {
+		t.Fatalf("opening test database: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	storage, err := store.New(db, store.FsOptions{
+		Root:         cfg.Storage.Root,
+		PathTemplate: cfg.Storage.PathTemplate,
+		Shard:        cfg.Storage.ShardDirs,
+	})
+	if err != nil {
+		t.Fatalf("creating storage: %v", err)
+	}
+
+	return startTestServer(t, cfg, storage)
+}
+
+// Start a test server using a mock store instead of the test database, see
+// storetest.Mock. The rows returned to the application are registered on the
+// returned mock. The configure function can be nil.
+func newMockServer(t *testing.T, configure func(cfg *config)) (*testServer, *storetest.Mock) {
+	t.Helper()
+	cfg := testConfig(t, "postgres://mock", configure)
+	storage, mock := storetest.NewMock(t)
+	return startTestServer(t, cfg, storage), mock
+}
+
+// Return a valid config for the test servers, starting from the defaults.
+func testConfig(t *testing.T, dsn string, configure func(cfg *config)) config {
+	t.Helper()
+	cfg, err := loadConfig("", false)
+	if err != nil {
+		t.Fatalf("loading default config: %v", err)
+	}
+	cfg.Port = 4000
+	cfg.Env = "dev"
+	cfg.Db.Dsn = dsn
+	cfg.Storage.Root = t.TempDir()
+	cfg.PublicHostname = "http://localhost"
+	cfg.Metrics.MetricsEndpoint = "/metrics"
+	if configure != nil {
+		configure(&cfg)
+	}
+	err = cfg.Validate()
+	if err != nil {
+		t.Fatalf("invalid test config: %v", err)
+	}
+	return cfg
+}
+
+func startTestServer(t *testing.T, cfg config, storage store.Store) *testServer {
+	t.Helper()
+
+	// Each server has its own registry, so more servers can be
+	// started in the same process without metrics conflicts.
+	mailer := &testMailer{sent: make(chan sentMail, 100)}
+	app := newApplication(cfg, storage, mailer, zap.NewNop().Sugar(), prometheus.NewRegistry())
+	srv := httptest.NewServer(app.handler())
+	t.Cleanup(func() {
+		srv.Close()
+		app.bgTasks.Wait()
+	})
+
+	return &testServer{Server: srv, app: app, mailer: mailer}
+}
+
+// Perform a request authenticated with the provided key (if not empty), returning
+// the response status code and body. The body is sent with the provided content
+// type, if not empty.
+func (ts *testServer) do(t *testing.T, method, path, key string, body io.Reader, contentType string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, resBody
+}
+
+// Perform a request with the JSON encoding of the input as body and decode the JSON
+// response into the output (if not nil), returning the response status code.
+func (ts *testServer) doJSON(t *testing.T, method, path, key string, input, output interface{}) int {
+	t.Helper()
+	var body io.Reader
+	if input != nil {
+		js, err := json.Marshal(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(js)
+	}
+
+	status, resBody := ts.do(t, method, path, key, body, "application/json")
+	if output != nil {
+		err := json.Unmarshal(resBody, output)
+		if err != nil {
+			t.Fatalf("decoding response %q: %v", resBody, err)
+		}
+	}
+	return status
+}
+
+// Register a user with a unique email, starting with the prefix, and activate it
+// with the token sent via email. The auth key of the user is returned.
+func (ts *testServer) newUser(t *testing.T, prefix string) string {
+	t.Helper()
+	email := storetest.Email(prefix)
+
+	var registered struct {
+		Keys struct {
+			AuthKey string `json:"auth_key"`
+		} `json:"keys"`
+	}
+	status := ts.doJSON(t, http.MethodPost, "/v1/users/register", "", map[string]string{
+		"name":     "Test User",
+		"email":    email,
+		"password": "pa55word-test",
+	}, &registered)
+	if status != http.StatusOK {
+		t.Fatalf("register: got status %d", status)
+	}
+	token, _ := ts.mailer.waitFor(t, email).Data["activationToken"].(string)
+	status = ts.doJSON(t, http.MethodGet, "/v1/users/activate?token="+token, "", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("activate: got status %d", status)
+	}
+	return registered.Keys.AuthKey
+}
+
+// Create a gallery of the user with the provided key, returning its ID.
+func (ts *testServer) newGallery(t *testing.T, key string, published bool) int64 {
+	t.Helper()
+	var created struct {
+		Gallery struct {
+			ID int64 `json:"id"`
+		} `json:"gallery"`
+	}
+	status := ts.doJSON(t, http.MethodPost, "/v1/galleries", key, map[string]interface{}{
+		"title":     "test gallery",
+		"published": published,
+	}, &created)
+	if status != http.StatusOK {
+		t.Fatalf("create gallery: got status %d", status)
+	}
+	return created.Gallery.ID
+}
+
+// Upload the content as a PNG image of the gallery, returning the ID of the image.
+func (ts *testServer) uploadImage(t *testing.T, key string, galleryID int64, title string, content []byte) int64 {
+	t.Helper()
+	path := fmt.Sprintf("/v1/galleries/%d/images?title=%s", galleryID, url.QueryEscape(title))
+	status, body := ts.do(t, http.MethodPost, path, key, bytes.NewReader(content), "image/png")
+	if status != http.StatusOK {
+		t.Fatalf("upload: got status %d: %s", status, body)
+	}
+	var uploaded struct {
+		Image struct {
+			ID int64 `json:"id"`
+		} `json:"image"`
+	}
+	err := json.Unmarshal(body, &uploaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uploaded.Image.ID
+}
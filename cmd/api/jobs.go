@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Periodically delete the tokens past their expiry, left behind by abandoned activation
+// and key recovery flows, and the expired idempotency keys. The job is disabled if the
+// interval is zero. It is tracked by bgTasks and stops when the context is cancelled,
+// so the shutdown waits for the current run to complete.
+func (app *application) startTokensCleanup(ctx context.Context) {
+	interval := time.Duration(app.config.Tokens.CleanupInterval) * time.Minute
+	if interval == 0 || app.tokens == nil {
+		return
+	}
+
+	app.bgTasks.Add(1)
+	go func() {
+		defer app.bgTasks.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				app.deleteExpired()
+			}
+		}
+	}()
+}
+
+// Run the cleanup once, logging how many tokens and idempotency keys were removed.
+func (app *application) deleteExpired() {
+	n, err := app.tokens.DeleteExpired()
+	if err != nil {
+		app.logger.Errorw("deleting expired tokens", "err", err)
+	} else {
+		app.logger.Infow("deleted expired tokens", "count", n)
+	}
+	if app.idemKeys == nil {
+		return
+	}
+	n, err = app.idemKeys.DeleteExpired(
+		time.Duration(app.config.Idempotency.TTL)*time.Hour,
+		time.Duration(app.config.Idempotency.Lease)*time.Minute,
+	)
+	if err != nil {
+		app.logger.Errorw("deleting expired idempotency keys", "err", err)
+		return
+	}
+	app.logger.Infow("deleted expired idempotency keys", "count", n)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// The fake stores delete a fixed number of rows, or fail.
+type expiredTokens struct {
+	deleted int64
+	err     error
+}
+
+func (et *expiredTokens) DeleteExpired() (int64, error) {
+	return et.deleted, et.err
+}
+
+type expiredKeys struct {
+	deleted    int64
+	err        error
+	ttl, lease time.Duration
+}
+
+func (ek *expiredKeys) DeleteExpired(ttl, lease time.Duration) (int64, error) {
+	ek.ttl, ek.lease = ttl, lease
+	return ek.deleted, ek.err
+}
+
+// Each run of the cleanup logs how many tokens and idempotency keys were removed,
+// or the errors, and the idempotency keys are deleted according to the config.
+func TestDeleteExpiredJob(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	tokens := &expiredTokens{deleted: 3}
+	keys := &expiredKeys{deleted: 2}
+	app := &application{logger: zap.New(core).Sugar(), tokens: tokens, idemKeys: keys}
+	app.config.Idempotency.TTL = 24
+	app.config.Idempotency.Lease = 10
+
+	app.deleteExpired()
+	entries := logs.TakeAll()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 log entries, got %d", len(entries))
+	}
+	for i, want := range []struct {
+		msg   string
+		count int64
+	}{
+		{"deleted expired tokens", 3},
+		{"deleted expired idempotency keys", 2},
+	} {
+		if entries[i].Message != want.msg || entries[i].ContextMap()["count"] != want.count {
+			t.Errorf("entry %d: expected %q with count %d, got %q %v", i, want.msg, want.count, entries[i].Message, entries[i].ContextMap())
+		}
+	}
+	if keys.ttl != 24*time.Hour || keys.lease != 10*time.Minute {
+		t.Errorf("expected the configured TTL and lease, got %v and %v", keys.ttl, keys.lease)
+	}
+
+	tokens.err = errors.New("database down")
+	keys.err = errors.New("database down")
+	app.deleteExpired()
+	if n := logs.FilterLevelExact(zap.ErrorLevel).Len(); n != 2 {
+		t.Fatalf("expected 2 logged errors, got %d", n)
+	}
+}
+
+// The job stops when the context is cancelled, so the shutdown doesn't hang.
+func TestTokensCleanupStops(t *testing.T) {
+	app := &application{logger: zap.NewNop().Sugar(), tokens: &expiredTokens{}}
+	app.config.Tokens.CleanupInterval = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app.startTokensCleanup(ctx)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		app.bgTasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the cleanup job didn't stop")
+	}
+}
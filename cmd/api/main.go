@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"os"
 	"time"
 
+	"github.com/golang-migrate/migrate/v4"
 	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 
+	"github.com/anBertoli/snap-vault/migrations"
 	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/logging"
 	"github.com/anBertoli/snap-vault/pkg/mailer"
 	"github.com/anBertoli/snap-vault/pkg/store"
 	"github.com/anBertoli/snap-vault/services/galleries"
@@ -31,9 +36,19 @@ func main() {
 		return
 	}
 
+	// Refuse to start with invalid configuration values.
+	err = cfg.Validate()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	// Create the logger to be used throughout the application, specifying the
-	// format of the logs.
-	logger := makeLogger(cfg.Env == "dev").Sugar()
+	// format of the logs. The level was already checked when validating the
+	// config and it can be changed at runtime when the config is reloaded.
+	level, _ := cfg.logLevel()
+	logLevel := zap.NewAtomicLevelAt(level)
+	logger := logging.New(cfg.Env == "dev", logLevel).Sugar()
 	logger.Infof("configuration %s", cfg.Expose())
 
 	// Open a pool of connection to the database.
@@ -42,17 +57,61 @@ func main() {
 		logger.Fatalf("cannot open db connection: %v", err)
 	}
 
+	// Apply the migrations embedded in the binary if asked to. Concurrent instances
+	// are serialized by golang-migrate with a database lock.
+	if cfg.AutoMigrate {
+		err = migrateDB(cfg.Db.Dsn)
+		if err != nil {
+			logger.Fatalf("cannot apply migrations: %v", err)
+		}
+		logger.Infow("database migrations applied", "version", store.SchemaVersion)
+	}
+
+	// Refuse to serve traffic if the migrations applied to the database don't match
+	// the schema the store expects, queries would fail in confusing ways otherwise.
+	err = store.CheckSchema(db)
+	if err != nil {
+		logger.Fatalf("cannot use the database, run the migrate command of the CLI first: %v", err)
+	}
+
 	// Instantiate the store struct that will be used to perform operations on the database.
 	// The store needs the connection pool created above and the path of the directory where
 	// images will be stored.
-	storage, err := store.New(db, cfg.Storage.Root)
+	storage, err := store.New(db, store.FsOptions{
+		Root:         cfg.Storage.Root,
+		PathTemplate: cfg.Storage.PathTemplate,
+		Shard:        cfg.Storage.ShardDirs,
+	})
 	if err != nil {
 		logger.Fatalw("creating storage", "err", err)
 	}
 
+	mailer := mailer.New(cfg.Smtp.Host, cfg.Smtp.Port, cfg.Smtp.Username, cfg.Smtp.Password, cfg.Smtp.Sender)
+
+	// Create the application struct, the entity that represent our JSON API. It provides
+	// the HTTP handlers as methods along several helper functions.
+	app := newApplication(cfg, storage, mailer, logger, nil)
+	app.logLevel = &logLevel
+
+	// Start listening of the address:port specified by the configs.
+	err = app.serve()
+	if err != nil {
+		logger.Fatalw("shutting down server", "err", err)
+	}
+}
+
+// Wire the services and create the application struct. Dependencies with side effects on
+// the outside world (the storage and the mailer) are provided by the caller, so they
+// can be replaced (e.g. to run the complete handler chain against a test database
+// and a no-op mailer). All the metrics are registered with the provided registerer,
+// the default Prometheus one if nil, so more applications can live in one process.
+func newApplication(cfg config, storage store.Store, mailer emailSender, logger *zap.SugaredLogger, registerer prometheus.Registerer) *application {
 	// The authenticator is used to authenticate requests in several auth middlewares
-	// that wrap our core services.
-	authenticator := auth.Authenticator{Store: storage}
+	// that wrap our core services. It also keeps track of the last activity of users.
+	authenticator := auth.Authenticator{
+		Store:            storage,
+		ActivityInterval: time.Duration(cfg.Auth.ActivityInterval) * time.Minute,
+	}
 
 	// Declare a users.Service interface variable, then assign to it the core service of the users
 	// package (it is a concrete value assigned to an interface). Decorate the interface with the
@@ -60,42 +119,121 @@ func main() {
 	// of service middlewares that provides specialized functionalities and enforce separation
 	// of concerns.
 	var usersService users.Service
-	usersService = &users.UsersService{Store: storage}
+	usersService = &users.UsersService{
+		Store:              storage,
+		MaxKeys:            cfg.Auth.MaxKeys,
+		MaxKeysIncludeMain: cfg.Auth.MaxKeysWithMain,
+		ActivationTTL:      time.Duration(cfg.Tokens.ActivationTTL) * time.Minute,
+		RecoveryTTL:        time.Duration(cfg.Tokens.RecoveryTTL) * time.Minute,
+	}
 	usersService = &users.ValidationMiddleware{Service: usersService}
+	usersService = &users.LockoutMiddleware{
+		Service:     usersService,
+		MaxAttempts: cfg.Auth.LockoutAttempts,
+		Window:      time.Duration(cfg.Auth.LockoutWindow) * time.Minute,
+	}
 	usersService = &users.AuthMiddleware{Service: usersService, Auth: authenticator}
 
 	// Repeat the same process for the galleries service.
 	var galleriesService galleries.Service
-	galleriesService = galleries.NewGalleriesService(storage, logger, 20)
-	galleriesService = &galleries.StatsMiddleware{Store: storage.Stats, Service: galleriesService}
-	galleriesService = &galleries.ValidationMiddleware{Service: galleriesService}
+	// The archive file mode and compression were already checked when validating the
+	// config. The core service is kept aside to resize the downloads limit when the
+	// config is reloaded.
+	archiveFileMode, _ := cfg.archiveFileMode()
+	archiveLevel, autoCompression, _ := cfg.archiveCompression()
+	galleriesCore := galleries.NewGalleriesService(storage, logger, galleries.Config{
+		Concurrency:       uint(cfg.Storage.ArchiveWorkers),
+		ArchiveFileMode:   archiveFileMode,
+		ArchiveRate:       cfg.Storage.ArchiveRate,
+		ArchiveLevel:      archiveLevel,
+		AutoCompression:   autoCompression,
+		ExcludeOwnerViews: cfg.Views.ExcludeOwner,
+		Registerer:        registerer,
+	})
+	galleriesService = galleriesCore
+	galleriesService = &galleries.StatsMiddleware{Store: storage.Stats, Logger: logger, Service: galleriesService}
+	galleriesService = &galleries.ValidationMiddleware{Service: galleriesService, MaxSelection: cfg.Storage.MaxSelection}
+	galleriesService = &galleries.IdempotencyMiddleware{
+		Store:   storage.Idempotency,
+		TTL:     time.Duration(cfg.Idempotency.TTL) * time.Hour,
+		Lease:   time.Duration(cfg.Idempotency.Lease) * time.Minute,
+		Logger:  logger,
+		Service: galleriesService,
+	}
 	galleriesService = &galleries.AuthMiddleware{Service: galleriesService, Auth: authenticator}
 
-	// Repeat the same process for the images service.
+	// Repeat the same process for the images service. Without a configured secret, URLs
+	// are signed with a random one, so they become invalid when the server restarts.
+	signingSecret := []byte(cfg.Auth.SigningSecret)
+	if len(signingSecret) == 0 {
+		signingSecret = make([]byte, minSigningSecretLen)
+		_, err := rand.Read(signingSecret)
+		if err != nil {
+			logger.Fatalw("generating signing secret", "err", err)
+		}
+		logger.Warn("auth.signing_secret not set, signed URLs will not survive a restart")
+	}
 	var imagesService images.Service
-	imagesService = &images.ImagesService{Store: storage}
-	imagesService = &images.StatsMiddleware{Store: storage.Stats, Service: imagesService, MaxBytes: cfg.Storage.MaxSpace}
-	imagesService = &images.ValidationMiddleware{Service: imagesService}
+	imagesService = &images.ImagesService{
+		Store:             storage,
+		MaxGalleryImages:  cfg.Storage.MaxGalleryImages,
+		ExcludeOwnerViews: cfg.Views.ExcludeOwner,
+		Signer:            images.URLSigner{Secret: signingSecret},
+		Logger:            logger,
+	}
+	imagesService = &images.StatsMiddleware{
+		Store:    storage.Stats,
+		Service:  imagesService,
+		MaxBytes: cfg.Storage.MaxSpace,
+		Logger:   logger,
+	}
+	imagesService = &images.ValidationMiddleware{
+		Service:      imagesService,
+		AllowedTypes: cfg.Limits.ImageTypes,
+		MaxWidth:     cfg.Limits.MaxImageWidth,
+		MaxHeight:    cfg.Limits.MaxImageHeight,
+		MaxSignedTTL: time.Duration(cfg.Auth.MaxSignedTTL) * time.Minute,
+	}
+	imagesService = &images.IdempotencyMiddleware{
+		Store:   storage.Idempotency,
+		TTL:     time.Duration(cfg.Idempotency.TTL) * time.Hour,
+		Lease:   time.Duration(cfg.Idempotency.Lease) * time.Minute,
+		Logger:  logger,
+		Service: imagesService,
+	}
 	imagesService = &images.AuthMiddleware{Service: imagesService, Auth: authenticator}
 
-	mailer := mailer.New(cfg.Smtp.Host, cfg.Smtp.Port, cfg.Smtp.Username, cfg.Smtp.Password, cfg.Smtp.Sender)
-
-	// Create the application struct, the entity that represent our JSON API. It provides
-	// the HTTP handlers as methods along several helper functions.
-	app := application{
-		users:     usersService,
-		galleries: galleriesService,
-		images:    imagesService,
-		mailer:    mailer,
-		logger:    logger,
-		config:    cfg,
+	app := &application{
+		users:      usersService,
+		galleries:  galleriesService,
+		images:     imagesService,
+		mailer:     mailer,
+		logger:     logger,
+		config:     cfg,
+		registerer: registerer,
+		downloads:  galleriesCore,
+		tokens:     &storage.Tokens,
+		idemKeys:   &storage.Idempotency,
 	}
+	app.live.set(cfg)
 
-	// Start listening of the address:port specified by the configs.
-	err = app.serve()
-	if err != nil {
-		logger.Fatalw("shutting down server", "err", err)
+	app.storageUnavailable = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "api_storage_unavailable",
+		Help: "Counter of the writes rejected because the storage is full or unwritable.",
+	})
+	app.bgDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "api_background_tasks_dropped",
+		Help: "Counter of the background tasks dropped because the queue was full.",
+	})
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
 	}
+	for _, c := range []prometheus.Collector{app.storageUnavailable, app.bgDropped} {
+		if err := registerer.Register(c); err != nil {
+			panic(err)
+		}
+	}
+	return app
 }
 
 // Create a database connection pool and configure it.
@@ -127,27 +265,18 @@ func openDB(cfg config) (*sqlx.DB, error) {
 	return db, nil
 }
 
-// Instantiate the appropriate logger based on the mode. The dev mode will result in colorized
-// and more readable log entries, while production logs will be entirely JSON-formatted.
-func makeLogger(dev bool) *zap.Logger {
-	var zapLogger *zap.Logger
-	if dev {
-		config := zap.NewDevelopmentEncoderConfig()
-		config.EncodeLevel = zapcore.CapitalColorLevelEncoder
-		config.EncodeTime = zapcore.ISO8601TimeEncoder
-		zapLogger = zap.New(
-			zapcore.NewCore(
-				zapcore.NewConsoleEncoder(config), os.Stdout, zap.DebugLevel,
-			),
-		)
-	} else {
-		config := zap.NewProductionEncoderConfig()
-		config.EncodeTime = zapcore.ISO8601TimeEncoder
-		zapLogger = zap.New(
-			zapcore.NewCore(
-				zapcore.NewJSONEncoder(config), os.Stdout, zap.DebugLevel,
-			),
-		)
-	}
-	return zapLogger
+// Apply all the embedded up migrations not yet applied to the database. The migrator
+// uses a dedicated connection, closed when done.
+func migrateDB(dsn string) error {
+	migrator, err := migrations.New(dsn)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	err = migrator.Up()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+	return nil
 }
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,19 +26,34 @@ import (
 // header and put it into the request context. The logic here is not meant to authenticate the user,
 // but to provide transport-specific data extraction. The authentication is business logic
 // and this will be handled by the service layer.
+//
+// If enabled in the configuration, the key is also accepted from a cookie or from a query
+// string parameter, for clients that cannot set headers. These are used only as fallbacks
+// when the header is absent, with precedence: header > cookie > query string.
 func (app *application) extractAuthKey(next http.Handler) http.Handler {
+	keyCookie := app.config.Auth.KeyCookie
+	keyQueryParam := app.config.Auth.KeyQueryParam
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		// Add the "Vary: Authorization" header to the response. This indicates to any
 		// caches that the response may vary based on the value of the Authorization
-		// header in the request.
+		// header in the request. The same holds for cookies if they carry the key.
 		w.Header().Add("Vary", "Authorization")
+		if keyCookie != "" {
+			w.Header().Add("Vary", "Cookie")
+		}
 
 		// Retrieve the value of the Authorization header from the request. If there is
-		// no Authorization header found, call the next handler in the chain and return
-		// without executing any of the code below.
+		// no Authorization header found, look for the fallbacks. If no key is found
+		// call the next handler in the chain and return without executing any of
+		// the code below.
 		authorizationHeader := r.Header.Get("Authorization")
 		if authorizationHeader == "" {
+			plainKey := fallbackAuthKey(r, keyCookie, keyQueryParam)
+			if plainKey != "" {
+				r = r.WithContext(auth.ContextSetKey(r.Context(), plainKey))
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -56,6 +78,39 @@ func (app *application) extractAuthKey(next http.Handler) http.Handler {
 	})
 }
 
+// Look for the auth key in the cookie and then in the query string parameter with the
+// provided names. Empty names disable the related source. An empty string is returned
+// if no key is found.
+func fallbackAuthKey(r *http.Request, cookieName, queryParam string) string {
+	if cookieName != "" {
+		cookie, err := r.Cookie(cookieName)
+		if err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	if queryParam != "" {
+		return r.URL.Query().Get(queryParam)
+	}
+	return ""
+}
+
+// Return the request URL as a string suitable for logs, that is, with the
+// auth key redacted if it is accepted from the query string.
+func (app *application) loggableURL(r *http.Request) string {
+	queryParam := app.config.Auth.KeyQueryParam
+	if queryParam == "" || r.URL.RawQuery == "" {
+		return r.URL.String()
+	}
+	qs := r.URL.Query()
+	if qs.Get(queryParam) == "" {
+		return r.URL.String()
+	}
+	qs.Set(queryParam, "REDACTED")
+	u := *r.URL
+	u.RawQuery = qs.Encode()
+	return u.String()
+}
+
 // The tracing middleware puts a request trace into the request context. If a trace is
 // already present the middleware acts as a no-op.
 func (app *application) tracing(next http.Handler) http.Handler {
@@ -98,7 +153,7 @@ func (app *application) logging(next http.Handler) http.Handler {
 			"start_time", requestTrace.Start,
 			"remote_addr", r.RemoteAddr,
 			"real_ip", ip,
-			"URL", r.URL,
+			"URL", app.loggableURL(r),
 			"method", r.Method,
 		)
 
@@ -119,6 +174,9 @@ func (app *application) logging(next http.Handler) http.Handler {
 		if requestTrace.PrivateErr != nil {
 			fields = append(fields, "private_err", requestTrace.PrivateErr)
 		}
+		if requestTrace.TimedOut {
+			fields = append(fields, "timed_out", true)
+		}
 
 		switch requestTrace.HttpCode / 100 {
 		case 0, 1, 2, 3:
@@ -136,6 +194,10 @@ func (app *application) logging(next http.Handler) http.Handler {
 // path and HTTP code) and the latency of the responses (divided by path). The scraping
 // endpoint itself is not monitored.
 func (app *application) metrics(next http.Handler) http.Handler {
+	registerer := app.registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
 
 	// Declare and register the counter of HTTP requests.
 	requestCount := prometheus.NewCounterVec(
@@ -145,7 +207,7 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		},
 		[]string{"path", "code"},
 	)
-	if err := prometheus.Register(requestCount); err != nil {
+	if err := registerer.Register(requestCount); err != nil {
 		panic(err)
 	}
 
@@ -158,7 +220,7 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		},
 		[]string{"path"},
 	)
-	if err := prometheus.Register(requestsLatency); err != nil {
+	if err := registerer.Register(requestsLatency); err != nil {
 		panic(err)
 	}
 
@@ -202,12 +264,13 @@ func (app *application) globalRateLimit(next http.Handler) http.Handler {
 	// Initialize a new rate limiter which allows an average of 'n' requests
 	// per second, with a maximum of 'm' requests in a single burst. Then
 	// return a closure that can access the limiter variable.
-	limiter := rate.NewLimiter(
-		rate.Limit(app.config.RateLimit.Rps),
-		app.config.RateLimit.Burst,
-	)
+	limiter := rate.NewLimiter(app.live.rateLimit())
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The parameters could have been changed by a config reload.
+		limit, burst := app.live.rateLimit()
+		updateLimiter(limiter, limit, burst)
+
 		// Call limiter.Allow() to see if the request is permitted, and if
 		// it's not return a 429 Too Many Requests response.
 		if !limiter.Allow() {
@@ -268,19 +331,19 @@ func (app *application) ipRateLimit(next http.Handler) http.Handler {
 			return
 		}
 
+		limit, burst := app.live.rateLimit()
 		mu.Lock()
 
 		// Create and add a new ipLimiter struct to the map if it doesn't already exist,
-		// then set lastSeen time to now().
+		// then set lastSeen time to now(). Existing limiters are updated if the parameters
+		// were changed by a config reload.
 		_, found := clients[ip]
 		if !found {
 			clients[ip] = &ipLimiter{
-				limiter: rate.NewLimiter(
-					rate.Limit(app.config.RateLimit.Rps),
-					app.config.RateLimit.Burst,
-				),
+				limiter: rate.NewLimiter(limit, burst),
 			}
 		}
+		updateLimiter(clients[ip].limiter, limit, burst)
 		clients[ip].lastSeen = time.Now()
 
 		// Call the Allow() method on the rate limiter for the current IP address. If
@@ -302,6 +365,134 @@ func (app *application) ipRateLimit(next http.Handler) http.Handler {
 	})
 }
 
+// Apply the provided parameters to the limiter, if different from the current ones.
+func updateLimiter(limiter *rate.Limiter, limit rate.Limit, burst int) {
+	if limiter.Limit() != limit {
+		limiter.SetLimit(limit)
+	}
+	if limiter.Burst() != burst {
+		limiter.SetBurst(burst)
+	}
+}
+
+// The strictRateLimit middleware applies stricter limits to the endpoints that send emails
+// and perform expensive hashing (registration, activation resend and key recovery), since
+// they are attractive targets for email bombing and enumeration. Requests are limited per
+// IP and per email address (if provided in the JSON body), independently of the general
+// rate limiter and of the other routes wrapped by this middleware. It is a no-op if the
+// strict limits are not configured.
+func (app *application) strictRateLimit(next http.Handler) http.Handler {
+	strict := app.config.RateLimit.Strict
+	if strict.PerMinute <= 0 {
+		return next
+	}
+
+	limit := rate.Limit(strict.PerMinute / 60)
+	byIP := newKeyedLimiter(limit, strict.Burst)
+	byEmail := newKeyedLimiter(limit, strict.Burst)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, err := realIP(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !byIP.allow(ip) {
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+		email := peekEmail(r, app.config.Limits.MaxJSONBody)
+		if email != "" && !byEmail.allow(email) {
+			app.rateLimitExceededResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The keyedLimiter keeps a rate limiter for each key (e.g. an IP address). Like in the
+// per-IP rate limiter above, entries not seen for a while are removed in background.
+type keyedLimiter struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[string]*keyedEntry
+}
+
+type keyedEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newKeyedLimiter(limit rate.Limit, burst int) *keyedLimiter {
+	kl := &keyedLimiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: make(map[string]*keyedEntry),
+	}
+
+	// An entry can be removed once its bucket is full again,
+	// since a new limiter would behave in the same way.
+	idle := 3 * time.Minute
+	refill := time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+	if refill > idle {
+		idle = refill
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			kl.mu.Lock()
+			for key, entry := range kl.limiters {
+				if time.Since(entry.lastSeen) > idle {
+					delete(kl.limiters, key)
+				}
+			}
+			kl.mu.Unlock()
+		}
+	}()
+	return kl
+}
+
+// Report whether a request with the provided key is allowed.
+func (kl *keyedLimiter) allow(key string) bool {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	entry, found := kl.limiters[key]
+	if !found {
+		entry = &keyedEntry{limiter: rate.NewLimiter(kl.limit, kl.burst)}
+		kl.limiters[key] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter.Allow()
+}
+
+// Return the normalized email field of the JSON body, empty if the body doesn't contain
+// one or it is malformed. At most limit bytes are read and the body is restored, so it
+// can be decoded (and validated) again by the handler.
+func peekEmail(r *http.Request, limit int64) string {
+	if r.Body == nil {
+		return ""
+	}
+	peeked, err := io.ReadAll(io.LimitReader(r.Body, limit))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peeked), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+
+	var input struct {
+		Email string `json:"email"`
+	}
+	err = json.Unmarshal(peeked, &input)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(input.Email))
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -321,14 +512,14 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			return
 		}
 
-		for _, trustedOrigin := range app.config.Cors.TrustedOrigins {
-			if origin != trustedOrigin {
+		for _, trustedOrigin := range app.live.origins() {
+			if !originMatches(trustedOrigin, origin) {
 				continue
 			}
 
 			// Set this header to communicate to the browser that it's ok to read the response. A
 			// wildcard (*) could be used here, but not in the case where the credentials are allowed
-			// (like below).
+			// (like below). The concrete origin is sent also when matched by a wildcard pattern.
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 
 			// If your API endpoint requires credentials (cookies or HTTP basic authentication) you
@@ -346,8 +537,12 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 				// For preflight requests we must authorize non-CORS safe headers and HTTP methods
 				// not allowed for simple CORS requests. Also the 'Access-Control-Allow-Origin' is
 				// vital for preflight requests, but we have already set it previously.
-				w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, GET, POST, PUT, PATCH, DELETE")
-				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				// The lists are configurable, the max age lets browsers cache the preflight result.
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(app.config.Cors.AllowedMethods, ", "))
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(app.config.Cors.AllowedHeaders, ", "))
+				if app.config.Cors.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(app.config.Cors.MaxAge))
+				}
 				w.WriteHeader(http.StatusOK)
 				return
 			}
@@ -357,6 +552,138 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
+// Report whether the origin of a request matches a trusted origin. Trusted origins are
+// compared exactly, unless their host starts with the '*.' wildcard (e.g.
+// https://*.example.com): in that case any subdomain matches, at any depth, provided
+// that the scheme and the port are the same. The match is anchored at a dot, so
+// https://evilexample.com doesn't match https://*.example.com, and neither does the
+// bare domain.
+func originMatches(trusted, origin string) bool {
+	if trusted == origin {
+		return true
+	}
+	scheme, host, ok := strings.Cut(trusted, "://*.")
+	if !ok {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+	if !strings.EqualFold(u.Scheme, scheme) {
+		return false
+	}
+	subdomain := strings.TrimSuffix(strings.ToLower(u.Host), "."+strings.ToLower(host))
+	return subdomain != "" && subdomain != strings.ToLower(u.Host) && !strings.ContainsAny(subdomain, ":[]")
+}
+
+// The compress middleware gzip-compresses the responses if the client accepts it. The decision
+// is deferred until the handler writes the status code, since only textual content types
+// are compressed: images and gallery archives are already compressed and are sent as they
+// are, as well as partial content (byte ranges refer to the uncompressed content).
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(gw, r)
+
+		// Write the remaining compressed data and the gzip footer.
+		err := gw.Close()
+		if err != nil {
+			app.logger.Errorw("closing gzip writer", "id", tracing.TraceFromRequestCtx(r).ID, "err", err)
+		}
+	})
+}
+
+// Report whether the value of an Accept-Encoding header includes gzip (with a non-zero quality).
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			q, err := strconv.ParseFloat(param[2:], 64)
+			if err != nil || q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// The content types worth compressing.
+var compressibleTypes = []string{"application/json", "application/x-ndjson", "application/xml", "text/"}
+
+// The gzipResponseWriter compresses the body if the response content type is compressible.
+// The choice is made when the status code is written (explicitly or on the first write).
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if !gw.decided {
+		gw.decided = true
+		header := gw.Header()
+		if status != http.StatusNoContent && status != http.StatusNotModified && status != http.StatusPartialContent &&
+			header.Get("Content-Encoding") == "" && isCompressible(header.Get("Content-Type")) {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", "gzip")
+			gw.gz = gzip.NewWriter(gw.ResponseWriter)
+		}
+	}
+	gw.ResponseWriter.WriteHeader(status)
+}
+
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gw.decided {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(p)
+	}
+	return gw.ResponseWriter.Write(p)
+}
+
+// Flush the compressed data written so far, so that streaming responses are still
+// delivered incrementally.
+func (gw *gzipResponseWriter) Flush() {
+	if gw.gz != nil {
+		_ = gw.gz.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (gw *gzipResponseWriter) Close() error {
+	if gw.gz == nil {
+		return nil
+	}
+	return gw.gz.Close()
+}
+
+func isCompressible(contentType string) bool {
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
 func realIP(r *http.Request) (string, error) {
 	addr := r.Header.Get("X-Real-Ip")
 	if addr == "" {
@@ -371,3 +698,136 @@ func realIP(r *http.Request) (string, error) {
 	}
 	return ip, nil
 }
+
+// The requestTimeout middleware bounds the time spent serving a request. The handler runs
+// with a context cancelled after the configured timeout, and if it didn't start writing
+// the response in time a 503 JSON error is sent to the client. Later writes of the handler
+// are discarded. Uploads and streamed downloads are excluded, since their duration depends
+// on the size of the content and on the speed of the client. It is a no-op if the timeout
+// is not configured.
+func (app *application) requestTimeout(next http.Handler) http.Handler {
+	timeout := time.Duration(app.config.Limits.RequestTimeout) * time.Second
+	if timeout <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isLongRunning(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		// The handler gets its own copy of the trace, since after a timeout it could
+		// still be running while the trace is read by the logging and metrics
+		// middlewares. The copy is merged back if the handler completes in time.
+		trace := tracing.TraceFromRequestCtx(r)
+		handlerTrace := *trace
+		hr := tracing.TraceToRequestCtx(r.WithContext(ctx), &handlerTrace)
+
+		tw := &timeoutWriter{w: w, h: w.Header().Clone()}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+				close(done)
+			}()
+			next.ServeHTTP(tw, hr)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			tw.mu.Lock()
+			if tw.wroteHeader {
+				// The response is already in progress, the status code can't be
+				// changed anymore: let the handler complete it.
+				tw.mu.Unlock()
+				<-done
+				break
+			}
+			tw.timedOut = true
+			tw.mu.Unlock()
+
+			trace.TimedOut = true
+			app.requestTimeoutResponse(w, r)
+			return
+		}
+
+		// Re-panic in this goroutine so the panic is handled by the server as usual.
+		select {
+		case p := <-panicked:
+			panic(p)
+		default:
+		}
+		*trace = handlerTrace
+	})
+}
+
+// Report whether the request is an image upload or streams an image or an archive,
+// which could legitimately take longer than the request timeout.
+func isLongRunning(r *http.Request) bool {
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/images") {
+		return true
+	}
+	if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/images/download") {
+		return true
+	}
+	if r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/content") {
+		return true
+	}
+	if strings.HasSuffix(r.URL.Path, "/export") {
+		return true
+	}
+	mode := readMode(r.URL.Query(), "mode", dataMode)
+	return mode == viewMode || mode == attachmentMode
+}
+
+// The timeoutWriter is used by the requestTimeout middleware. The handler works on
+// a separate header map, copied to the real response when the header is written.
+// After the timeout all the writes are discarded.
+type timeoutWriter struct {
+	w           http.ResponseWriter
+	h           http.Header
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeader(http.StatusOK)
+	return tw.w.Write(b)
+}
+
+// Must be called with the mutex held.
+func (tw *timeoutWriter) writeHeader(code int) {
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for k, v := range tw.h {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(code)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/services/users"
+)
+
+func TestOriginMatches(t *testing.T) {
+	tests := []struct {
+		trusted string
+		origin  string
+		match   bool
+	}{
+		{"https://example.com", "https://example.com", true},
+		{"https://example.com", "https://app.example.com", false},
+		{"https://*.example.com", "https://app.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://APP.Example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evilexample.com", false},
+		{"https://*.example.com", "https://app.example.com.evil.com", false},
+		{"https://*.example.com", "http://app.example.com", false},
+		{"https://*.example.com", "https://app.example.com:8443", false},
+		{"https://*.example.com:8443", "https://app.example.com:8443", true},
+		{"https://*.example.com:8443", "https://app.example.com:9443", false},
+		{"https://*.example.com:8443", "https://app.example.com", false},
+		{"https://*.example.com", "https://user@app.example.com", false},
+		{"https://*.example.com", "https://app.example.com/path", false},
+	}
+	for _, tt := range tests {
+		if got := originMatches(tt.trusted, tt.origin); got != tt.match {
+			t.Errorf("originMatches(%q, %q) = %v, want %v", tt.trusted, tt.origin, got, tt.match)
+		}
+	}
+}
+
+// The keyRecorder records the auth key found in the context of
+// the requests reaching the users service.
+type keyRecorder struct {
+	users.Service
+	keys []string
+}
+
+func (kr *keyRecorder) GetMe(ctx context.Context) (auth.Auth, error) {
+	key, ok := auth.ContextGetKey(ctx)
+	if ok {
+		kr.keys = append(kr.keys, key)
+	}
+	return kr.Service.GetMe(ctx)
+}
+
+// The key of a Bearer Authorization header reaches the services in the request context,
+// while malformed headers are rejected before reaching them.
+func TestExtractAuthKey(t *testing.T) {
+	ts, mock := newMockServer(t, nil)
+	mock.Set(store.User{ID: 1, Email: "key@example.com", Activated: true})
+	mock.Set(store.Keys{ID: 1, UserID: 1})
+	mock.Set([]string{store.PermissionMain})
+	recorder := &keyRecorder{Service: ts.app.users}
+	ts.app.users = recorder
+
+	status, body := ts.do(t, http.MethodGet, "/v1/users/me", "plain-key", nil, "")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d: %s", status, body)
+	}
+	if len(recorder.keys) != 1 || recorder.keys[0] != "plain-key" {
+		t.Fatalf("expected the key to reach the service, got %q", recorder.keys)
+	}
+
+	for _, header := range []string{"Bearer", "Basic plain-key", "bearer plain-key", "Bearer plain-key extra", "Bearer  plain-key"} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/users/me", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", header)
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var errRes struct {
+			Code string `json:"code"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&errRes)
+		_ = res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusUnauthorized || errRes.Code != "invalid_token" {
+			t.Errorf("header %q: got status %d and code %q", header, res.StatusCode, errRes.Code)
+		}
+	}
+	if len(recorder.keys) != 1 {
+		t.Fatalf("malformed headers reached the service: %q", recorder.keys)
+	}
+}
+
+// Send a request with the Origin header, a preflight one if method is not empty.
+func corsRequest(t *testing.T, ts *testServer, origin, method string) http.Header {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodOptions, ts.URL+"/v1/healthcheck", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method == "" {
+		req.Method = http.MethodGet
+	} else {
+		req.Header.Set("Access-Control-Request-Method", method)
+	}
+	req.Header.Set("Origin", origin)
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	return res.Header
+}
+
+// The preflight responses to trusted origins reflect the configured methods, headers
+// and max age.
+func TestCORSPreflight(t *testing.T) {
+	ts, _ := newMockServer(t, func(cfg *config) {
+		cfg.Cors.TrustedOrigins = []string{"https://app.example.com"}
+		cfg.Cors.AllowedMethods = []string{"GET", "POST"}
+		cfg.Cors.AllowedHeaders = []string{"Authorization", "X-Request-Id"}
+		cfg.Cors.MaxAge = 600
+	})
+
+	header := corsRequest(t, ts, "https://app.example.com", http.MethodPost)
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Headers":     "Authorization, X-Request-Id",
+		"Access-Control-Max-Age":           "600",
+	}
+	for name, value := range expected {
+		if header.Get(name) != value {
+			t.Errorf("expected %s %q, got %q", name, value, header.Get(name))
+		}
+	}
+
+	// Untrusted origins get no CORS headers.
+	header = corsRequest(t, ts, "https://other.example.com", http.MethodPost)
+	for name := range expected {
+		if header.Get(name) != "" {
+			t.Errorf("unexpected %s %q for an untrusted origin", name, header.Get(name))
+		}
+	}
+}
+
+// Origins matching a wildcard trusted origin are echoed back, never the pattern,
+// while lookalike origins are not trusted.
+func TestCORSWildcardOrigin(t *testing.T) {
+	ts, _ := newMockServer(t, func(cfg *config) {
+		cfg.Cors.TrustedOrigins = []string{"https://*.example.com"}
+	})
+
+	tests := []struct {
+		origin  string
+		trusted bool
+	}{
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"https://evilexample.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"http://app.example.com", false},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{"", http.MethodPut} {
+			allowed := corsRequest(t, ts, tt.origin, method).Get("Access-Control-Allow-Origin")
+			switch {
+			case tt.trusted && allowed != tt.origin:
+				t.Errorf("origin %s, preflight %q: expected the origin to be echoed, got %q", tt.origin, method, allowed)
+			case !tt.trusted && allowed != "":
+				t.Errorf("origin %s, preflight %q: expected no allowed origin, got %q", tt.origin, method, allowed)
+			}
+		}
+	}
+}
+
+// The strict limits of the endpoints sending emails trigger before the general rate
+// limiter, independently for each endpoint. Requests are limited by IP and by email.
+func TestStrictRateLimit(t *testing.T) {
+	ts, _ := newMockServer(t, func(cfg *config) {
+		cfg.RateLimit.Enabled = true
+		cfg.RateLimit.Rps = 100
+		cfg.RateLimit.Burst = 100
+		cfg.RateLimit.Strict.PerMinute = 1
+		cfg.RateLimit.Strict.Burst = 2
+	})
+
+	post := func(path, ip, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Real-Ip", ip+":1234")
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Invalid inputs, so nothing is created or sent.
+	for _, path := range []string{"/v1/users/register", "/v1/users/activate", "/v1/users/recover-key"} {
+		for i := 0; i < 2; i++ {
+			if status := post(path, "10.0.0.1", `{}`); status == http.StatusTooManyRequests {
+				t.Fatalf("%s: request %d limited", path, i)
+			}
+		}
+		if status := post(path, "10.0.0.1", `{}`); status != http.StatusTooManyRequests {
+			t.Fatalf("%s: expected the strict limit to trigger, got status %d", path, status)
+		}
+	}
+	status, _ := ts.do(t, http.MethodGet, "/v1/healthcheck", "", nil, "")
+	if status != http.StatusOK {
+		t.Fatalf("expected the general limit not to trigger, got status %d", status)
+	}
+
+	// The same email from different IPs.
+	for i := 0; i < 2; i++ {
+		if status := post("/v1/users/register", fmt.Sprintf("10.0.1.%d", i), `{"email": "bomb@example.com"}`); status == http.StatusTooManyRequests {
+			t.Fatalf("email request %d limited", i)
+		}
+	}
+	if status := post("/v1/users/register", "10.0.1.9", `{"email": "BOMB@example.com"}`); status != http.StatusTooManyRequests {
+		t.Fatalf("expected the limit by email to trigger, got status %d", status)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// The liveConfig holds the settings that can be changed while the server is running,
+// by reloading the config file (on SIGHUP). They are read by concurrent requests, so
+// the access is guarded by a mutex. All the other settings are read from the config
+// of the application, which never changes after startup.
+type liveConfig struct {
+	mu             sync.RWMutex
+	rps            float64
+	burst          int
+	trustedOrigins []string
+	archiveWorkers int
+}
+
+func (lc *liveConfig) set(cfg config) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.rps = cfg.RateLimit.Rps
+	lc.burst = cfg.RateLimit.Burst
+	lc.trustedOrigins = cfg.Cors.TrustedOrigins
+	lc.archiveWorkers = cfg.Storage.ArchiveWorkers
+}
+
+// Return the current rate limiting parameters.
+func (lc *liveConfig) rateLimit() (rate.Limit, int) {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return rate.Limit(lc.rps), lc.burst
+}
+
+// Return the current trusted origins. The slice is replaced on
+// reload and never modified, so it can be used without the lock.
+func (lc *liveConfig) origins() []string {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	return lc.trustedOrigins
+}
+
+// Re-read the config file and apply the new settings, see reload.
+func (app *application) reloadConfigFile() error {
+	cfg, err := loadConfig(app.config.ConfigPath, isFlagSet("config"))
+	if err != nil {
+		return err
+	}
+	return app.reload(cfg)
+}
+
+// Apply the settings of the provided config that can be safely changed at runtime: the
+// rate limiting parameters, the CORS trusted origins, the number of gallery archives
+// streamed concurrently and the log level. The config is validated first and nothing
+// is applied if it is invalid. Other changed settings (e.g. the db dsn or the port)
+// require a restart, they are ignored and reported in the logs.
+func (app *application) reload(cfg config) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+
+	var changes []interface{}
+	app.live.mu.Lock()
+	if app.live.rps != cfg.RateLimit.Rps || app.live.burst != cfg.RateLimit.Burst {
+		changes = append(changes, "rate-limit", fmt.Sprintf(
+			"rps %v -> %v, burst %d -> %d", app.live.rps, cfg.RateLimit.Rps, app.live.burst, cfg.RateLimit.Burst,
+		))
+	}
+	if !reflect.DeepEqual(app.live.trustedOrigins, cfg.Cors.TrustedOrigins) {
+		changes = append(changes, "cors.trusted_origins", fmt.Sprintf(
+			"%v -> %v", app.live.trustedOrigins, cfg.Cors.TrustedOrigins,
+		))
+	}
+	workersChanged := app.live.archiveWorkers != cfg.Storage.ArchiveWorkers
+	if workersChanged {
+		changes = append(changes, "storage.archive_workers", fmt.Sprintf(
+			"%d -> %d", app.live.archiveWorkers, cfg.Storage.ArchiveWorkers,
+		))
+	}
+	app.live.rps = cfg.RateLimit.Rps
+	app.live.burst = cfg.RateLimit.Burst
+	app.live.trustedOrigins = cfg.Cors.TrustedOrigins
+	app.live.archiveWorkers = cfg.Storage.ArchiveWorkers
+	app.live.mu.Unlock()
+
+	if workersChanged && app.downloads != nil {
+		app.downloads.SetConcurrency(uint(cfg.Storage.ArchiveWorkers))
+	}
+
+	// The level is switched atomically, subsequent entries of all
+	// the loggers derived from the application one are affected.
+	level, _ := cfg.logLevel()
+	if app.logLevel != nil && app.logLevel.Level() != level {
+		changes = append(changes, "log_level", fmt.Sprintf("%s -> %s", app.logLevel.Level(), level))
+		app.logLevel.SetLevel(level)
+	}
+
+	ignored := restartRequired(app.config, cfg)
+	if len(ignored) > 0 {
+		app.logger.Warnw("changed settings require a restart, ignored", "settings", strings.Join(ignored, ", "))
+	}
+	if len(changes) == 0 {
+		app.logger.Infow("configuration reloaded, nothing changed")
+		return nil
+	}
+	app.logger.Infow("configuration reloaded", changes...)
+	return nil
+}
+
+// Return the JSON names of the settings that differ between the two configs and
+// cannot be changed at runtime. Settings handled by reload are not compared.
+func restartRequired(current, next config) []string {
+	for _, c := range []*config{&current, &next} {
+		c.RateLimit.Rps = 0
+		c.RateLimit.Burst = 0
+		c.Cors.TrustedOrigins = nil
+		c.Storage.ArchiveWorkers = 0
+		c.LogLevel = ""
+	}
+
+	var names []string
+	var compare func(a, b reflect.Value, prefix string)
+	compare = func(a, b reflect.Value, prefix string) {
+		t := a.Type()
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if tag == "" || tag == "-" {
+				continue
+			}
+			name := prefix + tag
+			if a.Field(i).Kind() == reflect.Struct {
+				compare(a.Field(i), b.Field(i), name+".")
+				continue
+			}
+			if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+				names = append(names, name)
+			}
+		}
+	}
+	compare(reflect.ValueOf(current), reflect.ValueOf(next), "")
+	return names
+}
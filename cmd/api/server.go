@@ -12,8 +12,10 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 
 	"github.com/anBertoli/snap-vault/pkg/mailer"
 	"github.com/anBertoli/snap-vault/services/galleries"
@@ -27,25 +29,60 @@ type application struct {
 	users     users.Service
 	images    images.Service
 	galleries galleries.Service
-	mailer    mailer.Mailer
+	mailer    emailSender
 	logger    *zap.SugaredLogger
 	bgTasks   sync.WaitGroup
+	bgJobs    chan func()
+	bgOnce    sync.Once
+	// Limits the warnings logged when the background queue is full,
+	// the tasks dropped are counted by bgDropped (if not nil).
+	bgWarn    *rate.Limiter
+	bgDropped prometheus.Counter
 	config    config
+	// Registerer of the HTTP metrics, if nil the
+	// default Prometheus registerer is used.
+	registerer prometheus.Registerer
+	// Counter of the writes rejected by the storage, an increase of this
+	// metric typically means that the disk is full and requires operators
+	// attention. It is not counted if nil.
+	storageUnavailable prometheus.Counter
+	// Settings changed by config reloads, the downloads
+	// limit and the log level to be changed on reload.
+	live      liveConfig
+	downloads interface{ SetConcurrency(n uint) }
+	logLevel  *zap.AtomicLevel
+	// Deletes the expired tokens periodically, the
+	// cleanup job is not started if nil.
+	tokens interface{ DeleteExpired() (int64, error) }
+	// Deletes the expired idempotency keys in the same job,
+	// they are not deleted if nil.
+	idemKeys interface {
+		DeleteExpired(ttl, lease time.Duration) (int64, error)
+	}
+}
+
+// The emailSender interface is satisfied by the mailer.Mailer. It allows to replace
+// the SMTP mailer, e.g. with a no-op implementation.
+type emailSender interface {
+	Send(recipient, templateFile string, data interface{}) error
 }
 
+var _ emailSender = mailer.Mailer{}
+
 // The handler() method returns the server handler, that is, it registers all the HTTP API
 // endpoints on the router and returns it. The function is also useful as a 'map' of our
 // web service.
 func (app *application) handler() http.Handler {
 	router := mux.NewRouter()
 
-	router.Methods(http.MethodPost).Path("/v1/users/register").HandlerFunc(app.registerUserHandler)
-	router.Methods(http.MethodPost).Path("/v1/users/activate").HandlerFunc(app.regenerateActivationTokenHandler)
+	router.Methods(http.MethodPost).Path("/v1/users/register").Handler(app.strictRateLimit(http.HandlerFunc(app.registerUserHandler)))
+	router.Methods(http.MethodPost).Path("/v1/users/activate").Handler(app.strictRateLimit(http.HandlerFunc(app.regenerateActivationTokenHandler)))
 	router.Methods(http.MethodGet).Path("/v1/users/activate").HandlerFunc(app.activateUserHandler)
 	router.Methods(http.MethodGet).Path("/v1/users/me").HandlerFunc(app.getUserAccountHandler)
 	router.Methods(http.MethodGet).Path("/v1/users/stats").HandlerFunc(app.getUserStatsHandler)
+	router.Methods(http.MethodGet).Path("/v1/users/audit").HandlerFunc(app.listUserAuditHandler)
 
-	router.Methods(http.MethodPost).Path("/v1/users/recover-key").HandlerFunc(app.genKeyRecoveryTokenHandler)
+	router.Methods(http.MethodPost).Path("/v1/users/recover-key").Handler(app.strictRateLimit(http.HandlerFunc(app.genKeyRecoveryTokenHandler)))
 	router.Methods(http.MethodGet).Path("/v1/users/recover-key").HandlerFunc(app.recoverKeyHandler)
 
 	router.Methods(http.MethodGet).Path("/v1/users/keys").HandlerFunc(app.listUserKeysHandler)
@@ -55,25 +92,45 @@ func (app *application) handler() http.Handler {
 
 	router.Methods(http.MethodGet).Path("/v1/galleries").HandlerFunc(app.listGalleriesHandler)
 	router.Methods(http.MethodGet).Path("/v1/galleries/{id}").HandlerFunc(app.getGalleryHandler)
+	router.Methods(http.MethodGet).Path("/v1/galleries/{id}/stats").HandlerFunc(app.getGalleryStatsHandler)
 	router.Methods(http.MethodPost).Path("/v1/galleries").HandlerFunc(app.createGalleriesHandler)
 	router.Methods(http.MethodPut).Path("/v1/galleries/{id}").HandlerFunc(app.updateGalleryHandler)
 	router.Methods(http.MethodDelete).Path("/v1/galleries/{id}").HandlerFunc(app.deleteGalleryHandler)
 
+	router.Methods(http.MethodGet).Path("/v1/images").HandlerFunc(app.listOwnedImagesHandler)
 	router.Methods(http.MethodGet).Path("/v1/galleries/{gallery-id}/images").HandlerFunc(app.listGalleryImagesHandler)
+	router.Methods(http.MethodGet).Path("/v1/galleries/{gallery-id}/images/export").HandlerFunc(app.exportGalleryImagesHandler)
+	router.Methods(http.MethodPost).Path("/v1/galleries/{gallery-id}/images/download").HandlerFunc(app.downloadImagesHandler)
 	router.Methods(http.MethodGet).Path("/v1/galleries/images/{image-id}").HandlerFunc(app.getImageHandler)
+	router.Methods(http.MethodGet).Path("/v1/galleries/images/{image-id}/move-targets").HandlerFunc(app.listImageMoveTargetsHandler)
+	router.Methods(http.MethodPost).Path("/v1/galleries/images/{image-id}/signed-url").HandlerFunc(app.signImageURLHandler)
 	router.Methods(http.MethodPost).Path("/v1/galleries/{gallery-id}/images").HandlerFunc(app.createImageHandler)
 	router.Methods(http.MethodPut).Path("/v1/galleries/images/{image-id}").HandlerFunc(app.editImageHandler)
+	router.Methods(http.MethodPatch).Path("/v1/galleries/images/{image-id}").HandlerFunc(app.patchImageHandler)
+	router.Methods(http.MethodPut).Path("/v1/galleries/images/{image-id}/content").HandlerFunc(app.replaceImageContentHandler)
+	router.Methods(http.MethodPut).Path("/v1/galleries/{gallery-id}/images/order").HandlerFunc(app.reorderImagesHandler)
 	router.Methods(http.MethodDelete).Path("/v1/galleries/images/{image-id}").HandlerFunc(app.deleteImageHandler)
 
 	router.Methods(http.MethodGet).Path("/v1/public/galleries").HandlerFunc(app.listPublicGalleriesHandler)
 	router.Methods(http.MethodGet).Path("/v1/public/galleries/{gallery-id}").HandlerFunc(app.getPublicGalleryHandler)
 	router.Methods(http.MethodGet).Path("/v1/public/galleries/{gallery-id}/images").HandlerFunc(app.listPublicGalleryImagesHandler)
+	router.Methods(http.MethodPost).Path("/v1/public/galleries/{gallery-id}/images/download").HandlerFunc(app.downloadPublicImagesHandler)
 	router.Methods(http.MethodGet).Path("/v1/public/images").HandlerFunc(app.listPublicImagesHandler)
+	router.Methods(http.MethodGet).Path("/v1/public/images/sitemap.xml").HandlerFunc(app.publicImagesSitemapIndexHandler)
+	router.Methods(http.MethodGet).Path("/v1/public/images/sitemap-page.xml").HandlerFunc(app.publicImagesSitemapHandler)
 	router.Methods(http.MethodGet).Path("/v1/public/images/{image-id}").HandlerFunc(app.getPublicImageHandler)
+	router.Methods(http.MethodGet).Path("/v1/shared/images/{image-id}").HandlerFunc(app.getSharedImageHandler)
+
+	router.Methods(http.MethodGet).Path("/v1/admin/users").HandlerFunc(app.listUsersHandler)
 
 	router.Methods(http.MethodGet).Path("/v1/healthcheck").HandlerFunc(app.healthcheckHandler)
 	router.Methods(http.MethodGet).Path("/v1/permissions").HandlerFunc(app.listPermissionsHandler)
 
+	// Development endpoints, completely absent in other environments.
+	if app.config.Env == "dev" {
+		router.Methods(http.MethodGet).Path("/v1/dev/email-preview/{template}").HandlerFunc(app.emailPreviewHandler)
+	}
+
 	router.Methods(http.MethodGet).Path(app.config.Metrics.MetricsEndpoint).Handler(promhttp.Handler())
 
 	router.NotFoundHandler = http.HandlerFunc(app.routeNotFoundHandler)
@@ -83,7 +140,9 @@ func (app *application) handler() http.Handler {
 	// should be triggered before the rate limiting one. This because we want to avoid the
 	// circumstance of an allowed pre-flight request and a 'real' request blocked due to
 	// the rate limiting threshold reached.
-	handler := app.extractAuthKey(router)
+	handler := app.requestTimeout(router)
+	handler = app.extractAuthKey(handler)
+	handler = app.compress(handler)
 	handler = app.rateLimit(handler)
 	handler = app.logging(handler)
 	handler = app.metrics(handler)
@@ -104,6 +163,26 @@ func (app *application) serve() error {
 
 	shutdownError := make(chan error, 1)
 
+	// Start the periodic jobs, they are stopped when the server shuts down.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	app.startTokensCleanup(jobsCtx)
+
+	// This goroutine reloads the config file on SIGHUP, applying the settings that
+	// can be changed without restarting the server. An invalid config is logged
+	// and ignored, the current settings remain in place.
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			app.logger.Infow("reloading configuration", "path", app.config.ConfigPath)
+			err := app.reloadConfigFile()
+			if err != nil {
+				app.logger.Errorw("reloading configuration", "err", err)
+			}
+		}
+	}()
+
 	// This goroutine will block waiting for signals from the environment and/or the
 	// command line. It will handle SIGINT and SIGTERM in order to gracefully
 	// shutdown the server.
@@ -121,6 +200,7 @@ func (app *application) serve() error {
 		defer cancel()
 
 		err := srv.Shutdown(ctx)
+		stopJobs()
 
 		// Call Wait() to block until all background tasks are ended. This is a blocking
 		// operation. Then send any error encountered during the previous shutdown in the
@@ -159,12 +239,51 @@ func (app *application) serve() error {
 	return nil
 }
 
-// The background() helper accepts an arbitrary function as a parameter
-// and runs it as a background goroutine.
+// Minimum interval between two warnings about the background queue being full.
+const bgFullWarnInterval = 10 * time.Second
+
+// The background() helper accepts an arbitrary function as a parameter and runs it in
+// the background. Functions are queued and run by a fixed number of workers, so a burst
+// of requests can't spawn an unbounded number of goroutines (e.g. overwhelming the SMTP
+// server with emails). If the queue is full the function is dropped and counted, so
+// requests are never blocked by a slow task (e.g. an unresponsive SMTP server).
 func (app *application) background(fn func()) {
+	app.bgOnce.Do(app.startWorkers)
 	app.bgTasks.Add(1)
-	go func() {
-		defer app.bgTasks.Done()
-		fn()
+	select {
+	case app.bgJobs <- fn:
+	default:
+		app.bgTasks.Done()
+		if app.bgDropped != nil {
+			app.bgDropped.Inc()
+		}
+		if app.bgWarn.Allow() {
+			app.logger.Warnw("background queue full, task dropped", "workers", app.config.Background.Workers, "queue_size", app.config.Background.QueueSize)
+		}
+	}
+}
+
+// Start the workers running the functions passed to background(). They live as long as
+// the process, the tasks still queued at shutdown are waited for via bgTasks.
+func (app *application) startWorkers() {
+	app.bgJobs = make(chan func(), app.config.Background.QueueSize)
+	app.bgWarn = rate.NewLimiter(rate.Every(bgFullWarnInterval), 1)
+	for i := 0; i < app.config.Background.Workers; i++ {
+		go func() {
+			for fn := range app.bgJobs {
+				app.runTask(fn)
+			}
+		}()
+	}
+}
+
+// Run a background task, a panic is logged and doesn't stop the worker.
+func (app *application) runTask(fn func()) {
+	defer app.bgTasks.Done()
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.Errorw("background task panicked", "err", err)
+		}
 	}()
+	fn()
 }
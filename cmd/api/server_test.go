@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// Tasks submitted while the workers are busy and the queue is full are dropped
+// and counted, instead of blocking the caller.
+func TestBackgroundDropsWhenFull(t *testing.T) {
+	app := &application{
+		logger:    zap.NewNop().Sugar(),
+		bgDropped: prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"}),
+	}
+	app.config.Background.Workers = 1
+	app.config.Background.QueueSize = 1
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	app.background(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	app.background(func() {}) // queued
+
+	done := make(chan struct{})
+	go func() {
+		app.background(func() {})
+		app.background(func() {})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("background blocked with the queue full")
+	}
+	if n := testutil.ToFloat64(app.bgDropped); n != 2 {
+		t.Fatalf("expected 2 dropped tasks, got %v", n)
+	}
+
+	close(release)
+	app.bgTasks.Wait()
+}
+
+// Many submitted tasks are all run, but never more than the workers at the same time.
+func TestBackgroundBoundedConcurrency(t *testing.T) {
+	app := &application{logger: zap.NewNop().Sugar()}
+	app.config.Background.Workers = 4
+	app.config.Background.QueueSize = 200
+
+	var running, maxRunning, completed int64
+	for i := 0; i < 200; i++ {
+		app.background(func() {
+			n := atomic.AddInt64(&running, 1)
+			for {
+				prev := atomic.LoadInt64(&maxRunning)
+				if n <= prev || atomic.CompareAndSwapInt64(&maxRunning, prev, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&running, -1)
+			atomic.AddInt64(&completed, 1)
+		})
+	}
+	app.bgTasks.Wait()
+
+	if completed != 200 {
+		t.Fatalf("expected 200 completed tasks, got %d", completed)
+	}
+	if maxRunning > 4 {
+		t.Fatalf("expected at most 4 tasks at the same time, got %d", maxRunning)
+	}
+}
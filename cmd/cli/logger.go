@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/anBertoli/snap-vault/pkg/logging"
+)
+
+// The cliLogger is used by commands that support structured logs. The methods match
+// the ones of the zap sugared logger, so it is used directly for JSON logs.
+type cliLogger interface {
+	Infow(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+	Fatalw(msg string, keysAndValues ...interface{})
+	Sync() error
+}
+
+// Create the logger for the provided format, writing to w: 'text' logs are plain lines meant
+// to be read interactively, while 'json' logs share the configuration of the production API logs.
+func newCLILogger(format string, w io.Writer) (cliLogger, error) {
+	switch format {
+	case "text":
+		return textLogger{log.New(w, "", log.LstdFlags)}, nil
+	case "json":
+		return logging.NewTo(false, zap.NewAtomicLevelAt(zap.InfoLevel), zapcore.AddSync(w)).Sugar(), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, must be 'text' or 'json'", format)
+	}
+}
+
+// The textLogger writes the message followed by the fields
+// in the key=value form, using the standard logger.
+type textLogger struct {
+	*log.Logger
+}
+
+func (tl textLogger) Infow(msg string, keysAndValues ...interface{}) {
+	tl.Print(formatEntry(msg, keysAndValues))
+}
+
+func (tl textLogger) Errorw(msg string, keysAndValues ...interface{}) {
+	tl.Print(formatEntry("error: "+msg, keysAndValues))
+}
+
+func (tl textLogger) Fatalw(msg string, keysAndValues ...interface{}) {
+	tl.Fatal(formatEntry(msg, keysAndValues))
+}
+
+func (tl textLogger) Sync() error {
+	return nil
+}
+
+func formatEntry(msg string, keysAndValues []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	return b.String()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// The JSON logs are entries of the API format, with the fields of the migration
+// as top-level keys. The messages of golang-migrate are logged as they are.
+func TestCLILoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newCLILogger("json", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Infow("done", "action", "up", "from_version", "12", "to_version", "14")
+	logger.Errorw("error applying migrations", "action", "down", "err", errors.New("connection refused"))
+	migrationLogger{logger}.Printf("Finished 14/u create_idempotency_keys (read 1ms, ran 2ms)\n")
+	_ = logger.Sync()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 entries, got:\n%s", buf.String())
+	}
+	var entries []map[string]interface{}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		err := json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("invalid JSON entry %q: %v", line, err)
+		}
+		if _, ok := entry["ts"]; !ok {
+			t.Errorf("expected a timestamp in %q", line)
+		}
+		entries = append(entries, entry)
+	}
+
+	want := []map[string]interface{}{
+		{"level": "info", "msg": "done", "action": "up", "from_version": "12", "to_version": "14"},
+		{"level": "error", "msg": "error applying migrations", "action": "down", "err": "connection refused"},
+		{"level": "info", "msg": "Finished 14/u create_idempotency_keys (read 1ms, ran 2ms)"},
+	}
+	for i, fields := range want {
+		for k, v := range fields {
+			if entries[i][k] != v {
+				t.Errorf("entry %d: expected %s=%v, got %v", i, k, v, entries[i][k])
+			}
+		}
+	}
+}
+
+// The text logs are plain lines, with the fields in the key=value form.
+func TestCLILoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newCLILogger("text", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Infow("done", "action", "up", "from_version", "12", "to_version", "14")
+	logger.Errorw("error closing src", "err", errors.New("closed"))
+
+	out := buf.String()
+	for _, w := range []string{"done action=up from_version=12 to_version=14\n", "error: error closing src err=closed\n"} {
+		if !strings.Contains(out, w) {
+			t.Errorf("expected %q in the logs:\n%s", w, out)
+		}
+	}
+
+	_, err = newCLILogger("xml", &buf)
+	if err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
@@ -13,8 +13,12 @@ var rootCmd = &cobra.Command{
 }
 
 func main() {
-	// Register the migrate command.
+	// Register the migrate, stats, storage, tokens and users commands.
 	initMigrateCmd()
+	initStatsCmd()
+	initStorageCmd()
+	initTokensCmd()
+	initUsersCmd()
 
 	// Start parsing the command line arguments and execute the appropriate command.
 	err := rootCmd.Execute()
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/golang-migrate/migrate/v4"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/spf13/cobra"
+
+	"github.com/anBertoli/snap-vault/migrations"
 )
 
 // Define a new migrate command in our CLI.
@@ -21,46 +28,95 @@ var migrateCmd = &cobra.Command{
 func initMigrateCmd() {
 	flags := migrateCmd.Flags()
 	flags.String("database-url", "postgres://localhost:5432/snapvault?sslmode=disable", "database url (ex: postgres://localhost:5432/database?sslmode=disable)")
-	flags.String("migrations-folder", "file://migrations", "url path containing the migrations (ex: file://db/migrations-pg)")
-	flags.String("action", "up", "possible value: 'up', 'down' or 'drop'")
+	flags.String("migrations-folder", "", "url path containing the migrations (ex: file://migrations), the embedded migrations are used if empty")
+	flags.String("action", "up", "possible value: 'up', 'down', 'drop', 'version', 'force' or 'plan'")
 	flags.IntP("version-to-force", "f", 0, "version value to be forced")
+	flags.Bool("dry-run", false, "only report what the action would do, without applying anything")
+	flags.Bool("confirm-drop", false, "confirm the drop action, which deletes all the data")
+	flags.String("log-format", "text", "format of the logs, 'text' or 'json' (the same format of the API logs)")
 	rootCmd.AddCommand(migrateCmd)
 }
 
 // Execute the logic of the migrate command.
 func execMigrateCmd(cmd *cobra.Command, args []string) {
-	folder, err := cmd.Flags().GetString("migrations-folder")
+	logFormat, err := cmd.Flags().GetString("log-format")
 	if err != nil {
 		log.Fatal(err)
 	}
-	dbURL, err := cmd.Flags().GetString("database-url")
+	// The logs go to the standard error, so they don't mix with the printed plan.
+	logger, err := newCLILogger(logFormat, os.Stderr)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer logger.Sync()
+
+	folder, err := cmd.Flags().GetString("migrations-folder")
+	if err != nil {
+		logger.Fatalw("reading flags", "err", err)
+	}
+	dbURL, err := cmd.Flags().GetString("database-url")
+	if err != nil {
+		logger.Fatalw("reading flags", "err", err)
+	}
 	action, err := cmd.Flags().GetString("action")
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalw("reading flags", "err", err)
 	}
 	version, err := cmd.Flags().GetInt("version-to-force")
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalw("reading flags", "err", err)
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		logger.Fatalw("reading flags", "err", err)
+	}
+	confirmDrop, err := cmd.Flags().GetBool("confirm-drop")
+	if err != nil {
+		logger.Fatalw("reading flags", "err", err)
+	}
+
+	// The drop deletes all the data, so it must be explicitly confirmed
+	// (a dry run is harmless and doesn't need the confirmation).
+	if action == "drop" && !dryRun && !confirmDrop {
+		logger.Fatalw("the drop action deletes all the data, confirm it with --confirm-drop", "action", action)
 	}
 
-	migrator, err := migrate.New(folder, dbURL)
+	// The migrations embedded in the binary are used by default, a folder
+	// can be provided instead, e.g. to try new migrations during development.
+	// The source is also inspected directly to plan the migrations.
+	var src source.Driver
+	if folder == "" {
+		src, err = migrations.Source()
+	} else {
+		src, err = source.Open(folder)
+	}
+	if err != nil {
+		logger.Fatalw("error opening the migrations", "action", action, "err", err)
+	}
+	migrator, err := migrate.NewWithSourceInstance("migrations", src, dbURL)
 	if err != nil {
-		log.Fatalf("error executing the migration: %v", err)
+		logger.Fatalw("error executing the migration", "action", action, "err", err)
 	}
 	defer func() {
 		srcError, dbError := migrator.Close()
 		if srcError != nil {
-			log.Printf("error closing src: %v\n", srcError)
+			logger.Errorw("error closing src", "err", srcError)
 		}
 		if dbError != nil {
-			log.Printf("error closing database: %v\n", srcError)
+			logger.Errorw("error closing database", "err", dbError)
 		}
 	}()
-	migrator.Log = migrationLogger{log.Default()}
+	migrator.Log = migrationLogger{logger}
 
+	if dryRun || action == "plan" {
+		err = printPlan(os.Stdout, migrator, src, action, version)
+		if err != nil {
+			logger.Fatalw("error planning migrations", "action", action, "err", err)
+		}
+		return
+	}
+
+	fromVersion := currentVersion(migrator)
 	switch action {
 	case "up":
 		err = migrator.Up()
@@ -69,30 +125,165 @@ func execMigrateCmd(cmd *cobra.Command, args []string) {
 	case "drop":
 		err = migrator.Down()
 		if err != nil && err != migrate.ErrNoChange {
-			log.Fatalf("error during down phase (before drop): %v", err)
+			logger.Fatalw("error during down phase (before drop)", "action", action, "from_version", fromVersion, "err", err)
 		}
 		err = migrator.Drop()
 	case "version":
 		version, dirty, err := migrator.Version()
 		if err != nil {
-			log.Fatalf("error applying migrations: %v", err)
+			logger.Fatalw("error reading the version", "action", action, "err", err)
+		}
+		logger.Infow("current version", "action", action, "version", version, "dirty", dirty)
+	case "force":
+		err = migrator.Force(version)
+	}
+	if err != nil && err != migrate.ErrNoChange {
+		logger.Fatalw("error applying migrations", "action", action, "from_version", fromVersion, "to_version", currentVersion(migrator), "err", err)
+	}
+
+	logger.Infow("done", "action", action, "from_version", fromVersion, "to_version", currentVersion(migrator))
+}
+
+// Return the current version of the schema for logging purposes, a
+// description of the problem is returned if it cannot be read.
+func currentVersion(migrator *migrate.Migrate) string {
+	version, dirty, err := migrator.Version()
+	switch {
+	case errors.Is(err, migrate.ErrNilVersion):
+		return "none"
+	case err != nil:
+		return "unknown"
+	case dirty:
+		return fmt.Sprintf("%d (dirty)", version)
+	default:
+		return fmt.Sprint(version)
+	}
+}
+
+// Print to w what the action would do, without applying anything. The plan action
+// reports both the migrations that up would apply and the ones down would revert.
+func printPlan(w io.Writer, migrator *migrate.Migrate, src source.Driver, action string, forceVersion int) error {
+	current, dirty, err := migrator.Version()
+	applied := true
+	switch {
+	case errors.Is(err, migrate.ErrNilVersion):
+		applied = false
+		fmt.Fprintln(w, "current version: none")
+	case err != nil:
+		return err
+	default:
+		fmt.Fprintf(w, "current version: %d, dirty: %v\n", current, dirty)
+	}
+	if dirty {
+		fmt.Fprintln(w, "the schema is dirty, up and down fail until a version is forced")
+	}
+
+	switch action {
+	case "up", "plan":
+		pending, err := pendingMigrations(src, current, applied)
+		if err != nil {
+			return err
+		}
+		printMigrations(w, "up would apply", pending)
+	}
+	switch action {
+	case "down", "drop", "plan":
+		reverted, err := appliedMigrations(src, current, applied)
+		if err != nil {
+			return err
 		}
-		fmt.Printf("version: %v, dirty: %v\n", version, dirty)
+		printMigrations(w, "down would revert", reverted)
+	}
+	switch action {
+	case "drop":
+		fmt.Fprintln(w, "drop would then delete all the tables")
 	case "force":
-		err := migrator.Force(version)
+		fmt.Fprintf(w, "force would set the version to %d, without running any migration\n", forceVersion)
+	}
+	return nil
+}
+
+// Return the migrations following the current version, that is all of
+// them if no migration was applied yet.
+func pendingMigrations(src source.Driver, current uint, applied bool) ([]string, error) {
+	var (
+		next uint
+		err  error
+	)
+	if applied {
+		next, err = src.Next(current)
+	} else {
+		next, err = src.First()
+	}
+
+	var names []string
+	for ; err == nil; next, err = src.Next(next) {
+		name, err := migrationName(src, next)
 		if err != nil {
-			log.Fatalf("error applying migrations: %v", err)
+			return nil, err
 		}
+		names = append(names, name)
 	}
-	if err != nil && err != migrate.ErrNoChange {
-		log.Fatalf("error applying migrations: %v", err)
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
 	}
+	return names, nil
+}
+
+// Return the applied migrations, from the current version backwards.
+func appliedMigrations(src source.Driver, current uint, applied bool) ([]string, error) {
+	if !applied {
+		return nil, nil
+	}
+
+	var (
+		names []string
+		err   error
+	)
+	for prev := current; err == nil; prev, err = src.Prev(prev) {
+		name, err := migrationName(src, prev)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return names, nil
+}
 
-	log.Print("done")
+// Return the version and the description of a migration, e.g. '12 add_view_counts'.
+func migrationName(src source.Driver, version uint) (string, error) {
+	r, identifier, err := src.ReadUp(version)
+	if errors.Is(err, os.ErrNotExist) {
+		r, identifier, err = src.ReadDown(version)
+	}
+	if err != nil {
+		return "", err
+	}
+	_ = r.Close()
+	return fmt.Sprintf("%d %s", version, identifier), nil
 }
 
+func printMigrations(w io.Writer, title string, names []string) {
+	if len(names) == 0 {
+		fmt.Fprintf(w, "%s: nothing\n", title)
+		return
+	}
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", name)
+	}
+}
+
+// The migrationLogger adapts the CLI logger to the golang-migrate logger interface.
 type migrationLogger struct {
-	*log.Logger
+	cliLogger
+}
+
+func (ml migrationLogger) Printf(format string, v ...interface{}) {
+	ml.Infow(strings.TrimSpace(fmt.Sprintf(format, v...)))
 }
 
 func (ml migrationLogger) Verbose() bool {
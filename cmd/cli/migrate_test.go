@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+
+	"github.com/anBertoli/snap-vault/migrations"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+// The pending migrations follow the current version, while the applied ones
+// go from the current version backwards.
+func TestPlanMigrations(t *testing.T) {
+	src, err := migrations.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	tests := []struct {
+		name         string
+		current      uint
+		applied      bool
+		firstPending string
+		pending      int
+		firstApplied string
+		nApplied     int
+	}{
+		{name: "none", firstPending: "1 create_users", pending: store.SchemaVersion},
+		{name: "first", current: 1, applied: true, firstPending: "2 create_galleries", pending: store.SchemaVersion - 1, firstApplied: "1 create_users", nApplied: 1},
+		{name: "middle", current: 12, applied: true, firstPending: "13 add_images_dimensions", pending: store.SchemaVersion - 12, firstApplied: "12 add_view_counts", nApplied: 12},
+		{name: "latest", current: store.SchemaVersion, applied: true, firstApplied: "14 create_idempotency_keys", nApplied: store.SchemaVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pending, err := pendingMigrations(src, tt.current, tt.applied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pending) != tt.pending || (tt.pending > 0 && pending[0] != tt.firstPending) {
+				t.Fatalf("expected %d pending migrations from %q, got %q", tt.pending, tt.firstPending, pending)
+			}
+			applied, err := appliedMigrations(src, tt.current, tt.applied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) != tt.nApplied || (tt.nApplied > 0 && applied[0] != tt.firstApplied) {
+				t.Fatalf("expected %d applied migrations from %q, got %q", tt.nApplied, tt.firstApplied, applied)
+			}
+			if tt.nApplied > 0 && applied[len(applied)-1] != "1 create_users" {
+				t.Fatalf("expected the applied migrations to end with the first one, got %q", applied)
+			}
+		})
+	}
+}
+
+// The plan reports the current version of the database and what the action would
+// do, without applying anything.
+func TestPrintPlan(t *testing.T) {
+	dsn := storetest.FreshDSN(t)
+	src, err := migrations.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := migrate.NewWithSourceInstance("migrations", src, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrator.Close()
+
+	tests := []struct {
+		version uint
+		action  string
+		want    []string
+	}{
+		{
+			action: "plan",
+			want:   []string{"current version: none\n", "up would apply:\n  1 create_users\n", "down would revert: nothing\n"},
+		},
+		{
+			version: 12,
+			action:  "plan",
+			want: []string{
+				"current version: 12, dirty: false\n",
+				"up would apply:\n  13 add_images_dimensions\n  14 create_idempotency_keys\n",
+				"down would revert:\n  12 add_view_counts\n  11 add_galleries_version\n",
+			},
+		},
+		{
+			version: 12,
+			action:  "drop",
+			want:    []string{"down would revert:\n  12 add_view_counts\n", "drop would then delete all the tables\n"},
+		},
+		{
+			version: 12,
+			action:  "force",
+			want:    []string{"current version: 12, dirty: false\n", "force would set the version to 3, without running any migration\n"},
+		},
+		{
+			version: store.SchemaVersion,
+			action:  "up",
+			want:    []string{"current version: 14, dirty: false\n", "up would apply: nothing\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			if tt.version > 0 {
+				err := migrator.Migrate(tt.version)
+				if err != nil && err != migrate.ErrNoChange {
+					t.Fatal(err)
+				}
+			}
+
+			var buf bytes.Buffer
+			err := printPlan(&buf, migrator, src, tt.action, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(buf.String(), w) {
+					t.Errorf("expected %q in the plan:\n%s", w, buf.String())
+				}
+			}
+			if tt.action != "plan" && tt.action != "up" && strings.Contains(buf.String(), "up would apply") {
+				t.Errorf("unexpected up migrations in the plan:\n%s", buf.String())
+			}
+
+			// Nothing is applied by the plan.
+			want := "none"
+			if tt.version > 0 {
+				want = fmt.Sprint(tt.version)
+			}
+			if got := currentVersion(migrator); got != want {
+				t.Fatalf("expected version %s after the plan, got %s", want, got)
+			}
+		})
+	}
+}
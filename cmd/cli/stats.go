@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/cobra"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+)
+
+// Define a new stats command in our CLI. It only groups the stats related sub-commands.
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "inspect and repair users statistics",
+}
+
+// Define the reconcile sub-command of the stats command.
+var statsReconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "recompute users statistics from the actual galleries and images",
+	Run:   execStatsReconcileCmd,
+}
+
+// Register the command to the main command of the CLI.
+func initStatsCmd() {
+	flags := statsReconcileCmd.Flags()
+	flags.String("database-url", "postgres://localhost:5432/snapvault?sslmode=disable", "database url (ex: postgres://localhost:5432/database?sslmode=disable)")
+	flags.String("storage-root", ".", "root folder of the images storage")
+	flags.Int64("user-id", 0, "reconcile only the stats of this user (0 means all users)")
+	flags.Bool("dry-run", false, "only report discrepancies, without updating the stats")
+	statsCmd.AddCommand(statsReconcileCmd)
+	rootCmd.AddCommand(statsCmd)
+}
+
+// Execute the logic of the stats reconcile command. The stats table is maintained
+// incrementally, so it can drift from reality if an operation partially fails. Here
+// the counters are recomputed from the actual rows and, if different, overwritten.
+func execStatsReconcileCmd(cmd *cobra.Command, args []string) {
+	dbURL, err := cmd.Flags().GetString("database-url")
+	if err != nil {
+		log.Fatal(err)
+	}
+	storageRoot, err := cmd.Flags().GetString("storage-root")
+	if err != nil {
+		log.Fatal(err)
+	}
+	userID, err := cmd.Flags().GetInt64("user-id")
+	if err != nil {
+		log.Fatal(err)
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sqlx.Connect("postgres", dbURL)
+	if err != nil {
+		log.Fatalf("error connecting to the database: %v", err)
+	}
+	defer db.Close()
+
+	storage, err := store.New(db, store.FsOptions{Root: storageRoot})
+	if err != nil {
+		log.Fatalf("error creating storage: %v", err)
+	}
+
+	// Collect the stats rows to reconcile, a single one if a user was specified.
+	var allStats []store.Stats
+	if userID != 0 {
+		stats, err := storage.Stats.GetForUser(userID)
+		if err != nil {
+			log.Fatalf("error retrieving stats of user %d: %v", userID, err)
+		}
+		allStats = append(allStats, stats)
+	} else {
+		allStats, err = storage.Stats.GetAll()
+		if err != nil {
+			log.Fatalf("error retrieving stats: %v", err)
+		}
+	}
+
+	var drifted, failed int
+	for _, stats := range allStats {
+		nGalleries, err := storage.Galleries.CountForUser(stats.UserID)
+		if err != nil {
+			log.Printf("user %d: error counting galleries: %v", stats.UserID, err)
+			failed++
+			continue
+		}
+		nImages, nBytes, err := storage.Images.CountForUser(stats.UserID)
+		if err != nil {
+			log.Printf("user %d: error counting images: %v", stats.UserID, err)
+			failed++
+			continue
+		}
+
+		if stats.Galleries == nGalleries && stats.Images == nImages && stats.Space == nBytes {
+			continue
+		}
+		drifted++
+		log.Printf(
+			"user %d: galleries %d -> %d, images %d -> %d, bytes %d -> %d",
+			stats.UserID, stats.Galleries, nGalleries, stats.Images, nImages, stats.Space, nBytes,
+		)
+		if dryRun {
+			continue
+		}
+
+		// The update respects the version column, if the stats were modified
+		// in the meantime by the API the row is skipped and reported.
+		stats.Galleries = nGalleries
+		stats.Images = nImages
+		stats.Space = nBytes
+		_, err = storage.Stats.Update(stats)
+		switch {
+		case errors.Is(err, store.ErrRecordNotFound):
+			log.Printf("user %d: stats modified concurrently, skipped", stats.UserID)
+			failed++
+		case err != nil:
+			log.Printf("user %d: error updating stats: %v", stats.UserID, err)
+			failed++
+		}
+	}
+
+	log.Printf("checked: %d, drifted: %d, failed: %d, dry run: %v", len(allStats), drifted, failed, dryRun)
+	if failed > 0 {
+		log.Fatal("some stats were not reconciled")
+	}
+	log.Print("done")
+}
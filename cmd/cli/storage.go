@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/cobra"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+)
+
+// Define a new storage command in our CLI. It only groups the storage related sub-commands.
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "inspect and clean the images storage",
+}
+
+// Define the reap sub-command of the storage command.
+var storageReapCmd = &cobra.Command{
+	Use:   "reap",
+	Short: "delete the stored files without a related image in the database and the empty directories",
+	Run:   execStorageReapCmd,
+}
+
+// Define the dimensions sub-command of the storage command.
+var storageDimensionsCmd = &cobra.Command{
+	Use:   "dimensions",
+	Short: "decode and save the dimensions of the images stored without them",
+	Run:   execStorageDimensionsCmd,
+}
+
+// Register the command to the main command of the CLI.
+func initStorageCmd() {
+	flags := storageReapCmd.Flags()
+	flags.String("database-url", "postgres://localhost:5432/snapvault?sslmode=disable", "database url (ex: postgres://localhost:5432/database?sslmode=disable)")
+	flags.String("storage-root", ".", "root folder of the images storage")
+	flags.String("path-template", store.DefaultPathTemplate, "layout of the image files, as the storage.path_template of the API config")
+	flags.Duration("grace", time.Hour, "only files older than this are considered orphans")
+	flags.Bool("dry-run", false, "only report orphan files and empty directories, without deleting them")
+	storageCmd.AddCommand(storageReapCmd)
+
+	flags = storageDimensionsCmd.Flags()
+	flags.String("database-url", "postgres://localhost:5432/snapvault?sslmode=disable", "database url (ex: postgres://localhost:5432/database?sslmode=disable)")
+	flags.String("storage-root", ".", "root folder of the images storage")
+	flags.Bool("dry-run", false, "only report the decoded dimensions, without saving them")
+	storageCmd.AddCommand(storageDimensionsCmd)
+
+	rootCmd.AddCommand(storageCmd)
+}
+
+// Execute the logic of the storage reap command. A file is written before the related
+// image record is inserted, so a crash in between leaves behind a file that no image
+// refers to. These files are found and, if not in dry-run mode, deleted. Then the empty
+// directories of the storage (e.g. of galleries without images) are removed.
+func execStorageReapCmd(cmd *cobra.Command, args []string) {
+	dbURL, err := cmd.Flags().GetString("database-url")
+	if err != nil {
+		log.Fatal(err)
+	}
+	storageRoot, err := cmd.Flags().GetString("storage-root")
+	if err != nil {
+		log.Fatal(err)
+	}
+	pathTemplate, err := cmd.Flags().GetString("path-template")
+	if err != nil {
+		log.Fatal(err)
+	}
+	grace, err := cmd.Flags().GetDuration("grace")
+	if err != nil {
+		log.Fatal(err)
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sqlx.Connect("postgres", dbURL)
+	if err != nil {
+		log.Fatalf("error connecting to the database: %v", err)
+	}
+	defer db.Close()
+
+	storage, err := store.New(db, store.FsOptions{Root: storageRoot, PathTemplate: pathTemplate})
+	if err != nil {
+		log.Fatalf("error creating storage: %v", err)
+	}
+
+	orphans, err := storage.Images.FindOrphans(grace)
+	if err != nil {
+		log.Fatalf("error searching orphan files: %v", err)
+	}
+
+	var (
+		removed, failed int
+		freed           int64
+	)
+	for _, orphan := range orphans {
+		if dryRun {
+			log.Printf("orphan %s (%d bytes, modified %s)", orphan.Path, orphan.Size, orphan.ModTime.Format(time.RFC3339))
+			continue
+		}
+		err = storage.Images.RemoveFile(orphan.Path)
+		if err != nil {
+			log.Printf("error deleting %s: %v", orphan.Path, err)
+			failed++
+			continue
+		}
+		log.Printf("deleted %s (%d bytes)", orphan.Path, orphan.Size)
+		removed++
+		freed += orphan.Size
+	}
+
+	log.Printf("orphans: %d, deleted: %d, freed bytes: %d, failed: %d, dry run: %v", len(orphans), removed, freed, failed, dryRun)
+
+	// Directories emptied by the deletions above were just modified, they
+	// are removed by the next run once the grace period has elapsed.
+	dirs, err := storage.Images.RemoveEmptyDirs(grace, dryRun)
+	if err != nil {
+		log.Fatalf("error removing empty directories: %v", err)
+	}
+	for _, dir := range dirs {
+		if dryRun {
+			log.Printf("empty directory %s", dir)
+			continue
+		}
+		log.Printf("deleted directory %s", dir)
+	}
+	log.Printf("empty directories: %d, dry run: %v", len(dirs), dryRun)
+
+	if failed > 0 {
+		log.Fatal("some orphan files were not deleted")
+	}
+	log.Print("done")
+}
+
+// Execute the logic of the storage dimensions command. Images uploaded before the
+// dimensions were stored have none: their files are decoded and, if not in dry-run
+// mode, the dimensions are saved. Images in formats that can't be decoded are
+// reported and left without dimensions.
+func execStorageDimensionsCmd(cmd *cobra.Command, args []string) {
+	dbURL, err := cmd.Flags().GetString("database-url")
+	if err != nil {
+		log.Fatal(err)
+	}
+	storageRoot, err := cmd.Flags().GetString("storage-root")
+	if err != nil {
+		log.Fatal(err)
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sqlx.Connect("postgres", dbURL)
+	if err != nil {
+		log.Fatalf("error connecting to the database: %v", err)
+	}
+	defer db.Close()
+
+	storage, err := store.New(db, store.FsOptions{Root: storageRoot})
+	if err != nil {
+		log.Fatalf("error creating storage: %v", err)
+	}
+
+	const batchSize = 100
+	var (
+		afterID                           int64
+		checked, updated, skipped, failed int
+	)
+	for {
+		images, err := storage.Images.GetWithoutDimensions(afterID, batchSize)
+		if err != nil {
+			log.Fatalf("error retrieving images: %v", err)
+		}
+		if len(images) == 0 {
+			break
+		}
+		afterID = images[len(images)-1].ID
+
+		for _, img := range images {
+			checked++
+			cfg, err := decodeDimensions(storage, img.ID)
+			switch {
+			case errors.Is(err, image.ErrFormat):
+				log.Printf("image %d: format %s not supported, skipped", img.ID, img.ContentType)
+				skipped++
+				continue
+			case err != nil:
+				log.Printf("image %d: error decoding dimensions: %v", img.ID, err)
+				failed++
+				continue
+			}
+			if dryRun {
+				log.Printf("image %d: %dx%d", img.ID, cfg.Width, cfg.Height)
+				continue
+			}
+			err = storage.Images.SetDimensions(img.ID, cfg.Width, cfg.Height)
+			if err != nil {
+				log.Printf("image %d: error saving dimensions: %v", img.ID, err)
+				failed++
+				continue
+			}
+			updated++
+		}
+	}
+
+	log.Printf("checked: %d, updated: %d, skipped: %d, failed: %d, dry run: %v", checked, updated, skipped, failed, dryRun)
+	if failed > 0 {
+		log.Fatal("some dimensions were not saved")
+	}
+	log.Print("done")
+}
+
+// Decode the dimensions of the stored image, reading only its header.
+func decodeDimensions(storage store.Store, imageID int64) (image.Config, error) {
+	readCloser, err := storage.Images.GetReader(imageID)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer readCloser.Close()
+	cfg, _, err := image.DecodeConfig(readCloser)
+	return cfg, err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/cobra"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+)
+
+// Define a new tokens command in our CLI. It only groups the tokens related sub-commands.
+var tokensCmd = &cobra.Command{
+	Use:   "tokens",
+	Short: "manage activation and key recovery tokens",
+}
+
+// Define the cleanup sub-command of the tokens command.
+var tokensCleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "delete the tokens past their expiry",
+	Run:   execTokensCleanupCmd,
+}
+
+// Register the command to the main command of the CLI.
+func initTokensCmd() {
+	flags := tokensCleanupCmd.Flags()
+	flags.String("database-url", "postgres://localhost:5432/snapvault?sslmode=disable", "database url (ex: postgres://localhost:5432/database?sslmode=disable)")
+	tokensCmd.AddCommand(tokensCleanupCmd)
+	rootCmd.AddCommand(tokensCmd)
+}
+
+// Execute the logic of the tokens cleanup command. The API deletes the expired tokens
+// periodically, the command is useful when the job is disabled.
+func execTokensCleanupCmd(cmd *cobra.Command, args []string) {
+	dbURL, err := cmd.Flags().GetString("database-url")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := sqlx.Connect("postgres", dbURL)
+	if err != nil {
+		log.Fatalf("error connecting to the database: %v", err)
+	}
+	defer db.Close()
+
+	tokens := store.TokenStore{DB: db}
+	n, err := tokens.DeleteExpired()
+	if err != nil {
+		log.Fatalf("error deleting expired tokens: %v", err)
+	}
+	log.Printf("deleted %d expired tokens", n)
+}
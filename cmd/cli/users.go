@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/cobra"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+)
+
+// Define a new users command in our CLI. It only groups the users related sub-commands.
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "manage users",
+}
+
+// Define the admin sub-command of the users command.
+var usersAdminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "grant (or revoke) the admin permission to the main auth key of a user",
+	Run:   execUsersAdminCmd,
+}
+
+// Register the command to the main command of the CLI.
+func initUsersCmd() {
+	flags := usersAdminCmd.Flags()
+	flags.String("database-url", "postgres://localhost:5432/snapvault?sslmode=disable", "database url (ex: postgres://localhost:5432/database?sslmode=disable)")
+	flags.String("email", "", "email of the user")
+	flags.Bool("revoke", false, "revoke the admin permission instead of granting it")
+	usersCmd.AddCommand(usersAdminCmd)
+	rootCmd.AddCommand(usersCmd)
+}
+
+// Execute the logic of the users admin command. The admin permission cannot be assigned
+// through the API, it is linked here to the main auth key of the user, so it is
+// retained when other keys are created or edited.
+func execUsersAdminCmd(cmd *cobra.Command, args []string) {
+	dbURL, err := cmd.Flags().GetString("database-url")
+	if err != nil {
+		log.Fatal(err)
+	}
+	email, err := cmd.Flags().GetString("email")
+	if err != nil {
+		log.Fatal(err)
+	}
+	revoke, err := cmd.Flags().GetBool("revoke")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if email == "" {
+		log.Fatal("the email of the user must be provided")
+	}
+
+	db, err := sqlx.Connect("postgres", dbURL)
+	if err != nil {
+		log.Fatalf("error connecting to the database: %v", err)
+	}
+	defer db.Close()
+
+	usersStore := store.UsersStore{DB: db}
+	keysStore := store.KeysStore{DB: db}
+	permissionsStore := store.PermissionsStore{DB: db}
+
+	user, err := usersStore.GetForEmail(email)
+	if err != nil {
+		log.Fatalf("error retrieving user %s: %v", email, err)
+	}
+
+	// Look for the main key of the user among its keys.
+	keys, err := keysStore.GetAllForUser(user.ID)
+	if err != nil {
+		log.Fatalf("error retrieving auth keys: %v", err)
+	}
+	keyIDs := make([]int64, 0, len(keys))
+	for _, k := range keys {
+		keyIDs = append(keyIDs, k.ID)
+	}
+	permissions, err := permissionsStore.GetAllForKeys(keyIDs)
+	if err != nil {
+		log.Fatalf("error retrieving permissions: %v", err)
+	}
+	var mainKeyID int64
+	for _, id := range keyIDs {
+		if permissions[id].Include(store.PermissionMain) {
+			mainKeyID = id
+			break
+		}
+	}
+	if mainKeyID == 0 {
+		log.Fatalf("user %s has no main auth key", email)
+	}
+
+	if revoke {
+		err = permissionsStore.RevokeForKey(mainKeyID, store.PermissionAdmin)
+	} else {
+		err = permissionsStore.GrantForKey(mainKeyID, store.PermissionAdmin)
+	}
+	if err != nil {
+		log.Fatalf("error updating permissions: %v", err)
+	}
+	if revoke {
+		log.Printf("admin permission revoked from user %d (%s)", user.ID, email)
+	} else {
+		log.Printf("admin permission granted to user %d (%s)", user.ID, email)
+	}
+}
@@ -0,0 +1,3 @@
+BEGIN;
+ALTER TABLE stats DROP COLUMN IF EXISTS last_active_at;
+COMMIT;
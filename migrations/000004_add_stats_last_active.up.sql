@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE stats ADD COLUMN IF NOT EXISTS last_active_at TIMESTAMP;
+
+COMMIT;
@@ -0,0 +1,15 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id          BIGSERIAL   NOT NULL PRIMARY KEY,
+    action      TEXT        NOT NULL,
+    metadata    JSONB       NOT NULL DEFAULT '{}',
+    created_at  TIMESTAMP   NOT NULL DEFAULT NOW(),
+    user_id     BIGINT      NOT NULL,
+
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id, created_at);
+
+COMMIT;
@@ -0,0 +1,3 @@
+BEGIN;
+ALTER TABLE images DROP COLUMN IF EXISTS hash;
+COMMIT;
@@ -0,0 +1,4 @@
+BEGIN;
+DROP INDEX IF EXISTS images_gallery_position_idx;
+ALTER TABLE images DROP COLUMN IF EXISTS position;
+COMMIT;
@@ -0,0 +1,14 @@
+BEGIN;
+
+ALTER TABLE images ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0;
+
+-- Existing images are positioned following their insertion order.
+UPDATE images SET position = ordered.position
+FROM (
+    SELECT id, row_number() OVER (PARTITION BY gallery_id ORDER BY id) AS position FROM images
+) AS ordered
+WHERE images.id = ordered.id;
+
+CREATE INDEX IF NOT EXISTS images_gallery_position_idx ON images (gallery_id, position);
+
+COMMIT;
@@ -0,0 +1,4 @@
+BEGIN;
+ALTER TABLE galleries DROP CONSTRAINT IF EXISTS galleries_cover_image_fk;
+ALTER TABLE galleries DROP COLUMN IF EXISTS cover_image_id;
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE galleries ADD COLUMN IF NOT EXISTS cover_image_id BIGINT;
+
+-- Deleting the cover image simply removes the reference.
+ALTER TABLE galleries ADD CONSTRAINT galleries_cover_image_fk
+    FOREIGN KEY (cover_image_id) REFERENCES images (id) ON DELETE SET NULL;
+
+COMMIT;
@@ -0,0 +1,4 @@
+BEGIN;
+UPDATE images SET caption = '' WHERE caption IS NULL;
+ALTER TABLE images ALTER COLUMN caption SET NOT NULL;
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+-- A null caption means the caption was never set or was explicitly cleared.
+ALTER TABLE images ALTER COLUMN caption DROP NOT NULL;
+
+COMMIT;
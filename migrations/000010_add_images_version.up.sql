@@ -0,0 +1,6 @@
+BEGIN;
+
+-- The version is used for optimistic locking when updating images.
+ALTER TABLE images ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+
+COMMIT;
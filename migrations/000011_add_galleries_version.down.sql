@@ -0,0 +1,3 @@
+BEGIN;
+ALTER TABLE galleries DROP COLUMN IF EXISTS version;
+COMMIT;
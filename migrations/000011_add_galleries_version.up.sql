@@ -0,0 +1,6 @@
+BEGIN;
+
+-- The version is used for optimistic locking when updating galleries.
+ALTER TABLE galleries ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+ALTER TABLE galleries DROP COLUMN IF EXISTS view_count;
+ALTER TABLE galleries DROP COLUMN IF EXISTS download_count;
+ALTER TABLE images DROP COLUMN IF EXISTS view_count;
+COMMIT;
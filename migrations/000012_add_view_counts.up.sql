@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Counters of the public views and downloads, incremented atomically.
+ALTER TABLE galleries ADD COLUMN IF NOT EXISTS view_count BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE galleries ADD COLUMN IF NOT EXISTS download_count BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS view_count BIGINT NOT NULL DEFAULT 0;
+
+COMMIT;
@@ -0,0 +1,4 @@
+BEGIN;
+ALTER TABLE images DROP COLUMN IF EXISTS width;
+ALTER TABLE images DROP COLUMN IF EXISTS height;
+COMMIT;
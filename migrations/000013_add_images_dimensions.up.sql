@@ -0,0 +1,7 @@
+BEGIN;
+
+-- Dimensions in pixels of the images, NULL if they couldn't be decoded.
+ALTER TABLE images ADD COLUMN IF NOT EXISTS width INTEGER;
+ALTER TABLE images ADD COLUMN IF NOT EXISTS height INTEGER;
+
+COMMIT;
@@ -0,0 +1,14 @@
+BEGIN;
+
+-- Idempotency keys of the requests creating resources, scoped per user and per
+-- kind of resource. The resource ID is NULL while the request is in progress.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id BIGINT NOT NULL REFERENCES users ON DELETE CASCADE,
+    scope TEXT NOT NULL,
+    key TEXT NOT NULL,
+    resource_id BIGINT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, scope, key)
+);
+
+COMMIT;
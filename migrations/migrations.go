@@ -0,0 +1,31 @@
+// Package migrations embeds the SQL migrations of the database, so they can be applied
+// by the binaries without depending on the filesystem layout where they run.
+package migrations
+
+import (
+	"embed"
+	"net/http"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/httpfs"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// Create a migrator that applies the embedded migrations to the database at the
+// provided url. The caller must close the migrator when done.
+func New(dbURL string) (*migrate.Migrate, error) {
+	src, err := Source()
+	if err != nil {
+		return nil, err
+	}
+	return migrate.NewWithSourceInstance("httpfs", src, dbURL)
+}
+
+// Return a golang-migrate source reading the embedded migrations.
+func Source() (source.Driver, error) {
+	return httpfs.New(http.FS(files), "/")
+}
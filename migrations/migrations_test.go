@@ -0,0 +1,56 @@
+package migrations_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/anBertoli/snap-vault/migrations"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+// The embedded migrations bring a fresh database to the expected schema, and
+// they can be rolled back completely.
+func TestEmbeddedMigrations(t *testing.T) {
+	dsn := storetest.FreshDSN(t)
+
+	migrator, err := migrations.New(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrator.Close()
+
+	err = migrator.Up()
+	if err != nil {
+		t.Fatalf("applying the migrations: %v", err)
+	}
+	version, dirty, err := migrator.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != store.SchemaVersion || dirty {
+		t.Fatalf("expected version %d not dirty, got %d (dirty %v)", store.SchemaVersion, version, dirty)
+	}
+
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = store.CheckSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrator.Down()
+	if err != nil {
+		t.Fatalf("rolling back the migrations: %v", err)
+	}
+	_, _, err = migrator.Version()
+	if !errors.Is(err, migrate.ErrNilVersion) {
+		t.Fatalf("expected no version after the rollback, got %v", err)
+	}
+}
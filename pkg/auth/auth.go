@@ -1,8 +1,13 @@
+// Package auth authenticates the requests and carries the auth data in contexts. It
+// depends on the store to look up keys and users, while the store knows nothing about
+// authentication: services extract the auth data only with the helpers of this package
+// and pass plain values (e.g. user IDs) to the store.
 package auth
 
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/anBertoli/snap-vault/pkg/store"
 )
@@ -19,6 +24,9 @@ type Auth struct {
 // the user behind the request.
 type Authenticator struct {
 	Store store.Store
+	// Minimum interval between two updates of the last activity
+	// timestamp of a user. Zero disables the tracking.
+	ActivityInterval time.Duration
 }
 
 // Perform authentication using the provided plain text auth key. Note that the returned
@@ -53,6 +61,13 @@ func (a *Authenticator) Authenticate(plainKey string) (Auth, error) {
 		return Auth{}, err
 	}
 
+	// Track the last activity of the user. The store updates the timestamp at most
+	// once per interval. A failure here must not prevent the user from being
+	// authenticated, so the error is deliberately ignored.
+	if a.ActivityInterval > 0 {
+		_ = a.Store.Stats.TouchLastActive(user.ID, a.ActivityInterval)
+	}
+
 	return Auth{
 		User:  user,
 		Keys:  keys,
@@ -63,7 +78,7 @@ func (a *Authenticator) Authenticate(plainKey string) (Auth, error) {
 // Perform authentication, but extract the plain text auth key from the context passed in.
 // Just a wrapper over the authentication method above.
 func (a *Authenticator) AuthenticateFromCtx(ctx context.Context) (Auth, error) {
-	plainKey, ok := ctx.Value(keyContextKey).(string)
+	plainKey, ok := ContextGetKey(ctx)
 	if !ok {
 		return Auth{}, ErrUnauthenticated
 	}
@@ -130,7 +145,9 @@ func ContextGetAuth(ctx context.Context) (Auth, error) {
 	return authData, nil
 }
 
-// Retrieve the auth struct from a context, panicking if not found.
+// Retrieve the auth struct from a context, panicking if not found. Services use
+// ContextGetAuth instead, so that a route wired without the auth middleware
+// results in an unauthenticated error rather than a crash.
 func MustContextGetAuth(ctx context.Context) Auth {
 	authData, ok := ctx.Value(authContextKey).(Auth)
 	if !ok {
@@ -145,6 +162,12 @@ func ContextSetKey(ctx context.Context, key string) context.Context {
 	return childCtx
 }
 
+// Retrieve the auth key from the context, if set.
+func ContextGetKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(keyContextKey).(string)
+	return key, ok
+}
+
 var (
 	ErrUnauthenticated = errors.New("unauthenticated")
 	ErrNotActivated    = errors.New("user not activated")
@@ -1,15 +1,19 @@
 package filters
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"strings"
+	"time"
 )
 
 // The filters package provides utilities to be used in listing operations,
 // to easily support pagination and filtering.
 
-// Filtering and pagination input for listing operations.
+// Filtering and pagination input for listing operations. The SortSafeList holds the
+// base names of the sortable columns, the SortCol could be prefixed with '-' to
+// request the descending order.
 type Input struct {
 	Page                 int
 	PageSize             int
@@ -18,6 +22,27 @@ type Input struct {
 	Search               string
 	SearchCol            string
 	SearchColumnSafeList []string
+	// If set, an empty search is rejected instead of matching
+	// all the records (avoiding full table scans).
+	SearchRequired bool
+	// Optional bounds (inclusive) of the creation time of
+	// the records, a nil bound leaves the range open.
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	// If set, only the number of matching records is computed,
+	// the records are not retrieved.
+	CountOnly bool
+}
+
+// Default filtering and pagination parameters of a listing, used when the client doesn't
+// specify them, along with the safe lists of the sortable and searchable columns. Each
+// service package declares the defaults of its listings.
+type Defaults struct {
+	PageSize       int
+	Sort           string
+	SortSafeList   []string
+	SearchCol      string
+	SearchSafeList []string
 }
 
 // Metadata output of a listing operation, based upon the Input and
@@ -56,18 +81,55 @@ func (p Input) Offset() int {
 	return (p.Page - 1) * p.PageSize
 }
 
-// Make sure the filter input is valid, that is, the sortCol is valid (must be present in
-// SortSafeList) and the searchCol is valid (contained in the SearchColumnSafeList).
+// Build a SQL condition restricting the provided column to the creation time range of
+// the input. The bounds are referenced as the bound parameters $n and $n+1, and their
+// values must be passed to the query as returned by DateArgs. The condition is always
+// valid SQL, if a bound is not set that side of the range is left open.
+func BuildDateClause(column string, n int) string {
+	return fmt.Sprintf(
+		"($%[2]d::timestamp IS NULL OR %[1]s >= $%[2]d::timestamp) AND ($%[3]d::timestamp IS NULL OR %[1]s <= $%[3]d::timestamp)",
+		column, n, n+1,
+	)
+}
+
+// Return the values of the bound parameters referenced by BuildDateClause. Timestamps
+// are stored in UTC, so the bounds are converted accordingly.
+func (p Input) DateArgs() (from, to interface{}) {
+	if p.CreatedFrom != nil {
+		from = p.CreatedFrom.UTC()
+	}
+	if p.CreatedTo != nil {
+		to = p.CreatedTo.UTC()
+	}
+	return from, to
+}
+
+// Make sure the filter input is valid, that is, the sortCol is valid (once stripped of the
+// '-' prefix it must be present in SortSafeList), the searchCol is valid (contained in the SearchColumnSafeList),
+// the search term is present if required and the creation time range is not reversed.
 func (p Input) Validate() error {
+	if p.SearchRequired && strings.TrimSpace(p.Search) == "" {
+		return errors.New("a search term is required")
+	}
+	if p.CreatedFrom != nil && p.CreatedTo != nil && p.CreatedFrom.After(*p.CreatedTo) {
+		return errors.New("created_from must not be after created_to")
+	}
 	var ok bool
 	for _, safeValue := range p.SortSafeList {
-		if p.SortCol == safeValue {
+		if p.SortColumn() == safeValue {
 			ok = true
 		}
 	}
 	if !ok {
 		return fmt.Errorf("%s not allowed as ordering parameter", p.SortCol)
 	}
+	// Listings without searchable columns don't support searching at all.
+	if len(p.SearchColumnSafeList) == 0 {
+		if p.Search != "" {
+			return errors.New("search not supported")
+		}
+		return nil
+	}
 	for _, searchCol := range p.SearchColumnSafeList {
 		if p.SearchCol == searchCol {
 			return nil
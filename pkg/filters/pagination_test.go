@@ -0,0 +1,43 @@
+package filters
+
+import "testing"
+
+// The sort column is checked against the base names of the safe list, with or
+// without the '-' prefix of the descending order.
+func TestValidateSort(t *testing.T) {
+	tests := []struct {
+		sort      string
+		valid     bool
+		column    string
+		direction string
+	}{
+		{sort: "title", valid: true, column: "title", direction: "ASC"},
+		{sort: "-title", valid: true, column: "title", direction: "DESC"},
+		{sort: "password"},
+		{sort: "-password"},
+		{sort: "--title"},
+		{sort: "title-"},
+		{sort: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sort, func(t *testing.T) {
+			input := Input{
+				Page:         1,
+				PageSize:     10,
+				SortCol:      tt.sort,
+				SortSafeList: []string{"id", "title", "created_at"},
+			}
+			err := input.Validate()
+			if tt.valid != (err == nil) {
+				t.Fatalf("expected valid %v, got error %v", tt.valid, err)
+			}
+			if !tt.valid {
+				return
+			}
+			if input.SortColumn() != tt.column || input.SortDirection() != tt.direction {
+				t.Fatalf("expected %s %s, got %s %s", tt.column, tt.direction, input.SortColumn(), input.SortDirection())
+			}
+		})
+	}
+}
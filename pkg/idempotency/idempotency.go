@@ -0,0 +1,31 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+)
+
+// The idempotency package carries the idempotency key of a request, provided by clients
+// to safely retry requests creating resources, from the transport layer to the services.
+
+// Declare a private type to be used in context to avoid key collision.
+type privateKey string
+
+const keyContextKey privateKey = "idempotency-key"
+
+// Maximum length of the keys.
+const MaxKeyLen = 255
+
+var ErrInProgress = errors.New("a request with the same idempotency key is in progress")
+
+// Set the idempotency key into the context.
+func ContextSetKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyContextKey, key)
+}
+
+// Retrieve the idempotency key from the context, false is returned if
+// the request doesn't have one.
+func ContextGetKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(keyContextKey).(string)
+	return key, ok && key != ""
+}
@@ -0,0 +1,42 @@
+package logging
+
+import (
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// The logging package provides the zap logger configuration shared by the API and
+// the CLI, so the entries of both could be collected and parsed the same way.
+
+// Instantiate the appropriate logger based on the mode. The dev mode will result in colorized
+// and more readable log entries, while production logs will be entirely JSON-formatted.
+// Entries below the provided level are discarded.
+func New(dev bool, level zap.AtomicLevel) *zap.Logger {
+	return NewTo(dev, level, os.Stdout)
+}
+
+// Same as New, but the entries are written to out instead of the standard output.
+func NewTo(dev bool, level zap.AtomicLevel, out zapcore.WriteSyncer) *zap.Logger {
+	var zapLogger *zap.Logger
+	if dev {
+		config := zap.NewDevelopmentEncoderConfig()
+		config.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		config.EncodeTime = zapcore.ISO8601TimeEncoder
+		zapLogger = zap.New(
+			zapcore.NewCore(
+				zapcore.NewConsoleEncoder(config), out, level,
+			),
+		)
+	} else {
+		config := zap.NewProductionEncoderConfig()
+		config.EncodeTime = zapcore.ISO8601TimeEncoder
+		zapLogger = zap.New(
+			zapcore.NewCore(
+				zapcore.NewJSONEncoder(config), out, level,
+			),
+		)
+	}
+	return zapLogger
+}
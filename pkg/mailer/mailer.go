@@ -3,8 +3,14 @@ package mailer
 import (
 	"bytes"
 	"embed"
+	"errors"
+	"fmt"
 	"github.com/go-mail/mail/v2"
 	"html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
 	"time"
 )
 
@@ -37,46 +43,116 @@ func New(host string, port int, username, password, sender string) Mailer {
 
 // The Send method takes the recipient email address as the first parameter,
 // the name of the file containing the templates, and any dynamic data for
-// the templates as an interface{} parameter.
+// the templates as an interface{} parameter. The plain-text part of the email
+// is rendered from the companion .txt template (e.g. user_welcome.txt for
+// user_welcome.gohtml), if present, and sent along the HTML one as a
+// multipart/alternative message. Without it, an HTML-only email is sent.
 func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
+	msg, err := m.buildMessage(recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	// Open a connection to the SMTP server, send the message, then close the connection.
+	return m.dialer.DialAndSend(msg)
+}
+
+// Render the templates and build the message to be sent, see Send.
+func (m Mailer) buildMessage(recipient, templateFile string, data interface{}) (*mail.Message, error) {
+	email, err := Render(templateFile, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize a new mail.Message instance and set relevant mail headers. With both the
+	// bodies, use the SetBody method to set the plain-text body, the AddAlternative method
+	// to set the HTML body. It's important to note that AddAlternative() should always be
+	// called after SetBody.
+	msg := mail.NewMessage()
+	msg.SetHeader("To", recipient)
+	msg.SetHeader("From", m.sender)
+	msg.SetHeader("Subject", email.Subject)
+	if email.PlainBody == "" {
+		msg.SetBody("text/html", email.HTMLBody)
+		return msg, nil
+	}
+	msg.SetBody("text/plain", email.PlainBody)
+	msg.AddAlternative("text/html", email.HTMLBody)
+	return msg, nil
+}
+
+var ErrTemplateNotFound = errors.New("email template not found")
+
+// The Email contains the rendered parts of an email. The PlainBody is empty
+// if the template has no plain-text companion.
+type Email struct {
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+}
+
+// Render the templates of the email with the provided data, without sending it. An error
+// wrapping ErrTemplateNotFound is returned if the template file doesn't exist.
+func Render(templateFile string, data interface{}) (Email, error) {
+	_, err := fs.Stat(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return Email{}, fmt.Errorf("%w: %s", ErrTemplateNotFound, templateFile)
+	}
 
 	// Parse the required template file from the embedded file system.
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
 	if err != nil {
-		return err
+		return Email{}, err
 	}
 
 	// Execute the named template "subject", passing in the dynamic data.
 	subject := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(subject, "subject", data)
 	if err != nil {
-		return err
-	}
-
-	// Follow the same pattern to execute the "plainBody" template.
-	plainBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
-	if err != nil {
-		return err
+		return Email{}, err
 	}
 
 	// And likewise with the "htmlBody" template.
 	htmlBody := new(bytes.Buffer)
 	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
 	if err != nil {
-		return err
+		return Email{}, err
 	}
 
-	// Initialize a new mail.Message instance. Set relevant mail headers, use the SetBody
-	// method to set the plain-text body, the AddAlternative method to set the HTML body.
-	// It's important to note that AddAlternative() should always be called after SetBody.
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
+	// Render the plain-text body from the companion template, if any. The text/template
+	// package is used, so the content isn't escaped as HTML (e.g. '&' in links).
+	plainBody, err := renderText(textTemplateFile(templateFile), data)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Email{}, err
+	}
 
-	// Open a connection to the SMTP server, send the message, then close the connection.
-	return m.dialer.DialAndSend(msg)
+	return Email{
+		Subject:   subject.String(),
+		PlainBody: plainBody,
+		HTMLBody:  htmlBody.String(),
+	}, nil
+}
+
+// Return the name of the plain-text template companion of the HTML one.
+func textTemplateFile(templateFile string) string {
+	return strings.TrimSuffix(templateFile, path.Ext(templateFile)) + ".txt"
+}
+
+// Render the whole plain-text template file. An error wrapping fs.ErrNotExist
+// is returned if the template file doesn't exist.
+func renderText(templateFile string, data interface{}) (string, error) {
+	content, err := fs.ReadFile(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := texttemplate.New(templateFile).Parse(string(content))
+	if err != nil {
+		return "", err
+	}
+	body := new(bytes.Buffer)
+	err = tmpl.Execute(body, data)
+	if err != nil {
+		return "", err
+	}
+	return body.String(), nil
 }
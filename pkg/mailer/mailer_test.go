@@ -0,0 +1,93 @@
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+// The message has both the plain-text and the HTML parts, rendered with the same
+// data. The plain-text part is not escaped as HTML.
+func TestBuildMessageMultipart(t *testing.T) {
+	m := New("localhost", 25, "", "", "Snap Vault <no-reply@example.com>")
+	data := map[string]interface{}{
+		"userID":          7,
+		"hostName":        "https://example.com",
+		"activationToken": "TOKEN&X",
+		"tokenTTL":        "24 hours",
+	}
+	msg, err := m.buildMessage("user@example.com", "user_welcome.gohtml", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	_, err = msg.WriteTo(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := mail.ReadMessage(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("expected a multipart/alternative message, got %s", mediaType)
+	}
+
+	parts := map[string]string{}
+	var order []string
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		partType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[partType] = string(body)
+		order = append(order, partType)
+	}
+
+	// The preferred alternative, the HTML one, comes last.
+	if strings.Join(order, " ") != "text/plain text/html" {
+		t.Fatalf("expected the plain-text and the HTML parts, got %v", order)
+	}
+	if !strings.Contains(parts["text/plain"], "https://example.com/v1/users/activate?token=TOKEN&X") {
+		t.Errorf("activation link not in the plain-text part:\n%s", parts["text/plain"])
+	}
+	if !strings.Contains(parts["text/html"], "TOKEN&amp;X") {
+		t.Errorf("escaped token not in the HTML part:\n%s", parts["text/html"])
+	}
+}
+
+// Templates without the plain-text companion are recognized, and missing
+// templates are reported.
+func TestRenderMissingTemplates(t *testing.T) {
+	_, err := renderText(textTemplateFile("no_text.gohtml"), nil)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist, got %v", err)
+	}
+	_, err = Render("missing.gohtml", nil)
+	if !errors.Is(err, ErrTemplateNotFound) {
+		t.Fatalf("expected ErrTemplateNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anBertoli/snap-vault/pkg/filters"
+)
+
+// List of security-relevant actions recorded into the audit log.
+const (
+	AuditUserRegistered     = "user:registered"
+	AuditUserActivated      = "user:activated"
+	AuditActivationResent   = "user:activation-resent"
+	AuditKeyRecoveryStarted = "keys:recovery-started"
+	AuditMainKeyRegenerated = "keys:main-regenerated"
+	AuditKeyCreated         = "keys:created"
+	AuditKeyEdited          = "keys:edited"
+	AuditKeyDeleted         = "keys:deleted"
+)
+
+type AuditEntry struct {
+	ID        int64           `db:"id" json:"id"`
+	Action    string          `db:"action" json:"action"`
+	Metadata  json.RawMessage `db:"metadata" json:"metadata"`
+	CreatedAt time.Time       `db:"created_at" json:"created_at"`
+	UserID    int64           `db:"user_id" json:"user_id"`
+}
+
+// The store abstraction used to manipulate the audit log of users actions. It holds
+// a DB connection pool. Note that the audit log is append-only. Callers must never
+// pass plain text keys, tokens or passwords as metadata.
+type AuditStore struct {
+	DB Executor
+}
+
+// Append a new entry to the audit log of a user. The metadata is stored as JSON.
+func (as *AuditStore) Append(userID int64, action string, metadata map[string]interface{}) error {
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = as.DB.ExecContext(ctx, `
+		INSERT INTO audit_log (action, metadata, user_id) VALUES ($1, $2, $3)
+	`, action, metadataBytes, userID)
+
+	return err
+}
+
+// Obtain the audit log entries of the specified user. This operation supports filtering
+// and pagination so the method also returns pagination metadata.
+func (as *AuditStore) GetAllForUser(userID int64, filter filters.Input) ([]AuditEntry, filters.Meta, error) {
+	var (
+		entries = []AuditEntry{}
+		pagMeta = filter.CalculateMetadata(0)
+		tmp     []struct {
+			AuditEntry
+			Count int64 `db:"count"`
+		}
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := as.DB.SelectContext(ctx, &tmp, fmt.Sprintf(`
+		SELECT count(*) OVER(), * FROM audit_log
+		WHERE ((LOWER(%s) LIKE LOWER('%%' || $1 || '%%')) OR ($1 = '')) AND user_id = $2
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`,
+		filter.SearchCol, filter.SortColumn(), filter.SortDirection(),
+	), filter.Search, userID, filter.Limit(), filter.Offset())
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, pagMeta, nil
+		default:
+			return nil, pagMeta, err
+		}
+	}
+
+	for _, e := range tmp {
+		entries = append(entries, e.AuditEntry)
+	}
+	if len(tmp) > 0 {
+		pagMeta = filter.CalculateMetadata(tmp[0].Count)
+	}
+
+	return entries, pagMeta, nil
+}
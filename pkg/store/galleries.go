@@ -7,25 +7,32 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 
 	"github.com/anBertoli/snap-vault/pkg/filters"
 )
 
 type Gallery struct {
-	ID          int64     `json:"id" db:"id"`
-	UserID      int64     `json:"user_id" db:"user_id"`
-	Title       string    `json:"title" db:"title"`
-	Description string    `json:"description" db:"description"`
-	Published   bool      `json:"published" db:"published"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+	ID            int64     `json:"id" db:"id"`
+	UserID        int64     `json:"user_id" db:"user_id"`
+	Title         string    `json:"title" db:"title"`
+	Description   string    `json:"description" db:"description"`
+	Published     bool      `json:"published" db:"published"`
+	CoverImageID  *int64    `json:"cover_image_id" db:"cover_image_id"`
+	Version       int       `json:"version" db:"version"`
+	ViewCount     int64     `json:"view_count" db:"view_count"`
+	DownloadCount int64     `json:"download_count" db:"download_count"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+	// Metadata of the cover image, not stored in the galleries
+	// table, populated only when retrieving a single gallery.
+	CoverImage *Image `json:"cover_image,omitempty" db:"-"`
 }
 
 // The store abstraction used to manipulate galleries into our postgres database.
 // It holds a DB connection pool.
 type GalleriesStore struct {
-	DB *sqlx.DB
+	DB Executor
 }
 
 // Retrieve a specific gallery from the database.
@@ -61,23 +68,37 @@ func (gs *GalleriesStore) GetAllPublic(filter filters.Input) ([]Gallery, filters
 		}
 	)
 
+	// The query will filter results based on the search col parameter but only if the value
+	// is populated. The filtering is case-insensitive and the filter value must be a substring
+	// of the related record field. The search term is passed as a bound parameter, while the
+	// columns names are interpolated (they are checked against safe lists).
+	from, to := filter.DateArgs()
+	where := fmt.Sprintf(
+		`(LOWER(%s) LIKE '%%' || LOWER($1) || '%%' OR $1 = '') AND published = true AND %s`,
+		filter.SearchCol, filters.BuildDateClause("created_at", 2),
+	)
+	args := []interface{}{filter.Search, from, to}
+
+	// If only the count is requested, avoid fetching the records.
+	if filter.CountOnly {
+		meta, err := countListing(gs.DB, filter, `SELECT count(*) FROM galleries WHERE `+where, args...)
+		return galleries, meta, err
+	}
+
 	// The count(*) OVER() expression at the start of the query will result in the filtered
-	// record count being included as the first value in each row. The query will filter
-	// results based on the search col parameter but only if the value is populated. The
-	// filtering is case-insensitive and the filter value must be a substring of the
-	// related record field.
+	// record count being included as the first value in each row.
 	query := fmt.Sprintf(`
 		SELECT count(*) OVER(), * FROM galleries
-		WHERE ((LOWER(%s) LIKE LOWER('%%%s%%')) OR ($1 = '')) AND published = true
+		WHERE %s
 		ORDER BY %s %s, id ASC
-		LIMIT $2 OFFSET $3`,
-		filter.SearchCol, filter.Search, filter.SortColumn(), filter.SortDirection(),
+		LIMIT $4 OFFSET $5`,
+		where, filter.SortColumn(), filter.SortDirection(),
 	)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := gs.DB.SelectContext(ctx, &tmp, query, filter.Search, filter.Limit(), filter.Offset())
+	err := gs.DB.SelectContext(ctx, &tmp, query, append(args, filter.Limit(), filter.Offset())...)
 	if err != nil {
 		switch {
 		// No records is not an error here, so
@@ -100,9 +121,21 @@ func (gs *GalleriesStore) GetAllPublic(filter filters.Input) ([]Gallery, filters
 	return galleries, meta, nil
 }
 
-// Obtain a list of galleries for the specified user. This operation supports filtering
-// and pagination so the method also returns pagination metadata.
-func (gs *GalleriesStore) GetAllForUser(userID int64, filter filters.Input) ([]Gallery, filters.Meta, error) {
+// Obtain a list of galleries for the specified user. If published is not nil, only the galleries
+// with the provided published status are returned. This operation supports filtering and
+// pagination so the method also returns pagination metadata.
+func (gs *GalleriesStore) GetAllForUser(userID int64, published *bool, filter filters.Input) ([]Gallery, filters.Meta, error) {
+	// Gallery IDs start from 1, so no gallery is excluded.
+	return gs.getAllForUser(userID, 0, published, filter)
+}
+
+// Obtain a list of galleries for the specified user, excluding the gallery with the provided ID.
+// Since the exclusion is performed by the query, the pagination metadata remains consistent.
+func (gs *GalleriesStore) GetAllForUserExcept(userID, excludedID int64, filter filters.Input) ([]Gallery, filters.Meta, error) {
+	return gs.getAllForUser(userID, excludedID, nil, filter)
+}
+
+func (gs *GalleriesStore) getAllForUser(userID, excludedID int64, published *bool, filter filters.Input) ([]Gallery, filters.Meta, error) {
 	var (
 		galleries = []Gallery{}
 		pagMeta   = filter.CalculateMetadata(0)
@@ -112,16 +145,30 @@ func (gs *GalleriesStore) GetAllForUser(userID int64, filter filters.Input) ([]G
 		}
 	)
 
+	from, to := filter.DateArgs()
+	where := fmt.Sprintf(`
+		(LOWER(%s) LIKE '%%' || LOWER($1) || '%%' OR $1 = '') AND user_id = $2 AND id <> $3
+		AND ($4::boolean IS NULL OR published = $4) AND %s`,
+		filter.SearchCol, filters.BuildDateClause("created_at", 5),
+	)
+	args := []interface{}{filter.Search, userID, excludedID, published, from, to}
+
+	// If only the count is requested, avoid fetching the records.
+	if filter.CountOnly {
+		meta, err := countListing(gs.DB, filter, `SELECT count(*) FROM galleries WHERE `+where, args...)
+		return galleries, meta, err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	err := gs.DB.SelectContext(ctx, &tmp, fmt.Sprintf(`
 		SELECT count(*) OVER(), * FROM galleries
-		WHERE ((LOWER(%s) LIKE LOWER('%%%s%%')) OR ($1 = '')) AND user_id = $2
+		WHERE %s
 		ORDER BY %s %s, id ASC
-		LIMIT $3 OFFSET $4`,
-		filter.SearchCol, filter.Search, filter.SortColumn(), filter.SortDirection(),
-	), filter.Search, userID, filter.Limit(), filter.Offset())
+		LIMIT $7 OFFSET $8`,
+		where, filter.SortColumn(), filter.SortDirection(),
+	), append(args, filter.Limit(), filter.Offset())...)
 	if err != nil {
 		switch {
 		// No records is not an error here, so
@@ -143,6 +190,20 @@ func (gs *GalleriesStore) GetAllForUser(userID int64, filter filters.Input) ([]G
 	return galleries, pagMeta, nil
 }
 
+// Count the galleries owned by the specified user.
+func (gs *GalleriesStore) CountForUser(userID int64) (int, error) {
+	var count int
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := gs.DB.GetContext(ctx, &count, `SELECT count(*) FROM galleries WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
 // Inserts a new gallery. The gallery struct passed in must contain the necessary information,
 // but note that id, created_at and updated_at are set automatically by the database.
 func (gs *GalleriesStore) Insert(gallery Gallery) (Gallery, error) {
@@ -155,7 +216,7 @@ func (gs *GalleriesStore) Insert(gallery Gallery) (Gallery, error) {
 			INSERT
 			INTO galleries (title, description, published, user_id, created_at, updated_at)
 			VALUES ($1, $2, $3, $4, now(), now()) 
-			RETURNING id, created_at, updated_at
+			RETURNING id, created_at, updated_at, version
 	`, gallery.Title, gallery.Description, gallery.Published, gallery.UserID)
 	if err != nil {
 		return Gallery{}, err
@@ -172,15 +233,20 @@ func (gs *GalleriesStore) Update(gallery Gallery) (Gallery, error) {
 	defer cancel()
 
 	err := gs.DB.GetContext(ctx, &gallery, `
-			UPDATE galleries SET title = $1, description = $2, published = $3, updated_at = now()
-			WHERE id = $4
-			RETURNING created_at, updated_at
-	`, gallery.Title, gallery.Description, gallery.Published, gallery.ID)
+			UPDATE galleries
+			SET title = $1, description = $2, published = $3, cover_image_id = $4, updated_at = now(), version = version + 1
+			WHERE id = $5 AND version = $6
+			RETURNING created_at, updated_at, version
+	`, gallery.Title, gallery.Description, gallery.Published, gallery.CoverImageID, gallery.ID, gallery.Version)
 
+	var pqErr *pq.Error
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return Gallery{}, ErrRecordNotFound
+			return Gallery{}, ErrEditConflict
+		// The cover image doesn't exist (e.g. it was deleted concurrently).
+		case errors.As(err, &pqErr) && pqErr.Constraint == "galleries_cover_image_fk":
+			return Gallery{}, ErrCoverImageNotFound
 		default:
 			return Gallery{}, err
 		}
@@ -189,10 +255,30 @@ func (gs *GalleriesStore) Update(gallery Gallery) (Gallery, error) {
 	return gallery, err
 }
 
+// Atomically increment the public views counter of the gallery, or the downloads
+// counter if download is true. The updated_at and version columns are untouched,
+// counting a view isn't an edit of the gallery.
+func (gs *GalleriesStore) IncrementViews(id int64, download bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	column := "view_count"
+	if download {
+		column = "download_count"
+	}
+	_, err := gs.DB.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE galleries SET %[1]s = %[1]s + 1 WHERE id = $1
+	`, column), id)
+	return err
+}
+
 // Delete the specified gallery, note that deleting related images is a
 // responsibility of the caller.
 func (gs *GalleriesStore) DeleteGallery(id int64) error {
-	res, err := gs.DB.Exec(`DELETE from galleries WHERE id=$1`, id)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := gs.DB.ExecContext(ctx, `DELETE from galleries WHERE id=$1`, id)
 	if err != nil {
 		return err
 	}
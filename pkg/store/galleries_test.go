@@ -0,0 +1,241 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/anBertoli/snap-vault/pkg/filters"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+func galleriesFilter(page, pageSize int, sort string) filters.Input {
+	return filters.Input{
+		Page:                 page,
+		PageSize:             pageSize,
+		SortCol:              sort,
+		SortSafeList:         []string{"id", "title", "created_at"},
+		SearchCol:            "title",
+		SearchColumnSafeList: []string{"title"},
+	}
+}
+
+// A gallery can be inserted, retrieved, updated and deleted.
+func TestGalleriesCRUD(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "galleries-crud")
+
+	gallery, err := s.Galleries.Insert(store.Gallery{Title: "Holidays", Description: "Summer", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gallery.ID == 0 || gallery.Version != 1 || gallery.CreatedAt.IsZero() {
+		t.Fatalf("database values not returned: %+v", gallery)
+	}
+
+	got, err := s.Galleries.Get(gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Holidays" || got.Description != "Summer" || got.UserID != user.ID || got.Published {
+		t.Fatalf("unexpected gallery: %+v", got)
+	}
+
+	got.Title = "Winter holidays"
+	got.Published = true
+	updated, err := s.Galleries.Update(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Version != got.Version+1 {
+		t.Fatalf("expected version %d, got %d", got.Version+1, updated.Version)
+	}
+	got, err = s.Galleries.Get(gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Winter holidays" || !got.Published {
+		t.Fatalf("update not applied: %+v", got)
+	}
+
+	err = s.Galleries.DeleteGallery(gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Galleries.Get(gallery.ID)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound, got %v", err)
+	}
+	err = s.Galleries.DeleteGallery(gallery.ID)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound deleting twice, got %v", err)
+	}
+}
+
+// An update of a stale version of the gallery, or of a deleted gallery, is an edit
+// conflict, and a cover image which doesn't exist is reported as such.
+func TestGalleriesUpdateConflict(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "galleries-conflict")
+
+	gallery, err := s.Galleries.Insert(store.Gallery{Title: "Conflict", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Galleries.Update(gallery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Galleries.Update(gallery)
+	if !errors.Is(err, store.ErrEditConflict) {
+		t.Fatalf("expected ErrEditConflict updating a stale version, got %v", err)
+	}
+
+	gallery, err = s.Galleries.Get(gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := int64(-1)
+	gallery.CoverImageID = &missing
+	_, err = s.Galleries.Update(gallery)
+	if !errors.Is(err, store.ErrCoverImageNotFound) {
+		t.Fatalf("expected ErrCoverImageNotFound, got %v", err)
+	}
+
+	gallery.CoverImageID = nil
+	err = s.Galleries.DeleteGallery(gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Galleries.Update(gallery)
+	if !errors.Is(err, store.ErrEditConflict) {
+		t.Fatalf("expected ErrEditConflict updating a deleted gallery, got %v", err)
+	}
+}
+
+// The listings of the galleries of a user are paginated, filtered and sorted.
+func TestGalleriesListing(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "galleries-list")
+	other := storetest.NewUser(t, s, "galleries-list-other")
+
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		gallery, err := s.Galleries.Insert(store.Gallery{
+			Title:     fmt.Sprintf("gallery %d", i),
+			Published: i%2 == 0,
+			UserID:    user.ID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, gallery.ID)
+	}
+	_, err := s.Galleries.Insert(store.Gallery{Title: "gallery of another user", UserID: other.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var listed []int64
+	for page := 1; page <= 3; page++ {
+		galleries, meta, err := s.Galleries.GetAllForUser(user.ID, nil, galleriesFilter(page, 2, "id"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.TotalRecords != 5 || meta.LastPage != 3 || meta.CurrentPage != page {
+			t.Fatalf("unexpected metadata of page %d: %+v", page, meta)
+		}
+		for _, g := range galleries {
+			listed = append(listed, g.ID)
+		}
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(ids) {
+		t.Fatalf("expected galleries %v, got %v", ids, listed)
+	}
+
+	galleries, _, err := s.Galleries.GetAllForUser(user.ID, nil, galleriesFilter(1, 10, "-id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 5 || galleries[0].ID != ids[4] {
+		t.Fatalf("expected galleries in descending order, got %v", galleries)
+	}
+
+	published := true
+	galleries, meta, err := s.Galleries.GetAllForUser(user.ID, &published, galleriesFilter(1, 10, "id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 3 || meta.TotalRecords != 3 {
+		t.Fatalf("expected 3 published galleries, got %d", len(galleries))
+	}
+
+	filter := galleriesFilter(1, 10, "id")
+	filter.Search = "GALLERY 3"
+	galleries, _, err = s.Galleries.GetAllForUser(user.ID, nil, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 1 || galleries[0].ID != ids[3] {
+		t.Fatalf("expected the searched gallery, got %v", galleries)
+	}
+
+	galleries, meta, err = s.Galleries.GetAllForUserExcept(user.ID, ids[0], galleriesFilter(1, 10, "id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 4 || meta.TotalRecords != 4 || galleries[0].ID != ids[1] {
+		t.Fatalf("expected the excluded gallery to be skipped, got %v", galleries)
+	}
+
+	filter = galleriesFilter(1, 10, "id")
+	filter.CountOnly = true
+	galleries, meta, err = s.Galleries.GetAllForUser(user.ID, nil, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 0 || meta.TotalRecords != 5 {
+		t.Fatalf("expected only the count, got %d galleries and %+v", len(galleries), meta)
+	}
+
+	count, err := s.Galleries.CountForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Fatalf("expected 5 galleries, got %d", count)
+	}
+}
+
+// Galleries with the same value of the sort column are ordered by ID, in both
+// directions, so no gallery is repeated or skipped across the pages.
+func TestGalleriesListingTies(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "galleries-ties")
+
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		gallery, err := s.Galleries.Insert(store.Gallery{Title: "same title", UserID: user.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, gallery.ID)
+	}
+
+	for _, sort := range []string{"title", "-title"} {
+		var listed []int64
+		for page := 1; page <= 3; page++ {
+			galleries, _, err := s.Galleries.GetAllForUser(user.ID, nil, galleriesFilter(page, 2, sort))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, g := range galleries {
+				listed = append(listed, g.ID)
+			}
+		}
+		if fmt.Sprint(listed) != fmt.Sprint(ids) {
+			t.Fatalf("sorting by %s: expected galleries %v, got %v", sort, ids, listed)
+		}
+	}
+}
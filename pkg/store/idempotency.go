@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The store abstraction used to keep track of the idempotency keys of the requests
+// creating resources. It holds a DB connection pool.
+type IdempotencyStore struct {
+	DB Executor
+}
+
+// Reserve the key for a new request, reporting whether it succeeded. A key is reserved
+// if it was never used, if its request completed more than ttl ago or if its request is
+// in progress since more than lease (e.g. the server crashed before completing it). The
+// primary key serializes concurrent reservations of the same key, only one succeeds.
+func (is *IdempotencyStore) Reserve(userID int64, scope, key string, ttl, lease time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reserved bool
+	err := is.DB.GetContext(ctx, &reserved, `
+		INSERT INTO idempotency_keys (user_id, scope, key, resource_id, created_at)
+		VALUES ($1, $2, $3, NULL, NOW())
+		ON CONFLICT (user_id, scope, key) DO UPDATE
+			SET resource_id = NULL, created_at = NOW()
+			WHERE (idempotency_keys.resource_id IS NOT NULL AND idempotency_keys.created_at < NOW() - make_interval(secs => $4))
+			OR (idempotency_keys.resource_id IS NULL AND idempotency_keys.created_at < NOW() - make_interval(secs => $5))
+		RETURNING true
+	`, userID, scope, key, ttl.Seconds(), lease.Seconds())
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return reserved, nil
+}
+
+// Return the ID of the resource created by the request with the provided key, nil
+// if the request is still in progress. If the key doesn't exist ErrRecordNotFound
+// is returned.
+func (is *IdempotencyStore) Get(userID int64, scope, key string) (*int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var resourceID *int64
+	err := is.DB.GetContext(ctx, &resourceID, `
+		SELECT resource_id FROM idempotency_keys 
+		WHERE user_id = $1 AND scope = $2 AND key = $3
+	`, userID, scope, key)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, ErrRecordNotFound
+	case err != nil:
+		return nil, err
+	}
+	return resourceID, nil
+}
+
+// Record the ID of the resource created by the request with the reserved key.
+func (is *IdempotencyStore) Complete(userID int64, scope, key string, resourceID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := is.DB.ExecContext(ctx, `
+		UPDATE idempotency_keys SET resource_id = $4 
+		WHERE user_id = $1 AND scope = $2 AND key = $3
+	`, userID, scope, key, resourceID)
+	return err
+}
+
+// Release a reserved key, so that the request could be retried with the same key.
+// It is used when the request fails and no resource is created.
+func (is *IdempotencyStore) Release(userID int64, scope, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := is.DB.ExecContext(ctx, `
+		DELETE FROM idempotency_keys 
+		WHERE user_id = $1 AND scope = $2 AND key = $3 AND resource_id IS NULL
+	`, userID, scope, key)
+	return err
+}
+
+// Delete the keys of the requests completed more than ttl ago and of the requests in
+// progress since more than lease, returning the number of keys deleted.
+func (is *IdempotencyStore) DeleteExpired(ttl, lease time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := is.DB.ExecContext(ctx, `
+		DELETE FROM idempotency_keys
+		WHERE (resource_id IS NOT NULL AND created_at < NOW() - make_interval(secs => $1))
+		OR (resource_id IS NULL AND created_at < NOW() - make_interval(secs => $2))
+	`, ttl.Seconds(), lease.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
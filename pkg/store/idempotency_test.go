@@ -0,0 +1,117 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+const (
+	testTTL   = 24 * time.Hour
+	testLease = 10 * time.Minute
+)
+
+// Move back the creation time of the key, simulating the passing of time.
+func ageKey(t *testing.T, db *sqlx.DB, userID int64, key string, age time.Duration) {
+	t.Helper()
+	_, err := db.ExecContext(context.Background(), `
+		UPDATE idempotency_keys SET created_at = NOW() - make_interval(secs => $3)
+		WHERE user_id = $1 AND key = $2
+	`, userID, key, age.Seconds())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A key in progress can be reserved again after the lease, while a completed
+// key only after the TTL.
+func TestReserveLease(t *testing.T) {
+	s, db := storetest.New(t)
+	user := storetest.NewUser(t, s, "idempotency")
+
+	reserve := func(key string) bool {
+		t.Helper()
+		ok, err := s.Idempotency.Reserve(user.ID, "test", key, testTTL, testLease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if !reserve("in-progress") || reserve("in-progress") {
+		t.Fatal("a new key must be reserved exactly once")
+	}
+	ageKey(t, db, user.ID, "in-progress", testLease+time.Minute)
+	if !reserve("in-progress") {
+		t.Fatal("key in progress not reserved after the lease")
+	}
+
+	if !reserve("completed") {
+		t.Fatal("new key not reserved")
+	}
+	err := s.Idempotency.Complete(user.ID, "test", "completed", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageKey(t, db, user.ID, "completed", testLease+time.Minute)
+	if reserve("completed") {
+		t.Fatal("completed key reserved within the TTL")
+	}
+	ageKey(t, db, user.ID, "completed", testTTL+time.Minute)
+	if !reserve("completed") {
+		t.Fatal("completed key not reserved after the TTL")
+	}
+}
+
+// Only the keys past their lease (in progress) or TTL (completed) are deleted.
+func TestDeleteExpiredKeys(t *testing.T) {
+	s, db := storetest.New(t)
+	user := storetest.NewUser(t, s, "idempotency")
+
+	seed := []struct {
+		key       string
+		completed bool
+		age       time.Duration
+		expired   bool
+	}{
+		{"stale", false, testLease + time.Minute, true},
+		{"running", false, time.Minute, false},
+		{"old", true, testTTL + time.Minute, true},
+		{"recent", true, testLease + time.Minute, false},
+	}
+	for _, sd := range seed {
+		_, err := s.Idempotency.Reserve(user.ID, "test", sd.key, testTTL, testLease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sd.completed {
+			err = s.Idempotency.Complete(user.ID, "test", sd.key, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ageKey(t, db, user.ID, sd.key, sd.age)
+	}
+
+	_, err := s.Idempotency.DeleteExpired(testTTL, testLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sd := range seed {
+		var n int
+		err := db.GetContext(context.Background(), &n, `
+			SELECT COUNT(*) FROM idempotency_keys WHERE user_id = $1 AND key = $2
+		`, user.ID, sd.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sd.expired != (n == 0) {
+			t.Errorf("key %s: expired %v, found %d rows", sd.key, sd.expired, n)
+		}
+	}
+}
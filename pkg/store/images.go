@@ -2,16 +2,22 @@ package store
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
-	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 
 	"github.com/anBertoli/snap-vault/pkg/filters"
 )
@@ -20,9 +26,15 @@ type Image struct {
 	ID          int64     `json:"id" db:"id"`
 	Path        string    `json:"-" db:"filepath"`
 	Title       string    `json:"title" db:"title"`
-	Caption     string    `json:"caption" db:"caption"`
+	Caption     *string   `json:"caption" db:"caption"`
 	Size        int64     `json:"size" db:"size"`
 	ContentType string    `json:"content_type" db:"content_type"`
+	Width       *int      `json:"width" db:"width"`
+	Height      *int      `json:"height" db:"height"`
+	Hash        string    `json:"-" db:"hash"`
+	Position    int       `json:"position" db:"position"`
+	Version     int       `json:"version" db:"version"`
+	ViewCount   int64     `json:"view_count" db:"view_count"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
 	GalleryID   int64     `json:"gallery_id" db:"gallery_id"`
@@ -30,17 +42,49 @@ type Image struct {
 	UserID      int64     `json:"user_id" db:"user_id"`
 }
 
+// Return a stable entity tag for the image bytes, to be used in HTTP caching. The
+// tag is based on the hash of the content, computed when the image is stored. For
+// images stored before hashes were introduced, the ID and the size are used.
+func (i Image) ETag() string {
+	if i.Hash != "" {
+		return fmt.Sprintf(`"%s"`, i.Hash)
+	}
+	return fmt.Sprintf(`"%d-%d"`, i.ID, i.Size)
+}
+
+// Columns selected when retrieving images, the galleries table must be joined to
+// provide more infos in the returned images.
+const imageColumns = `
+	images.id, images.filepath, images.title, images.size, images.content_type, images.width, images.height, images.caption, images.hash,
+	images.position, images.version, images.view_count, images.created_at, images.updated_at, images.gallery_id, galleries.user_id as user_id, galleries.published`
+
 // The store abstraction used to manipulate images into our postgres
 // database and into the file system storage. It holds a DB
 // connection pool.
 type ImagesStore struct {
-	db     *sqlx.DB
+	db     Executor
 	fsRoot string
+	shard  bool
+	layout PathTemplate
+}
+
+// Options of the file system storage of images. Root is the directory where
+// images are saved. PathTemplate is the layout of new files under the root
+// (see PathTemplate), DefaultPathTemplate if empty. If Shard is true, new
+// images are spread over two levels of subdirectories of the directory
+// produced by the template, derived from the hash of the file name (e.g.
+// gallery_5/ab/cd/<name>), to keep directories small.
+type FsOptions struct {
+	Root         string
+	PathTemplate string
+	Shard        bool
 }
 
 // Instantiate a new images store. The constructor is used
-// to check if the provided store path is valid.
-func NewImagesStore(db *sqlx.DB, path string) (ImagesStore, error) {
+// to check if the provided store path is valid. The executor is usually
+// a connection pool, see New.
+func NewImagesStore(db Executor, opts FsOptions) (ImagesStore, error) {
+	path := opts.Root
 	absPath, err := filepath.Abs(path)
 	if err != nil {
 		return ImagesStore{}, err
@@ -52,9 +96,19 @@ func NewImagesStore(db *sqlx.DB, path string) (ImagesStore, error) {
 	if !stat.IsDir() {
 		return ImagesStore{}, fmt.Errorf("'%s' is not a dir", path)
 	}
+	tmpl := opts.PathTemplate
+	if tmpl == "" {
+		tmpl = DefaultPathTemplate
+	}
+	layout, err := ParsePathTemplate(tmpl)
+	if err != nil {
+		return ImagesStore{}, err
+	}
 	return ImagesStore{
 		db:     db,
 		fsRoot: absPath,
+		shard:  opts.Shard,
+		layout: layout,
 	}, nil
 }
 
@@ -64,15 +118,13 @@ func (is *ImagesStore) Get(imageID int64) (Image, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// Join the galleries and users tables to provide more infos in
-	// the returned image.
+	// Join the galleries table to provide more infos in the returned image. The join is
+	// an inner one: an image whose gallery doesn't exist anymore (e.g. deleted concurrently)
+	// is reported as not found, like an image that never existed.
 	err := is.db.GetContext(ctx, &image, `
-		SELECT 
-			images.id, images.filepath, images.title, images.size, images.caption, images.content_type, images.created_at, 
-  			images.updated_at, images.gallery_id, users.id as user_id, galleries.published
+		SELECT `+imageColumns+`
 		FROM images 
-			LEFT JOIN galleries on images.gallery_id = galleries.id
-			LEFT JOIN users on users.id = galleries.user_id
+			JOIN galleries on images.gallery_id = galleries.id
 		WHERE images.id = $1
 	`, imageID)
 
@@ -88,20 +140,19 @@ func (is *ImagesStore) Get(imageID int64) (Image, error) {
 	return image, nil
 }
 
-// Return a read-closer that provides the bytes content of a specific image. The
-// returned read-closer must be closed by the caller, if not, file descriptors
+// Return a read-seek-closer that provides the bytes content of a specific image. The
+// returned read-seek-closer must be closed by the caller, if not, file descriptors
 // will be leaked.
-func (is *ImagesStore) GetReader(imageID int64) (io.ReadCloser, error) {
+func (is *ImagesStore) GetReader(imageID int64) (io.ReadSeekCloser, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	// As in Get, images without a gallery are not found.
 	var image Image
 	err := is.db.GetContext(ctx, &image, `
-		SELECT 
-			images.id, images.filepath, images.title, images.size, images.content_type, images.caption, images.created_at, 
-  			images.updated_at, images.gallery_id, galleries.user_id as user_id
+		SELECT `+imageColumns+`
 		FROM images 
-		LEFT JOIN galleries on images.gallery_id = galleries.id
+		JOIN galleries on images.gallery_id = galleries.id
 		WHERE images.id = $1
 	`, imageID)
 
@@ -145,20 +196,33 @@ func (is *ImagesStore) GetAllPublic(filter filters.Input) ([]Image, filters.Meta
 
 	// Like in the galleries listing operations we include the count and we provide
 	// support for records filtering based on search col field.
+	from, to := filter.DateArgs()
+	where := fmt.Sprintf(
+		`(LOWER(images.%s) LIKE '%%' || LOWER($1) || '%%' OR $1 = '') AND published = true AND %s`,
+		filter.SearchCol, filters.BuildDateClause("images.created_at", 2),
+	)
+	args := []interface{}{filter.Search, from, to}
+
+	// If only the count is requested, avoid fetching the records.
+	if filter.CountOnly {
+		meta, err := countListing(is.db, filter, `
+			SELECT count(*) FROM images LEFT JOIN galleries on images.gallery_id = galleries.id
+			WHERE `+where, args...)
+		return images, meta, err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	err := is.db.SelectContext(ctx, &tmp, fmt.Sprintf(`
-		SELECT count(*) OVER(), 
-			images.id, images.filepath, images.title, images.size, images.content_type, images.caption, images.created_at, 
-			images.updated_at, images.gallery_id, galleries.user_id as user_id, galleries.published
+		SELECT count(*) OVER(), `+imageColumns+`
 		FROM images 
 		LEFT JOIN galleries on images.gallery_id = galleries.id
-		WHERE ((LOWER(images.%s) LIKE LOWER('%%%s%%')) OR ($1 = '')) AND published = true
+		WHERE %s
 		ORDER BY images.%s %s, id ASC
-		LIMIT $2 OFFSET $3`,
-		filter.SearchCol, filter.Search, filter.SortColumn(), filter.SortDirection(),
-	), filter.Search, filter.Limit(), filter.Offset())
+		LIMIT $4 OFFSET $5`,
+		where, filter.SortColumn(), filter.SortDirection(),
+	), append(args, filter.Limit(), filter.Offset())...)
 
 	if err != nil {
 		switch {
@@ -180,6 +244,110 @@ func (is *ImagesStore) GetAllPublic(filter filters.Input) ([]Image, filters.Meta
 	return images, metadata, nil
 }
 
+// Obtain up to 'limit' public images with an ID greater than the provided one, sorted by ID.
+// This is keyset pagination: unlike the offset-based listings the cost of a page doesn't
+// grow with the position and no total count is computed, so it is suitable to iterate
+// over all the public images.
+func (is *ImagesStore) GetPublicAfter(afterID int64, limit int) ([]Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	images := []Image{}
+	err := is.db.SelectContext(ctx, &images, `
+		SELECT `+imageColumns+`
+		FROM images 
+		JOIN galleries on images.gallery_id = galleries.id
+		WHERE galleries.published = true AND images.id > $1
+		ORDER BY images.id ASC
+		LIMIT $2
+	`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// Return the cursors of the pages of public images, when iterating over them with
+// GetPublicAfter and the provided page size: the first page starts after zero, the
+// following ones after the last image of the previous page.
+func (is *ImagesStore) GetPublicPageCursors(pageSize int) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var cursors []int64
+	err := is.db.SelectContext(ctx, &cursors, `
+		SELECT id FROM (
+			SELECT images.id, row_number() OVER (ORDER BY images.id) AS n, count(*) OVER () AS total
+			FROM images
+			JOIN galleries on images.gallery_id = galleries.id
+			WHERE galleries.published = true
+		) AS numbered
+		WHERE n % $1 = 0 AND n < total
+		ORDER BY id ASC
+	`, pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]int64{0}, cursors...), nil
+}
+
+// Obtain a list of the images owned by a specific user, across all his galleries. This operation
+// supports filtering and pagination so the method also returns pagination metadata.
+func (is *ImagesStore) GetAllForUser(userID int64, filter filters.Input) ([]Image, filters.Meta, error) {
+	var (
+		images   = []Image{}
+		metadata = filter.CalculateMetadata(0)
+		// Use a temporary variable to scan also the count.
+		tmp []struct {
+			Count int64 `db:"count"`
+			Image
+		}
+	)
+
+	from, to := filter.DateArgs()
+	where := fmt.Sprintf(
+		`(LOWER(images.%s) LIKE '%%' || LOWER($1) || '%%' OR $1 = '') AND galleries.user_id = $2 AND %s`,
+		filter.SearchCol, filters.BuildDateClause("images.created_at", 3),
+	)
+	args := []interface{}{filter.Search, userID, from, to}
+
+	// If only the count is requested, avoid fetching the records.
+	if filter.CountOnly {
+		meta, err := countListing(is.db, filter, `
+			SELECT count(*) FROM images JOIN galleries on images.gallery_id = galleries.id
+			WHERE `+where, args...)
+		return images, meta, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := is.db.SelectContext(ctx, &tmp, fmt.Sprintf(`
+		SELECT count(*) OVER(), `+imageColumns+`
+		FROM images 
+			JOIN galleries on images.gallery_id = galleries.id
+		WHERE %s
+		ORDER BY images.%s %s, id ASC
+		LIMIT $5 OFFSET $6`,
+		where, filter.SortColumn(), filter.SortDirection(),
+	), append(args, filter.Limit(), filter.Offset())...)
+	if err != nil {
+		return nil, metadata, err
+	}
+
+	// Convert the results into an images slice, then calculate pagination metadata.
+	for _, i := range tmp {
+		images = append(images, i.Image)
+	}
+	if len(tmp) > 0 {
+		metadata = filter.CalculateMetadata(tmp[0].Count)
+	}
+
+	return images, metadata, nil
+}
+
 // Obtain a list of images belonging to a specific gallery. This operation supports filtering and
 // pagination so the method also returns pagination metadata.
 func (is *ImagesStore) GetAllForGallery(galleryID int64, filter filters.Input) ([]Image, filters.Meta, error) {
@@ -193,21 +361,31 @@ func (is *ImagesStore) GetAllForGallery(galleryID int64, filter filters.Input) (
 		}
 	)
 
+	from, to := filter.DateArgs()
+	where := fmt.Sprintf(
+		`(LOWER(images.%s) LIKE '%%' || LOWER($1) || '%%' OR $1 = '') AND gallery_id = $2 AND %s`,
+		filter.SearchCol, filters.BuildDateClause("images.created_at", 3),
+	)
+	args := []interface{}{filter.Search, galleryID, from, to}
+
+	// If only the count is requested, avoid fetching the records.
+	if filter.CountOnly {
+		meta, err := countListing(is.db, filter, `SELECT count(*) FROM images WHERE `+where, args...)
+		return images, meta, err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	err := is.db.SelectContext(ctx, &tmp, fmt.Sprintf(`
-		SELECT count(*) OVER(), 
-                images.id, images.filepath, images.title, images.size, images.content_type, images.caption, images.created_at, 
-				images.updated_at, images.gallery_id, users.id as user_id, galleries.published
+		SELECT count(*) OVER(), `+imageColumns+`
 		FROM images 
 			LEFT JOIN galleries on images.gallery_id = galleries.id
-			LEFT JOIN users on users.id = galleries.user_id
-		WHERE ((LOWER(images.%s) LIKE LOWER('%%%s%%')) OR ($1 = '')) AND gallery_id = $2
+		WHERE %s
 		ORDER BY images.%s %s, id ASC
-		LIMIT $3 OFFSET $4`,
-		filter.SearchCol, filter.Search, filter.SortColumn(), filter.SortDirection(),
-	), filter.Search, galleryID, filter.Limit(), filter.Offset())
+		LIMIT $5 OFFSET $6`,
+		where, filter.SortColumn(), filter.SortDirection(),
+	), append(args, filter.Limit(), filter.Offset())...)
 
 	if err != nil {
 		switch {
@@ -229,96 +407,309 @@ func (is *ImagesStore) GetAllForGallery(galleryID int64, filter filters.Input) (
 	return images, metadata, nil
 }
 
+// Count the images owned by the specified user (across all his galleries) and
+// sum their sizes in bytes.
+func (is *ImagesStore) CountForUser(userID int64) (int, int64, error) {
+	var res struct {
+		Count int   `db:"count"`
+		Bytes int64 `db:"bytes"`
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := is.db.GetContext(ctx, &res, `
+		SELECT count(images.id) AS count, COALESCE(SUM(images.size), 0) AS bytes
+		FROM images
+			JOIN galleries on images.gallery_id = galleries.id
+		WHERE galleries.user_id = $1
+	`, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return res.Count, res.Bytes, nil
+}
+
+// Returns the number of images of a specific gallery.
+func (is *ImagesStore) CountForGallery(galleryID int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := is.db.GetContext(ctx, &count, `
+		SELECT count(*) FROM images WHERE gallery_id = $1
+	`, galleryID)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Obtain the images with the provided IDs, ordered by ID. IDs without an
+// image are ignored, so fewer images than IDs could be returned.
+func (is *ImagesStore) GetMany(imageIDs []int64) ([]Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	images := []Image{}
+	err := is.db.SelectContext(ctx, &images, `
+		SELECT `+imageColumns+`
+		FROM images 
+		JOIN galleries on images.gallery_id = galleries.id
+		WHERE images.id = ANY($1)
+		ORDER BY images.id ASC
+	`, pq.Array(imageIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// Obtain at most limit images without dimensions, with ID greater than afterID and
+// ordered by ID, so that all of them can be visited with subsequent calls.
+func (is *ImagesStore) GetWithoutDimensions(afterID int64, limit int) ([]Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	images := []Image{}
+	err := is.db.SelectContext(ctx, &images, `
+		SELECT `+imageColumns+`
+		FROM images 
+		JOIN galleries on images.gallery_id = galleries.id
+		WHERE (images.width IS NULL OR images.height IS NULL) AND images.id > $1
+		ORDER BY images.id ASC
+		LIMIT $2
+	`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// Set the dimensions of an image. The updated_at and version columns are untouched,
+// the dimensions are derived from the content, which doesn't change.
+func (is *ImagesStore) SetDimensions(imageID int64, width, height int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := is.db.ExecContext(ctx, `
+		UPDATE images SET width = $1, height = $2 WHERE id = $3
+	`, width, height, imageID)
+	return err
+}
+
+// Atomically increment the public views counter of the image. The updated_at and
+// version columns are untouched, counting a view isn't an edit of the image.
+func (is *ImagesStore) IncrementViews(imageID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := is.db.ExecContext(ctx, `UPDATE images SET view_count = view_count + 1 WHERE id = $1`, imageID)
+	return err
+}
+
+// Aggregate data about the images of a gallery. LastUpdated is nil if the gallery has no images.
+type ImagesAggregate struct {
+	Count       int        `db:"count"`
+	Bytes       int64      `db:"bytes"`
+	LastUpdated *time.Time `db:"last_updated"`
+}
+
+// Returns the number of images of a specific gallery, their total size in bytes and
+// the last time one of them was updated.
+func (is *ImagesStore) AggregateForGallery(galleryID int64) (ImagesAggregate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var agg ImagesAggregate
+	err := is.db.GetContext(ctx, &agg, `
+		SELECT count(*) AS count, COALESCE(SUM(size), 0) AS bytes, MAX(updated_at) AS last_updated
+		FROM images WHERE gallery_id = $1
+	`, galleryID)
+	if err != nil {
+		return ImagesAggregate{}, err
+	}
+
+	return agg, nil
+}
+
 // Inserts a new image for a specific gallery into the database and save the image bytes
 // into the file system. The image struct passed in must contain the necessary information,
 // but note that id, created_at and updated_at are set automatically by the database.
 func (is *ImagesStore) Insert(r io.Reader, image Image) (Image, error) {
-	var (
-		imageSize int64
-		relPath   string
-	)
+	if r == nil {
+		return Image{}, ErrEmptyBytes
+	}
 
-	// Compute the path where the image will be saved, using a random string.
-	// If a name collision occur, retry again with a different random string.
-	for {
-		relPath = filepath.Join(
-			fmt.Sprintf("gallery_%d", image.GalleryID),
-			fmt.Sprintf("%s_%s", image.Title, randString(25)),
-		)
-		path, err := filepath.Abs(filepath.Join(is.fsRoot, relPath))
-		if err != nil {
-			return Image{}, err
-		}
-		imageSize, err = is.writeImage(r, path)
-		if errors.Is(err, ErrFileAlreadyExists) {
-			continue
-		}
-		if err != nil {
-			return Image{}, err
-		}
-		break
+	// The title is provided by users, only a sanitized version of it is used
+	// in the file name, while the title saved in the db is left unchanged.
+	fileName := SanitizeFileName(image.Title)
+	if fileName == "" {
+		return Image{}, ErrInvalidFileName
+	}
+
+	relPath, imageSize, imageHash, err := is.saveImage(r, image, fileName)
+	if err != nil {
+		return Image{}, err
 	}
 
 	// Update relevant image fields then insert an image record into the db.
 	image.Path = relPath
 	image.Size = imageSize
+	image.Hash = imageHash
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := is.db.GetContext(ctx, &image, `
+	// New images are appended at the end of the gallery.
+	err = is.db.GetContext(ctx, &image, `
 		INSERT
-			INTO images (filepath, title, caption, created_at, updated_at, size, content_type, gallery_id)
-			VALUES ($1, $2, $3, now(), now(), $4, $5, $6) 
-			RETURNING id, created_at, updated_at
-	`, image.Path, image.Title, image.Caption, imageSize, image.ContentType, image.GalleryID)
+			INTO images (filepath, title, caption, created_at, updated_at, size, content_type, width, height, hash, gallery_id, position)
+			VALUES ($1, $2, $3, now(), now(), $4, $5, $6, $7, $8, $9, (
+				SELECT COALESCE(MAX(position), 0) + 1 FROM images WHERE gallery_id = $9
+			)) 
+			RETURNING id, position, version, created_at, updated_at
+	`, image.Path, image.Title, image.Caption, imageSize, image.ContentType, image.Width, image.Height, image.Hash, image.GalleryID)
 	if err != nil {
+		// Don't leave a file without the related record.
+		path, pathErr := filepath.Abs(filepath.Join(is.fsRoot, relPath))
+		if pathErr == nil {
+			_ = os.Remove(path)
+		}
 		return Image{}, err
 	}
 
 	return image, nil
 }
 
-// Helper func used to write an image into the file system store. The file is
-// created with O_EXCL mode, that is, it must not exist.
-func (is *ImagesStore) writeImage(r io.Reader, path string) (int64, error) {
-	err := os.MkdirAll(filepath.Dir(path), 0755)
-	if err != nil {
-		return 0, err
+// Build the path, relative to the storage root, of a new image file. Without
+// sharding files are saved directly in the directory produced by the path
+// template. With sharding the first two bytes of the hash of the file name
+// select two levels of subdirectories. Since the relative path is saved in
+// the db, files written with a different setting are still found.
+func (is *ImagesStore) imagePath(dir string, fileName string) string {
+	if !is.shard {
+		return filepath.Join(dir, fileName)
 	}
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
-	if os.IsExist(err) {
-		return 0, ErrFileAlreadyExists
+	sum := sha256.Sum256([]byte(fileName))
+	shard := hex.EncodeToString(sum[:2])
+	return filepath.Join(dir, shard[:2], shard[2:], fileName)
+}
+
+// Save the image bytes into a new file, at the path produced by the path template for
+// the image (its gallery ID and user ID are used) and the provided file name. The path
+// of the file, relative to the storage root, is returned along with the size and the
+// SHA-256 hash of the bytes.
+func (is *ImagesStore) saveImage(r io.Reader, image Image, fileName string) (string, int64, string, error) {
+	vars := pathVars{
+		galleryID: image.GalleryID,
+		userID:    image.UserID,
+		name:      fileName,
+		date:      time.Now().UTC(),
 	}
+	dir := is.layout.dirPath(vars)
+
+	// Stream the bytes into a temporary file of the target directory, so that an
+	// interrupted upload never leaves a partial file at a path used by images.
+	tmpFile, err := createTemp(filepath.Join(is.fsRoot, dir))
 	if err != nil {
-		return 0, err
+		return "", 0, "", storageError(err)
 	}
-	n, err := io.Copy(file, r)
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmpFile, hash), r)
 	if err != nil {
-		return n, err
+		_ = tmpFile.Close()
+		return "", 0, "", storageError(err)
 	}
-	err = file.Close()
+	err = tmpFile.Close()
 	if err != nil {
-		return n, err
+		return "", 0, "", storageError(err)
+	}
+
+	// Move the complete file to its final path, using a random string in the name.
+	// The file is linked instead of renamed since, unlike rename, link fails if the
+	// target exists: in case of a name collision retry with a different random string.
+	// The temporary name is then removed by the deferred call. The directory can be
+	// pruned by a concurrent delete right after being created, so also retry (a few
+	// times) if it doesn't exist.
+	for missing := 0; ; {
+		relPath := is.imagePath(dir, is.layout.fileName(vars, randString(25)))
+		path, err := filepath.Abs(filepath.Join(is.fsRoot, relPath))
+		if err != nil {
+			return "", 0, "", err
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return "", 0, "", storageError(err)
+		}
+		err = os.Link(tmpPath, path)
+		if os.IsExist(err) {
+			continue
+		}
+		if os.IsNotExist(err) && missing < 3 {
+			missing++
+			continue
+		}
+		if err != nil {
+			return "", 0, "", storageError(err)
+		}
+		return relPath, n, hex.EncodeToString(hash.Sum(nil)), nil
+	}
+}
+
+// Create a temporary file in the provided directory, creating the directory first.
+// Empty gallery directories are removed when their last image is deleted: if that
+// happens between the two steps the directory is created again.
+func createTemp(dir string) (*os.File, error) {
+	for attempt := 0; ; attempt++ {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.CreateTemp(dir, ".upload_*")
+		if os.IsNotExist(err) && attempt < 3 {
+			continue
+		}
+		return f, err
 	}
-	return n, err
 }
 
-// Update data about a specific image into the database.
+// Wrap errors caused by a full or unwritable file system with ErrStorageUnavailable,
+// so callers can tell them apart from other failures. Other errors are returned
+// unchanged.
+func storageError(err error) error {
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT),
+		errors.Is(err, syscall.EROFS), errors.Is(err, os.ErrPermission):
+		return fmt.Errorf("%w: %v", ErrStorageUnavailable, err)
+	default:
+		return err
+	}
+}
+
+// Update data about a specific image into the database. The update is performed only if
+// the version of the image is still the provided one (optimistic locking), otherwise, if
+// the image was modified or deleted in the meantime, ErrEditConflict is returned.
 func (is *ImagesStore) Update(image Image) (Image, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	err := is.db.GetContext(ctx, &image, `
-		UPDATE images SET title = $1, caption = $2, updated_at = $3 
-		WHERE id = $4
-		RETURNING updated_at
-	`, image.Title, image.Caption, time.Now().UTC(), image.ID)
+		UPDATE images SET title = $1, caption = $2, updated_at = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING updated_at, version
+	`, image.Title, image.Caption, time.Now().UTC(), image.ID, image.Version)
 
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return Image{}, ErrRecordNotFound
+			return Image{}, ErrEditConflict
 		default:
 			return Image{}, err
 		}
@@ -327,6 +718,121 @@ func (is *ImagesStore) Update(image Image) (Image, error) {
 	return image, nil
 }
 
+// Replace the content of an existing image, keeping its ID and metadata. The new bytes
+// are written to a new file, then the record is updated with the new path, size, content
+// type and hash, only if the image version is unchanged. Once the record is updated the
+// previous file is removed. If the image was modified or deleted in the meantime the new
+// file is removed and ErrEditConflict is returned. The image must carry the ID, version,
+// title, gallery ID and content type, while the old file path is read from its Path.
+func (is *ImagesStore) ReplaceContent(r io.Reader, image Image) (Image, error) {
+	if r == nil {
+		return Image{}, ErrEmptyBytes
+	}
+
+	fileName := SanitizeFileName(image.Title)
+	if fileName == "" {
+		return Image{}, ErrInvalidFileName
+	}
+
+	oldPath, err := filepath.Abs(filepath.Join(is.fsRoot, image.Path))
+	if err != nil {
+		return Image{}, err
+	}
+
+	// Save the new content using a new file name, as done when inserting images.
+	relPath, imageSize, imageHash, err := is.saveImage(r, image, fileName)
+	if err != nil {
+		return Image{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	image.Path = relPath
+	image.Size = imageSize
+	image.Hash = imageHash
+	err = is.db.GetContext(ctx, &image, `
+		UPDATE images SET filepath = $1, size = $2, content_type = $3, width = $4, height = $5, hash = $6,
+			updated_at = $7, version = version + 1
+		WHERE id = $8 AND version = $9
+		RETURNING updated_at, version
+	`, image.Path, image.Size, image.ContentType, image.Width, image.Height, image.Hash, time.Now().UTC(), image.ID, image.Version)
+	if err != nil {
+		// Don't leave a file without the related record.
+		path, pathErr := filepath.Abs(filepath.Join(is.fsRoot, relPath))
+		if pathErr == nil {
+			_ = os.Remove(path)
+		}
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return Image{}, ErrEditConflict
+		default:
+			return Image{}, err
+		}
+	}
+
+	// The record points to the new file. A failure here only leaves an
+	// orphan file, which is collected by the storage reap command.
+	_ = os.Remove(oldPath)
+
+	return image, nil
+}
+
+// Assign the positions of the images of a gallery following the order of the provided
+// IDs. The IDs must match exactly the images of the gallery, otherwise ErrOrderMismatch
+// is returned. The gallery images are locked and updated in a single transaction, so
+// concurrent inserts or deletions cannot interleave with the check.
+func (is *ImagesStore) Reorder(galleryID int64, imageIDs []int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Begin the transaction.
+	tx, err := beginTx(ctx, is.db)
+	if err != nil {
+		return err
+	}
+
+	var currentIDs []int64
+	err = tx.SelectContext(ctx, &currentIDs, `
+		SELECT id FROM images WHERE gallery_id = $1 FOR UPDATE
+	`, galleryID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// Compare the two sets of IDs, the caller is expected to
+	// provide unique IDs so the lengths must match.
+	current := make(map[int64]bool, len(currentIDs))
+	for _, id := range currentIDs {
+		current[id] = true
+	}
+	if len(imageIDs) != len(currentIDs) {
+		_ = tx.Rollback()
+		return ErrOrderMismatch
+	}
+	for _, id := range imageIDs {
+		if !current[id] {
+			_ = tx.Rollback()
+			return ErrOrderMismatch
+		}
+	}
+
+	// The position of each image is its (1-based) index in the provided list.
+	_, err = tx.ExecContext(ctx, `
+		UPDATE images SET position = ordered.position
+		FROM unnest($1::bigint[]) WITH ORDINALITY AS ordered(id, position)
+		WHERE images.id = ordered.id AND images.gallery_id = $2
+	`, pq.Array(imageIDs), galleryID)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// Commit the transaction.
+	return tx.Commit()
+}
+
 // Delete the specified image both from the gallery and from the store.
 func (is *ImagesStore) Delete(imageID int64) error {
 	var image Image
@@ -355,6 +861,7 @@ func (is *ImagesStore) Delete(imageID int64) error {
 	if err != nil {
 		return err
 	}
+	is.pruneDirs(filepath.Dir(path))
 
 	// Delete the image metadata from the database.
 	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
@@ -374,6 +881,297 @@ func (is *ImagesStore) Delete(imageID int64) error {
 	return nil
 }
 
+// Delete the metadata of the image from the database, returning the deleted image. The
+// file is left in place: this allows to delete the row in a transaction along with other
+// changes (e.g. the stats update), and to remove the file with DeleteFile only after the
+// commit, so a rollback never leaves a row without its file.
+func (is *ImagesStore) DeleteRecord(imageID int64) (Image, error) {
+	var image Image
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := is.db.GetContext(ctx, &image, `DELETE FROM images WHERE id = $1 RETURNING *`, imageID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return Image{}, ErrRecordNotFound
+		default:
+			return Image{}, err
+		}
+	}
+
+	return image, nil
+}
+
+// Delete the file of an image whose metadata was deleted with DeleteRecord.
+func (is *ImagesStore) DeleteFile(image Image) error {
+	path, err := filepath.Abs(filepath.Join(is.fsRoot, image.Path))
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(path)
+	if err != nil {
+		return err
+	}
+	is.pruneDirs(filepath.Dir(path))
+	return nil
+}
+
+// Remove the provided directory and its parents, up to the storage root, as long
+// as they are empty. Removing a directory fails if it's not empty, so files written in
+// the meantime are never lost; uploads recreate the directories if needed. Errors are
+// ignored, leftover directories are eventually removed by RemoveEmptyDirs.
+func (is *ImagesStore) pruneDirs(dir string) {
+	root, err := filepath.Abs(is.fsRoot)
+	if err != nil {
+		return
+	}
+	for strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Remove the empty directories of the images storage (the ones produced by the path
+// templates and the shard subdirectories, see storageDirs) not modified within the
+// grace period. Directories left empty by the removal of their subdirectories are
+// removed too. The paths of the removed directories, relative to the storage root,
+// are returned. In dry-run mode nothing is removed and the directories that would
+// be removed are returned.
+func (is *ImagesStore) RemoveEmptyDirs(grace time.Duration, dryRun bool) ([]string, error) {
+	threshold := time.Now().Add(-grace)
+
+	topDirs, err := is.storageDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, topDir := range topDirs {
+		// Walk visits parents before their children, collect the directories
+		// and process them in reverse order, deepest first.
+		var dirs []string
+		err = filepath.Walk(topDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				dirs = append(dirs, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		gone := map[string]bool{}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			dir := dirs[i]
+			info, err := os.Stat(dir)
+			if err != nil {
+				return nil, err
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return nil, err
+			}
+
+			// The directory is empty if all its entries were removed (or
+			// would be removed in dry-run mode) in a previous iteration. A
+			// directory emptied this way is not subject to the grace period.
+			emptied := len(entries) > 0
+			for _, e := range entries {
+				if !gone[filepath.Join(dir, e.Name())] {
+					emptied = false
+					break
+				}
+			}
+			if !emptied && (len(entries) > 0 || info.ModTime().After(threshold)) {
+				continue
+			}
+
+			if !dryRun {
+				err = os.Remove(dir)
+				if err != nil {
+					// Probably written in the meantime, keep it.
+					continue
+				}
+			}
+			gone[dir] = true
+			relPath, err := filepath.Rel(is.fsRoot, dir)
+			if err != nil {
+				return nil, err
+			}
+			removed = append(removed, relPath)
+		}
+	}
+
+	return removed, nil
+}
+
+// Return the entries of the storage root that can hold image files: the ones produced by
+// the configured path template and, since files saved with a previous layout are never
+// moved, the ones produced by the default template.
+func (is *ImagesStore) storageDirs() ([]string, error) {
+	// The default template is always valid.
+	defaultLayout, _ := ParsePathTemplate(DefaultPathTemplate)
+
+	var (
+		dirs []string
+		seen = map[string]bool{}
+	)
+	for _, pattern := range []string{defaultLayout.rootGlob(), is.layout.rootGlob()} {
+		matches, err := filepath.Glob(filepath.Join(is.fsRoot, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				dirs = append(dirs, m)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// A file of the images storage without a related record in the database.
+type OrphanFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Find the files of the images storage which have no corresponding image in the database.
+// Orphans are left behind when a crash occurs between the file write and the DB insert.
+// Only files older than the grace period are reported, so images being uploaded right
+// now are not mistaken for orphans. Only the directories produced by the path templates
+// are inspected, see storageDirs.
+func (is *ImagesStore) FindOrphans(grace time.Duration) ([]OrphanFile, error) {
+	var (
+		candidates []OrphanFile
+		threshold  = time.Now().Add(-grace)
+	)
+
+	dirs, err := is.storageDirs()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || info.ModTime().After(threshold) {
+				return nil
+			}
+			relPath, err := filepath.Rel(is.fsRoot, path)
+			if err != nil {
+				return err
+			}
+			candidates = append(candidates, OrphanFile{
+				Path:    relPath,
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check the candidates against the database in batches.
+	const batchSize = 500
+	var orphans []OrphanFile
+	for start := 0; start < len(candidates); start += batchSize {
+		end := start + batchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		batch := candidates[start:end]
+		paths := make([]string, 0, len(batch))
+		for _, c := range batch {
+			paths = append(paths, c.Path)
+		}
+
+		existing, err := is.existingPaths(paths)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range batch {
+			if !existing[c.Path] {
+				orphans = append(orphans, c)
+			}
+		}
+	}
+
+	return orphans, nil
+}
+
+// Return the set of the provided relative paths which are referenced by an image.
+func (is *ImagesStore) existingPaths(paths []string) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var found []string
+	err := is.db.SelectContext(ctx, &found, `
+		SELECT filepath FROM images WHERE filepath = ANY($1)
+	`, pq.Array(paths))
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]bool, len(found))
+	for _, p := range found {
+		existing[p] = true
+	}
+	return existing, nil
+}
+
+// Remove a file of the images storage, specified by its path relative to the
+// storage root (as reported by FindOrphans).
+func (is *ImagesStore) RemoveFile(relPath string) error {
+	path, err := filepath.Abs(filepath.Join(is.fsRoot, relPath))
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Max length in bytes of a sanitized file name.
+const maxFileNameLen = 100
+
+// Sanitize a user provided string (e.g. an image title) so that it can be used safely as
+// a single component of a file path. Path separators and control characters are replaced
+// by underscores, leading dots are removed (so '.' and '..' cannot be produced) and the
+// result is truncated at a valid UTF-8 boundary. An empty string is returned if nothing
+// usable remains.
+func SanitizeFileName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '/', r == '\\', r == utf8.RuneError, unicode.IsControl(r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	sanitized := strings.TrimLeft(strings.TrimSpace(b.String()), ".")
+	for len(sanitized) > maxFileNameLen {
+		_, size := utf8.DecodeLastRuneInString(sanitized)
+		sanitized = sanitized[:len(sanitized)-size]
+	}
+	if strings.Trim(sanitized, "_ ") == "" {
+		return ""
+	}
+	return sanitized
+}
+
 // Generate a random string.
 func randString(length int) string {
 	runes := []rune("123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
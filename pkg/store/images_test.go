@@ -0,0 +1,366 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/anBertoli/snap-vault/pkg/filters"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+func imagesFilter(page, pageSize int, sort string) filters.Input {
+	return filters.Input{
+		Page:                 page,
+		PageSize:             pageSize,
+		SortCol:              sort,
+		SortSafeList:         []string{"id", "title", "size", "created_at"},
+		SearchCol:            "title",
+		SearchColumnSafeList: []string{"title"},
+	}
+}
+
+func insertImage(t *testing.T, s store.Store, gallery store.Gallery, title, content string) store.Image {
+	t.Helper()
+	image, err := s.Images.Insert(strings.NewReader(content), store.Image{
+		Title:       title,
+		ContentType: "image/png",
+		GalleryID:   gallery.ID,
+		UserID:      gallery.UserID,
+	})
+	if err != nil {
+		t.Fatalf("inserting image: %v", err)
+	}
+	return image
+}
+
+// An image can be inserted, retrieved with its bytes, updated and deleted
+// along with its file.
+func TestImagesCRUD(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "images-crud")
+	gallery, err := s.Galleries.Insert(store.Gallery{Title: "Images", UserID: user.ID, Published: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := insertImage(t, s, gallery, "sunset.png", "not really a png")
+	if image.ID == 0 || image.Size != 16 || image.Hash == "" || image.Position != 1 {
+		t.Fatalf("unexpected inserted image: %+v", image)
+	}
+
+	got, err := s.Images.Get(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "sunset.png" || got.UserID != user.ID || !got.Published || got.Path != image.Path {
+		t.Fatalf("unexpected image: %+v", got)
+	}
+	r, err := s.Images.GetReader(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "not really a png" {
+		t.Fatalf("unexpected content %q", content)
+	}
+
+	caption := "A sunset"
+	got.Caption = &caption
+	updated, err := s.Images.Update(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Version != got.Version+1 {
+		t.Fatalf("expected version %d, got %d", got.Version+1, updated.Version)
+	}
+	_, err = s.Images.Update(got)
+	if !errors.Is(err, store.ErrEditConflict) {
+		t.Fatalf("expected ErrEditConflict updating a stale version, got %v", err)
+	}
+
+	err = s.Images.Delete(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Images.Get(image.ID)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound, got %v", err)
+	}
+	_, err = s.Images.GetReader(image.ID)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound reading a deleted image, got %v", err)
+	}
+	err = s.Images.Delete(image.ID)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound deleting twice, got %v", err)
+	}
+	_, err = s.Images.DeleteRecord(image.ID)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound deleting the record twice, got %v", err)
+	}
+}
+
+// The record of an image can be deleted in a transaction, while the file is
+// removed only afterwards.
+func TestImagesDeleteRecord(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "images-delete-record")
+	gallery, err := s.Galleries.Insert(store.Gallery{Title: "Images", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := insertImage(t, s, gallery, "delete.png", "content")
+
+	var deleted store.Image
+	err = s.WithTx(func(tx store.Store) error {
+		var err error
+		deleted, err = tx.Images.DeleteRecord(image.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.ID != image.ID || deleted.Path != image.Path {
+		t.Fatalf("unexpected deleted image: %+v", deleted)
+	}
+	_, err = s.Images.Get(image.ID)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound, got %v", err)
+	}
+	// The file is still there until it's deleted explicitly.
+	orphans, err := s.Images.FindOrphans(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 1 || orphans[0].Path != image.Path {
+		t.Fatalf("expected the file of the deleted image, got %v", orphans)
+	}
+	err = s.Images.DeleteFile(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphans, err = s.Images.FindOrphans(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Fatalf("expected no files left, got %v", orphans)
+	}
+}
+
+// The listings of the images of a gallery and of a user are paginated and sorted,
+// and the count of a user includes the images of all its galleries.
+func TestImagesListing(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "images-list")
+	first, err := s.Galleries.Insert(store.Gallery{Title: "First", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Galleries.Insert(store.Gallery{Title: "Second", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		image := insertImage(t, s, first, fmt.Sprintf("image-%d.png", i), strings.Repeat("x", i+1))
+		ids = append(ids, image.ID)
+	}
+	insertImage(t, s, second, "other.png", "other")
+
+	var listed []int64
+	for page := 1; page <= 3; page++ {
+		images, meta, err := s.Images.GetAllForGallery(first.ID, imagesFilter(page, 2, "id"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.TotalRecords != 5 || meta.LastPage != 3 {
+			t.Fatalf("unexpected metadata of page %d: %+v", page, meta)
+		}
+		for _, i := range images {
+			listed = append(listed, i.ID)
+		}
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(ids) {
+		t.Fatalf("expected images %v, got %v", ids, listed)
+	}
+
+	images, _, err := s.Images.GetAllForGallery(first.ID, imagesFilter(1, 10, "-size"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 5 || images[0].ID != ids[4] {
+		t.Fatalf("expected images sorted by descending size, got %v", images)
+	}
+
+	images, meta, err := s.Images.GetAllForUser(user.ID, imagesFilter(1, 10, "id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 6 || meta.TotalRecords != 6 {
+		t.Fatalf("expected 6 images of the user, got %d", len(images))
+	}
+
+	count, bytes, err := s.Images.CountForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 6 || bytes != 1+2+3+4+5+5 {
+		t.Fatalf("unexpected count %d and bytes %d", count, bytes)
+	}
+	count, err = s.Images.CountForGallery(second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 image in the second gallery, got %d", count)
+	}
+}
+
+// Titles are turned into a single path component, without separators or
+// control characters and without leading dots.
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "sunset.png", want: "sunset.png"},
+		{name: "  sunset.png ", want: "sunset.png"},
+		{name: "../../etc/passwd", want: "_.._etc_passwd"},
+		{name: "/etc/passwd", want: "_etc_passwd"},
+		{name: `..\..\win.ini`, want: "_.._win.ini"},
+		{name: "evil.sh\x00.png", want: "evil.sh_.png"},
+		{name: "tab\tand\nnewline", want: "tab_and_newline"},
+		{name: ".hidden", want: "hidden"},
+		{name: strings.Repeat("é", 60), want: strings.Repeat("é", 50)},
+		{name: ".."},
+		{name: "/"},
+		{name: "\x00\x01"},
+		{name: " "},
+		{name: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := store.SanitizeFileName(tt.name)
+			if got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// Malicious titles are kept in the db, while the file is saved in the directory of
+// the gallery. Titles without usable characters are rejected.
+func TestImagesMaliciousTitle(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "images-title")
+	gallery, err := s.Galleries.Insert(store.Gallery{Title: "Titles", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := insertImage(t, s, gallery, "../../etc/passwd", "content")
+	if image.Title != "../../etc/passwd" {
+		t.Fatalf("expected the title to be unchanged, got %q", image.Title)
+	}
+	if strings.Contains(image.Path, "/etc/") || strings.Contains(image.Path, "../") {
+		t.Fatalf("unexpected path %q", image.Path)
+	}
+	r, err := s.Images.GetReader(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = r.Close()
+
+	_, err = s.Images.Insert(strings.NewReader("content"), store.Image{
+		Title:       "/\x00/",
+		ContentType: "image/png",
+		GalleryID:   gallery.ID,
+		UserID:      user.ID,
+	})
+	if !errors.Is(err, store.ErrInvalidFileName) {
+		t.Fatalf("expected ErrInvalidFileName, got %v", err)
+	}
+}
+
+// Images with the same value of the sort column are ordered by ID, in both
+// directions, so no image is repeated or skipped across the pages.
+func TestImagesListingTies(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "images-ties")
+	gallery, err := s.Galleries.Insert(store.Gallery{Title: "Ties", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		ids = append(ids, insertImage(t, s, gallery, "same.png", "same content").ID)
+	}
+
+	for _, sort := range []string{"size", "-size", "title", "-title"} {
+		var listed []int64
+		for page := 1; page <= 3; page++ {
+			images, _, err := s.Images.GetAllForGallery(gallery.ID, imagesFilter(page, 2, sort))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, image := range images {
+				listed = append(listed, image.ID)
+			}
+		}
+		if fmt.Sprint(listed) != fmt.Sprint(ids) {
+			t.Fatalf("sorting by %s: expected images %v, got %v", sort, ids, listed)
+		}
+	}
+}
+
+// Return the regular files under the root directory, temporary ones included.
+func storedFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// An upload failing partway leaves neither the partial file nor the record of the image,
+// and the error of the reader is returned.
+func TestImagesInsertInterrupted(t *testing.T) {
+	s, m := storetest.NewMock(t)
+
+	r := io.MultiReader(strings.NewReader(strings.Repeat("x", 64*1024)), iotest.ErrReader(io.ErrUnexpectedEOF))
+	_, err := s.Images.Insert(r, store.Image{Title: "partial.png", ContentType: "image/png", GalleryID: 1, UserID: 1})
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected the error of the reader, got %v", err)
+	}
+	if files := storedFiles(t, m.Root); len(files) != 0 {
+		t.Fatalf("expected no files left, got %q", files)
+	}
+	if len(m.Queries) != 0 {
+		t.Fatalf("expected no queries, got %q", m.Queries)
+	}
+}
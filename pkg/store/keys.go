@@ -7,9 +7,10 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"time"
 
-	"github.com/jmoiron/sqlx"
+	"github.com/anBertoli/snap-vault/pkg/filters"
 )
 
 type Keys struct {
@@ -23,7 +24,7 @@ type Keys struct {
 // The store abstraction used to manipulate user auth keys into the database. It holds a
 // DB connection pool. Only the hashed version of the keys are saved into the db.
 type KeysStore struct {
-	DB *sqlx.DB
+	DB Executor
 }
 
 // Creates a new auth key and saves the hash into the database. The plain text version
@@ -94,6 +95,43 @@ func (ks *KeysStore) GetAllForUser(userID int64) ([]Keys, error) {
 	return keys, err
 }
 
+// Obtain a paginated list of the auth keys of the specified user. The method also returns
+// pagination metadata. Searching is not supported.
+func (ks *KeysStore) GetPageForUser(userID int64, filter filters.Input) ([]Keys, filters.Meta, error) {
+	var (
+		keys     = []Keys{}
+		metadata = filter.CalculateMetadata(0)
+		// Use a temporary variable to scan also the count.
+		tmp []struct {
+			Count int64 `db:"count"`
+			Keys
+		}
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := ks.DB.SelectContext(ctx, &tmp, fmt.Sprintf(`
+		SELECT count(*) OVER(), id, auth_key_hash, created_at, user_id
+		FROM auth_keys WHERE user_id = $1
+		ORDER BY %s %s, id ASC
+		LIMIT $2 OFFSET $3`,
+		filter.SortColumn(), filter.SortDirection(),
+	), userID, filter.Limit(), filter.Offset())
+	if err != nil {
+		return nil, metadata, err
+	}
+
+	for _, k := range tmp {
+		keys = append(keys, k.Keys)
+	}
+	if len(tmp) > 0 {
+		metadata = filter.CalculateMetadata(tmp[0].Count)
+	}
+
+	return keys, metadata, nil
+}
+
 // Insert a new auth key into the database. Only the hashed version is saved.
 func (ks *KeysStore) Insert(keys Keys) (Keys, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -0,0 +1,102 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/anBertoli/snap-vault/pkg/filters"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+// Keys are retrieved by their plain text version, which is never stored, and
+// can only be deleted by their owner.
+func TestKeys(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "keys")
+	other := storetest.NewUser(t, s, "keys-other")
+
+	keys, err := s.Keys.New(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.ID == 0 || keys.AuthKey == "" || keys.AuthKeyHash == keys.AuthKey {
+		t.Fatalf("unexpected new keys: %+v", keys)
+	}
+
+	got, err := s.Keys.GetForPlainKey(keys.AuthKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != keys.ID || got.UserID != user.ID || got.AuthKey != "" {
+		t.Fatalf("unexpected keys: %+v", got)
+	}
+	_, err = s.Keys.GetForPlainKey(keys.AuthKeyHash)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound using the hash as key, got %v", err)
+	}
+
+	err = s.Keys.DeleteKey(keys.ID, other.ID)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound deleting the key of another user, got %v", err)
+	}
+	err = s.Keys.DeleteKey(keys.ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Keys.GetForPlainKey(keys.AuthKey)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound, got %v", err)
+	}
+}
+
+// The keys of a user are listed in pages.
+func TestKeysListing(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "keys-list")
+	other := storetest.NewUser(t, s, "keys-list-other")
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		keys, err := s.Keys.New(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, keys.ID)
+	}
+	_, err := s.Keys.New(other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := s.Keys.GetAllForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(all))
+	}
+
+	var listed []int64
+	for page := 1; page <= 2; page++ {
+		keys, meta, err := s.Keys.GetPageForUser(user.ID, filters.Input{
+			Page:         page,
+			PageSize:     2,
+			SortCol:      "id",
+			SortSafeList: []string{"id", "created_at"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.TotalRecords != 3 || meta.LastPage != 2 {
+			t.Fatalf("unexpected metadata of page %d: %+v", page, meta)
+		}
+		for _, k := range keys {
+			listed = append(listed, k.ID)
+		}
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(ids) {
+		t.Fatalf("expected keys %v, got %v", ids, listed)
+	}
+}
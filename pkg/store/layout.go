@@ -0,0 +1,113 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default layout of the image files in the storage: a directory per gallery, holding
+// files named after the (sanitized) image title followed by a random suffix.
+const DefaultPathTemplate = "gallery_{gallery_id}/{name}_{rand}"
+
+var ErrInvalidPathTemplate = errors.New("invalid path template")
+
+// Placeholders supported in path templates. The date is the one of the upload (UTC),
+// the name is the sanitized image title and rand is a random string.
+var pathPlaceholders = []string{"{gallery_id}", "{user_id}", "{year}", "{month}", "{day}", "{name}", "{rand}"}
+
+// The PathTemplate describes where new image files are saved, relative to the storage
+// root, as a slash separated path with placeholders (e.g. "{year}/{month}/{name}_{rand}").
+// The template is evaluated when an image file is written, then the resulting path is
+// saved in the database, so the files are always read from the path they were saved to,
+// whatever the layout is.
+type PathTemplate struct {
+	dir  string
+	file string
+}
+
+// The values the placeholders of a path template are replaced with.
+type pathVars struct {
+	galleryID int64
+	userID    int64
+	name      string
+	date      time.Time
+}
+
+// Parse and validate a path template. The template must be relative, without empty, '.'
+// and '..' segments, and it can contain only the supported placeholders. The {rand}
+// placeholder is required in the file name (the last segment), to make it unique, and
+// it is not allowed in the directories. An error wrapping ErrInvalidPathTemplate is
+// returned if the template is not valid.
+func ParsePathTemplate(tmpl string) (PathTemplate, error) {
+	if tmpl == "" {
+		return PathTemplate{}, fmt.Errorf("%w: must be provided", ErrInvalidPathTemplate)
+	}
+
+	segments := strings.Split(tmpl, "/")
+	for i, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return PathTemplate{}, fmt.Errorf("%w: empty, '.' or '..' segment in '%s'", ErrInvalidPathTemplate, tmpl)
+		}
+		if i < len(segments)-1 && strings.Contains(segment, "{rand}") {
+			return PathTemplate{}, fmt.Errorf("%w: {rand} is allowed only in the file name", ErrInvalidPathTemplate)
+		}
+		// What remains once the known placeholders are removed must be plain text:
+		// braces are left by unknown placeholders, while glob metacharacters are
+		// excluded since the templates are also used to find the storage directories.
+		rest := segment
+		for _, p := range pathPlaceholders {
+			rest = strings.ReplaceAll(rest, p, "")
+		}
+		if strings.ContainsAny(rest, `{}*?[]\`) {
+			return PathTemplate{}, fmt.Errorf("%w: unknown placeholder or invalid character in '%s'", ErrInvalidPathTemplate, segment)
+		}
+	}
+
+	file := segments[len(segments)-1]
+	if !strings.Contains(file, "{rand}") {
+		return PathTemplate{}, fmt.Errorf("%w: the file name must contain {rand}", ErrInvalidPathTemplate)
+	}
+	return PathTemplate{
+		dir:  strings.Join(segments[:len(segments)-1], "/"),
+		file: file,
+	}, nil
+}
+
+// Return the directory of new files, relative to the storage root.
+func (pt PathTemplate) dirPath(vars pathVars) string {
+	return filepath.FromSlash(pt.replacer(vars, "").Replace(pt.dir))
+}
+
+// Return the name of a new file, using the provided random string.
+func (pt PathTemplate) fileName(vars pathVars, rand string) string {
+	return pt.replacer(vars, rand).Replace(pt.file)
+}
+
+func (pt PathTemplate) replacer(vars pathVars, rand string) *strings.Replacer {
+	return strings.NewReplacer(
+		"{gallery_id}", strconv.FormatInt(vars.galleryID, 10),
+		"{user_id}", strconv.FormatInt(vars.userID, 10),
+		"{year}", vars.date.Format("2006"),
+		"{month}", vars.date.Format("01"),
+		"{day}", vars.date.Format("02"),
+		"{name}", vars.name,
+		"{rand}", rand,
+	)
+}
+
+// Return a glob pattern matching the entries of the storage root produced by the
+// template, that is, its first segment with the placeholders replaced by '*'.
+func (pt PathTemplate) rootGlob() string {
+	first := pt.file
+	if pt.dir != "" {
+		first = strings.SplitN(pt.dir, "/", 2)[0]
+	}
+	for _, p := range pathPlaceholders {
+		first = strings.ReplaceAll(first, p, "*")
+	}
+	return first
+}
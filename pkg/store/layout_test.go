@@ -0,0 +1,125 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+// Templates with unknown placeholders, traversal segments or without the random
+// part in the file name are rejected.
+func TestParsePathTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl  string
+		valid bool
+	}{
+		{tmpl: store.DefaultPathTemplate, valid: true},
+		{tmpl: "{year}/{month}/{day}/{name}_{rand}", valid: true},
+		{tmpl: "user_{user_id}/gallery_{gallery_id}/{rand}", valid: true},
+		{tmpl: "{rand}", valid: true},
+		{tmpl: ""},
+		{tmpl: "/{name}_{rand}"},
+		{tmpl: "{year}//{name}_{rand}"},
+		{tmpl: "../{name}_{rand}"},
+		{tmpl: "gallery_{gallery_id}/./{name}_{rand}"},
+		{tmpl: "gallery_{gallery_id}/{name}"},
+		{tmpl: "{rand}/{name}_{rand}"},
+		{tmpl: "{hour}/{name}_{rand}"},
+		{tmpl: "gallery_*/{name}_{rand}"},
+		{tmpl: `gallery\{gallery_id}/{name}_{rand}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			_, err := store.ParsePathTemplate(tt.tmpl)
+			if tt.valid && err != nil {
+				t.Fatalf("expected a valid template, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, store.ErrInvalidPathTemplate) {
+				t.Fatalf("expected ErrInvalidPathTemplate, got %v", err)
+			}
+		})
+	}
+}
+
+// New files are saved at the path produced by the configured template, while the
+// reads resolve the stored path, whatever the template of the store reading them.
+func TestImagesPathTemplates(t *testing.T) {
+	_, db := storetest.New(t)
+	root := t.TempDir()
+	reader, err := store.New(db, store.FsOptions{Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := storetest.NewUser(t, reader, "layout")
+	gallery, err := reader.Galleries.Insert(store.Gallery{UserID: user.ID, Title: "layout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	tests := []struct {
+		tmpl  string
+		shard bool
+		want  string
+	}{
+		{
+			tmpl: "{year}/{month}/{day}/{name}_{rand}",
+			want: fmt.Sprintf(`^%s/%s/%s/photo\.png_\w+$`, now.Format("2006"), now.Format("01"), now.Format("02")),
+		},
+		{
+			tmpl: "user_{user_id}/gallery_{gallery_id}/{rand}-{name}",
+			want: fmt.Sprintf(`^user_%d/gallery_%d/\w+-photo\.png$`, user.ID, gallery.ID),
+		},
+		{
+			tmpl:  "user_{user_id}/{name}_{rand}",
+			shard: true,
+			want:  fmt.Sprintf(`^user_%d/[0-9a-f]{2}/[0-9a-f]{2}/photo\.png_\w+$`, user.ID),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			writer, err := store.New(db, store.FsOptions{Root: root, PathTemplate: tt.tmpl, Shard: tt.shard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			content := "bytes of " + tt.tmpl
+			image, err := writer.Images.Insert(strings.NewReader(content), store.Image{
+				Title:       "photo.png",
+				ContentType: "image/png",
+				GalleryID:   gallery.ID,
+				UserID:      user.ID,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The date could change between the insert and the expected
+			// path, only in the (unlikely) case the test runs at midnight.
+			if !regexp.MustCompile(tt.want).MatchString(filepath.ToSlash(image.Path)) {
+				t.Fatalf("path %q doesn't match %q", image.Path, tt.want)
+			}
+
+			r, err := reader.Images.GetReader(image.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			read, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(read) != content {
+				t.Fatalf("expected %q, read %q", content, read)
+			}
+		})
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 )
 
@@ -15,7 +14,8 @@ import (
 // auth keys during as part of the normal API operations, but keep in mind that they are
 // 'constants' in our DB and are not directly editable from our application.
 const (
-	PermissionMain = "*:*" // non manipulable
+	PermissionMain  = "*:*"   // non manipulable
+	PermissionAdmin = "admin" // non manipulable, granted with the CLI
 
 	PermissionListKeys   = "keys:list"
 	PermissionCreateKeys = "keys:create"
@@ -36,22 +36,64 @@ const (
 	PermissionDownloadImage = "images:download"
 )
 
-// The list of permissions that could be linked or unlinked from auth keys.
-var EditablePermissions = Permissions{
-	PermissionListKeys,
-	PermissionCreateKeys,
-	PermissionUpdateKeys,
-	PermissionDeleteKeys,
-	PermissionListGalleries,
-	PermissionCreateGallery,
-	PermissionUpdateGallery,
-	PermissionDeleteGallery,
-	PermissionDownloadGallery,
-	PermissionListImages,
-	PermissionCreateImage,
-	PermissionUpdateImage,
-	PermissionDeleteImage,
-	PermissionDownloadImage,
+// Description of a permission, used to document the permissions to clients
+// (e.g. to build a permission picker).
+type PermissionInfo struct {
+	Code        string `json:"code"`
+	Resource    string `json:"resource"`
+	Action      string `json:"action"`
+	Description string `json:"description"`
+}
+
+// Permissions of the same resource.
+type PermissionGroup struct {
+	Resource    string           `json:"resource"`
+	Permissions []PermissionInfo `json:"permissions"`
+}
+
+// The catalog of the permissions that could be linked or unlinked from auth keys,
+// ordered by resource. A new editable permission must be added here.
+var PermissionsCatalog = []PermissionInfo{
+	{PermissionListKeys, "keys", "list", "List the auth keys and their permissions"},
+	{PermissionCreateKeys, "keys", "create", "Create new auth keys"},
+	{PermissionUpdateKeys, "keys", "update", "Edit the permissions of auth keys"},
+	{PermissionDeleteKeys, "keys", "delete", "Delete auth keys"},
+	{PermissionListGalleries, "galleries", "list", "List and read galleries"},
+	{PermissionCreateGallery, "galleries", "create", "Create new galleries"},
+	{PermissionUpdateGallery, "galleries", "update", "Edit galleries"},
+	{PermissionDeleteGallery, "galleries", "delete", "Delete galleries along with their images"},
+	{PermissionDownloadGallery, "galleries", "download", "Download galleries as archives"},
+	{PermissionListImages, "images", "list", "List and read images"},
+	{PermissionCreateImage, "images", "create", "Upload new images"},
+	{PermissionUpdateImage, "images", "update", "Edit and reorder images, replace their content"},
+	{PermissionDeleteImage, "images", "delete", "Delete images"},
+	{PermissionDownloadImage, "images", "download", "Download images and share them with signed URLs"},
+	{PermissionGetStats, "users", "stats", "Read the usage stats of the user"},
+}
+
+// The list of permissions that could be linked or unlinked from auth keys,
+// derived from the catalog so the two can't drift apart.
+var EditablePermissions = catalogCodes()
+
+func catalogCodes() Permissions {
+	codes := make(Permissions, 0, len(PermissionsCatalog))
+	for _, p := range PermissionsCatalog {
+		codes = append(codes, p.Code)
+	}
+	return codes
+}
+
+// Return the permissions of the catalog grouped by resource, in the catalog order.
+func PermissionGroups() []PermissionGroup {
+	var groups []PermissionGroup
+	for _, p := range PermissionsCatalog {
+		if len(groups) == 0 || groups[len(groups)-1].Resource != p.Resource {
+			groups = append(groups, PermissionGroup{Resource: p.Resource})
+		}
+		last := &groups[len(groups)-1]
+		last.Permissions = append(last.Permissions, p)
+	}
+	return groups
 }
 
 // Define a type to easily manipulate permissions.
@@ -81,10 +123,53 @@ func (p Permissions) Invalids() Permissions {
 	return invalids
 }
 
+// Compare the permissions with a target set. Missing permissions are the ones
+// included in the target but not in p, extra permissions are the ones included
+// in p but not in the target. The order of the sets doesn't matter.
+func (p Permissions) Diff(target Permissions) (missing, extra Permissions) {
+	return target.Subtract(p), p.Subtract(target)
+}
+
+// Return the permissions of p not included in other. The result keeps the order
+// of p and contains no duplicates.
+func (p Permissions) Subtract(other Permissions) Permissions {
+	var res Permissions
+	for i := range p {
+		if !other.Include(p[i]) && !res.Include(p[i]) {
+			res = append(res, p[i])
+		}
+	}
+	return res
+}
+
+// Return the permissions included in both p and other, without duplicates.
+func (p Permissions) Intersect(other Permissions) Permissions {
+	var res Permissions
+	for i := range p {
+		if other.Include(p[i]) && !res.Include(p[i]) {
+			res = append(res, p[i])
+		}
+	}
+	return res
+}
+
+// Return the permissions included in p or in other, without duplicates.
+func (p Permissions) Union(other Permissions) Permissions {
+	var res Permissions
+	for _, perms := range []Permissions{p, other} {
+		for i := range perms {
+			if !res.Include(perms[i]) {
+				res = append(res, perms[i])
+			}
+		}
+	}
+	return res
+}
+
 // The store abstraction used to manipulate permissions into the database. It holds a
 // DB connection pool.
 type PermissionsStore struct {
-	DB *sqlx.DB
+	DB Executor
 }
 
 // Retrieve all permissions associated with a specified key. The provided key could be hashed
@@ -119,6 +204,61 @@ func (ps *PermissionsStore) GetAllForKey(key string, isKeyHashed bool) (Permissi
 	return permissions, nil
 }
 
+// Retrieve the permissions of several auth keys with a single query. The permissions are
+// grouped by auth key ID, keys without permissions are not present in the result.
+func (ps *PermissionsStore) GetAllForKeys(keyIDs []int64) (map[int64]Permissions, error) {
+	var rows []struct {
+		AuthKeyID int64  `db:"auth_key_id"`
+		Code      string `db:"code"`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := ps.DB.SelectContext(ctx, &rows, `
+		SELECT auth_keys_permissions.auth_key_id, permissions.code FROM permissions
+		INNER JOIN auth_keys_permissions ON auth_keys_permissions.permission_id = permissions.id 
+		WHERE auth_keys_permissions.auth_key_id = ANY($1)
+		ORDER BY auth_keys_permissions.auth_key_id, permissions.id
+	`, pq.Array(keyIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := make(map[int64]Permissions, len(keyIDs))
+	for _, row := range rows {
+		permissions[row.AuthKeyID] = append(permissions[row.AuthKeyID], row.Code)
+	}
+
+	return permissions, nil
+}
+
+// Link the provided permissions to an auth key, keeping the permissions already linked.
+func (ps *PermissionsStore) GrantForKey(keyID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := ps.DB.ExecContext(ctx, `
+		INSERT INTO auth_keys_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
+	`, keyID, pq.Array(codes))
+	return err
+}
+
+// Unlink the provided permissions from an auth key, other permissions are kept.
+func (ps *PermissionsStore) RevokeForKey(keyID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := ps.DB.ExecContext(ctx, `
+		DELETE FROM auth_keys_permissions USING permissions
+		WHERE auth_keys_permissions.permission_id = permissions.id
+		AND auth_keys_permissions.auth_key_id = $1 AND permissions.code = ANY($2)
+	`, keyID, pq.Array(codes))
+	return err
+}
+
 // Replace associated permissions of an auth key with the provided permissions. The
 // old permissions are deleted while the new permissions are inserted in a single
 // transaction.
@@ -128,7 +268,7 @@ func (ps *PermissionsStore) ReplaceForKey(keyID int64, codes ...string) error {
 	defer cancel()
 
 	// Begin the transaction.
-	tx, err := ps.DB.BeginTxx(ctx, nil)
+	tx, err := beginTx(ctx, ps.DB)
 	if err != nil {
 		return err
 	}
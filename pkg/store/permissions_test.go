@@ -0,0 +1,159 @@
+package store_test
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+)
+
+// The set operations on permissions ignore the duplicates and keep the order of p.
+func TestPermissionsSetOperations(t *testing.T) {
+	const (
+		a = store.PermissionListImages
+		b = store.PermissionCreateImage
+		c = store.PermissionDeleteImage
+		d = store.PermissionListKeys
+	)
+
+	tests := []struct {
+		name      string
+		p         store.Permissions
+		other     store.Permissions
+		subtract  store.Permissions
+		intersect store.Permissions
+		union     store.Permissions
+		missing   store.Permissions
+	}{
+		{
+			name: "both empty",
+		},
+		{
+			name:     "empty other",
+			p:        store.Permissions{a, b},
+			subtract: store.Permissions{a, b},
+			union:    store.Permissions{a, b},
+		},
+		{
+			name:    "empty p",
+			other:   store.Permissions{a, b},
+			union:   store.Permissions{a, b},
+			missing: store.Permissions{a, b},
+		},
+		{
+			name:      "equal",
+			p:         store.Permissions{a, b},
+			other:     store.Permissions{b, a},
+			intersect: store.Permissions{a, b},
+			union:     store.Permissions{a, b},
+		},
+		{
+			name:     "disjoint",
+			p:        store.Permissions{a, b},
+			other:    store.Permissions{c, d},
+			subtract: store.Permissions{a, b},
+			union:    store.Permissions{a, b, c, d},
+			missing:  store.Permissions{c, d},
+		},
+		{
+			name:      "overlapping",
+			p:         store.Permissions{a, b, c},
+			other:     store.Permissions{c, d, a},
+			subtract:  store.Permissions{b},
+			intersect: store.Permissions{a, c},
+			union:     store.Permissions{a, b, c, d},
+			missing:   store.Permissions{d},
+		},
+		{
+			name:      "duplicates",
+			p:         store.Permissions{a, b, a, b},
+			other:     store.Permissions{b, c, c},
+			subtract:  store.Permissions{a},
+			intersect: store.Permissions{b},
+			union:     store.Permissions{a, b, c},
+			missing:   store.Permissions{c},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.Subtract(tt.other); !reflect.DeepEqual(got, tt.subtract) {
+				t.Errorf("Subtract: expected %v, got %v", tt.subtract, got)
+			}
+			if got := tt.p.Intersect(tt.other); !reflect.DeepEqual(got, tt.intersect) {
+				t.Errorf("Intersect: expected %v, got %v", tt.intersect, got)
+			}
+			if got := tt.p.Union(tt.other); !reflect.DeepEqual(got, tt.union) {
+				t.Errorf("Union: expected %v, got %v", tt.union, got)
+			}
+
+			// The missing permissions are the ones of the target not in p, the
+			// extra ones are the permissions of p not in the target.
+			missing, extra := tt.p.Diff(tt.other)
+			if !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("Diff: expected missing %v, got %v", tt.missing, missing)
+			}
+			if !reflect.DeepEqual(extra, tt.subtract) {
+				t.Errorf("Diff: expected extra %v, got %v", tt.subtract, extra)
+			}
+		})
+	}
+}
+
+// Every permission constant, apart from the non manipulable ones, must be in the
+// catalog, with the resource and the action of its code. The constants are read
+// from the source, so a new permission not added to the catalog is reported.
+func TestPermissionsCatalog(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "permissions.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	constants := map[string]string{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.ValueSpec)
+		if !ok {
+			return true
+		}
+		for i, name := range spec.Names {
+			if i >= len(spec.Values) || !strings.HasPrefix(name.Name, "Permission") {
+				continue
+			}
+			lit, ok := spec.Values[i].(*ast.BasicLit)
+			if !ok {
+				continue
+			}
+			code, err := strconv.Unquote(lit.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			constants[name.Name] = code
+		}
+		return false
+	})
+	if len(constants) == 0 {
+		t.Fatal("no permission constants found")
+	}
+
+	catalog := map[string]bool{}
+	for _, p := range store.PermissionsCatalog {
+		if catalog[p.Code] {
+			t.Errorf("permission %s is in the catalog twice", p.Code)
+		}
+		catalog[p.Code] = true
+		if p.Resource+":"+p.Action != p.Code || p.Description == "" {
+			t.Errorf("permission %s is not described properly: %+v", p.Code, p)
+		}
+	}
+
+	for name, code := range constants {
+		nonManipulable := code == store.PermissionMain || code == store.PermissionAdmin
+		if nonManipulable == catalog[code] {
+			t.Errorf("permission %s (%s): expected in the catalog %v", name, code, !nonManipulable)
+		}
+	}
+}
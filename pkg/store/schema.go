@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Version of the database schema the store is written against, that is the
+// version of the last migration in the migrations folder. It must be bumped
+// when a migration is added.
+const SchemaVersion = 14
+
+var ErrSchemaMismatch = errors.New("database schema version mismatch")
+
+// Check that the migrations applied to the database (as recorded by golang-migrate in
+// the schema_migrations table) match the SchemaVersion expected by the store. An error
+// wrapping ErrSchemaMismatch is returned if the schema is out-of-date, newer than the
+// expected one or left dirty by a failed migration.
+func CheckSchema(db *sqlx.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	version, dirty, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	switch {
+	case dirty:
+		return fmt.Errorf("%w: version %d is dirty, a migration failed", ErrSchemaMismatch, version)
+	case version < SchemaVersion:
+		return fmt.Errorf("%w: version %d is out-of-date, expected %d", ErrSchemaMismatch, version, SchemaVersion)
+	case version > SchemaVersion:
+		return fmt.Errorf("%w: version %d is newer than the expected %d", ErrSchemaMismatch, version, SchemaVersion)
+	}
+	return nil
+}
+
+// Read the current schema version, zero if no migration was ever applied.
+func schemaVersion(ctx context.Context, db *sqlx.DB) (int64, bool, error) {
+	var exists bool
+	err := db.GetContext(ctx, &exists, `SELECT to_regclass('schema_migrations') IS NOT NULL`)
+	if err != nil {
+		return 0, false, err
+	}
+	if !exists {
+		return 0, false, nil
+	}
+
+	var row struct {
+		Version int64 `db:"version"`
+		Dirty   bool  `db:"dirty"`
+	}
+	err = db.GetContext(ctx, &row, `SELECT version, dirty FROM schema_migrations LIMIT 1`)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return 0, false, nil
+	case err != nil:
+		return 0, false, err
+	}
+	return row.Version, row.Dirty, nil
+}
@@ -0,0 +1,115 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/anBertoli/snap-vault/migrations"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+// The SchemaVersion must be bumped along with the migrations: it must be the
+// version of the last embedded migration, and each migration must be reversible.
+func TestSchemaVersionMatchesMigrations(t *testing.T) {
+	src, err := migrations.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	version, err := src.First()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		r, _, err := src.ReadDown(version)
+		if err != nil {
+			t.Fatalf("migration %d has no down migration: %v", version, err)
+		}
+		_ = r.Close()
+
+		next, err := src.Next(version)
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		version = next
+	}
+	if version != store.SchemaVersion {
+		t.Fatalf("the last migration is %d, while SchemaVersion is %d", version, store.SchemaVersion)
+	}
+}
+
+// A migrated database matches the expected schema.
+func TestCheckSchema(t *testing.T) {
+	_, db := storetest.New(t)
+	err := store.CheckSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Databases not migrated, out-of-date, newer or left dirty are reported. Each case
+// uses its own schema, with the migrations table filled by hand.
+func TestCheckSchemaMismatch(t *testing.T) {
+	dsn := storetest.DSN(t)
+
+	tests := []struct {
+		name    string
+		version int64
+		dirty   bool
+		noTable bool
+	}{
+		{name: "not migrated", noTable: true},
+		{name: "no version"},
+		{name: "out-of-date", version: store.SchemaVersion - 1},
+		{name: "newer", version: store.SchemaVersion + 1},
+		{name: "dirty", version: store.SchemaVersion, dirty: true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A single connection, so the search path set below applies to all the queries.
+			db, err := sqlx.Connect("postgres", dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.SetMaxOpenConns(1)
+			schema := fmt.Sprintf("schema_check_%d_%d", time.Now().UnixNano(), i)
+			t.Cleanup(func() {
+				_, _ = db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+				_ = db.Close()
+			})
+			_, err = db.Exec(`CREATE SCHEMA ` + schema + `; SET search_path TO ` + schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.noTable {
+				_, err = db.Exec(`CREATE TABLE schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.version > 0 {
+				_, err = db.Exec(`INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)`, tt.version, tt.dirty)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = store.CheckSchema(db)
+			if !errors.Is(err, store.ErrSchemaMismatch) {
+				t.Fatalf("expected ErrSchemaMismatch, got %v", err)
+			}
+		})
+	}
+}
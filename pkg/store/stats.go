@@ -5,23 +5,22 @@ import (
 	"database/sql"
 	"errors"
 	"time"
-
-	"github.com/jmoiron/sqlx"
 )
 
 type Stats struct {
-	Galleries int       `db:"n_galleries" json:"n_galleries"`
-	Images    int       `db:"n_images" json:"n_images"`
-	Space     int64     `db:"n_bytes" json:"n_bytes"`
-	UserID    int64     `db:"user_id" json:"user_id"`
-	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
-	Version   int       `db:"version" json:"-"`
+	Galleries    int        `db:"n_galleries" json:"n_galleries"`
+	Images       int        `db:"n_images" json:"n_images"`
+	Space        int64      `db:"n_bytes" json:"n_bytes"`
+	UserID       int64      `db:"user_id" json:"user_id"`
+	UpdatedAt    time.Time  `db:"updated_at" json:"updated_at"`
+	LastActiveAt *time.Time `db:"last_active_at" json:"last_active_at"`
+	Version      int        `db:"version" json:"-"`
 }
 
 // The store abstraction used o manipulate user statistics into the database. It holds a
 // DB connection pool.
 type StatsStore struct {
-	DB *sqlx.DB
+	DB Executor
 }
 
 // Retrieve statistics about a specific user.
@@ -43,7 +42,51 @@ func (ss *StatsStore) GetForUser(userID int64) (Stats, error) {
 	return stats, nil
 }
 
-// Initialize a statistics row into the database for a specific user.
+// Retrieve the statistics of all users.
+func (ss *StatsStore) GetAll() ([]Stats, error) {
+	var stats []Stats
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := ss.DB.SelectContext(ctx, &stats, `SELECT * FROM stats ORDER BY user_id`)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// Overwrite the counters of the statistics row of a specific user. The write is performed
+// only if the row wasn't modified in the meantime (optimistic locking on the version
+// column), in that case an ErrRecordNotFound error is returned.
+func (ss *StatsStore) Update(stats Stats) (Stats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := ss.DB.GetContext(ctx, &stats, `
+		UPDATE stats
+		SET n_galleries = $1, n_images = $2, n_bytes = $3, updated_at = $4, version = version + 1 WHERE user_id = $5 AND version = $6
+		RETURNING version, updated_at
+	`, stats.Galleries, stats.Images, stats.Space, time.Now().UTC(), stats.UserID, stats.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return Stats{}, ErrRecordNotFound
+		default:
+			return Stats{}, err
+		}
+	}
+
+	return stats, nil
+}
+
+// Initialize a statistics row into the database for a specific user. The operation is
+// idempotent, if the row already exists it is left untouched.
 func (ss *StatsStore) InitStatsForUser(userID int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -51,54 +94,41 @@ func (ss *StatsStore) InitStatsForUser(userID int64) error {
 	_, err := ss.DB.ExecContext(ctx, `
 		INSERT INTO stats (n_galleries, n_images, n_bytes, user_id, updated_at)
 		VALUES (0, 0, 0, $1, $2)
+		ON CONFLICT (user_id) DO NOTHING
 	`, userID, time.Now().UTC())
 
 	return err
 }
 
-// Increment or decrement the images counter statistic for a specific user.
-func (ss *StatsStore) IncrementImages(userID int64, n int) error {
-	stats, err := ss.GetForUser(userID)
-	if err != nil {
-		return err
-	}
-
+// Set the last activity timestamp of a specific user to now, but only if the previous
+// one is older than the provided interval. This keeps the write amplification low when
+// called on every authenticated request. The version column is not bumped since the
+// last activity is not a counter and it mustn't conflict with concurrent increments.
+func (ss *StatsStore) TouchLastActive(userID int64, interval time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	res, err := ss.DB.ExecContext(ctx, ` 
-		UPDATE stats
-		SET n_images = n_images + $1, updated_at = $2, version = version + 1 WHERE user_id = $3 AND version = $4
-	`, n, time.Now().UTC(), userID, stats.Version)
-	if err != nil {
-		return err
-	}
-
-	rn, err := res.RowsAffected()
-	if err != nil {
-		return err
-	}
-	if rn == 0 {
-		return ErrRecordNotFound
-	}
+	now := time.Now().UTC()
+	_, err := ss.DB.ExecContext(ctx, `
+		UPDATE stats SET last_active_at = $1
+		WHERE user_id = $2 AND (last_active_at IS NULL OR last_active_at <= $3)
+	`, now, userID, now.Add(-interval))
 
-	return nil
+	return err
 }
 
-// Increment or decrement the space-used statistic (in bytes) for a specific user.
-func (ss *StatsStore) IncrementBytes(userID, n int64) error {
-	stats, err := ss.GetForUser(userID)
-	if err != nil {
-		return err
-	}
-
+// Increment or decrement both the images counter and the space-used statistic (in bytes)
+// for a specific user. The two counters are updated by a single statement, so they can't
+// be partially applied.
+func (ss *StatsStore) IncrementImagesAndBytes(userID int64, images int, bytes int64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	res, err := ss.DB.ExecContext(ctx, ` 
+	res, err := ss.DB.ExecContext(ctx, `
 		UPDATE stats
-		SET n_bytes = n_bytes + $1, updated_at = $2, version = version + 1 WHERE user_id = $3 AND version = $4
-	`, n, time.Now().UTC(), userID, stats.Version)
+		SET n_images = n_images + $1, n_bytes = n_bytes + $2, updated_at = $3, version = version + 1
+		WHERE user_id = $4
+	`, images, bytes, time.Now().UTC(), userID)
 	if err != nil {
 		return err
 	}
@@ -116,18 +146,15 @@ func (ss *StatsStore) IncrementBytes(userID, n int64) error {
 
 // Increment or decrement the galleries counter statistic for a specific user.
 func (ss *StatsStore) IncrementGalleries(userID int64, n int) error {
-	stats, err := ss.GetForUser(userID)
-	if err != nil {
-		return err
-	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	res, err := ss.DB.ExecContext(ctx, ` 
+	// The counter is updated atomically by the database, so concurrent increments
+	// don't conflict. The version is still bumped to invalidate stale full updates.
+	res, err := ss.DB.ExecContext(ctx, `
 		UPDATE stats
-		SET n_galleries = n_galleries + $1, updated_at = $2, version = version + 1 WHERE user_id = $3 AND version = $4
-	`, n, time.Now().UTC(), userID, stats.Version)
+		SET n_galleries = n_galleries + $1, updated_at = $2, version = version + 1 WHERE user_id = $3
+	`, n, time.Now().UTC(), userID)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,81 @@
+package store_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+// The counters are incremented atomically, while full updates of a stale
+// version of the stats are rejected.
+func TestStats(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "stats")
+
+	// Initializing the stats again leaves them untouched.
+	err := s.Stats.IncrementGalleries(user.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Stats.InitStatsForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Stats.IncrementImagesAndBytes(user.ID, 3, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Stats.IncrementImagesAndBytes(user.ID, -1, -100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := s.Stats.GetForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Galleries != 2 || stats.Images != 2 || stats.Space != 200 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	stats.Galleries = 10
+	updated, err := s.Stats.Update(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Version != stats.Version+1 {
+		t.Fatalf("expected version %d, got %d", stats.Version+1, updated.Version)
+	}
+	_, err = s.Stats.Update(stats)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound updating a stale version, got %v", err)
+	}
+}
+
+// The stats of a user without the stats row are not found.
+func TestStatsNotFound(t *testing.T) {
+	s, _ := storetest.New(t)
+	user, err := s.Users.Insert(store.User{
+		Name:         "Test User",
+		Email:        storetest.Email("stats-missing"),
+		PasswordHash: "not-a-real-hash",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Stats.GetForUser(user.ID)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound, got %v", err)
+	}
+	err = s.Stats.IncrementGalleries(user.ID, 1)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound incrementing the galleries, got %v", err)
+	}
+	err = s.Stats.IncrementImagesAndBytes(user.ID, 1, 1)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound incrementing the images, got %v", err)
+	}
+}
@@ -1,14 +1,23 @@
 package store
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+
+	"github.com/anBertoli/snap-vault/pkg/filters"
 )
 
 // The Store struct is a wrapper around the different types of storages
 // present in this package.
 type Store struct {
+	// The connection pool used to begin transactions, nil
+	// if the store is already bound to a transaction.
+	db *sqlx.DB
+
 	Users       UsersStore
 	Keys        KeysStore
 	Permissions PermissionsStore
@@ -16,15 +25,18 @@ type Store struct {
 	Galleries   GalleriesStore
 	Images      ImagesStore
 	Stats       StatsStore
+	Audit       AuditStore
+	Idempotency IdempotencyStore
 }
 
 // Create a new Store struct.
-func New(db *sqlx.DB, storeRoot string) (Store, error) {
-	imagesStore, err := NewImagesStore(db, storeRoot)
+func New(db *sqlx.DB, fsOpts FsOptions) (Store, error) {
+	imagesStore, err := NewImagesStore(db, fsOpts)
 	if err != nil {
 		return Store{}, err
 	}
 	return Store{
+		db:          db,
 		Users:       UsersStore{db},
 		Keys:        KeysStore{db},
 		Permissions: PermissionsStore{db},
@@ -32,14 +44,112 @@ func New(db *sqlx.DB, storeRoot string) (Store, error) {
 		Galleries:   GalleriesStore{db},
 		Images:      imagesStore,
 		Stats:       StatsStore{db},
+		Audit:       AuditStore{db},
+		Idempotency: IdempotencyStore{db},
 	}, nil
 }
 
+// Run the provided function in a single database transaction. The function receives a
+// copy of the store whose substores execute their statements in the transaction. The
+// transaction is committed if the function returns no error, otherwise it is rolled
+// back and the error returned. Side effects outside the database (e.g. files or emails)
+// should be performed by the caller after WithTx returns. If the store is already
+// bound to a transaction the function simply joins it.
+func (s Store) WithTx(fn func(tx Store) error) error {
+	if s.db == nil {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	txStore := Store{
+		Users:       UsersStore{tx},
+		Keys:        KeysStore{tx},
+		Permissions: PermissionsStore{tx},
+		Tokens:      TokenStore{tx},
+		Galleries:   GalleriesStore{tx},
+		Images:      ImagesStore{db: tx, fsRoot: s.Images.fsRoot, shard: s.Images.shard, layout: s.Images.layout},
+		Stats:       StatsStore{tx},
+		Audit:       AuditStore{tx},
+		Idempotency: IdempotencyStore{tx},
+	}
+	err = fn(txStore)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Count the records matching a listing, used when only the pagination metadata of the
+// listing is requested. The query must select a single count of the matching records.
+func countListing(db Executor, filter filters.Input, query string, args ...interface{}) (filters.Meta, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int64
+	err := db.GetContext(ctx, &count, query, args...)
+	if err != nil {
+		return filter.CalculateMetadata(0), err
+	}
+	return filter.CalculateMetadata(count), nil
+}
+
+// The Executor interface is satisfied both by a connection pool (*sqlx.DB) and by
+// a transaction (*sqlx.Tx), so the substores can run their statements in both.
+type Executor interface {
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// A transaction begun by a substore method. If the executor of the substore
+// is already a transaction, the statements join it and the commit or the
+// rollback are left to the owner of the outer transaction.
+type subTx struct {
+	Executor
+	tx *sqlx.Tx
+}
+
+func (st subTx) Commit() error {
+	if st.tx == nil {
+		return nil
+	}
+	return st.tx.Commit()
+}
+
+func (st subTx) Rollback() error {
+	if st.tx == nil {
+		return nil
+	}
+	return st.tx.Rollback()
+}
+
+// Begin a transaction on the executor, or join the one the executor already is.
+func beginTx(ctx context.Context, e Executor) (subTx, error) {
+	db, ok := e.(*sqlx.DB)
+	if !ok {
+		return subTx{Executor: e}, nil
+	}
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return subTx{}, err
+	}
+	return subTx{Executor: tx, tx: tx}, nil
+}
+
 var (
-	ErrDuplicateEmail    = errors.New("duplicate email")
-	ErrRecordNotFound    = errors.New("record not found")
-	ErrEditConflict      = errors.New("edit conflict")
-	ErrFileAlreadyExists = errors.New("file already exists")
-	ErrEmptyBytes        = errors.New("no bytes")
-	ErrForbidden         = errors.New("forbidden")
+	ErrDuplicateEmail     = errors.New("duplicate email")
+	ErrRecordNotFound     = errors.New("record not found")
+	ErrEditConflict       = errors.New("edit conflict")
+	ErrEmptyBytes         = errors.New("no bytes")
+	ErrForbidden          = errors.New("forbidden")
+	ErrOrderMismatch      = errors.New("order mismatch")
+	ErrStorageUnavailable = errors.New("storage unavailable")
+	ErrInvalidFileName    = errors.New("invalid file name")
+	ErrCoverImageNotFound = errors.New("cover image not found")
 )
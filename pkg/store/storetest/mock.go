@@ -0,0 +1,137 @@
+package storetest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/store"
+)
+
+// Mock is a fake store.Executor used to test the services without a database. The
+// rows returned to the stores are registered by type with Set: GetContext fills the
+// destination with the value registered for its type and SelectContext fills a
+// destination slice with the slice registered for its type. Destinations without a
+// registered value get sql.ErrNoRows, which the stores report as ErrRecordNotFound.
+//
+// Note that the listings scan into unexported types of the store, so the mock is
+// meant for the paths retrieving single records (or plain slices).
+type Mock struct {
+	mu     sync.Mutex
+	values map[reflect.Type]interface{}
+	errs   map[reflect.Type]error
+
+	// Number of rows reported as affected by the statements run with ExecContext.
+	RowsAffected int64
+	// Queries run on the mock, in order.
+	Queries []string
+	// Root directory of the image files of the store returned by NewMock.
+	Root string
+}
+
+// Register the value returned for the destinations of its type.
+func (m *Mock) Set(value interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values == nil {
+		m.values = map[reflect.Type]interface{}{}
+	}
+	m.values[reflect.TypeOf(value)] = value
+}
+
+// Make the queries scanning into the type of the value fail with the error.
+func (m *Mock) Fail(value interface{}, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.errs == nil {
+		m.errs = map[reflect.Type]error{}
+	}
+	m.errs[reflect.TypeOf(value)] = err
+}
+
+func (m *Mock) GetContext(_ context.Context, dest interface{}, query string, _ ...interface{}) error {
+	return m.fill(dest, query)
+}
+
+func (m *Mock) SelectContext(_ context.Context, dest interface{}, query string, _ ...interface{}) error {
+	return m.fill(dest, query)
+}
+
+func (m *Mock) ExecContext(_ context.Context, query string, _ ...interface{}) (sql.Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Queries = append(m.Queries, query)
+	return mockResult(m.RowsAffected), nil
+}
+
+func (m *Mock) fill(dest interface{}, query string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Queries = append(m.Queries, query)
+
+	destValue := reflect.ValueOf(dest)
+	if destValue.Kind() != reflect.Ptr || destValue.IsNil() {
+		return fmt.Errorf("storetest: destination %T is not a non-nil pointer", dest)
+	}
+	typ := destValue.Elem().Type()
+	if err, ok := m.errs[typ]; ok {
+		return err
+	}
+	value, ok := m.values[typ]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	destValue.Elem().Set(reflect.ValueOf(value))
+	return nil
+}
+
+type mockResult int64
+
+func (r mockResult) LastInsertId() (int64, error) { return 0, nil }
+func (r mockResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+// Return a store whose substores run their statements on a new Mock, with the images
+// saved in a temporary directory. The store behaves as if it was bound to a
+// transaction, so WithTx simply runs the provided function on it.
+func NewMock(t testing.TB) (store.Store, *Mock) {
+	t.Helper()
+	m := &Mock{Root: t.TempDir()}
+
+	images, err := store.NewImagesStore(m, store.FsOptions{Root: m.Root})
+	if err != nil {
+		t.Fatalf("creating images store: %v", err)
+	}
+	return store.Store{
+		Users:       store.UsersStore{DB: m},
+		Keys:        store.KeysStore{DB: m},
+		Permissions: store.PermissionsStore{DB: m},
+		Tokens:      store.TokenStore{DB: m},
+		Galleries:   store.GalleriesStore{DB: m},
+		Images:      images,
+		Stats:       store.StatsStore{DB: m},
+		Audit:       store.AuditStore{DB: m},
+		Idempotency: store.IdempotencyStore{DB: m},
+	}, m
+}
+
+// Return a context authenticated as the user with a main auth key, using a mock
+// store. The user, the key and its permissions are registered on the mock, so
+// they are also returned by later queries retrieving them.
+func MockAuthContext(t *testing.T, s store.Store, m *Mock, user store.User) context.Context {
+	t.Helper()
+	m.Set(user)
+	m.Set(store.Keys{ID: user.ID, UserID: user.ID, AuthKey: "mock-key"})
+	m.Set([]string{store.PermissionMain})
+
+	authenticator := auth.Authenticator{Store: s}
+	ctx := auth.ContextSetKey(context.Background(), "mock-key")
+	_, err := authenticator.RequireActivatedUser(&ctx)
+	if err != nil {
+		t.Fatalf("authenticating: %v", err)
+	}
+	return ctx
+}
@@ -0,0 +1,181 @@
+// Package storetest provides a store backed by the test database to the tests of the
+// packages using the store. The tests using it are skipped if the test database is not
+// configured via the SNAPVAULT_TEST_DB_DSN environment variable.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+
+	"github.com/anBertoli/snap-vault/migrations"
+	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/store"
+)
+
+// Environment variable holding the DSN of the test database. The database is
+// shared by all the tests, which must not rely on it being empty.
+const DSNEnv = "SNAPVAULT_TEST_DB_DSN"
+
+// Return the DSN of the test database, skipping the test if it is not configured.
+func DSN(t *testing.T) string {
+	t.Helper()
+	dsn := os.Getenv(DSNEnv)
+	if dsn == "" {
+		t.Skipf("%s not set, skipping test using the database", DSNEnv)
+	}
+	return dsn
+}
+
+// Create an empty schema in the test database and return a DSN using it as the
+// search path, to work as on a fresh database. The schema is dropped when the
+// test completes.
+func FreshDSN(t *testing.T) string {
+	t.Helper()
+	dsn := DSN(t)
+
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connecting to test database: %v", err)
+	}
+	schema := fmt.Sprintf("fresh_%d_%d", time.Now().UnixNano(), atomic.AddInt64(&emailSeq, 1))
+	t.Cleanup(func() {
+		_, _ = db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		_ = db.Close()
+	})
+	_, err = db.Exec(`CREATE SCHEMA ` + schema)
+	if err != nil {
+		t.Fatalf("creating schema: %v", err)
+	}
+
+	if !strings.Contains(dsn, "://") {
+		return dsn + " search_path=" + schema
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("parsing test database DSN: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Migrate the test database and return a store using it, with the images saved in
+// a temporary directory. The connection pool is closed when the test completes.
+func New(t *testing.T) (store.Store, *sqlx.DB) {
+	t.Helper()
+	dsn := DSN(t)
+
+	migrator, err := migrations.New(dsn)
+	if err != nil {
+		t.Fatalf("creating migrator: %v", err)
+	}
+	err = migrator.Up()
+	_, _ = migrator.Close()
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		t.Fatalf("migrating test database: %v", err)
+	}
+
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connecting to test database: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	s, err := store.New(db, store.FsOptions{Root: t.TempDir()})
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+	return s, db
+}
+
+var emailSeq int64
+
+// Return an email address not used by other tests, starting with the prefix.
+func Email(prefix string) string {
+	n := atomic.AddInt64(&emailSeq, 1)
+	return fmt.Sprintf("%s-%d-%d@example.com", prefix, time.Now().UnixNano(), n)
+}
+
+// Insert an activated user with a unique email, starting with the prefix,
+// and initialize its stats.
+func NewUser(t *testing.T, s store.Store, prefix string) store.User {
+	t.Helper()
+	user, err := s.Users.Insert(store.User{
+		Name:         "Test User",
+		Email:        Email(prefix),
+		PasswordHash: "not-a-real-hash",
+		Activated:    true,
+	})
+	if err != nil {
+		t.Fatalf("inserting user: %v", err)
+	}
+	err = s.Stats.InitStatsForUser(user.ID)
+	if err != nil {
+		t.Fatalf("initializing stats: %v", err)
+	}
+	return user
+}
+
+// Return a context authenticated as the user, with a new main auth key.
+func AuthContext(t *testing.T, s store.Store, user store.User) context.Context {
+	t.Helper()
+	keys, err := s.Keys.New(user.ID)
+	if err != nil {
+		t.Fatalf("creating auth key: %v", err)
+	}
+	err = s.Permissions.ReplaceForKey(keys.ID, store.PermissionMain)
+	if err != nil {
+		t.Fatalf("setting key permissions: %v", err)
+	}
+	authenticator := auth.Authenticator{Store: s}
+	ctx := auth.ContextSetKey(context.Background(), keys.AuthKey)
+	_, err = authenticator.RequireActivatedUser(&ctx)
+	if err != nil {
+		t.Fatalf("authenticating: %v", err)
+	}
+	return ctx
+}
+
+// Make the writes on the table fail, for the rows of the users whose email starts
+// with the prefix and satisfying the condition (e.g. "NEW.n_images < OLD.n_images").
+// The event is the one of the trigger raising the error, e.g. "INSERT" or "UPDATE",
+// the trigger is removed when the test completes. It is used to inject failures in
+// the middle of transactions, the rows of the table must have a user_id column.
+func FailWrites(t *testing.T, db *sqlx.DB, table, event, emailPrefix, condition string) {
+	t.Helper()
+	name := "fail_" + table + "_" + strings.ReplaceAll(emailPrefix, "-", "_")
+
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE OR REPLACE FUNCTION %[1]s() RETURNS trigger AS $$
+		BEGIN
+			IF (%[2]s) AND EXISTS (SELECT 1 FROM users WHERE id = NEW.user_id AND email LIKE '%[3]s%%') THEN
+				RAISE EXCEPTION 'injected failure';
+			END IF;
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS %[1]s ON %[4]s;
+		CREATE TRIGGER %[1]s BEFORE %[5]s ON %[4]s FOR EACH ROW EXECUTE PROCEDURE %[1]s();
+	`, name, condition, emailPrefix, table, event))
+	if err != nil {
+		t.Fatalf("creating failure trigger: %v", err)
+	}
+	t.Cleanup(func() {
+		_, err := db.Exec(fmt.Sprintf(`DROP TRIGGER IF EXISTS %[1]s ON %[2]s; DROP FUNCTION IF EXISTS %[1]s()`, name, table))
+		if err != nil {
+			t.Errorf("dropping failure trigger: %v", err)
+		}
+	})
+}
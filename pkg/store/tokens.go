@@ -2,9 +2,9 @@ package store
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"time"
-
-	"github.com/jmoiron/sqlx"
 )
 
 // Define the scope of the tokens used in the application.
@@ -25,7 +25,7 @@ type Token struct {
 // The store abstraction used to manipulate tokens into the database. It holds a DB
 // connection pool. Only the hashed version of the token are saved into the db.
 type TokenStore struct {
-	DB *sqlx.DB
+	DB Executor
 }
 
 // Creates a new token with the given scope and ttl (time-to-live) and saves the hash into the
@@ -70,6 +70,31 @@ func (m *TokenStore) Insert(token Token) (Token, error) {
 	return token, nil
 }
 
+// Consume a valid (not expired) token with the given scope, deleting it and returning
+// the ID of its owner. If the token doesn't exist or is expired ErrRecordNotFound is
+// returned. Since the token is deleted, concurrent requests consuming the same token
+// are serialized by the row lock: only one of them finds it.
+func (m *TokenStore) Consume(scope, tokenPlain string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID int64
+	err := m.DB.GetContext(ctx, &userID, `
+		DELETE FROM tokens WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id
+	`, hashString(tokenPlain), scope, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
+
 // Delete all tokens with the given scope for the specified user.
 func (m *TokenStore) DeleteAllForUser(scope string, userID int64) error {
 
@@ -91,3 +116,16 @@ func (m *TokenStore) DeleteAllForUser(scope string, userID int64) error {
 
 	return nil
 }
+
+// Delete the tokens past their expiry, of all the scopes. The number
+// of deleted tokens is returned.
+func (m *TokenStore) DeleteExpired() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `DELETE FROM tokens WHERE expiry < now()`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,95 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+// Only the expired tokens are removed by DeleteExpired, of all the scopes.
+func TestDeleteExpired(t *testing.T) {
+	s, db := storetest.New(t)
+	user := storetest.NewUser(t, s, "tokens")
+
+	seed := []struct {
+		ttl   time.Duration
+		scope string
+	}{
+		{-time.Hour, store.ScopeActivation},
+		{-time.Minute, store.ScopeRecoverMainKeys},
+		{time.Hour, store.ScopeActivation},
+		{time.Hour, store.ScopeRecoverMainKeys},
+	}
+	valid := map[string]bool{}
+	for _, sd := range seed {
+		token, err := s.Tokens.New(user.ID, sd.ttl, sd.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sd.ttl > 0 {
+			valid[token.Hash] = true
+		}
+	}
+
+	n, err := s.Tokens.DeleteExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other tests could have left expired tokens behind.
+	if n < 2 {
+		t.Fatalf("expected at least 2 deleted tokens, got %d", n)
+	}
+
+	var hashes []string
+	err = db.SelectContext(context.Background(), &hashes, `SELECT hash FROM tokens WHERE user_id = $1`, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != len(valid) {
+		t.Fatalf("expected %d tokens left, got %d", len(valid), len(hashes))
+	}
+	for _, h := range hashes {
+		if !valid[h] {
+			t.Fatalf("expired token %s not deleted", h)
+		}
+	}
+}
+
+// A token is consumed only once, and only if not expired and of the requested scope.
+func TestConsume(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "consume")
+
+	valid, err := s.Tokens.New(user.ID, time.Hour, store.ScopeRecoverMainKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := s.Tokens.New(user.ID, -time.Minute, store.ScopeRecoverMainKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Tokens.Consume(store.ScopeActivation, valid.Plain)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound with another scope, got %v", err)
+	}
+	userID, err := s.Tokens.Consume(store.ScopeRecoverMainKeys, valid.Plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != user.ID {
+		t.Fatalf("expected user %d, got %d", user.ID, userID)
+	}
+	_, err = s.Tokens.Consume(store.ScopeRecoverMainKeys, valid.Plain)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound consuming twice, got %v", err)
+	}
+	_, err = s.Tokens.Consume(store.ScopeRecoverMainKeys, expired.Plain)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound with an expired token, got %v", err)
+	}
+}
@@ -4,9 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
-	"github.com/jmoiron/sqlx"
+	"github.com/anBertoli/snap-vault/pkg/filters"
 )
 
 type User struct {
@@ -24,7 +25,61 @@ type User struct {
 // The store abstraction used to manipulate users into our postgres database.
 // It holds a DB connection pool.
 type UsersStore struct {
-	DB *sqlx.DB
+	DB Executor
+}
+
+// Obtain a list of all the users. This operation supports filtering and pagination
+// so the method also returns pagination metadata.
+func (us *UsersStore) GetAll(filter filters.Input) ([]User, filters.Meta, error) {
+	var (
+		users = []User{}
+		meta  = filter.CalculateMetadata(0)
+		// Use a tmp variable to scan also the count.
+		tmp []struct {
+			User
+			Count int64 `db:"count"`
+		}
+	)
+
+	// The search term is passed as a bound parameter, while the columns
+	// names are interpolated (they are checked against safe lists).
+	from, to := filter.DateArgs()
+	where := fmt.Sprintf(
+		`(LOWER(%s) LIKE '%%' || LOWER($1) || '%%' OR $1 = '') AND %s`,
+		filter.SearchCol, filters.BuildDateClause("created_at", 2),
+	)
+	args := []interface{}{filter.Search, from, to}
+
+	// If only the count is requested, avoid fetching the records.
+	if filter.CountOnly {
+		meta, err := countListing(us.DB, filter, `SELECT count(*) FROM users WHERE `+where, args...)
+		return users, meta, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), * FROM users
+		WHERE %s
+		ORDER BY %s %s, id ASC
+		LIMIT $4 OFFSET $5`,
+		where, filter.SortColumn(), filter.SortDirection(),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := us.DB.SelectContext(ctx, &tmp, query, append(args, filter.Limit(), filter.Offset())...)
+	if err != nil {
+		return nil, meta, err
+	}
+
+	for _, u := range tmp {
+		users = append(users, u.User)
+	}
+	if len(tmp) > 0 {
+		meta = filter.CalculateMetadata(tmp[0].Count)
+	}
+
+	return users, meta, nil
 }
 
 // Retrieve a user using its email.
@@ -46,6 +101,27 @@ func (us *UsersStore) GetForEmail(email string) (User, error) {
 	return user, nil
 }
 
+// Lock the row of the user until the end of the transaction, serializing the operations
+// on the user that check and then modify related rows (e.g. the limit of auth keys).
+// It must be called on a store bound to a transaction, see Store.WithTx.
+func (us *UsersStore) Lock(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+	err := us.DB.GetContext(ctx, &id, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Retrieve a user from one of its auth keys. The provided key argument is
 // the plain text version of the auth key and it's hashed before searching
 // the user into the database.
@@ -26,6 +26,7 @@ type RequestTrace struct {
 	HttpCode   int
 	PublicErr  interface{}
 	PrivateErr error
+	TimedOut   bool
 }
 
 // Enrich the HTTP request with a newly initialized trace.
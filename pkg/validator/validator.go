@@ -3,6 +3,7 @@ package validator
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -14,10 +15,18 @@ func New() Validator {
 }
 
 // Implement the Error interface, so the Validator could be used as a regular error.
+// Fields are sorted, so the message is stable. Note that when JSON-encoded the
+// Validator is a plain object, the keys are sorted by the encoding/json package.
 func (v Validator) Error() string {
-	var messages []string
-	for key, val := range v {
-		messages = append(messages, fmt.Sprintf("%s: %s", key, val))
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	messages := make([]string, 0, len(keys))
+	for _, key := range keys {
+		messages = append(messages, fmt.Sprintf("%s: %s", key, v[key]))
 	}
 	return strings.Join(messages, ", ")
 }
@@ -47,3 +56,13 @@ func (v *Validator) Check(ok bool, key, message string) {
 func Matches(value string, rx *regexp.Regexp) bool {
 	return rx.MatchString(value)
 }
+
+// Returns true if a string value is included in the provided list.
+func In(value string, list ...string) bool {
+	for i := range list {
+		if value == list[i] {
+			return true
+		}
+	}
+	return false
+}
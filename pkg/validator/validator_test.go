@@ -0,0 +1,44 @@
+package validator
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// The errors are reported sorted by field, both in the message and in the JSON
+// encoding, regardless of the order they were added.
+func TestValidatorOrdering(t *testing.T) {
+	v := New()
+	v.AddError("password", "must be provided")
+	v.AddError("email", "must be a valid email address")
+	v.AddError("name", "must be provided")
+	v.AddError("email", "must be provided")
+
+	expected := "email: must be a valid email address, name: must be provided, password: must be provided"
+	for i := 0; i < 10; i++ {
+		if v.Error() != expected {
+			t.Fatalf("expected message %q, got %q", expected, v.Error())
+		}
+	}
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `{"email":"must be a valid email address","name":"must be provided","password":"must be provided"}`
+	if string(js) != expected {
+		t.Fatalf("expected JSON %s, got %s", expected, js)
+	}
+}
+
+func TestValidatorOk(t *testing.T) {
+	v := New()
+	v.Check(true, "name", "must be provided")
+	if !v.Ok() || v.Error() != "" {
+		t.Fatalf("expected no errors, got %q", v.Error())
+	}
+	v.Check(false, "name", "must be provided")
+	if v.Ok() {
+		t.Fatal("expected an error")
+	}
+}
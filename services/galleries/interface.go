@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 
 	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
@@ -13,21 +14,50 @@ import (
 // via transport-specific adapters, e.g. the JSON-HTTP api.
 type Service interface {
 	ListAllPublic(ctx context.Context, filter filters.Input) ([]store.Gallery, filters.Meta, error)
-	ListAllOwned(ctx context.Context, filter filters.Input) ([]store.Gallery, filters.Meta, error)
+	ListAllOwned(ctx context.Context, filter filters.Input, published *bool) ([]store.Gallery, filters.Meta, error)
 	Get(ctx context.Context, public bool, galleryID int64) (store.Gallery, error)
 	Download(ctx context.Context, public bool, galleryID int64) (store.Gallery, io.ReadCloser, error)
+	DownloadSelection(ctx context.Context, public bool, galleryID int64, imageIDs []int64) (store.Gallery, io.ReadCloser, error)
 	Insert(ctx context.Context, gallery store.Gallery) (store.Gallery, error)
 	Update(ctx context.Context, gallery store.Gallery) (store.Gallery, error)
 	Delete(ctx context.Context, galleryID int64) error
+	Stats(ctx context.Context, galleryID int64) (Stats, error)
+	CountView(ctx context.Context, gallery store.Gallery, download bool) error
+}
+
+// Aggregate statistics of a single gallery. The last update is the most
+// recent between the update of the gallery and the ones of its images.
+type Stats struct {
+	GalleryID   int64     `json:"gallery_id"`
+	Images      int       `json:"images"`
+	Bytes       int64     `json:"bytes"`
+	LastUpdated time.Time `json:"last_updated"`
 }
 
 var (
 	ErrBusy = errors.New("busy")
 )
 
+// Columns of the galleries that listings can be sorted (ascending
+// or descending) and searched by.
+var (
+	SortSafeList   = []string{"id", "title", "created_at"}
+	SearchSafeList = []string{"title", "description"}
+)
+
+// Defaults of the galleries listings.
+var ListDefaults = filters.Defaults{
+	PageSize:       20,
+	Sort:           "id",
+	SortSafeList:   SortSafeList,
+	SearchCol:      "title",
+	SearchSafeList: SearchSafeList,
+}
+
 // This checks makes sure that all service implementation remain
 // valid while we refactor our code.
 var _ Service = &GalleriesService{}
 var _ Service = &AuthMiddleware{}
 var _ Service = &ValidationMiddleware{}
 var _ Service = &StatsMiddleware{}
+var _ Service = &IdempotencyMiddleware{}
@@ -21,12 +21,12 @@ type AuthMiddleware struct {
 }
 
 // Perform authentication and check that appropriate listing permissions are present.
-func (am *AuthMiddleware) ListAllOwned(ctx context.Context, filter filters.Input) ([]store.Gallery, filters.Meta, error) {
+func (am *AuthMiddleware) ListAllOwned(ctx context.Context, filter filters.Input, published *bool) ([]store.Gallery, filters.Meta, error) {
 	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionListGalleries)
 	if err != nil {
 		return nil, filters.Meta{}, err
 	}
-	return am.Service.ListAllOwned(ctx, filter)
+	return am.Service.ListAllOwned(ctx, filter, published)
 }
 
 // Perform authentication and check that appropriate get permissions are present.
@@ -51,6 +51,17 @@ func (am *AuthMiddleware) Download(ctx context.Context, public bool, galleryID i
 	return am.Service.Download(ctx, public, galleryID)
 }
 
+// Perform authentication and check that appropriate download permissions are present.
+func (am *AuthMiddleware) DownloadSelection(ctx context.Context, public bool, galleryID int64, imageIDs []int64) (store.Gallery, io.ReadCloser, error) {
+	if !public {
+		_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionDownloadGallery)
+		if err != nil {
+			return store.Gallery{}, nil, err
+		}
+	}
+	return am.Service.DownloadSelection(ctx, public, galleryID, imageIDs)
+}
+
 // Perform authentication and check that appropriate insert permissions are present.
 func (am *AuthMiddleware) Insert(ctx context.Context, gallery store.Gallery) (store.Gallery, error) {
 	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionCreateGallery)
@@ -77,3 +88,19 @@ func (am *AuthMiddleware) Delete(ctx context.Context, galleryID int64) error {
 	}
 	return am.Service.Delete(ctx, galleryID)
 }
+
+// Views are counted for anonymous requests too. If an auth key was provided, the user
+// is authenticated so the owner of the gallery can be recognized, ignoring failures.
+func (am *AuthMiddleware) CountView(ctx context.Context, gallery store.Gallery, download bool) error {
+	_, _ = am.Auth.RequireAuthenticatedUser(&ctx)
+	return am.Service.CountView(ctx, gallery, download)
+}
+
+// Perform authentication and check that appropriate listing permissions are present.
+func (am *AuthMiddleware) Stats(ctx context.Context, galleryID int64) (Stats, error) {
+	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionListGalleries)
+	if err != nil {
+		return Stats{}, err
+	}
+	return am.Service.Stats(ctx, galleryID)
+}
@@ -0,0 +1,85 @@
+package galleries
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/idempotency"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/validator"
+)
+
+// The IdempotencyMiddleware makes the creation of galleries idempotent when the request
+// carries an idempotency key: the first request creates the gallery, while requests
+// repeated with the same key within the TTL return the same gallery. A request still in
+// progress holds its key at most for the Lease, so a crashed request doesn't block the
+// key until the TTL. Keys are scoped per user. The middleware must be wrapped by the
+// auth middleware, since the user must be known. Other methods are handled directly
+// by the embedded Service.
+type IdempotencyMiddleware struct {
+	Store  store.IdempotencyStore
+	TTL    time.Duration
+	Lease  time.Duration
+	Logger *zap.SugaredLogger
+	Service
+}
+
+const idempotencyScope = "galleries"
+
+// Create the gallery only if the key was never used (or it expired), otherwise
+// return the gallery created by the first request with the same key.
+func (im *IdempotencyMiddleware) Insert(ctx context.Context, gallery store.Gallery) (store.Gallery, error) {
+	key, ok := idempotency.ContextGetKey(ctx)
+	if !ok {
+		return im.Service.Insert(ctx, gallery)
+	}
+	v := validator.New()
+	v.Check(len(key) <= idempotency.MaxKeyLen, "idempotency_key", "must not be more than 255 bytes long")
+	if !v.Ok() {
+		return store.Gallery{}, v
+	}
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Gallery{}, err
+	}
+	userID := authData.User.ID
+
+	reserved, err := im.Store.Reserve(userID, idempotencyScope, key, im.TTL, im.Lease)
+	if err != nil {
+		return store.Gallery{}, err
+	}
+	if !reserved {
+		galleryID, err := im.Store.Get(userID, idempotencyScope, key)
+		switch {
+		case errors.Is(err, store.ErrRecordNotFound):
+			// The key was released in the meantime.
+			return store.Gallery{}, idempotency.ErrInProgress
+		case err != nil:
+			return store.Gallery{}, err
+		case galleryID == nil:
+			return store.Gallery{}, idempotency.ErrInProgress
+		}
+		return im.Service.Get(ctx, false, *galleryID)
+	}
+
+	gallery, err = im.Service.Insert(ctx, gallery)
+	if err != nil {
+		releaseErr := im.Store.Release(userID, idempotencyScope, key)
+		if releaseErr != nil {
+			im.Logger.Errorw("releasing idempotency key", "user_id", userID, "err", releaseErr)
+		}
+		return store.Gallery{}, err
+	}
+
+	// The gallery was created, so the request is successful anyway: a retry
+	// would find the key in progress until it expires.
+	err = im.Store.Complete(userID, idempotencyScope, key, gallery.ID)
+	if err != nil {
+		im.Logger.Errorw("completing idempotency key", "user_id", userID, "gallery_id", gallery.ID, "err", err)
+	}
+	return gallery, nil
+}
@@ -3,6 +3,8 @@ package galleries
 import (
 	"context"
 
+	"go.uber.org/zap"
+
 	"github.com/anBertoli/snap-vault/pkg/auth"
 	"github.com/anBertoli/snap-vault/pkg/store"
 )
@@ -10,8 +12,13 @@ import (
 // The StatsMiddleware updates the user stats about the number of galleries. Some methods
 // are no-ops since they don't need to modify the stats of a user (the calls are handled
 // directly from the embedded Service interface).
+//
+// Once a gallery is created or deleted the operation is reported as successful even if
+// the stats update fails: the error is logged and the drift can be repaired with the
+// stats reconcile command of the CLI.
 type StatsMiddleware struct {
-	Store store.StatsStore
+	Store  store.StatsStore
+	Logger *zap.SugaredLogger
 	Service
 }
 
@@ -24,18 +31,26 @@ func (sm *StatsMiddleware) Insert(ctx context.Context, gallery store.Gallery) (s
 
 	err = sm.Store.IncrementGalleries(gallery.UserID, 1)
 	if err != nil {
-		return store.Gallery{}, err
+		sm.Logger.Errorw("incrementing stats", "user_id", gallery.UserID, "gallery_id", gallery.ID, "err", err)
 	}
 	return gallery, nil
 }
 
 // Decrement the galleries counter for the user if the gallery is deleted.
 func (sm *StatsMiddleware) Delete(ctx context.Context, galleryID int64) error {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return err
+	}
 
-	err := sm.Service.Delete(ctx, galleryID)
+	err = sm.Service.Delete(ctx, galleryID)
 	if err != nil {
 		return err
 	}
-	return sm.Store.IncrementGalleries(authData.User.ID, -1)
+
+	err = sm.Store.IncrementGalleries(authData.User.ID, -1)
+	if err != nil {
+		sm.Logger.Errorw("decrementing stats", "user_id", authData.User.ID, "gallery_id", galleryID, "err", err)
+	}
+	return nil
 }
@@ -0,0 +1,55 @@
+package galleries
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+// The createdService creates and deletes galleries without touching the store.
+type createdService struct {
+	Service
+}
+
+func (cs *createdService) Insert(ctx context.Context, gallery store.Gallery) (store.Gallery, error) {
+	gallery.ID = 10
+	return gallery, nil
+}
+
+func (cs *createdService) Delete(ctx context.Context, galleryID int64) error {
+	return nil
+}
+
+// A failed update of the stats is logged, while the creation and the deletion of
+// the gallery are still reported as successful.
+func TestStatsFailure(t *testing.T) {
+	s, m := storetest.NewMock(t)
+	ctx := storetest.MockAuthContext(t, s, m, store.User{ID: 1, Activated: true})
+	// No stats row is updated, so the increments fail.
+	m.RowsAffected = 0
+
+	core, logs := observer.New(zap.ErrorLevel)
+	sm := &StatsMiddleware{Store: s.Stats, Logger: zap.New(core).Sugar(), Service: &createdService{}}
+
+	gallery, err := sm.Insert(ctx, store.Gallery{Title: "Stats", UserID: 1})
+	if err != nil {
+		t.Fatalf("expected the insert to succeed, got %v", err)
+	}
+	if gallery.ID != 10 {
+		t.Fatalf("expected the created gallery, got %+v", gallery)
+	}
+	err = sm.Delete(ctx, gallery.ID)
+	if err != nil {
+		t.Fatalf("expected the delete to succeed, got %v", err)
+	}
+
+	entries := logs.FilterField(zap.Int64("gallery_id", 10)).All()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 logged stats failures, got %d", len(entries))
+	}
+}
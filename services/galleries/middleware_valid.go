@@ -2,6 +2,8 @@ package galleries
 
 import (
 	"context"
+	"fmt"
+	"io"
 
 	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
@@ -13,6 +15,9 @@ import (
 // service in the chain will receive valid data. Some methods are no-ops since there it isn't
 // needed to validate data (the calls are handled directly from the embedded Service interface).
 type ValidationMiddleware struct {
+	// Maximum number of images downloaded with a single
+	// selection, zero means no limit.
+	MaxSelection int
 	Service
 }
 
@@ -28,14 +33,31 @@ func (vm *ValidationMiddleware) ListAllPublic(ctx context.Context, filter filter
 }
 
 // Validate the filtering and pagination parameters used in listing.
-func (vm *ValidationMiddleware) ListAllOwned(ctx context.Context, filter filters.Input) ([]store.Gallery, filters.Meta, error) {
+func (vm *ValidationMiddleware) ListAllOwned(ctx context.Context, filter filters.Input, published *bool) ([]store.Gallery, filters.Meta, error) {
 	err := filter.Validate()
 	if err != nil {
 		v := validator.New()
 		v.AddError("pagination", err.Error())
 		return nil, filters.Meta{}, v
 	}
-	return vm.Service.ListAllOwned(ctx, filter)
+	return vm.Service.ListAllOwned(ctx, filter, published)
+}
+
+// Validate the selection of images to be downloaded: it must not be empty, must
+// not exceed the maximum size and must not contain duplicates.
+func (vm *ValidationMiddleware) DownloadSelection(ctx context.Context, public bool, galleryID int64, imageIDs []int64) (store.Gallery, io.ReadCloser, error) {
+	v := validator.New()
+	v.Check(len(imageIDs) > 0, "images", "must be provided")
+	v.Check(vm.MaxSelection <= 0 || len(imageIDs) <= vm.MaxSelection, "images", fmt.Sprintf("must not be more than %d", vm.MaxSelection))
+	seen := make(map[int64]bool, len(imageIDs))
+	for _, id := range imageIDs {
+		v.Check(!seen[id], "images", "must not contain duplicates")
+		seen[id] = true
+	}
+	if !v.Ok() {
+		return store.Gallery{}, nil, v
+	}
+	return vm.Service.DownloadSelection(ctx, public, galleryID, imageIDs)
 }
 
 // Validate the title to be used to insert a new gallery.
@@ -0,0 +1,51 @@
+package galleries
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/validator"
+)
+
+// The selectionService accepts any selection without reading the store.
+type selectionService struct {
+	Service
+}
+
+func (ss *selectionService) DownloadSelection(ctx context.Context, public bool, galleryID int64, imageIDs []int64) (store.Gallery, io.ReadCloser, error) {
+	return store.Gallery{ID: galleryID}, io.NopCloser(nil), nil
+}
+
+// The selections must be non-empty, within the limit and without duplicates.
+func TestValidateDownloadSelection(t *testing.T) {
+	tests := []struct {
+		name     string
+		imageIDs []int64
+		valid    bool
+	}{
+		{name: "within the limit", imageIDs: []int64{1, 2, 3}, valid: true},
+		{name: "empty"},
+		{name: "over the limit", imageIDs: []int64{1, 2, 3, 4}},
+		{name: "duplicates", imageIDs: []int64{1, 2, 1}},
+	}
+
+	vm := &ValidationMiddleware{MaxSelection: 3, Service: &selectionService{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := vm.DownloadSelection(context.Background(), true, 10, tt.imageIDs)
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("expected the selection to be accepted, got %v", err)
+				}
+				return
+			}
+			var v validator.Validator
+			if !errors.As(err, &v) || v["images"] == "" {
+				t.Fatalf("expected a validation error of images, got %v", err)
+			}
+		})
+	}
+}
@@ -2,34 +2,116 @@ package galleries
 
 import (
 	"archive/tar"
-	"bytes"
 	"compress/gzip"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 
 	"github.com/anBertoli/snap-vault/pkg/auth"
 	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
 	"github.com/anBertoli/snap-vault/pkg/tracing"
+	"github.com/anBertoli/snap-vault/pkg/validator"
 )
 
-func NewGalleriesService(store store.Store, logger *zap.SugaredLogger, concurrency uint) *GalleriesService {
+// Default file mode of the entries of the gallery archives.
+const defaultArchiveFileMode os.FileMode = 0644
+
+// Config holds the tunable parameters of the GalleriesService.
+type Config struct {
+	// Maximum number of gallery archives built concurrently.
+	Concurrency uint
+	// File mode of the archive entries, if zero defaultArchiveFileMode is used.
+	ArchiveFileMode os.FileMode
+	// Aggregate bytes per second written by all the archives being streamed,
+	// zero means no limit.
+	ArchiveRate int
+	// Gzip compression level of the archives, from gzip.HuffmanOnly to
+	// gzip.BestCompression. Note that the zero value is gzip.NoCompression.
+	ArchiveLevel int
+	// If set, galleries made mostly of already compressed images (e.g. JPEG)
+	// are archived without compression, regardless of ArchiveLevel.
+	AutoCompression bool
+	// If set, views and downloads of public galleries by
+	// their owner are not counted.
+	ExcludeOwnerViews bool
+	// Registerer of the download metrics, if nil the
+	// default Prometheus registerer is used.
+	Registerer prometheus.Registerer
+}
+
+func NewGalleriesService(store store.Store, logger *zap.SugaredLogger, config Config) *GalleriesService {
+	if config.ArchiveFileMode == 0 {
+		config.ArchiveFileMode = defaultArchiveFileMode
+	}
+
+	// The limiter is shared by all the downloads, so the total throughput is bounded
+	// regardless of the number of concurrent archives (which is limited by the
+	// semaphore). The bucket holds at most one second of bytes.
+	var limiter *rate.Limiter
+	if config.ArchiveRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(config.ArchiveRate), config.ArchiveRate)
+	}
+
+	registerer := config.Registerer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	// Declare and register the gauge of the downloads currently in progress and the
+	// counter of the downloads rejected because all the slots were taken. Compared
+	// with the configured concurrency they show how close the service is to saturation.
+	inFlight := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "api_gallery_downloads_in_flight",
+		Help: "Number of gallery archives currently streamed.",
+	})
+	if err := registerer.Register(inFlight); err != nil {
+		panic(err)
+	}
+	busy := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "api_gallery_downloads_busy",
+		Help: "Counter of gallery downloads rejected because too many archives were streamed.",
+	})
+	if err := registerer.Register(busy); err != nil {
+		panic(err)
+	}
+
 	return &GalleriesService{
-		logger: logger,
-		sema:   make(chan struct{}, concurrency),
-		store:  store,
+		logger:    logger,
+		sema:      &semaphore{limit: config.Concurrency},
+		limiter:   limiter,
+		store:     store,
+		fileMode:  config.ArchiveFileMode,
+		level:     config.ArchiveLevel,
+		auto:      config.AutoCompression,
+		exclOwner: config.ExcludeOwnerViews,
+		inFlight:  inFlight,
+		busy:      busy,
 	}
 }
 
 // The GalleriesService retrieves and save galleries data in a relation database.
 type GalleriesService struct {
-	logger *zap.SugaredLogger
-	store  store.Store
-	sema   chan struct{}
+	logger    *zap.SugaredLogger
+	store     store.Store
+	sema      *semaphore
+	limiter   *rate.Limiter
+	fileMode  os.FileMode
+	level     int
+	auto      bool
+	exclOwner bool
+	inFlight  prometheus.Gauge
+	busy      prometheus.Counter
 }
 
 // Returns a filtered and paginated list of public galleries.
@@ -41,10 +123,14 @@ func (gs *GalleriesService) ListAllPublic(ctx context.Context, filter filters.In
 	return galleries, metadata, nil
 }
 
-// Returns a filtered and paginated list of galleries owned by the authenticated user.
-func (gs *GalleriesService) ListAllOwned(ctx context.Context, filter filters.Input) ([]store.Gallery, filters.Meta, error) {
-	authData := auth.MustContextGetAuth(ctx)
-	galleries, metadata, err := gs.store.Galleries.GetAllForUser(authData.User.ID, filter)
+// Returns a filtered and paginated list of galleries owned by the authenticated user. If
+// published is not nil, only galleries with that published status are listed.
+func (gs *GalleriesService) ListAllOwned(ctx context.Context, filter filters.Input, published *bool) ([]store.Gallery, filters.Meta, error) {
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+	galleries, metadata, err := gs.store.Galleries.GetAllForUser(authData.User.ID, published, filter)
 	if err != nil {
 		return nil, filters.Meta{}, err
 	}
@@ -76,43 +162,98 @@ func (gs *GalleriesService) Get(ctx context.Context, public bool, galleryID int6
 		}
 	}
 
+	// Include the metadata of the cover image, if any. The image could have been
+	// deleted in the meantime, in that case the gallery is returned without it.
+	if gallery.CoverImageID != nil {
+		image, err := gs.store.Images.Get(*gallery.CoverImageID)
+		switch {
+		case errors.Is(err, store.ErrRecordNotFound):
+			gallery.CoverImageID = nil
+		case err != nil:
+			return store.Gallery{}, err
+		default:
+			gallery.CoverImage = &image
+		}
+	}
+
 	return gallery, nil
 }
 
 // Download all gallery images as a compressed tar archive (tar.gz), the request could
 // be public or authenticated.
 func (gs *GalleriesService) Download(ctx context.Context, public bool, galleryID int64) (store.Gallery, io.ReadCloser, error) {
+	gallery, err := gs.downloadableGallery(ctx, public, galleryID)
+	if err != nil {
+		return store.Gallery{}, nil, err
+	}
+	return gs.startArchive(ctx, gallery, func() ([]store.Image, error) {
+		return galleryImages(gs.store, galleryID)
+	})
+}
 
-	gallery, err := gs.store.Galleries.Get(galleryID)
+// Download the selected images of a gallery as a compressed tar archive (tar.gz), the
+// request could be public or authenticated. All the images must belong to the gallery.
+func (gs *GalleriesService) DownloadSelection(ctx context.Context, public bool, galleryID int64, imageIDs []int64) (store.Gallery, io.ReadCloser, error) {
+	gallery, err := gs.downloadableGallery(ctx, public, galleryID)
 	if err != nil {
 		return store.Gallery{}, nil, err
 	}
 
-	// Depending of the type of the request check if the request could be performed.
-	// If it is a public request, check that the gallery is published, else check
-	// the authenticated user is the owner of the gallery.
+	images, err := gs.store.Images.GetMany(imageIDs)
+	if err != nil {
+		return store.Gallery{}, nil, err
+	}
+	if len(images) != len(imageIDs) {
+		return store.Gallery{}, nil, store.ErrRecordNotFound
+	}
+	for _, image := range images {
+		if image.GalleryID != galleryID {
+			return store.Gallery{}, nil, store.ErrForbidden
+		}
+	}
+
+	return gs.startArchive(ctx, gallery, func() ([]store.Image, error) {
+		return images, nil
+	})
+}
+
+// Retrieve a gallery to be downloaded, checking that the request could be performed.
+// If it is a public request, check that the gallery is published, else check the
+// authenticated user is the owner of the gallery.
+func (gs *GalleriesService) downloadableGallery(ctx context.Context, public bool, galleryID int64) (store.Gallery, error) {
+	gallery, err := gs.store.Galleries.Get(galleryID)
+	if err != nil {
+		return store.Gallery{}, err
+	}
+
 	if public {
 		if !gallery.Published {
-			return store.Gallery{}, nil, store.ErrForbidden
+			return store.Gallery{}, store.ErrForbidden
 		}
 	} else {
 		authData, err := auth.ContextGetAuth(ctx)
 		if err != nil {
-			return store.Gallery{}, nil, err
+			return store.Gallery{}, err
 		}
 		if authData.User.ID != gallery.UserID {
-			return store.Gallery{}, nil, store.ErrForbidden
+			return store.Gallery{}, store.ErrForbidden
 		}
 	}
+	return gallery, nil
+}
 
+// Start streaming the archive of the images returned by the provided function, which is
+// called only once a slot of the semaphore is acquired. The returned reader provides
+// the bytes of the archive.
+func (gs *GalleriesService) startArchive(ctx context.Context, gallery store.Gallery, images func() ([]store.Image, error)) (store.Gallery, io.ReadCloser, error) {
 	// Try to acquire a token in the semaphore and continue in case of success. If the
 	// the current concurrency is reached, return an explicative error to inform the
 	// caller that the service is currently too busy.
-	select {
-	case gs.sema <- struct{}{}:
-	default:
+	if !gs.sema.tryAcquire() {
+		gs.busy.Inc()
 		return store.Gallery{}, nil, ErrBusy
 	}
+	gs.inFlight.Inc()
 
 	// Start a goroutine in charge of streaming the compressed tar archive to the provided
 	// writer. The writer is an io.Pipe, which is necessary since the caller expects a reader.
@@ -126,12 +267,20 @@ func (gs *GalleriesService) Download(ctx context.Context, public bool, galleryID
 		// reading from the reader) that the bytes are ended.
 		defer func() {
 			w.Close()
-			<-gs.sema
+			gs.inFlight.Dec()
+			gs.sema.release()
 		}()
 
 		// Start the helper function that will write the newly generated archive
-		// into the writer passed in.
-		err := gs.streamGallery(ctx, w, galleryID)
+		// into the writer passed in, throttled by the shared limiter if present.
+		var dst io.Writer = w
+		if gs.limiter != nil {
+			dst = &limitedWriter{ctx: ctx, w: w, limiter: gs.limiter}
+		}
+		imgs, err := images()
+		if err == nil {
+			err = gs.streamImages(dst, imgs)
+		}
 		if err != nil {
 			switch {
 			// This error is originated from the consumer side and we cannot do anything
@@ -149,11 +298,21 @@ func (gs *GalleriesService) Download(ctx context.Context, public bool, galleryID
 	return gallery, r, nil
 }
 
+// Change the maximum number of gallery archives built concurrently. Downloads
+// in progress are not interrupted if the new limit is lower than their number,
+// new downloads are rejected until enough of them complete.
+func (gs *GalleriesService) SetConcurrency(n uint) {
+	gs.sema.resize(n)
+}
+
 // Create a new gallery with the provided data, owned by the authenticated user.
 func (gs *GalleriesService) Insert(ctx context.Context, gallery store.Gallery) (store.Gallery, error) {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Gallery{}, err
+	}
 
-	gallery, err := gs.store.Galleries.Insert(store.Gallery{
+	gallery, err = gs.store.Galleries.Insert(store.Gallery{
 		UserID:      authData.User.ID,
 		Title:       gallery.Title,
 		Description: gallery.Description,
@@ -168,7 +327,10 @@ func (gs *GalleriesService) Insert(ctx context.Context, gallery store.Gallery) (
 // Updates an existing gallery with the data provided, the gallery must be owned
 // by the authenticated user.
 func (gs *GalleriesService) Update(ctx context.Context, gallery store.Gallery) (store.Gallery, error) {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Gallery{}, err
+	}
 
 	galleryToUpdate, err := gs.store.Galleries.Get(gallery.ID)
 	if err != nil {
@@ -180,18 +342,45 @@ func (gs *GalleriesService) Update(ctx context.Context, gallery store.Gallery) (
 		return store.Gallery{}, store.ErrForbidden
 	}
 
+	// The cover image must be one of the images of the gallery (and so it
+	// is owned by the authenticated user).
+	if gallery.CoverImageID != nil {
+		image, err := gs.store.Images.Get(*gallery.CoverImageID)
+		if err != nil && !errors.Is(err, store.ErrRecordNotFound) {
+			return store.Gallery{}, err
+		}
+		if err != nil || image.GalleryID != gallery.ID {
+			v := validator.New()
+			v.AddError("cover_image_id", "must be an image of the gallery")
+			return store.Gallery{}, v
+		}
+	}
+
+	// If the client provided the version of the gallery it has seen, the
+	// update must be applied to that version, otherwise the current one is
+	// used.
+	version := galleryToUpdate.Version
+	if gallery.Version != 0 {
+		version = gallery.Version
+	}
+
 	gallery, err = gs.store.Galleries.Update(store.Gallery{
-		ID:          gallery.ID,
-		Title:       gallery.Title,
-		Description: gallery.Description,
-		Published:   gallery.Published,
-		UserID:      authData.User.ID,
+		ID:           gallery.ID,
+		Version:      version,
+		Title:        gallery.Title,
+		Description:  gallery.Description,
+		Published:    gallery.Published,
+		CoverImageID: gallery.CoverImageID,
+		UserID:       authData.User.ID,
 	})
 	if err != nil {
 		switch {
-		case errors.Is(err, store.ErrRecordNotFound):
-			// The gallery is not more present, this is a concurrency issue, that is while
-			// this request is being processed another request deleted the gallery.
+		// The cover image was deleted concurrently during this request.
+		case errors.Is(err, store.ErrCoverImageNotFound):
+			return store.Gallery{}, store.ErrEditConflict
+		case errors.Is(err, store.ErrEditConflict):
+			// The gallery was modified or deleted by another request while this
+			// request was being processed.
 			return store.Gallery{}, store.ErrEditConflict
 		default:
 			return store.Gallery{}, err
@@ -204,7 +393,10 @@ func (gs *GalleriesService) Update(ctx context.Context, gallery store.Gallery) (
 // Delete a gallery and all related images. The authenticated user must be
 // the owner of the gallery.
 func (gs *GalleriesService) Delete(ctx context.Context, galleryID int64) error {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return err
+	}
 
 	galleryToDelete, err := gs.store.Galleries.Get(galleryID)
 	if err != nil {
@@ -216,63 +408,122 @@ func (gs *GalleriesService) Delete(ctx context.Context, galleryID int64) error {
 		return store.ErrForbidden
 	}
 
-	// Retrieves all the images of the gallery of the authenticated user and
-	// delete all of them. Break the loop while all images are processed.
-	var page = 1
-	for {
-		pagImages, meta, err := gs.store.Images.GetAllForGallery(galleryID, filters.Input{
-			Page:         page,
-			PageSize:     100,
-			SortCol:      "id",
-			SortSafeList: []string{"id"},
-		})
+	// Delete the image rows, decrement the stats of the user and delete the gallery in
+	// a single transaction, so a failure leaves everything in place. The files are
+	// removed only after the commit: if a removal fails the file is an orphan, which
+	// is reported and can be removed by the storage command of the CLI.
+	var deleted []store.Image
+	err = gs.store.WithTx(func(tx store.Store) error {
+		images, err := galleryImages(tx, galleryID)
 		if err != nil {
 			return err
 		}
-		for _, image := range pagImages {
-			err := gs.store.Images.Delete(image.ID)
+		var bytes int64
+		for _, image := range images {
+			image, err := tx.Images.DeleteRecord(image.ID)
+			if err != nil {
+				switch {
+				case errors.Is(err, store.ErrRecordNotFound):
+					// Deleted concurrently along with its stats.
+					continue
+				default:
+					return err
+				}
+			}
+			deleted = append(deleted, image)
+			bytes += image.Size
+		}
+		if len(deleted) > 0 {
+			err = tx.Stats.IncrementImagesAndBytes(galleryToDelete.UserID, -len(deleted), -bytes)
 			if err != nil {
 				return err
 			}
 		}
-		if meta.LastPage == meta.CurrentPage {
-			break
+
+		err = tx.Galleries.DeleteGallery(galleryID)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrRecordNotFound):
+				// Edit conflict, but still ok in this case,
+				// someone else already deleted the gallery.
+			default:
+				return err
+			}
 		}
-		page++
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	err = gs.store.Galleries.DeleteGallery(galleryID)
-	if err != nil {
-		switch {
-		case errors.Is(err, store.ErrRecordNotFound):
-			// Edit conflict, but still ok in this case,
-			// someone else already deleted the gallery.
-		default:
-			return err
+	for _, image := range deleted {
+		err := gs.store.Images.DeleteFile(image)
+		if err != nil {
+			gs.logger.Errorw("deleting image file, the file is orphaned", "image_id", image.ID, "path", image.Path, "err", err)
 		}
 	}
 
 	return nil
 }
 
-// The streamGallery function is a helper that writes a compressed tar archive to the
-// provided writer argument. The writer could be a file or a network connection, or
-// alternatively it could be a write end of a pipe. In the last case, this function
-// is typically called in a separate goroutine.
-func (gs *GalleriesService) streamGallery(ctx context.Context, w io.Writer, galleryID int64) error {
+// Compute the aggregate statistics of a gallery of the authenticated user: the number of
+// images, their total size and the last update of the gallery or of one of its images.
+func (gs *GalleriesService) Stats(ctx context.Context, galleryID int64) (Stats, error) {
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	gallery, err := gs.store.Galleries.Get(galleryID)
+	if err != nil {
+		return Stats{}, err
+	}
+	if authData.User.ID != gallery.UserID {
+		return Stats{}, store.ErrForbidden
+	}
+
+	agg, err := gs.store.Images.AggregateForGallery(galleryID)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats := Stats{
+		GalleryID:   galleryID,
+		Images:      agg.Count,
+		Bytes:       agg.Bytes,
+		LastUpdated: gallery.UpdatedAt,
+	}
+	if agg.LastUpdated != nil && agg.LastUpdated.After(stats.LastUpdated) {
+		stats.LastUpdated = *agg.LastUpdated
+	}
+	return stats, nil
+}
+
+// Count a view of a public gallery, or a download if download is true. The owner
+// is excluded if configured so and the request is authenticated.
+func (gs *GalleriesService) CountView(ctx context.Context, gallery store.Gallery, download bool) error {
+	if gs.exclOwner {
+		authData, err := auth.ContextGetAuth(ctx)
+		if err == nil && authData.User.ID == gallery.UserID {
+			return nil
+		}
+	}
+	return gs.store.Galleries.IncrementViews(gallery.ID, download)
+}
 
-	// Iterate over subsequent pages of images collecting all of them.
+// Retrieve all the images of a gallery, iterating over subsequent pages. The store
+// could be bound to a transaction.
+func galleryImages(s store.Store, galleryID int64) ([]store.Image, error) {
 	var images []store.Image
 	var page = 1
 	for {
-		pagImages, pagOut, err := gs.store.Images.GetAllForGallery(galleryID, filters.Input{
+		pagImages, pagOut, err := s.Images.GetAllForGallery(galleryID, filters.Input{
 			Page:         page,
 			PageSize:     100,
 			SortCol:      "id",
 			SortSafeList: []string{"id"},
 		})
 		if err != nil {
-			return err
+			return nil, err
 		}
 		images = append(images, pagImages...)
 		if pagOut.CurrentPage == pagOut.LastPage {
@@ -280,44 +531,39 @@ func (gs *GalleriesService) streamGallery(ctx context.Context, w io.Writer, gall
 		}
 		page++
 	}
+	return images, nil
+}
 
+// The streamImages function is a helper that writes a compressed tar archive of the
+// provided images to the writer argument. The writer could be a file or a network
+// connection, or alternatively it could be a write end of a pipe. In the last case,
+// this function is typically called in a separate goroutine.
+func (gs *GalleriesService) streamImages(w io.Writer, images []store.Image) error {
 	// Build a writer that, in order, writes files to the tar archive, compress the data and
 	// re-writes resulting bytes to the provided writer argument. To obtain this we chain
 	// different types of writers, possible due to the fact that both the tar and the gzip
 	// writers need a writer interface and not a concrete type.
-	gzipWriter := gzip.NewWriter(w)
+	level := gs.level
+	if gs.auto && mostlyCompressed(images) {
+		level = gzip.NoCompression
+	}
+	gzipWriter, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
 	tarWriter := tar.NewWriter(gzipWriter)
 
-	for _, image := range images {
-		readCloser, err := gs.store.Images.GetReader(image.ID)
-		if err != nil {
-			return err
-		}
+	// Names of the entries already in the archive, to avoid duplicates.
+	entryNames := make(map[string]bool, len(images))
 
-		// We must cache all the image bytes in memory since the file size of the archive
-		// entries must be actually written before the data itself.
-		imageBytes, err := io.ReadAll(readCloser)
-		if err != nil {
-			return err
-		}
-		err = readCloser.Close()
-		if err != nil {
-			return err
-		}
-		imageName := image.Title
-		if image.Title == "" {
+	for _, image := range images {
+		imageName := archiveEntryName(image.Title)
+		if imageName == "" {
 			imageName = filepath.Base(image.Path)
 		}
+		imageName = uniqueEntryName(imageName, image.ID, entryNames)
 
-		err = tarWriter.WriteHeader(&tar.Header{
-			Size: int64(len(imageBytes)),
-			Name: imageName,
-			Mode: 0666,
-		})
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(tarWriter, bytes.NewReader(imageBytes))
+		err := gs.writeArchiveEntry(tarWriter, image, imageName)
 		if err != nil {
 			return err
 		}
@@ -325,7 +571,7 @@ func (gs *GalleriesService) streamGallery(ctx context.Context, w io.Writer, gall
 
 	// Close the writers to flush all the data to the writer provided
 	// as argument. Here the order matters.
-	err := tarWriter.Flush()
+	err = tarWriter.Flush()
 	if err != nil {
 		return err
 	}
@@ -335,3 +581,147 @@ func (gs *GalleriesService) streamGallery(ctx context.Context, w io.Writer, gall
 	}
 	return gzipWriter.Close()
 }
+
+// Write the image to the tar archive as an entry with the provided name. The bytes are
+// streamed from the file, using the size of the image for the header. The tar format
+// requires the entry to be exactly as long as declared in the header: if the file is
+// longer the tar writer fails, if it is shorter the entry would be padded with the
+// next entry bytes, so both cases are reported instead of producing a broken archive.
+func (gs *GalleriesService) writeArchiveEntry(tw *tar.Writer, image store.Image, name string) error {
+	readCloser, err := gs.store.Images.GetReader(image.ID)
+	if err != nil {
+		return err
+	}
+	defer readCloser.Close()
+
+	// Regular file entries, the modification time is the last update of the image
+	// so extracted files preserve a meaningful timestamp.
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Size:     image.Size,
+		Name:     name,
+		Mode:     int64(gs.fileMode.Perm()),
+		ModTime:  image.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, readCloser)
+	if err != nil {
+		return fmt.Errorf("archive entry %s: %w", name, err)
+	}
+	if n != image.Size {
+		return fmt.Errorf("archive entry %s: wrote %d bytes, %d declared", name, n, image.Size)
+	}
+	return nil
+}
+
+// Content types of the image formats already compressed, gzip
+// barely reduces their size at a considerable CPU cost.
+var compressedTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/heic"}
+
+// Report whether at least 80% of the bytes of the images are of already compressed formats.
+func mostlyCompressed(images []store.Image) bool {
+	var total, compressed int64
+	for _, image := range images {
+		total += image.Size
+		for _, t := range compressedTypes {
+			if image.ContentType == t {
+				compressed += image.Size
+				break
+			}
+		}
+	}
+	return total > 0 && compressed*5 >= total*4
+}
+
+// Sanitize an image title to be used as name of an archive entry. Titles are user
+// provided, so they could contain path separators, absolute paths or '..' segments
+// that would write outside the extraction directory (zip-slip). Only the last
+// element of the path is kept, then it is sanitized like the file names on disk,
+// so that control characters (e.g. NUL bytes truncating the name) don't reach the
+// archive. An empty string is returned if nothing usable remains.
+func archiveEntryName(title string) string {
+	name := strings.ReplaceAll(title, "\\", "/")
+	return store.SanitizeFileName(path.Base(path.Clean("/" + name)))
+}
+
+// Make the archive entry name unique among the already used names, which are updated.
+// Extracting an archive with duplicate names would silently overwrite files, so on a
+// collision the image ID is appended to the name, before the extension. If the name is
+// still taken a numeric suffix is appended as well.
+func uniqueEntryName(name string, imageID int64, used map[string]bool) string {
+	if !used[name] {
+		used[name] = true
+		return name
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	unique := fmt.Sprintf("%s_%d%s", base, imageID, ext)
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d_%d%s", base, imageID, i, ext)
+	}
+	used[unique] = true
+	return unique
+}
+
+// The limitedWriter throttles writes to the underlying writer using a rate limiter,
+// where each byte costs a token. Writes larger than the limiter burst are split in
+// smaller chunks. Waits are interrupted when the context is cancelled.
+type limitedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	limiter *rate.Limiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := len(p)
+		if burst := lw.limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		err := lw.limiter.WaitN(lw.ctx, chunk)
+		if err != nil {
+			return written, err
+		}
+		n, err := lw.w.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// The semaphore bounds the number of concurrent downloads. Unlike a buffered
+// channel its size can be changed while tokens are held.
+type semaphore struct {
+	mu     sync.Mutex
+	limit  uint
+	active uint
+}
+
+// Acquire a token if one is available, without blocking.
+func (s *semaphore) tryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active >= s.limit {
+		return false
+	}
+	s.active++
+	return true
+}
+
+func (s *semaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+}
+
+func (s *semaphore) resize(limit uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+}
@@ -0,0 +1,649 @@
+package galleries
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+	"github.com/anBertoli/snap-vault/pkg/validator"
+)
+
+func newMockService(t *testing.T) (*GalleriesService, store.Store, *storetest.Mock) {
+	s, m := storetest.NewMock(t)
+	gs := NewGalleriesService(s, zap.NewNop().Sugar(), Config{
+		Concurrency: 1,
+		Registerer:  prometheus.NewRegistry(),
+	})
+	return gs, s, m
+}
+
+// The owner and the public visibility of a gallery are checked before returning it.
+func TestGet(t *testing.T) {
+	owner := store.User{ID: 1, Activated: true}
+	other := store.User{ID: 2, Activated: true}
+
+	tests := []struct {
+		name    string
+		gallery *store.Gallery
+		user    *store.User
+		public  bool
+		err     error
+	}{
+		{name: "not found", user: &owner, err: store.ErrRecordNotFound},
+		{name: "public not found", public: true, err: store.ErrRecordNotFound},
+		{name: "owner", gallery: &store.Gallery{ID: 10, UserID: owner.ID}, user: &owner},
+		{name: "other user", gallery: &store.Gallery{ID: 10, UserID: owner.ID}, user: &other, err: store.ErrForbidden},
+		{name: "other user of published", gallery: &store.Gallery{ID: 10, UserID: owner.ID, Published: true}, user: &other, err: store.ErrForbidden},
+		{name: "public published", gallery: &store.Gallery{ID: 10, UserID: owner.ID, Published: true}, public: true},
+		{name: "public unpublished", gallery: &store.Gallery{ID: 10, UserID: owner.ID}, public: true, err: store.ErrForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs, s, m := newMockService(t)
+			ctx := context.Background()
+			if tt.user != nil {
+				ctx = storetest.MockAuthContext(t, s, m, *tt.user)
+			}
+			if tt.gallery != nil {
+				m.Set(*tt.gallery)
+			}
+
+			gallery, err := gs.Get(ctx, tt.public, 10)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if err == nil && gallery.ID != tt.gallery.ID {
+				t.Fatalf("expected gallery %d, got %d", tt.gallery.ID, gallery.ID)
+			}
+		})
+	}
+}
+
+// A missing cover image doesn't prevent the gallery from being returned.
+func TestGetMissingCover(t *testing.T) {
+	gs, s, m := newMockService(t)
+	ctx := storetest.MockAuthContext(t, s, m, store.User{ID: 1, Activated: true})
+	cover := int64(5)
+	m.Set(store.Gallery{ID: 10, UserID: 1, CoverImageID: &cover})
+
+	gallery, err := gs.Get(ctx, false, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gallery.CoverImageID != nil || gallery.CoverImage != nil {
+		t.Fatalf("expected no cover image, got %v", gallery.CoverImageID)
+	}
+}
+
+// Only the owner can update a gallery.
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		gallery *store.Gallery
+		err     error
+	}{
+		{name: "not found", err: store.ErrRecordNotFound},
+		{name: "other user", gallery: &store.Gallery{ID: 10, UserID: 2, Version: 1}, err: store.ErrForbidden},
+		{name: "owner", gallery: &store.Gallery{ID: 10, UserID: 1, Version: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs, s, m := newMockService(t)
+			ctx := storetest.MockAuthContext(t, s, m, store.User{ID: 1, Activated: true})
+			if tt.gallery != nil {
+				m.Set(*tt.gallery)
+			}
+
+			_, err := gs.Update(ctx, store.Gallery{ID: 10, Title: "New title"})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// The cover image must be one of the images of the gallery.
+func TestUpdateForeignCover(t *testing.T) {
+	gs, s, m := newMockService(t)
+	ctx := storetest.MockAuthContext(t, s, m, store.User{ID: 1, Activated: true})
+	m.Set(store.Gallery{ID: 10, UserID: 1, Version: 1})
+	m.Set(store.Image{ID: 5, GalleryID: 11, UserID: 1})
+
+	cover := int64(5)
+	_, err := gs.Update(ctx, store.Gallery{ID: 10, Title: "New title", CoverImageID: &cover})
+	var v validator.Validator
+	if !errors.As(err, &v) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+}
+
+// Titles are reduced to a single safe component, so that the extraction of an
+// archive cannot write outside its directory.
+func TestArchiveEntryName(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{title: "sunset.png", want: "sunset.png"},
+		{title: "../../etc/passwd", want: "passwd"},
+		{title: "/etc/passwd", want: "passwd"},
+		{title: `..\..\windows\win.ini`, want: "win.ini"},
+		{title: "photos/../../../x.png", want: "x.png"},
+		{title: "photos/", want: "photos"},
+		{title: "evil.sh\x00.png", want: "evil.sh_.png"},
+		{title: "line\nbreak.png", want: "line_break.png"},
+		{title: ".hidden.png", want: "hidden.png"},
+		{title: ".."},
+		{title: "."},
+		{title: "/"},
+		{title: "\x00"},
+		{title: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			got := archiveEntryName(tt.title)
+			if got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// Tokens are not available over the limit, also after the limit is lowered
+// while they are held.
+func TestSemaphore(t *testing.T) {
+	s := &semaphore{limit: 1}
+	if !s.tryAcquire() || s.tryAcquire() {
+		t.Fatal("expected a single token with limit 1")
+	}
+	s.resize(3)
+	if !s.tryAcquire() || !s.tryAcquire() || s.tryAcquire() {
+		t.Fatal("expected 3 tokens after growing the limit")
+	}
+	s.resize(1)
+	s.release()
+	s.release()
+	if s.tryAcquire() {
+		t.Fatal("expected no tokens until the held ones are below the new limit")
+	}
+	s.release()
+	if !s.tryAcquire() {
+		t.Fatal("expected a token once all the held ones are released")
+	}
+}
+
+// Downloads over the concurrency limit are rejected with ErrBusy, and the limit
+// can be changed at runtime.
+func TestArchiveConcurrency(t *testing.T) {
+	gs, _, _ := newMockService(t)
+	ctx := context.Background()
+	gallery := store.Gallery{ID: 1}
+
+	// The archives are kept in progress until unblocked.
+	unblock := make(chan struct{})
+	images := func() ([]store.Image, error) {
+		<-unblock
+		return nil, nil
+	}
+	start := func() (io.ReadCloser, error) {
+		_, r, err := gs.startArchive(ctx, gallery, images)
+		return r, err
+	}
+
+	first, err := start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = start()
+	if !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy with concurrency 1, got %v", err)
+	}
+
+	gs.SetConcurrency(2)
+	second, err := start()
+	if err != nil {
+		t.Fatalf("expected a download after raising the concurrency, got %v", err)
+	}
+	_, err = start()
+	if !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy with concurrency 2, got %v", err)
+	}
+
+	// Once the downloads complete, only one at a time is allowed again.
+	gs.SetConcurrency(1)
+	close(unblock)
+	for _, r := range []io.ReadCloser{first, second} {
+		_, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Close()
+	}
+	waitIdle(t, gs)
+
+	third, err := start()
+	if err != nil {
+		t.Fatalf("expected a download after the others completed, got %v", err)
+	}
+	defer third.Close()
+	_, err = start()
+	if !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy after lowering the concurrency, got %v", err)
+	}
+}
+
+// Wait for the tokens of the completed downloads to be released, which happens
+// right after their archives are closed.
+func waitIdle(t *testing.T, gs *GalleriesService) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		gs.sema.mu.Lock()
+		active := gs.sema.active
+		gs.sema.mu.Unlock()
+		if active == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d downloads still in progress", active)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Insert a gallery with two images, counted in the stats of the user.
+func insertGalleryImages(t *testing.T, s store.Store, user store.User) (store.Gallery, []store.Image) {
+	t.Helper()
+	gallery, err := s.Galleries.Insert(store.Gallery{UserID: user.ID, Title: "gallery"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []store.Image
+	var size int64
+	for _, title := range []string{"first.png", "second.png"} {
+		image, err := s.Images.Insert(strings.NewReader("content of "+title), store.Image{
+			Title:       title,
+			ContentType: "image/png",
+			GalleryID:   gallery.ID,
+			UserID:      user.ID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, image)
+		size += image.Size
+	}
+	err = s.Stats.IncrementImagesAndBytes(user.ID, len(images), size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gallery, images
+}
+
+// Deleting a gallery deletes its images, files included, and decrements the stats.
+func TestDelete(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "gallery-delete")
+	ctx := storetest.AuthContext(t, s, user)
+	gs := NewGalleriesService(s, zap.NewNop().Sugar(), Config{Concurrency: 1, Registerer: prometheus.NewRegistry()})
+	gallery, images := insertGalleryImages(t, s, user)
+
+	err := gs.Delete(ctx, gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Galleries.Get(gallery.ID)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected the gallery to be deleted, got %v", err)
+	}
+	for _, image := range images {
+		_, err = s.Images.Get(image.ID)
+		if !errors.Is(err, store.ErrRecordNotFound) {
+			t.Fatalf("expected the image %d to be deleted, got %v", image.ID, err)
+		}
+	}
+	orphans, err := s.Images.FindOrphans(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans) != 0 {
+		t.Fatalf("expected the files to be deleted, got %v", orphans)
+	}
+	stats, err := s.Stats.GetForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Images != 0 || stats.Space != 0 {
+		t.Fatalf("expected the stats to be decremented, got %+v", stats)
+	}
+}
+
+// If the stats can't be decremented nothing is deleted, files included.
+func TestDeleteStatsFailure(t *testing.T) {
+	s, db := storetest.New(t)
+	user := storetest.NewUser(t, s, "gallery-fail-stats")
+	ctx := storetest.AuthContext(t, s, user)
+	gs := NewGalleriesService(s, zap.NewNop().Sugar(), Config{Concurrency: 1, Registerer: prometheus.NewRegistry()})
+	gallery, images := insertGalleryImages(t, s, user)
+
+	storetest.FailWrites(t, db, "stats", "UPDATE", "gallery-fail-stats", "NEW.n_images < OLD.n_images")
+	err := gs.Delete(ctx, gallery.ID)
+	if err == nil {
+		t.Fatal("expected the deletion to fail")
+	}
+
+	_, err = s.Galleries.Get(gallery.ID)
+	if err != nil {
+		t.Fatalf("gallery not found after the failed deletion: %v", err)
+	}
+	for _, image := range images {
+		file, err := s.Images.GetReader(image.ID)
+		if err != nil {
+			t.Fatalf("image %d not found after the failed deletion: %v", image.ID, err)
+		}
+		content, err := io.ReadAll(file)
+		_ = file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "content of "+image.Title {
+			t.Fatalf("unexpected content of image %d: %q", image.ID, content)
+		}
+	}
+}
+
+// Save the file of the image returned by the mock for all the IDs.
+func mockImageFile(t *testing.T, m *storetest.Mock, content string) store.Image {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(m.Root, "image.bin"), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := store.Image{ID: 1, Path: "image.bin", Size: int64(len(content))}
+	m.Set(image)
+	return image
+}
+
+// Read all the entries of a gzipped tar archive.
+func extractArchive(t *testing.T, r io.Reader) ([]*tar.Header, map[string]string) {
+	t.Helper()
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	var headers []*tar.Header
+	files := map[string]string{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return headers, files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, header)
+		files[header.Name] = string(content)
+	}
+}
+
+// Images with the same title are all present in the archive, with unique names
+// keeping the extension, and with the file mode and modification time set.
+func TestStreamDuplicateTitles(t *testing.T) {
+	gs, _, m := newMockService(t)
+	file := mockImageFile(t, m, "image bytes")
+	updated := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	var images []store.Image
+	for i, title := range []string{"IMG_0001.jpg", "IMG_0001.jpg", "IMG_0001.jpg", "other/IMG_0001_2.jpg", ""} {
+		image := file
+		image.ID = int64(i + 1)
+		image.Title = title
+		image.UpdatedAt = updated
+		images = append(images, image)
+	}
+
+	var archive bytes.Buffer
+	err := gs.streamImages(&archive, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, files := extractArchive(t, &archive)
+
+	expected := []string{"IMG_0001.jpg", "IMG_0001_2.jpg", "IMG_0001_3.jpg", "IMG_0001_2_4.jpg", "image.bin"}
+	if len(headers) != len(expected) || len(files) != len(expected) {
+		t.Fatalf("expected %d files, got %v", len(expected), files)
+	}
+	for i, header := range headers {
+		if header.Name != expected[i] {
+			t.Errorf("entry %d: expected name %s, got %s", i, expected[i], header.Name)
+		}
+		if files[header.Name] != "image bytes" {
+			t.Errorf("entry %s: unexpected content %q", header.Name, files[header.Name])
+		}
+		if header.Mode != int64(defaultArchiveFileMode.Perm()) || !header.ModTime.Equal(updated) {
+			t.Errorf("entry %s: unexpected mode %o and modification time %v", header.Name, header.Mode, header.ModTime)
+		}
+	}
+}
+
+// A file shorter or longer than the declared size of the image fails the archive,
+// and the error reaches the reader of the download instead of a broken archive.
+func TestStreamSizeMismatch(t *testing.T) {
+	gs, _, m := newMockService(t)
+	file := mockImageFile(t, m, "image bytes")
+
+	for _, size := range []int64{file.Size - 5, file.Size + 5} {
+		image := file
+		image.Title = "image.png"
+		image.Size = size
+
+		err := gs.streamImages(io.Discard, []store.Image{image})
+		if err == nil {
+			t.Fatalf("declared size %d of %d bytes: expected an error", size, file.Size)
+		}
+
+		_, r, err := gs.startArchive(context.Background(), store.Gallery{ID: 1}, func() ([]store.Image, error) {
+			return []store.Image{image}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(r)
+		_ = r.Close()
+		if err == nil {
+			t.Fatalf("declared size %d of %d bytes: expected the download to fail", size, file.Size)
+		}
+		waitIdle(t, gs)
+	}
+}
+
+// Return the size of the archive of the images built with the compression level.
+func archiveSize(t testing.TB, gs *GalleriesService, level int, images []store.Image) int {
+	t.Helper()
+	gs.level = level
+	var archive bytes.Buffer
+	err := gs.streamImages(&archive, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive.Len()
+}
+
+// Higher levels produce smaller archives of compressible images, while galleries of
+// already compressed formats are archived without compression if so configured.
+func TestArchiveCompression(t *testing.T) {
+	gs, _, m := newMockService(t)
+	file := mockImageFile(t, m, strings.Repeat("compressible image bytes ", 4000))
+	image := file
+	image.Title = "image.bmp"
+	image.ContentType = "image/bmp"
+	images := []store.Image{image}
+
+	stored := archiveSize(t, gs, gzip.NoCompression, images)
+	fast := archiveSize(t, gs, gzip.BestSpeed, images)
+	best := archiveSize(t, gs, gzip.BestCompression, images)
+	if stored <= int(file.Size) || fast >= stored/10 || best > fast {
+		t.Fatalf("unexpected archive sizes: stored %d, fastest %d, best %d", stored, fast, best)
+	}
+
+	// The same bytes declared as JPEG are not compressed with the auto compression.
+	gs.auto = true
+	image.ContentType = "image/jpeg"
+	auto := archiveSize(t, gs, gzip.BestCompression, []store.Image{image})
+	if auto != stored {
+		t.Fatalf("expected the size without compression %d, got %d", stored, auto)
+	}
+}
+
+// Compare the time and the size of the archives at different compression levels.
+func BenchmarkArchiveCompression(b *testing.B) {
+	s, m := storetest.NewMock(b)
+	gs := NewGalleriesService(s, zap.NewNop().Sugar(), Config{Concurrency: 1, Registerer: prometheus.NewRegistry()})
+
+	// Random bytes, as the ones of compressed formats, with a text section.
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(content[:len(content)/2])
+	copy(content[len(content)/2:], strings.Repeat("compressible image bytes ", len(content)/50))
+	err := os.WriteFile(filepath.Join(m.Root, "image.bin"), content, 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	image := store.Image{ID: 1, Title: "image.bin", Path: "image.bin", Size: int64(len(content))}
+	m.Set(image)
+
+	for _, level := range []int{gzip.NoCompression, gzip.BestSpeed, gzip.DefaultCompression, gzip.BestCompression} {
+		b.Run(fmt.Sprintf("level=%d", level), func(b *testing.B) {
+			b.SetBytes(image.Size)
+			var size int
+			for i := 0; i < b.N; i++ {
+				size = archiveSize(b, gs, level, []store.Image{image})
+			}
+			b.ReportMetric(float64(size), "archive-bytes")
+		})
+	}
+}
+
+// The aggregates of a gallery are reported to its owner only, with the last update
+// of the gallery or of its images, whichever is the latest.
+func TestStats(t *testing.T) {
+	gs, s, m := newMockService(t)
+	galleryUpdate := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	imageUpdate := galleryUpdate.Add(time.Hour)
+	m.Set(store.Gallery{ID: 10, UserID: 1, UpdatedAt: galleryUpdate})
+	m.Set(store.ImagesAggregate{Count: 3, Bytes: 300, LastUpdated: &imageUpdate})
+
+	ctx := storetest.MockAuthContext(t, s, m, store.User{ID: 1, Activated: true})
+	stats, err := gs.Stats(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Stats{GalleryID: 10, Images: 3, Bytes: 300, LastUpdated: imageUpdate}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+
+	// Without images the last update is the one of the gallery.
+	m.Set(store.ImagesAggregate{})
+	stats, err = gs.Stats(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = Stats{GalleryID: 10, LastUpdated: galleryUpdate}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+
+	other := storetest.MockAuthContext(t, s, m, store.User{ID: 2, Activated: true})
+	_, err = gs.Stats(other, 10)
+	if !errors.Is(err, store.ErrForbidden) {
+		t.Fatalf("expected ErrForbidden for another user, got %v", err)
+	}
+}
+
+// The aggregates match the images inserted in the gallery.
+func TestStatsAggregates(t *testing.T) {
+	s, _ := storetest.New(t)
+	user := storetest.NewUser(t, s, "gallery-stats")
+	ctx := storetest.AuthContext(t, s, user)
+	gs := NewGalleriesService(s, zap.NewNop().Sugar(), Config{Concurrency: 1, Registerer: prometheus.NewRegistry()})
+	gallery, images := insertGalleryImages(t, s, user)
+
+	stats, err := gs.Stats(ctx, gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := images[0].Size + images[1].Size
+	if stats.GalleryID != gallery.ID || stats.Images != 2 || stats.Bytes != size || stats.LastUpdated.Before(images[1].UpdatedAt) {
+		t.Fatalf("unexpected stats %+v of images %+v", stats, images)
+	}
+}
+
+// Only images of the gallery can be selected, and all of them must exist.
+func TestDownloadSelection(t *testing.T) {
+	tests := []struct {
+		name string
+		// Galleries of the images found for the selection.
+		galleryIDs []int64
+		err        error
+	}{
+		{name: "valid subset", galleryIDs: []int64{10, 10}},
+		{name: "image of another gallery", galleryIDs: []int64{10, 11}, err: store.ErrForbidden},
+		{name: "missing image", galleryIDs: []int64{10}, err: store.ErrRecordNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gs, s, m := newMockService(t)
+			ctx := storetest.MockAuthContext(t, s, m, store.User{ID: 1, Activated: true})
+			m.Set(store.Gallery{ID: 10, UserID: 1})
+			file := mockImageFile(t, m, "image bytes")
+
+			var images []store.Image
+			for i, galleryID := range tt.galleryIDs {
+				image := file
+				image.ID = int64(i + 1)
+				image.Title = fmt.Sprintf("image %d", i+1)
+				image.GalleryID = galleryID
+				images = append(images, image)
+			}
+			m.Set(images)
+
+			_, r, err := gs.DownloadSelection(ctx, false, 10, []int64{1, 2})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			headers, _ := extractArchive(t, r)
+			if len(headers) != 2 || headers[0].Name != "image 1" || headers[1].Name != "image 2" {
+				t.Fatalf("expected the 2 selected images, got %v", headers)
+			}
+		})
+	}
+}
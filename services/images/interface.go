@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 
 	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
@@ -13,16 +14,52 @@ import (
 // via transport-specific adapters, e.g. the JSON-HTTP api.
 type Service interface {
 	ListAllPublic(ctx context.Context, filter filters.Input) ([]store.Image, filters.Meta, error)
+	ListPublicAfter(ctx context.Context, afterID int64, limit int) ([]store.Image, error)
+	ListPublicPageCursors(ctx context.Context, pageSize int) ([]int64, error)
 	ListForGallery(ctx context.Context, public bool, galleryID int64, filter filters.Input) ([]store.Image, filters.Meta, error)
+	ListAllOwned(ctx context.Context, filter filters.Input) ([]store.Image, filters.Meta, error)
+	ListMoveTargets(ctx context.Context, imageID int64, filter filters.Input) ([]store.Gallery, filters.Meta, error)
 	Get(ctx context.Context, public bool, imageID int64) (store.Image, error)
-	Download(ctx context.Context, public bool, imageID int64) (store.Image, io.ReadCloser, error)
+	Download(ctx context.Context, public bool, imageID int64) (store.Image, io.ReadSeekCloser, error)
+	SignURL(ctx context.Context, imageID int64, ttl time.Duration) (string, time.Time, error)
+	DownloadSigned(ctx context.Context, imageID, expires int64, signature string) (store.Image, io.ReadSeekCloser, error)
+	CountView(ctx context.Context, image store.Image) error
 	Insert(ctx context.Context, reader io.Reader, image store.Image) (store.Image, error)
+	Replace(ctx context.Context, reader io.Reader, image store.Image) (store.Image, store.Image, error)
 	Update(ctx context.Context, image store.Image) (store.Image, error)
+	Patch(ctx context.Context, imageID int64, patch Patch) (store.Image, error)
+	Reorder(ctx context.Context, galleryID int64, imageIDs []int64) error
 	Delete(ctx context.Context, imageID int64) (store.Image, error)
 }
 
+// Patch holds a partial update of an image. Nil fields are left unchanged, while
+// the caption could also be explicitly cleared with a non-nil pointer to a nil
+// string.
+type Patch struct {
+	Version *int
+	Title   *string
+	Caption **string
+}
+
+// Columns of the images that listings can be sorted (ascending
+// or descending) and searched by.
+var (
+	SortSafeList   = []string{"id", "title", "created_at", "position"}
+	SearchSafeList = []string{"title", "caption"}
+)
+
+// Defaults of the images listings.
+var ListDefaults = filters.Defaults{
+	PageSize:       20,
+	Sort:           "id",
+	SortSafeList:   SortSafeList,
+	SearchCol:      "title",
+	SearchSafeList: SearchSafeList,
+}
+
 var (
 	ErrMaxSpaceReached = errors.New("max space reached")
+	ErrGalleryFull     = errors.New("gallery full")
 )
 
 // This checks makes sure that all service implementation remain
@@ -31,3 +68,4 @@ var _ Service = &ImagesService{}
 var _ Service = &AuthMiddleware{}
 var _ Service = &ValidationMiddleware{}
 var _ Service = &StatsMiddleware{}
+var _ Service = &IdempotencyMiddleware{}
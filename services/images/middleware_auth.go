@@ -3,6 +3,7 @@ package images
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/anBertoli/snap-vault/pkg/auth"
 	"github.com/anBertoli/snap-vault/pkg/filters"
@@ -32,6 +33,28 @@ func (am *AuthMiddleware) ListForGallery(ctx context.Context, public bool, galle
 	return am.Service.ListForGallery(ctx, public, galleryID, filter)
 }
 
+// Perform authentication and check that permissions to list images are present.
+func (am *AuthMiddleware) ListAllOwned(ctx context.Context, filter filters.Input) ([]store.Image, filters.Meta, error) {
+	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionListImages)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+	return am.Service.ListAllOwned(ctx, filter)
+}
+
+// Perform authentication and check that permissions to list both images and
+// galleries are present.
+func (am *AuthMiddleware) ListMoveTargets(ctx context.Context, imageID int64, filter filters.Input) ([]store.Gallery, filters.Meta, error) {
+	authData, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionListImages)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+	if !authData.Perms.Include(store.PermissionMain, store.PermissionListGalleries) {
+		return nil, filters.Meta{}, auth.ErrNoPermission
+	}
+	return am.Service.ListMoveTargets(ctx, imageID, filter)
+}
+
 // Perform authentication and check that permissions to retrieve an image are present.
 func (am *AuthMiddleware) Get(ctx context.Context, public bool, imageID int64) (store.Image, error) {
 	if !public {
@@ -43,8 +66,15 @@ func (am *AuthMiddleware) Get(ctx context.Context, public bool, imageID int64) (
 	return am.Service.Get(ctx, public, imageID)
 }
 
+// Views are counted for anonymous requests too. If an auth key was provided, the user
+// is authenticated so the owner of the image can be recognized, ignoring failures.
+func (am *AuthMiddleware) CountView(ctx context.Context, image store.Image) error {
+	_, _ = am.Auth.RequireAuthenticatedUser(&ctx)
+	return am.Service.CountView(ctx, image)
+}
+
 // Perform authentication and check that permissions to download an image are present.
-func (am *AuthMiddleware) Download(ctx context.Context, public bool, imageID int64) (store.Image, io.ReadCloser, error) {
+func (am *AuthMiddleware) Download(ctx context.Context, public bool, imageID int64) (store.Image, io.ReadSeekCloser, error) {
 	if !public {
 		_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionDownloadImage)
 		if err != nil {
@@ -54,6 +84,16 @@ func (am *AuthMiddleware) Download(ctx context.Context, public bool, imageID int
 	return am.Service.Download(ctx, public, imageID)
 }
 
+// Perform authentication and check that permissions to download an image are present,
+// since the signed URL allows to download it.
+func (am *AuthMiddleware) SignURL(ctx context.Context, imageID int64, ttl time.Duration) (string, time.Time, error) {
+	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionDownloadImage)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return am.Service.SignURL(ctx, imageID, ttl)
+}
+
 // Perform authentication and check that permissions to create a new image are present.
 func (am *AuthMiddleware) Insert(ctx context.Context, reader io.Reader, image store.Image) (store.Image, error) {
 	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionCreateImage)
@@ -63,6 +103,15 @@ func (am *AuthMiddleware) Insert(ctx context.Context, reader io.Reader, image st
 	return am.Service.Insert(ctx, reader, image)
 }
 
+// Perform authentication and check that permissions to edit an existing image are present.
+func (am *AuthMiddleware) Replace(ctx context.Context, reader io.Reader, image store.Image) (store.Image, store.Image, error) {
+	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionUpdateImage)
+	if err != nil {
+		return store.Image{}, store.Image{}, err
+	}
+	return am.Service.Replace(ctx, reader, image)
+}
+
 // Perform authentication and check that permissions to edit an existing image are present.
 func (am *AuthMiddleware) Update(ctx context.Context, image store.Image) (store.Image, error) {
 	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionUpdateImage)
@@ -72,6 +121,24 @@ func (am *AuthMiddleware) Update(ctx context.Context, image store.Image) (store.
 	return am.Service.Update(ctx, image)
 }
 
+// Perform authentication and check that permissions to update an image are present.
+func (am *AuthMiddleware) Patch(ctx context.Context, imageID int64, patch Patch) (store.Image, error) {
+	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionUpdateImage)
+	if err != nil {
+		return store.Image{}, err
+	}
+	return am.Service.Patch(ctx, imageID, patch)
+}
+
+// Perform authentication and check that permissions to update images are present.
+func (am *AuthMiddleware) Reorder(ctx context.Context, galleryID int64, imageIDs []int64) error {
+	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionUpdateImage)
+	if err != nil {
+		return err
+	}
+	return am.Service.Reorder(ctx, galleryID, imageIDs)
+}
+
 // Perform authentication and check that permissions to delete an existing image are present.
 func (am *AuthMiddleware) Delete(ctx context.Context, imageID int64) (store.Image, error) {
 	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionDeleteImage)
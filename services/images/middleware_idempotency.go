@@ -0,0 +1,86 @@
+package images
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/idempotency"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/validator"
+)
+
+// The IdempotencyMiddleware makes the creation of images idempotent when the request
+// carries an idempotency key: the first request creates the image, while requests
+// repeated with the same key within the TTL return the same image (the body is not
+// read). A request still in progress holds its key at most for the Lease, so a crashed
+// request doesn't block the key until the TTL. Keys are scoped per user. The middleware
+// must be wrapped by the auth middleware, since the user must be known. Other methods
+// are handled directly by the embedded Service.
+type IdempotencyMiddleware struct {
+	Store  store.IdempotencyStore
+	TTL    time.Duration
+	Lease  time.Duration
+	Logger *zap.SugaredLogger
+	Service
+}
+
+const idempotencyScope = "images"
+
+// Create the image only if the key was never used (or it expired), otherwise
+// return the image created by the first request with the same key.
+func (im *IdempotencyMiddleware) Insert(ctx context.Context, reader io.Reader, image store.Image) (store.Image, error) {
+	key, ok := idempotency.ContextGetKey(ctx)
+	if !ok {
+		return im.Service.Insert(ctx, reader, image)
+	}
+	v := validator.New()
+	v.Check(len(key) <= idempotency.MaxKeyLen, "idempotency_key", "must not be more than 255 bytes long")
+	if !v.Ok() {
+		return store.Image{}, v
+	}
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Image{}, err
+	}
+	userID := authData.User.ID
+
+	reserved, err := im.Store.Reserve(userID, idempotencyScope, key, im.TTL, im.Lease)
+	if err != nil {
+		return store.Image{}, err
+	}
+	if !reserved {
+		imageID, err := im.Store.Get(userID, idempotencyScope, key)
+		switch {
+		case errors.Is(err, store.ErrRecordNotFound):
+			// The key was released in the meantime.
+			return store.Image{}, idempotency.ErrInProgress
+		case err != nil:
+			return store.Image{}, err
+		case imageID == nil:
+			return store.Image{}, idempotency.ErrInProgress
+		}
+		return im.Service.Get(ctx, false, *imageID)
+	}
+
+	image, err = im.Service.Insert(ctx, reader, image)
+	if err != nil {
+		releaseErr := im.Store.Release(userID, idempotencyScope, key)
+		if releaseErr != nil {
+			im.Logger.Errorw("releasing idempotency key", "user_id", userID, "err", releaseErr)
+		}
+		return store.Image{}, err
+	}
+
+	// The image was created, so the request is successful anyway: a retry
+	// would find the key in progress until it expires.
+	err = im.Store.Complete(userID, idempotencyScope, key, image.ID)
+	if err != nil {
+		im.Logger.Errorw("completing idempotency key", "user_id", userID, "image_id", image.ID, "err", err)
+	}
+	return image, nil
+}
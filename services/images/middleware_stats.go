@@ -4,6 +4,8 @@ import (
 	"context"
 	"io"
 
+	"go.uber.org/zap"
+
 	"github.com/anBertoli/snap-vault/pkg/auth"
 	"github.com/anBertoli/snap-vault/pkg/store"
 )
@@ -12,17 +14,28 @@ import (
 // bytes of a user. Additionally it check if the user has exceeded the space it can use to
 // store data. Some methods are no-ops since they don't need to modify the stats of a user
 // (the calls are handled directly from the embedded Service interface).
+//
+// Once an image is stored the operation is reported as successful even if the stats
+// update fails: the error is logged and the drift can be repaired with the stats
+// reconcile command of the CLI. Deletions are not handled here, the core service
+// decrements the stats in the same transaction that deletes the image.
 type StatsMiddleware struct {
 	Store    store.StatsStore
 	MaxBytes int64
+	Logger   *zap.SugaredLogger
 	Service
 }
 
 // Increment the images and space-user counters for the user if a new image is successfully created.
 // Before the actual image creation, this method will check if the user has already reached
-// the max-space threshold.
+// the max-space threshold. Since the size of the image is known only once it is read, the
+// upload is also limited to the space remaining: if the stream exceeds it, the write fails
+// and the partial file is removed by the store.
 func (sm *StatsMiddleware) Insert(ctx context.Context, reader io.Reader, image store.Image) (store.Image, error) {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Image{}, err
+	}
 
 	stats, err := sm.Store.GetForUser(authData.User.ID)
 	if err != nil {
@@ -36,37 +49,67 @@ func (sm *StatsMiddleware) Insert(ctx context.Context, reader io.Reader, image s
 	}
 
 	// Insert the image, then increment related counters for the user.
+	reader = &quotaReader{r: reader, remaining: sm.MaxBytes - stats.Space}
 	image, err = sm.Service.Insert(ctx, reader, image)
 	if err != nil {
 		return image, err
 	}
 
-	err = sm.Store.IncrementImages(image.UserID, 1)
-	if err != nil {
-		return store.Image{}, err
-	}
-	err = sm.Store.IncrementBytes(image.UserID, image.Size)
+	err = sm.Store.IncrementImagesAndBytes(image.UserID, 1, image.Size)
 	if err != nil {
-		return store.Image{}, err
+		sm.Logger.Errorw("incrementing stats", "user_id", image.UserID, "image_id", image.ID, "err", err)
 	}
 	return image, nil
 }
 
-// Decrement the images and the space-used counters for the user if the image is deleted.
-func (sm *StatsMiddleware) Delete(ctx context.Context, imageID int64) (store.Image, error) {
-	image, err := sm.Service.Delete(ctx, imageID)
+// Adjust the space-used counter by the difference in size when the content of an image is
+// replaced. The upload is limited to the space remaining, plus the size of the replaced
+// image that will be freed.
+func (sm *StatsMiddleware) Replace(ctx context.Context, reader io.Reader, image store.Image) (store.Image, store.Image, error) {
+	authData, err := auth.ContextGetAuth(ctx)
 	if err != nil {
-		return image, err
+		return store.Image{}, store.Image{}, err
 	}
 
-	err = sm.Store.IncrementImages(image.UserID, -1)
+	stats, err := sm.Store.GetForUser(authData.User.ID)
 	if err != nil {
-		return store.Image{}, err
+		return store.Image{}, store.Image{}, err
 	}
-	err = sm.Store.IncrementBytes(image.UserID, -image.Size)
+	current, err := sm.Service.Get(ctx, false, image.ID)
 	if err != nil {
-		return store.Image{}, err
+		return store.Image{}, store.Image{}, err
 	}
 
-	return image, nil
+	reader = &quotaReader{r: reader, remaining: sm.MaxBytes - stats.Space + current.Size}
+	newImage, oldImage, err := sm.Service.Replace(ctx, reader, image)
+	if err != nil {
+		return newImage, oldImage, err
+	}
+
+	err = sm.Store.IncrementImagesAndBytes(newImage.UserID, 0, newImage.Size-oldImage.Size)
+	if err != nil {
+		sm.Logger.Errorw("updating stats", "user_id", newImage.UserID, "image_id", newImage.ID, "err", err)
+	}
+	return newImage, oldImage, nil
+}
+
+// The quotaReader reads from the wrapped reader up to the remaining space of the
+// user. Reading past that point fails with ErrMaxSpaceReached.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	// Read at most one byte more than allowed, so that a stream
+	// of exactly the remaining size is accepted.
+	if int64(len(p)) > qr.remaining+1 {
+		p = p[:qr.remaining+1]
+	}
+	n, err := qr.r.Read(p)
+	qr.remaining -= int64(n)
+	if qr.remaining < 0 {
+		return n, ErrMaxSpaceReached
+	}
+	return n, err
 }
@@ -4,8 +4,14 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/gabriel-vasile/mimetype"
 
@@ -20,6 +26,15 @@ import (
 // methods are no-ops since there it isn't needed to validate data (the calls are handled
 // directly from the embedded Service interface).
 type ValidationMiddleware struct {
+	// MIME types accepted for images, if empty all the image types are accepted.
+	AllowedTypes []string
+	// Maximum width and height of images in pixels, zero means no limit. Dimensions
+	// are checked only for the formats decoded by the standard library (JPEG, PNG
+	// and GIF), other formats are accepted.
+	MaxWidth  int
+	MaxHeight int
+	// Maximum validity of signed URLs.
+	MaxSignedTTL time.Duration
 	Service
 }
 
@@ -34,6 +49,27 @@ func (vm *ValidationMiddleware) ListAllPublic(ctx context.Context, filter filter
 	return vm.Service.ListAllPublic(ctx, filter)
 }
 
+// Validate the cursor and the page size of the keyset listing.
+func (vm *ValidationMiddleware) ListPublicAfter(ctx context.Context, afterID int64, limit int) ([]store.Image, error) {
+	v := validator.New()
+	v.Check(afterID >= 0, "after", "must not be negative")
+	v.Check(limit > 0 && limit <= 1000, "limit", "must be between 1 and 1000")
+	if !v.Ok() {
+		return nil, v
+	}
+	return vm.Service.ListPublicAfter(ctx, afterID, limit)
+}
+
+// Validate the size of the pages.
+func (vm *ValidationMiddleware) ListPublicPageCursors(ctx context.Context, pageSize int) ([]int64, error) {
+	v := validator.New()
+	v.Check(pageSize > 0, "page_size", "must be positive")
+	if !v.Ok() {
+		return nil, v
+	}
+	return vm.Service.ListPublicPageCursors(ctx, pageSize)
+}
+
 // Validate the filtering and pagination parameters used in listing.
 func (vm *ValidationMiddleware) ListForGallery(ctx context.Context, public bool, galleryID int64, filter filters.Input) ([]store.Image, filters.Meta, error) {
 	err := filter.Validate()
@@ -45,11 +81,128 @@ func (vm *ValidationMiddleware) ListForGallery(ctx context.Context, public bool,
 	return vm.Service.ListForGallery(ctx, public, galleryID, filter)
 }
 
+// Validate the filtering and pagination parameters used in listing.
+func (vm *ValidationMiddleware) ListAllOwned(ctx context.Context, filter filters.Input) ([]store.Image, filters.Meta, error) {
+	err := filter.Validate()
+	if err != nil {
+		v := validator.New()
+		v.AddError("pagination", err.Error())
+		return nil, filters.Meta{}, v
+	}
+	return vm.Service.ListAllOwned(ctx, filter)
+}
+
+// Validate the filtering and pagination parameters used in listing.
+func (vm *ValidationMiddleware) ListMoveTargets(ctx context.Context, imageID int64, filter filters.Input) ([]store.Gallery, filters.Meta, error) {
+	err := filter.Validate()
+	if err != nil {
+		v := validator.New()
+		v.AddError("pagination", err.Error())
+		return nil, filters.Meta{}, v
+	}
+	return vm.Service.ListMoveTargets(ctx, imageID, filter)
+}
+
 // Validate that the image bytes are not zero and the title is valid. Additionally detect the
 // content mime type and make sure it is an image.
 func (vm *ValidationMiddleware) Insert(ctx context.Context, reader io.Reader, image store.Image) (store.Image, error) {
 	v := validator.New()
 
+	if reader == nil {
+		v.AddError("image", "must be provided")
+		return store.Image{}, v
+	}
+
+	reader, contentType, err := detectContentType(reader)
+	if err != nil {
+		return store.Image{}, err
+	}
+	image.ContentType = contentType
+
+	v.Check(image.Title != "", "title", "must be specified")
+	v.Check(image.Title == "" || store.SanitizeFileName(image.Title) != "", "title", "must contain characters usable in a file name")
+	reader = vm.checkImage(v, reader, &image)
+	if !v.Ok() {
+		return store.Image{}, v
+	}
+
+	return vm.Service.Insert(ctx, reader, image)
+}
+
+// Validate that the new image bytes are not zero and detect their mime
+// type, making sure it is an image.
+func (vm *ValidationMiddleware) Replace(ctx context.Context, reader io.Reader, image store.Image) (store.Image, store.Image, error) {
+	v := validator.New()
+
+	if reader == nil {
+		v.AddError("image", "must be provided")
+		return store.Image{}, store.Image{}, v
+	}
+
+	reader, contentType, err := detectContentType(reader)
+	if err != nil {
+		return store.Image{}, store.Image{}, err
+	}
+	image.ContentType = contentType
+
+	reader = vm.checkImage(v, reader, &image)
+	if !v.Ok() {
+		return store.Image{}, store.Image{}, v
+	}
+
+	return vm.Service.Replace(ctx, reader, image)
+}
+
+// Bytes read at most to decode the dimensions of an image.
+const maxImageHeader = 1024 * 1024
+
+// Check that the content type is an allowed image type and that the dimensions of the
+// image are within the limits, adding the problems found to the validator. The decoded
+// dimensions are set in the image, they are left nil if the format isn't supported or
+// if they can't be read and no limit is configured. As for the content type detection,
+// the returned reader must be used in place of the provided one.
+func (vm *ValidationMiddleware) checkImage(v validator.Validator, reader io.Reader, img *store.Image) io.Reader {
+	contentType := img.ContentType
+	if !strings.HasPrefix(contentType, "image/") {
+		v.AddError("image", "not in supported format")
+		return reader
+	}
+	if len(vm.AllowedTypes) > 0 && !validator.In(contentType, vm.AllowedTypes...) {
+		v.AddError("image", fmt.Sprintf("format %s not allowed, allowed formats: %s", contentType, strings.Join(vm.AllowedTypes, ", ")))
+		return reader
+	}
+	// Decode only the header of the image, keeping the bytes consumed
+	// so they can be read again by the next services.
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(io.LimitReader(reader, maxImageHeader), &header))
+	reader = io.MultiReader(&header, reader)
+	// Without limits to enforce, an image whose header can't be decoded is
+	// accepted as an image in an unsupported format, without dimensions.
+	limited := vm.MaxWidth > 0 || vm.MaxHeight > 0
+	switch {
+	case errors.Is(err, image.ErrFormat):
+		return reader
+	case err != nil && !limited:
+		return reader
+	case err != nil:
+		v.AddError("image", "dimensions cannot be read, the image could be corrupted")
+		return reader
+	}
+	img.Width = &cfg.Width
+	img.Height = &cfg.Height
+
+	if vm.MaxWidth > 0 && cfg.Width > vm.MaxWidth {
+		v.AddError("width", fmt.Sprintf("width of %d pixels exceeds the maximum of %d", cfg.Width, vm.MaxWidth))
+	}
+	if vm.MaxHeight > 0 && cfg.Height > vm.MaxHeight {
+		v.AddError("height", fmt.Sprintf("height of %d pixels exceeds the maximum of %d", cfg.Height, vm.MaxHeight))
+	}
+	return reader
+}
+
+// Detect the MIME type of the content of the reader. The returned reader must be used
+// in place of the provided one, since the first bytes are consumed by the detection.
+func detectContentType(reader io.Reader) (io.Reader, string, error) {
 	// Read at most 512 bytes from the reader, that is, the image. If err is io.EOF the
 	// reader is empty, if err is io.ErrUnexpectedEOF the body has less than 512 bytes.
 	// In the last case we we are still good since we can try to extract the MIME type
@@ -59,38 +212,68 @@ func (vm *ValidationMiddleware) Insert(ctx context.Context, reader io.Reader, im
 	if err != nil {
 		switch {
 		case errors.Is(err, io.EOF):
-			return store.Image{}, store.ErrEmptyBytes
+			return nil, "", store.ErrEmptyBytes
 		case errors.Is(err, io.ErrUnexpectedEOF):
 		default:
-			return store.Image{}, err
+			return nil, "", err
 		}
 	}
 
 	// Re-slice the byte to include only the portion of bytes filled by the read function
 	// above (n could also be 512). Then try to guess the MIME type.
 	buf = buf[:n]
-	image.ContentType = mimetype.Detect(buf).String()
+	contentType := mimetype.Detect(buf).String()
+
+	// We must reform the reader since we have consumed the first 512 bytes of it. The
+	// io.MultiReader returns a new reader that will read sequentially from the provided
+	// readers.
+	return io.MultiReader(bytes.NewReader(buf), reader), contentType, nil
+}
 
+//  Validate the title used to update an existing image.
+func (vm *ValidationMiddleware) Update(ctx context.Context, image store.Image) (store.Image, error) {
+	v := validator.New()
 	v.Check(image.Title != "", "title", "must be specified")
-	v.Check(strings.HasPrefix(image.ContentType, "image/"), "image", "not in supported format")
 	if !v.Ok() {
 		return store.Image{}, v
 	}
+	return vm.Service.Update(ctx, image)
+}
 
-	// Before going ahead with the next.Insert() call we must reform the reader since we
-	// have consumed the first 512 bytes of it. The io.MultiReader returns a new reader
-	// that will read sequentially from the provided readers.
-	reader = io.MultiReader(bytes.NewReader(buf), reader)
+// Validate that the title, if provided, is not empty.
+func (vm *ValidationMiddleware) Patch(ctx context.Context, imageID int64, patch Patch) (store.Image, error) {
+	v := validator.New()
+	if patch.Title != nil {
+		v.Check(*patch.Title != "", "title", "must not be empty")
+	}
+	if !v.Ok() {
+		return store.Image{}, v
+	}
+	return vm.Service.Patch(ctx, imageID, patch)
+}
 
-	return vm.Service.Insert(ctx, reader, image)
+// Validate the validity of the signed URL, it must be positive and not exceed the maximum.
+func (vm *ValidationMiddleware) SignURL(ctx context.Context, imageID int64, ttl time.Duration) (string, time.Time, error) {
+	v := validator.New()
+	v.Check(ttl >= time.Second, "ttl", "must be at least one second")
+	v.Check(ttl <= vm.MaxSignedTTL, "ttl", fmt.Sprintf("must not be more than %d seconds", int64(vm.MaxSignedTTL/time.Second)))
+	if !v.Ok() {
+		return "", time.Time{}, v
+	}
+	return vm.Service.SignURL(ctx, imageID, ttl)
 }
 
-//  Validate the title used to update an existing image.
-func (vm *ValidationMiddleware) Update(ctx context.Context, image store.Image) (store.Image, error) {
+// Validate that the images order is provided and doesn't contain duplicates.
+func (vm *ValidationMiddleware) Reorder(ctx context.Context, galleryID int64, imageIDs []int64) error {
 	v := validator.New()
-	v.Check(image.Title != "", "title", "must be specified")
+	v.Check(len(imageIDs) > 0, "image_ids", "must be provided")
+	seen := make(map[int64]bool, len(imageIDs))
+	for _, id := range imageIDs {
+		v.Check(!seen[id], "image_ids", "must not contain duplicates")
+		seen[id] = true
+	}
 	if !v.Ok() {
-		return store.Image{}, v
+		return v
 	}
-	return vm.Service.Update(ctx, image)
+	return vm.Service.Reorder(ctx, galleryID, imageIDs)
 }
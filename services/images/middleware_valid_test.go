@@ -0,0 +1,131 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/validator"
+)
+
+// The insertRecorder records the image and the bytes reaching the service.
+type insertRecorder struct {
+	Service
+	image   store.Image
+	content []byte
+}
+
+func (ir *insertRecorder) Insert(ctx context.Context, reader io.Reader, image store.Image) (store.Image, error) {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return store.Image{}, err
+	}
+	ir.image = image
+	ir.content = content
+	return image, nil
+}
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// The dimensions of JPEG and PNG images are decoded, while they are left nil for the
+// formats that can't be decoded. The bytes reach the service unchanged.
+func TestInsertDimensions(t *testing.T) {
+	// A WebP header, detected as an image but not decoded by the standard library.
+	webp := append([]byte("RIFF\x24\x00\x00\x00WEBPVP8 "), make([]byte, 600)...)
+
+	tests := []struct {
+		name        string
+		content     []byte
+		contentType string
+		width       int
+		height      int
+	}{
+		{name: "png", content: encodePNG(t, 30, 20), contentType: "image/png", width: 30, height: 20},
+		{name: "jpeg", content: encodeJPEG(t, 17, 41), contentType: "image/jpeg", width: 17, height: 41},
+		{name: "not decoded", content: webp, contentType: "image/webp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &insertRecorder{}
+			vm := &ValidationMiddleware{Service: recorder}
+
+			_, err := vm.Insert(context.Background(), bytes.NewReader(tt.content), store.Image{Title: "image"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := recorder.image
+			if got.ContentType != tt.contentType {
+				t.Fatalf("expected content type %s, got %s", tt.contentType, got.ContentType)
+			}
+			if tt.width == 0 {
+				if got.Width != nil || got.Height != nil {
+					t.Fatalf("expected no dimensions, got %v x %v", got.Width, got.Height)
+				}
+			} else if got.Width == nil || got.Height == nil || *got.Width != tt.width || *got.Height != tt.height {
+				t.Fatalf("expected %d x %d, got %v x %v", tt.width, tt.height, got.Width, got.Height)
+			}
+			if !bytes.Equal(recorder.content, tt.content) {
+				t.Fatal("the content reaching the service was changed")
+			}
+		})
+	}
+}
+
+// Images larger than the limits are rejected, and so are the ones whose dimensions
+// can't be read when limits are configured.
+func TestInsertDimensionLimits(t *testing.T) {
+	truncated := encodePNG(t, 10, 10)[:20]
+
+	tests := []struct {
+		name    string
+		content []byte
+		field   string
+	}{
+		{name: "within the limits", content: encodePNG(t, 100, 50)},
+		{name: "too wide", content: encodePNG(t, 101, 50), field: "width"},
+		{name: "too high", content: encodeJPEG(t, 100, 51), field: "height"},
+		{name: "corrupted", content: truncated, field: "image"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &ValidationMiddleware{MaxWidth: 100, MaxHeight: 50, Service: &insertRecorder{}}
+			_, err := vm.Insert(context.Background(), bytes.NewReader(tt.content), store.Image{Title: "image"})
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("expected the image to be accepted, got %v", err)
+				}
+				return
+			}
+			var v validator.Validator
+			if !errors.As(err, &v) || v[tt.field] == "" {
+				t.Fatalf("expected a validation error of %s, got %v", tt.field, err)
+			}
+		})
+	}
+}
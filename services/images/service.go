@@ -5,16 +5,35 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"time"
+
+	"go.uber.org/zap"
 
 	"github.com/anBertoli/snap-vault/pkg/auth"
 	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/validator"
 )
 
-// The GalleriesService retrieves and save gallery images metadata in a relation database
+// The ImagesService retrieves and save gallery images metadata in a relation database
 // and the actual image file in the file system.
+//
+// All the methods reading images follow the same policy: a nonexistent image, an image
+// whose gallery was deleted (even concurrently) and a gallery that doesn't exist result
+// in store.ErrRecordNotFound, while an existing image (or gallery) owned by another user
+// or, for public requests, not published results in store.ErrForbidden.
 type ImagesService struct {
 	Store store.Store
+	// Maximum number of images in a single gallery,
+	// zero means no limit.
+	MaxGalleryImages int
+	// If set, views of public images by their owner are not counted.
+	ExcludeOwnerViews bool
+	// Signs and verifies the URLs used to share single images.
+	Signer URLSigner
+	// Logs the failures not returned to the caller (e.g. the
+	// removal of files after the deletion of their images).
+	Logger *zap.SugaredLogger
 }
 
 // Returns a filtered and paginated list of public images.
@@ -26,6 +45,28 @@ func (is *ImagesService) ListAllPublic(ctx context.Context, filter filters.Input
 	return images, metadata, nil
 }
 
+// Returns up to 'limit' public images following the provided image ID. It is used to
+// iterate over all the public images with bounded memory.
+func (is *ImagesService) ListPublicAfter(ctx context.Context, afterID int64, limit int) ([]store.Image, error) {
+	return is.Store.Images.GetPublicAfter(afterID, limit)
+}
+
+// Returns the cursors (the 'afterID' argument of ListPublicAfter) of the pages of
+// public images with the provided size, used to split the listing into pages.
+func (is *ImagesService) ListPublicPageCursors(ctx context.Context, pageSize int) ([]int64, error) {
+	return is.Store.Images.GetPublicPageCursors(pageSize)
+}
+
+// Returns a filtered and paginated list of all the images owned by the
+// authenticated user, regardless of the gallery they belong to.
+func (is *ImagesService) ListAllOwned(ctx context.Context, filter filters.Input) ([]store.Image, filters.Meta, error) {
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+	return is.Store.Images.GetAllForUser(authData.User.ID, filter)
+}
+
 // Returns a filtered and paginated list of images about a specific gallery
 // owned by the authenticated user.
 func (is *ImagesService) ListForGallery(ctx context.Context, public bool, galleryID int64, filter filters.Input) ([]store.Image, filters.Meta, error) {
@@ -65,6 +106,33 @@ func (is *ImagesService) ListForGallery(ctx context.Context, public bool, galler
 	return images, metadata, nil
 }
 
+// Returns a filtered and paginated list of the galleries where an image owned by
+// the authenticated user could be moved to, that is, all his galleries except the
+// one currently holding the image.
+func (is *ImagesService) ListMoveTargets(ctx context.Context, imageID int64, filter filters.Input) ([]store.Gallery, filters.Meta, error) {
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+
+	image, err := is.Store.Images.Get(imageID)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+
+	// Make sure that the authenticated user is the owner of the image.
+	if image.UserID != authData.User.ID {
+		return nil, filters.Meta{}, store.ErrForbidden
+	}
+
+	galleries, metadata, err := is.Store.Galleries.GetAllForUserExcept(authData.User.ID, image.GalleryID, filter)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+
+	return galleries, metadata, nil
+}
+
 // Fetch the image data, the request could be public or authenticated.
 func (is *ImagesService) Get(ctx context.Context, public bool, imageID int64) (store.Image, error) {
 
@@ -94,8 +162,8 @@ func (is *ImagesService) Get(ctx context.Context, public bool, imageID int64) (s
 }
 
 // Download a specific image, the request could be public or authenticated. The images bytes are
-// provided as a reader.
-func (is *ImagesService) Download(ctx context.Context, public bool, imageID int64) (store.Image, io.ReadCloser, error) {
+// provided as a seekable reader.
+func (is *ImagesService) Download(ctx context.Context, public bool, imageID int64) (store.Image, io.ReadSeekCloser, error) {
 	image, err := is.Store.Images.Get(imageID)
 	if err != nil {
 		return store.Image{}, nil, err
@@ -118,23 +186,73 @@ func (is *ImagesService) Download(ctx context.Context, public bool, imageID int6
 		}
 	}
 
-	readCloser, err := is.Store.Images.GetReader(imageID)
+	// The image (or its gallery) could have been deleted after being fetched,
+	// in that case the image is not found, consistently with the policy.
+	readSeekCloser, err := is.Store.Images.GetReader(imageID)
 	if err != nil {
-		switch {
-		case errors.Is(err, store.ErrRecordNotFound):
-			return store.Image{}, nil, store.ErrEditConflict
-		default:
-			return store.Image{}, nil, err
-		}
+		return store.Image{}, nil, err
+	}
+
+	return image, readSeekCloser, nil
+}
+
+// Produce the path of a signed URL that allows anyone to download the image until the
+// returned expiration time, without an auth key. The authenticated user must be the
+// owner of the image gallery.
+func (is *ImagesService) SignURL(ctx context.Context, imageID int64, ttl time.Duration) (string, time.Time, error) {
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return "", time.Time{}, auth.ErrUnauthenticated
 	}
 
-	return image, readCloser, nil
+	image, err := is.Store.Images.Get(imageID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if authData.User.ID != image.UserID {
+		return "", time.Time{}, store.ErrForbidden
+	}
+
+	// The expiration is truncated to seconds since it is encoded as unix
+	// time in the URL, this way the returned time matches the URL one.
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	return is.Signer.SignedPath(imageID, expires), expires, nil
+}
+
+// Download a specific image with a signed URL. The signature and the expiration time are
+// checked before anything else, so no information about the image is leaked otherwise.
+func (is *ImagesService) DownloadSigned(ctx context.Context, imageID, expires int64, signature string) (store.Image, io.ReadSeekCloser, error) {
+	err := is.Signer.Verify(imageID, expires, signature)
+	if err != nil {
+		return store.Image{}, nil, err
+	}
+
+	image, err := is.Store.Images.Get(imageID)
+	if err != nil {
+		return store.Image{}, nil, err
+	}
+
+	// The image (or its gallery) could have been deleted after being fetched,
+	// in that case the image is not found, consistently with the policy.
+	readSeekCloser, err := is.Store.Images.GetReader(imageID)
+	if err != nil {
+		return store.Image{}, nil, err
+	}
+
+	return image, readSeekCloser, nil
 }
 
 // Creates a new image for a specific gallery owned by the authenticated user. The actual image
 // bytes are provided as a reader from the caller.
 func (is *ImagesService) Insert(ctx context.Context, reader io.Reader, image store.Image) (store.Image, error) {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Image{}, err
+	}
+
+	if reader == nil {
+		return store.Image{}, store.ErrEmptyBytes
+	}
 
 	gallery, err := is.Store.Galleries.Get(image.GalleryID)
 	if err != nil {
@@ -150,6 +268,19 @@ func (is *ImagesService) Insert(ctx context.Context, reader io.Reader, image sto
 		return store.Image{}, store.ErrForbidden
 	}
 
+	// Check the gallery limit before writing the image bytes. Concurrent uploads
+	// could slightly exceed the limit, this is acceptable since the purpose is
+	// to avoid huge galleries, not to enforce an exact count.
+	if is.MaxGalleryImages > 0 {
+		count, err := is.Store.Images.CountForGallery(gallery.ID)
+		if err != nil {
+			return store.Image{}, err
+		}
+		if count >= is.MaxGalleryImages {
+			return store.Image{}, ErrGalleryFull
+		}
+	}
+
 	image, err = is.Store.Images.Insert(reader, store.Image{
 		Title:       image.Title,
 		Caption:     image.Caption,
@@ -171,10 +302,46 @@ func (is *ImagesService) Insert(ctx context.Context, reader io.Reader, image sto
 	return image, nil
 }
 
+// Replace the bytes of an image owned by the authenticated user, keeping its ID, position
+// and metadata. The content type of the new bytes must be provided in the image along
+// with its ID. The updated image is returned along with the image as it was before.
+func (is *ImagesService) Replace(ctx context.Context, reader io.Reader, image store.Image) (store.Image, store.Image, error) {
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Image{}, store.Image{}, err
+	}
+
+	if reader == nil {
+		return store.Image{}, store.Image{}, store.ErrEmptyBytes
+	}
+
+	oldImage, err := is.Store.Images.Get(image.ID)
+	if err != nil {
+		return store.Image{}, store.Image{}, err
+	}
+	if oldImage.UserID != authData.User.ID {
+		return store.Image{}, store.Image{}, store.ErrForbidden
+	}
+
+	newImage := oldImage
+	newImage.ContentType = image.ContentType
+	newImage.Width = image.Width
+	newImage.Height = image.Height
+	newImage, err = is.Store.Images.ReplaceContent(reader, newImage)
+	if err != nil {
+		return store.Image{}, store.Image{}, err
+	}
+
+	return newImage, oldImage, nil
+}
+
 // Updates an existing image with the data provided, the image gallery must be owned
 // by the authenticated user.
 func (is *ImagesService) Update(ctx context.Context, image store.Image) (store.Image, error) {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Image{}, err
+	}
 
 	oldImage, err := is.Store.Images.Get(image.ID)
 	if err != nil {
@@ -191,6 +358,12 @@ func (is *ImagesService) Update(ctx context.Context, image store.Image) (store.I
 		return store.Image{}, store.ErrForbidden
 	}
 
+	// If the client provided the version of the image it has seen, the
+	// update must be applied to that version, otherwise the current one is
+	// used.
+	if image.Version != 0 {
+		oldImage.Version = image.Version
+	}
 	oldImage.Title = image.Title
 	oldImage.Caption = image.Caption
 
@@ -208,9 +381,81 @@ func (is *ImagesService) Update(ctx context.Context, image store.Image) (store.I
 	return image, nil
 }
 
-// Delete a specific image. The authenticated user must be the owner of the image gallery.
+// Partially update an image owned by the authenticated user, only the fields
+// set in the patch are modified.
+func (is *ImagesService) Patch(ctx context.Context, imageID int64, patch Patch) (store.Image, error) {
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Image{}, err
+	}
+
+	image, err := is.Store.Images.Get(imageID)
+	if err != nil {
+		return store.Image{}, err
+	}
+
+	// Make sure that the authenticated user is the owner of the gallery.
+	if image.UserID != authData.User.ID {
+		return store.Image{}, store.ErrForbidden
+	}
+
+	if patch.Version != nil {
+		image.Version = *patch.Version
+	}
+	if patch.Title != nil {
+		image.Title = *patch.Title
+	}
+	if patch.Caption != nil {
+		image.Caption = *patch.Caption
+	}
+
+	// The image is updated only if not modified or deleted concurrently.
+	image, err = is.Store.Images.Update(image)
+	if err != nil {
+		return store.Image{}, err
+	}
+
+	return image, nil
+}
+
+// Reorder the images of a gallery owned by the authenticated user. The provided IDs must list
+// all the images of the gallery exactly once, in the desired order.
+func (is *ImagesService) Reorder(ctx context.Context, galleryID int64, imageIDs []int64) error {
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return err
+	}
+
+	gallery, err := is.Store.Galleries.Get(galleryID)
+	if err != nil {
+		return err
+	}
+	if gallery.UserID != authData.User.ID {
+		return store.ErrForbidden
+	}
+
+	err = is.Store.Images.Reorder(galleryID, imageIDs)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrOrderMismatch):
+			v := validator.New()
+			v.AddError("image_ids", "must list all the images of the gallery")
+			return v
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete a specific image and update the stats of the user accordingly. The authenticated
+// user must be the owner of the image gallery.
 func (is *ImagesService) Delete(ctx context.Context, imageID int64) (store.Image, error) {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Image{}, err
+	}
 
 	image, err := is.Store.Images.Get(imageID)
 	if err != nil {
@@ -227,15 +472,42 @@ func (is *ImagesService) Delete(ctx context.Context, imageID int64) (store.Image
 		return store.Image{}, store.ErrForbidden
 	}
 
-	err = is.Store.Images.Delete(imageID)
-	if err != nil {
-		switch {
-		case errors.Is(err, store.ErrRecordNotFound):
-			return store.Image{}, store.ErrEditConflict
-		default:
-			return store.Image{}, err
+	// Delete the image row and decrement the user stats in a single transaction, so the
+	// counters can't drift from the actual images. The file is removed after the commit:
+	// if the removal fails the file is an orphan, which is reported and can be removed
+	// by the storage command of the CLI.
+	var deleted store.Image
+	err = is.Store.WithTx(func(tx store.Store) error {
+		deleted, err = tx.Images.DeleteRecord(imageID)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrRecordNotFound):
+				return store.ErrEditConflict
+			default:
+				return err
+			}
 		}
+		return tx.Stats.IncrementImagesAndBytes(image.UserID, -1, -deleted.Size)
+	})
+	if err != nil {
+		return store.Image{}, err
+	}
+	err = is.Store.Images.DeleteFile(deleted)
+	if err != nil {
+		is.Logger.Errorw("deleting image file, the file is orphaned", "image_id", deleted.ID, "path", deleted.Path, "err", err)
 	}
 
 	return image, nil
 }
+
+// Count a view of a public image. The owner is excluded if configured
+// so and the request is authenticated.
+func (is *ImagesService) CountView(ctx context.Context, image store.Image) error {
+	if is.ExcludeOwnerViews {
+		authData, err := auth.ContextGetAuth(ctx)
+		if err == nil && authData.User.ID == image.UserID {
+			return nil
+		}
+	}
+	return is.Store.Images.IncrementViews(image.ID)
+}
@@ -0,0 +1,214 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/anBertoli/snap-vault/pkg/filters"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+)
+
+// If the decrement of the stats fails, the deletion is rolled back: both the image
+// row and the file are still there.
+func TestDeleteStatsFailure(t *testing.T) {
+	s, db := storetest.New(t)
+	user := storetest.NewUser(t, s, "fail-stats")
+	ctx := storetest.AuthContext(t, s, user)
+	is := &ImagesService{Store: s, Logger: zap.NewNop().Sugar()}
+
+	gallery, err := s.Galleries.Insert(store.Gallery{UserID: user.ID, Title: "gallery"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content bytes.Buffer
+	err = png.Encode(&content, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := is.Insert(ctx, bytes.NewReader(content.Bytes()), store.Image{
+		Title:       "image",
+		ContentType: "image/png",
+		GalleryID:   gallery.ID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.FailWrites(t, db, "stats", "UPDATE", "fail-stats", "NEW.n_images < OLD.n_images")
+	_, err = is.Delete(ctx, img.ID)
+	if err == nil {
+		t.Fatal("expected the deletion to fail")
+	}
+
+	_, err = s.Images.Get(img.ID)
+	if err != nil {
+		t.Fatalf("image row not found after the failed deletion: %v", err)
+	}
+	file, err := s.Images.GetReader(img.ID)
+	if err != nil {
+		t.Fatalf("image file not found after the failed deletion: %v", err)
+	}
+	defer file.Close()
+	stored, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, content.Bytes()) {
+		t.Fatal("image file changed after the failed deletion")
+	}
+}
+
+// The owner of an image signs a URL which allows to download it without a key until
+// its expiration, as long as the URL is not altered.
+func TestSignedURL(t *testing.T) {
+	s, m := storetest.NewMock(t)
+	signer := URLSigner{Secret: []byte("a-secret-of-at-least-32-bytes-long")}
+	is := &ImagesService{Store: s, Signer: signer, Logger: zap.NewNop().Sugar()}
+	err := os.WriteFile(filepath.Join(m.Root, "image.png"), []byte("image bytes"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Set(store.Image{ID: 42, UserID: 1, Path: "image.png"})
+
+	other := storetest.MockAuthContext(t, s, m, store.User{ID: 2, Activated: true})
+	_, _, err = is.SignURL(other, 42, time.Hour)
+	if !errors.Is(err, store.ErrForbidden) {
+		t.Fatalf("expected ErrForbidden signing an image of another user, got %v", err)
+	}
+	owner := storetest.MockAuthContext(t, s, m, store.User{ID: 1, Activated: true})
+	path, _, err := is.SignURL(owner, 42, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := u.Query().Get("signature")
+
+	_, r, err := is.DownloadSigned(context.Background(), 42, expires, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil || string(content) != "image bytes" {
+		t.Fatalf("unexpected content %q: %v", content, err)
+	}
+
+	_, _, err = is.DownloadSigned(context.Background(), 42, expires+1, signature)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected ErrInvalidSignature with a tampered expiry, got %v", err)
+	}
+	past := time.Now().Add(-time.Minute)
+	u, err = url.Parse(signer.SignedPath(42, past))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = is.DownloadSigned(context.Background(), 42, past.Unix(), u.Query().Get("signature"))
+	if !errors.Is(err, ErrSignatureExpired) {
+		t.Fatalf("expected ErrSignatureExpired, got %v", err)
+	}
+}
+
+// All the methods reading images apply the same policy: an image owned by another user
+// is forbidden, while a nonexistent image and an image of a deleted gallery are not found.
+func TestReadPolicy(t *testing.T) {
+	s, _ := storetest.New(t)
+	signer := URLSigner{Secret: []byte("a-secret-of-at-least-32-bytes-long")}
+	is := &ImagesService{Store: s, Signer: signer, Logger: zap.NewNop().Sugar()}
+	owner := storetest.NewUser(t, s, "policy-owner")
+	other := storetest.NewUser(t, s, "policy-other")
+	ownerCtx := storetest.AuthContext(t, s, owner)
+	otherCtx := storetest.AuthContext(t, s, other)
+
+	insert := func() (store.Gallery, store.Image) {
+		t.Helper()
+		gallery, err := s.Galleries.Insert(store.Gallery{UserID: owner.ID, Title: "policy"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := s.Images.Insert(bytes.NewReader([]byte("image bytes")), store.Image{
+			Title:       "image",
+			ContentType: "image/png",
+			GalleryID:   gallery.ID,
+			UserID:      owner.ID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gallery, img
+	}
+	gallery, img := insert()
+	deletedGallery, deletedImg := insert()
+	_, err := s.Images.DeleteRecord(deletedImg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Galleries.DeleteGallery(deletedGallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reads := map[string]func(ctx context.Context, imageID int64) error{
+		"get": func(ctx context.Context, imageID int64) error {
+			_, err := is.Get(ctx, false, imageID)
+			return err
+		},
+		"download": func(ctx context.Context, imageID int64) error {
+			_, r, err := is.Download(ctx, false, imageID)
+			if err == nil {
+				_ = r.Close()
+			}
+			return err
+		},
+		"sign": func(ctx context.Context, imageID int64) error {
+			_, _, err := is.SignURL(ctx, imageID, time.Hour)
+			return err
+		},
+	}
+	for name, read := range reads {
+		t.Run(name, func(t *testing.T) {
+			if err := read(ownerCtx, img.ID); err != nil {
+				t.Fatalf("owner: %v", err)
+			}
+			if err := read(otherCtx, img.ID); !errors.Is(err, store.ErrForbidden) {
+				t.Errorf("another user: expected ErrForbidden, got %v", err)
+			}
+			if err := read(ownerCtx, deletedImg.ID); !errors.Is(err, store.ErrRecordNotFound) {
+				t.Errorf("deleted gallery: expected ErrRecordNotFound, got %v", err)
+			}
+			if err := read(ownerCtx, img.ID+1_000_000); !errors.Is(err, store.ErrRecordNotFound) {
+				t.Errorf("nonexistent image: expected ErrRecordNotFound, got %v", err)
+			}
+		})
+	}
+
+	// The listing of the images of a gallery follows the same policy.
+	filter := filters.Input{Page: 1, PageSize: 10, SortCol: "id", SortSafeList: SortSafeList}
+	_, _, err = is.ListForGallery(otherCtx, false, gallery.ID, filter)
+	if !errors.Is(err, store.ErrForbidden) {
+		t.Errorf("listing of another user: expected ErrForbidden, got %v", err)
+	}
+	_, _, err = is.ListForGallery(ownerCtx, false, deletedGallery.ID, filter)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Errorf("listing of a deleted gallery: expected ErrRecordNotFound, got %v", err)
+	}
+}
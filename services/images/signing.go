@@ -0,0 +1,54 @@
+package images
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrSignatureExpired = errors.New("signature expired")
+)
+
+// The URLSigner produces and verifies the signatures of the URLs that allow to download
+// a single image without an auth key. The signature is an HMAC-SHA256, computed with
+// the secret over the image ID and the expiration time, so none of them can be changed
+// without invalidating the URL.
+type URLSigner struct {
+	Secret []byte
+}
+
+// Build the path of the URL that allows to download the image until the expiration time.
+func (us URLSigner) SignedPath(imageID int64, expires time.Time) string {
+	exp := expires.Unix()
+	return fmt.Sprintf("/v1/shared/images/%d?expires=%d&signature=%s", imageID, exp, base64.RawURLEncoding.EncodeToString(us.sign(imageID, exp)))
+}
+
+// Check that the signature was produced by this signer for the provided image ID and
+// expiration time (unix seconds), and that the expiration time is not passed yet.
+func (us URLSigner) Verify(imageID, expires int64, signature string) error {
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	// The comparison is performed in constant time, to not leak
+	// how many bytes of the provided signature are correct.
+	if !hmac.Equal(got, us.sign(imageID, expires)) {
+		return ErrInvalidSignature
+	}
+	if time.Now().Unix() > expires {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func (us URLSigner) sign(imageID, expires int64) []byte {
+	mac := hmac.New(sha256.New, us.Secret)
+	mac.Write([]byte(strconv.FormatInt(imageID, 10) + ":" + strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,62 @@
+package images
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLSignerVerify(t *testing.T) {
+	signer := URLSigner{Secret: []byte("a-secret-of-at-least-32-bytes-long")}
+	other := URLSigner{Secret: []byte("another-secret-of-at-least-32-bytes")}
+	valid := time.Now().Add(time.Hour).Unix()
+	expired := time.Now().Add(-time.Minute).Unix()
+	signature := func(imageID, expires int64) string {
+		path := signer.SignedPath(imageID, time.Unix(expires, 0))
+		u, err := url.Parse(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(u.Path, "/v1/shared/images/"+strconv.FormatInt(imageID, 10)) {
+			t.Fatalf("unexpected signed path %s", path)
+		}
+		return u.Query().Get("signature")
+	}
+	tampered := func(sig string) string {
+		raw, err := base64.RawURLEncoding.DecodeString(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw[0] ^= 0xff
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+
+	tests := []struct {
+		name      string
+		imageID   int64
+		expires   int64
+		signature string
+		err       error
+	}{
+		{"valid", 42, valid, signature(42, valid), nil},
+		{"expired", 42, expired, signature(42, expired), ErrSignatureExpired},
+		{"tampered id", 43, valid, signature(42, valid), ErrInvalidSignature},
+		{"tampered expiry", 42, valid + 3600, signature(42, valid), ErrInvalidSignature},
+		{"tampered signature", 42, valid, tampered(signature(42, valid)), ErrInvalidSignature},
+		{"bad base64", 42, valid, "not*base64!", ErrInvalidSignature},
+		{"empty signature", 42, valid, "", ErrInvalidSignature},
+		{"other secret", 42, valid, base64.RawURLEncoding.EncodeToString(other.sign(42, valid)), ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := signer.Verify(tt.imageID, tt.expires, tt.signature)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
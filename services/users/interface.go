@@ -5,6 +5,7 @@ import (
 	"errors"
 
 	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
 )
 
@@ -15,21 +16,57 @@ type Service interface {
 	RegenerateActivationToken(ctx context.Context, email, password string) (store.User, string, error)
 	ActivateUser(ctx context.Context, token string) (store.User, error)
 
-	ListUserKeys(ctx context.Context) ([]KeysList, error)
+	ListUserKeys(ctx context.Context, filter filters.Input, target store.Permissions) ([]KeysList, filters.Meta, error)
 	AddUserKey(ctx context.Context, permissions store.Permissions) (store.Keys, error)
 	EditUserKey(ctx context.Context, keyID int64, permissions store.Permissions) (store.Keys, store.Permissions, error)
 	DeleteUserKey(ctx context.Context, keyID int64) error
 
 	GetMe(ctx context.Context) (auth.Auth, error)
 	GetStats(ctx context.Context) (store.Stats, error)
+	ListAudit(ctx context.Context, filter filters.Input) ([]store.AuditEntry, filters.Meta, error)
+	ListAll(ctx context.Context, filter filters.Input) ([]store.User, filters.Meta, error)
 
 	GenKeyRecoveryToken(ctx context.Context, email, password string) (string, error)
 	RegenerateMainKey(ctx context.Context, token string) (store.Keys, error)
 }
 
+// Columns of the users that the admin listing can be sorted
+// (ascending or descending) and searched by.
+var (
+	SortSafeList   = []string{"id", "name", "email", "created_at"}
+	SearchSafeList = []string{"name", "email"}
+)
+
+// Defaults of the users listing (for administration), of the auth keys
+// listing and of the audit log listing. Keys can't be searched, the most
+// recent audit entries are listed first.
+var (
+	ListDefaults = filters.Defaults{
+		PageSize:       20,
+		Sort:           "id",
+		SortSafeList:   SortSafeList,
+		SearchCol:      "email",
+		SearchSafeList: SearchSafeList,
+	}
+	KeysListDefaults = filters.Defaults{
+		PageSize:     20,
+		Sort:         "id",
+		SortSafeList: []string{"id", "created_at"},
+	}
+	AuditListDefaults = filters.Defaults{
+		PageSize:       20,
+		Sort:           "-id",
+		SortSafeList:   []string{"id", "created_at"},
+		SearchCol:      "action",
+		SearchSafeList: []string{"action"},
+	}
+)
+
 var (
 	ErrMainKeysEdit  = errors.New("main keys not editable")
 	ErrAlreadyActive = errors.New("user already activated")
+	ErrAccountLocked = errors.New("account locked")
+	ErrTooManyKeys   = errors.New("too many keys")
 )
 
 // This checks makes sure that all service implementation remain
@@ -37,3 +74,4 @@ var (
 var _ Service = &UsersService{}
 var _ Service = &AuthMiddleware{}
 var _ Service = &ValidationMiddleware{}
+var _ Service = &LockoutMiddleware{}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
 )
 
@@ -19,12 +20,12 @@ type AuthMiddleware struct {
 }
 
 // Perform authentication and check that permissions to list user keys are present.
-func (am *AuthMiddleware) ListUserKeys(ctx context.Context) ([]KeysList, error) {
+func (am *AuthMiddleware) ListUserKeys(ctx context.Context, filter filters.Input, target store.Permissions) ([]KeysList, filters.Meta, error) {
 	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain, store.PermissionListKeys)
 	if err != nil {
-		return nil, err
+		return nil, filters.Meta{}, err
 	}
-	return am.Service.ListUserKeys(ctx)
+	return am.Service.ListUserKeys(ctx, filter, target)
 }
 
 // Perform authentication and check that permissions to create user keys are present.
@@ -71,3 +72,23 @@ func (am *AuthMiddleware) GetStats(ctx context.Context) (store.Stats, error) {
 	}
 	return am.Service.GetStats(ctx)
 }
+
+// Perform authentication and check that the admin permission is present. The main
+// permission is not enough, since it is owned by every user.
+func (am *AuthMiddleware) ListAll(ctx context.Context, filter filters.Input) ([]store.User, filters.Meta, error) {
+	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionAdmin)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+	return am.Service.ListAll(ctx, filter)
+}
+
+// Perform authentication and check that the main permission is present, since
+// the audit log contains security-relevant information.
+func (am *AuthMiddleware) ListAudit(ctx context.Context, filter filters.Input) ([]store.AuditEntry, filters.Meta, error) {
+	_, err := am.Auth.RequireUserPermissions(&ctx, store.PermissionMain)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+	return am.Service.ListAudit(ctx, filter)
+}
@@ -0,0 +1,125 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/store"
+)
+
+// The LockoutMiddleware protects the methods verifying passwords against brute-force attacks.
+// Failed attempts are counted per email, after MaxAttempts failures within Window further
+// attempts are rejected with ErrAccountLocked until Window elapses. A successful attempt
+// resets the counter. This is independent of the IP-based rate limiting, since attackers
+// could spread requests over many addresses. The state is kept in memory.
+//
+// The methods not verifying passwords are handled directly from the embedded Service.
+type LockoutMiddleware struct {
+	MaxAttempts int
+	Window      time.Duration
+	Service
+
+	mu        sync.Mutex
+	attempts  map[string]*failedAttempts
+	lastSweep time.Time
+	// Source of the current time, replaced in tests. If nil time.Now is used.
+	now func() time.Time
+}
+
+// Failed attempts registered for an email.
+type failedAttempts struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// Reject the request if the account is locked, then keep track of the outcome.
+func (lm *LockoutMiddleware) RegenerateActivationToken(ctx context.Context, email, password string) (store.User, string, error) {
+	if lm.locked(email) {
+		return store.User{}, "", ErrAccountLocked
+	}
+	user, token, err := lm.Service.RegenerateActivationToken(ctx, email, password)
+	lm.record(email, err)
+	return user, token, err
+}
+
+// Reject the request if the account is locked, then keep track of the outcome.
+func (lm *LockoutMiddleware) GenKeyRecoveryToken(ctx context.Context, email, password string) (string, error) {
+	if lm.locked(email) {
+		return "", ErrAccountLocked
+	}
+	token, err := lm.Service.GenKeyRecoveryToken(ctx, email, password)
+	lm.record(email, err)
+	return token, err
+}
+
+// Report whether the attempts for the provided email are currently rejected.
+func (lm *LockoutMiddleware) locked(email string) bool {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	entry, ok := lm.attempts[strings.ToLower(email)]
+	return ok && lm.clock().Before(entry.lockedUntil)
+}
+
+// Update the failed attempts for the provided email based on the outcome of the
+// operation. Only wrong credentials count as failures, a success resets the counter
+// while other errors are ignored.
+func (lm *LockoutMiddleware) record(email string, err error) {
+	if lm.MaxAttempts <= 0 {
+		return
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	email = strings.ToLower(email)
+	now := lm.clock()
+
+	switch {
+	case err == nil:
+		delete(lm.attempts, email)
+	case errors.Is(err, auth.ErrUnauthenticated):
+		if lm.attempts == nil {
+			lm.attempts = make(map[string]*failedAttempts)
+		}
+		lm.sweep(now)
+
+		// Start counting again if the previous failures are too old.
+		entry, ok := lm.attempts[email]
+		if !ok || now.Sub(entry.first) > lm.Window {
+			entry = &failedAttempts{first: now}
+			lm.attempts[email] = entry
+		}
+		entry.count++
+		if entry.count >= lm.MaxAttempts {
+			entry.lockedUntil = now.Add(lm.Window)
+		}
+	}
+}
+
+// Return the current time.
+func (lm *LockoutMiddleware) clock() time.Time {
+	if lm.now != nil {
+		return lm.now()
+	}
+	return time.Now()
+}
+
+// Remove the entries not relevant anymore, at most once per window, so that
+// the memory used doesn't grow indefinitely. Must be called holding the lock.
+func (lm *LockoutMiddleware) sweep(now time.Time) {
+	if now.Sub(lm.lastSweep) < lm.Window {
+		return
+	}
+	lm.lastSweep = now
+	for email, entry := range lm.attempts {
+		if now.Sub(entry.first) > lm.Window && now.After(entry.lockedUntil) {
+			delete(lm.attempts, email)
+		}
+	}
+}
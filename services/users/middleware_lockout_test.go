@@ -0,0 +1,173 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/anBertoli/snap-vault/pkg/auth"
+)
+
+// The passwordService accepts only the "right" password, counting the calls.
+type passwordService struct {
+	Service
+	calls int
+	err   error
+}
+
+func (ps *passwordService) GenKeyRecoveryToken(ctx context.Context, email, password string) (string, error) {
+	ps.calls++
+	switch {
+	case ps.err != nil:
+		return "", ps.err
+	case password != "right":
+		return "", auth.ErrUnauthenticated
+	}
+	return "token", nil
+}
+
+// A fake clock, advanced manually.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newLockout(maxAttempts int) (*LockoutMiddleware, *passwordService, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	service := &passwordService{}
+	lm := &LockoutMiddleware{
+		MaxAttempts: maxAttempts,
+		Window:      15 * time.Minute,
+		Service:     service,
+		now:         clock.now,
+	}
+	return lm, service, clock
+}
+
+func attempt(lm *LockoutMiddleware, email, password string) error {
+	_, err := lm.GenKeyRecoveryToken(context.Background(), email, password)
+	return err
+}
+
+// Once the failures reach the threshold the account is locked, also for the right
+// password, and the wrapped service is not called anymore.
+func TestLockoutThreshold(t *testing.T) {
+	lm, service, _ := newLockout(3)
+
+	for i := 0; i < 3; i++ {
+		err := attempt(lm, "user@example.com", "wrong")
+		if !errors.Is(err, auth.ErrUnauthenticated) {
+			t.Fatalf("attempt %d: expected ErrUnauthenticated, got %v", i, err)
+		}
+	}
+	err := attempt(lm, "USER@example.com", "right")
+	if !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("expected ErrAccountLocked, got %v", err)
+	}
+	if service.calls != 3 {
+		t.Fatalf("expected 3 calls of the service, got %d", service.calls)
+	}
+
+	// Other accounts are not affected.
+	err = attempt(lm, "other@example.com", "right")
+	if err != nil {
+		t.Fatalf("expected the other account to be usable, got %v", err)
+	}
+}
+
+// A success resets the failures, and errors other than wrong credentials don't count.
+func TestLockoutReset(t *testing.T) {
+	lm, service, _ := newLockout(3)
+
+	_ = attempt(lm, "user@example.com", "wrong")
+	_ = attempt(lm, "user@example.com", "wrong")
+	err := attempt(lm, "user@example.com", "right")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = attempt(lm, "user@example.com", "wrong")
+	_ = attempt(lm, "user@example.com", "wrong")
+
+	service.err = errors.New("database down")
+	for i := 0; i < 3; i++ {
+		_ = attempt(lm, "user@example.com", "wrong")
+	}
+	service.err = nil
+
+	err = attempt(lm, "user@example.com", "right")
+	if err != nil {
+		t.Fatalf("expected no lockout, got %v", err)
+	}
+}
+
+// The lock expires after the window, and failures older than the window are
+// not counted anymore.
+func TestLockoutExpiry(t *testing.T) {
+	lm, _, clock := newLockout(3)
+
+	for i := 0; i < 3; i++ {
+		_ = attempt(lm, "user@example.com", "wrong")
+	}
+	clock.advance(14 * time.Minute)
+	err := attempt(lm, "user@example.com", "right")
+	if !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("expected ErrAccountLocked within the window, got %v", err)
+	}
+	clock.advance(2 * time.Minute)
+	err = attempt(lm, "user@example.com", "right")
+	if err != nil {
+		t.Fatalf("expected the lock to be expired, got %v", err)
+	}
+
+	_ = attempt(lm, "user@example.com", "wrong")
+	_ = attempt(lm, "user@example.com", "wrong")
+	clock.advance(16 * time.Minute)
+	_ = attempt(lm, "user@example.com", "wrong")
+	err = attempt(lm, "user@example.com", "wrong")
+	if !errors.Is(err, auth.ErrUnauthenticated) {
+		t.Fatalf("expected the old failures to be forgotten, got %v", err)
+	}
+}
+
+// The entries of the failures not relevant anymore are removed.
+func TestLockoutSweep(t *testing.T) {
+	lm, _, clock := newLockout(2)
+
+	_ = attempt(lm, "stale@example.com", "wrong")
+	_ = attempt(lm, "locked@example.com", "wrong")
+	_ = attempt(lm, "locked@example.com", "wrong")
+	clock.advance(10 * time.Minute)
+	_ = attempt(lm, "recent@example.com", "wrong")
+
+	// When the sweep runs the failure of stale@ and the lock of locked@ are
+	// expired, while the failure of recent@ is still within the window.
+	clock.advance(10 * time.Minute)
+	_ = attempt(lm, "trigger@example.com", "wrong")
+
+	for _, email := range []string{"stale@example.com", "locked@example.com"} {
+		if _, ok := lm.attempts[email]; ok {
+			t.Errorf("expected the entry of %s to be removed", email)
+		}
+	}
+	for _, email := range []string{"recent@example.com", "trigger@example.com"} {
+		if _, ok := lm.attempts[email]; !ok {
+			t.Errorf("expected the entry of %s to be kept", email)
+		}
+	}
+}
+
+// With no maximum number of attempts the lockout is disabled.
+func TestLockoutDisabled(t *testing.T) {
+	lm, _, _ := newLockout(0)
+
+	for i := 0; i < 10; i++ {
+		_ = attempt(lm, "user@example.com", "wrong")
+	}
+	err := attempt(lm, "user@example.com", "right")
+	if err != nil {
+		t.Fatalf("expected no lockout, got %v", err)
+	}
+}
@@ -2,7 +2,9 @@ package users
 
 import (
 	"context"
+	"fmt"
 
+	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
 	"github.com/anBertoli/snap-vault/pkg/validator"
 )
@@ -90,3 +92,43 @@ func (vm *ValidationMiddleware) EditUserKey(ctx context.Context, keyID int64, pe
 	}
 	return vm.Service.EditUserKey(ctx, keyID, permissions)
 }
+
+// Validate the filtering and pagination parameters used in listing, along with
+// the optional target permissions set.
+func (vm *ValidationMiddleware) ListUserKeys(ctx context.Context, filter filters.Input, target store.Permissions) ([]KeysList, filters.Meta, error) {
+	v := validator.New()
+	err := filter.Validate()
+	if err != nil {
+		v.AddError("pagination", err.Error())
+	}
+	if target != nil {
+		invalids := target.Invalids()
+		v.Check(len(invalids) == 0, "target", fmt.Sprintf("invalid permissions: %v", invalids))
+	}
+	if !v.Ok() {
+		return nil, filters.Meta{}, v
+	}
+	return vm.Service.ListUserKeys(ctx, filter, target)
+}
+
+// Validate the filtering and pagination parameters used in listing.
+func (vm *ValidationMiddleware) ListAll(ctx context.Context, filter filters.Input) ([]store.User, filters.Meta, error) {
+	err := filter.Validate()
+	if err != nil {
+		v := validator.New()
+		v.AddError("pagination", err.Error())
+		return nil, filters.Meta{}, v
+	}
+	return vm.Service.ListAll(ctx, filter)
+}
+
+// Validate the filtering and pagination parameters used in listing.
+func (vm *ValidationMiddleware) ListAudit(ctx context.Context, filter filters.Input) ([]store.AuditEntry, filters.Meta, error) {
+	err := filter.Validate()
+	if err != nil {
+		v := validator.New()
+		v.AddError("pagination", err.Error())
+		return nil, filters.Meta{}, v
+	}
+	return vm.Service.ListAudit(ctx, filter)
+}
@@ -8,6 +8,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/filters"
 	"github.com/anBertoli/snap-vault/pkg/store"
 	"github.com/anBertoli/snap-vault/pkg/validator"
 )
@@ -15,6 +16,28 @@ import (
 // The UsersService retrieves and save users data and user statistics in a relation database.
 type UsersService struct {
 	Store store.Store
+	// Maximum number of auth keys of a user, zero means no limit. The main
+	// key is counted only if MaxKeysIncludeMain is set.
+	MaxKeys            int
+	MaxKeysIncludeMain bool
+	// Lifetimes of the activation and of the key recovery tokens, if
+	// zero they default to 24 hours and 3 hours respectively.
+	ActivationTTL time.Duration
+	RecoveryTTL   time.Duration
+}
+
+func (us *UsersService) activationTTL() time.Duration {
+	if us.ActivationTTL == 0 {
+		return 24 * time.Hour
+	}
+	return us.ActivationTTL
+}
+
+func (us *UsersService) recoveryTTL() time.Duration {
+	if us.RecoveryTTL == 0 {
+		return 3 * time.Hour
+	}
+	return us.RecoveryTTL
 }
 
 // Register a new user into the system and generate 'main' keys for the user. The
@@ -35,31 +58,47 @@ func (us *UsersService) RegisterUser(ctx context.Context, name, email, password
 		PasswordHash: string(hash),
 	}
 
-	user, err = us.Store.Users.Insert(user)
-	if err != nil {
-		return store.User{}, store.Keys{}, "", err
-	}
+	// All the writes are performed in a single transaction, so a failure in any
+	// step doesn't leave behind a partially registered user (e.g. without stats).
+	var (
+		keys            store.Keys
+		activationToken store.Token
+	)
+	err = us.Store.WithTx(func(tx store.Store) error {
+		user, err = tx.Users.Insert(user)
+		if err != nil {
+			return err
+		}
 
-	// Create new keys for the user with 'main' permissions. The plan version
-	// of the key is returned to the caller and not stored anywhere.
-	keys, err := us.Store.Keys.New(user.ID)
-	if err != nil {
-		return store.User{}, store.Keys{}, "", err
-	}
-	err = us.Store.Permissions.ReplaceForKey(keys.ID, store.PermissionMain)
-	if err != nil {
-		return store.User{}, store.Keys{}, "", err
-	}
+		// Create new keys for the user with 'main' permissions. The plan version
+		// of the key is returned to the caller and not stored anywhere.
+		keys, err = tx.Keys.New(user.ID)
+		if err != nil {
+			return err
+		}
+		err = tx.Permissions.ReplaceForKey(keys.ID, store.PermissionMain)
+		if err != nil {
+			return err
+		}
 
-	// Create an activation token that must be delivered in some form to
-	// the user. This is responsibility of the caller.
-	activationToken, err := us.Store.Tokens.New(user.ID, time.Hour*24, store.ScopeActivation)
-	if err != nil {
-		return store.User{}, store.Keys{}, "", err
-	}
+		// Create an activation token that must be delivered in some form to
+		// the user. This is responsibility of the caller, once the registration
+		// is committed.
+		activationToken, err = tx.Tokens.New(user.ID, us.activationTTL(), store.ScopeActivation)
+		if err != nil {
+			return err
+		}
+
+		// Initialize stats for the user.
+		err = tx.Stats.InitStatsForUser(user.ID)
+		if err != nil {
+			return err
+		}
 
-	// Initialize stats for the user.
-	err = us.Store.Stats.InitStatsForUser(user.ID)
+		return tx.Audit.Append(user.ID, store.AuditUserRegistered, map[string]interface{}{
+			"main_key_id": keys.ID,
+		})
+	})
 	if err != nil {
 		return store.User{}, store.Keys{}, "", err
 	}
@@ -67,6 +106,10 @@ func (us *UsersService) RegisterUser(ctx context.Context, name, email, password
 	return user, keys, activationToken.Plain, nil
 }
 
+// Hash compared with the provided password when a user is not found. It has the same
+// cost of the hashes of real passwords, so both paths take a comparable time.
+var dummyPasswordHash = []byte("$2a$12$XO5JNgRsxeLWtF5kJCaUk.tURMr6TAiIfXxmZX7RPqwHgoND1pO1G")
+
 // Regenerate the activation token for a specific user. Old activations tokens
 // are deleted.
 func (us *UsersService) RegenerateActivationToken(ctx context.Context, email, password string) (store.User, string, error) {
@@ -74,6 +117,9 @@ func (us *UsersService) RegenerateActivationToken(ctx context.Context, email, pa
 	if err != nil {
 		switch {
 		case errors.Is(err, store.ErrRecordNotFound):
+			// Spend the same time of a password check, so that the response
+			// time doesn't reveal whether the email is registered.
+			_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
 			return store.User{}, "", auth.ErrUnauthenticated
 		default:
 			return store.User{}, "", err
@@ -96,12 +142,25 @@ func (us *UsersService) RegenerateActivationToken(ctx context.Context, email, pa
 		return store.User{}, "", ErrAlreadyActive
 	}
 
-	// Delete all old activation tokens and recreate a new one.
-	err = us.Store.Tokens.DeleteAllForUser(store.ScopeActivation, user.ID)
-	if err != nil {
-		return store.User{}, "", err
-	}
-	token, err := us.Store.Tokens.New(user.ID, time.Hour*24, store.ScopeActivation)
+	// Delete all old activation tokens and recreate a new one. There could be none,
+	// since expired tokens are removed periodically by the cleanup job.
+	var token store.Token
+	err = us.Store.WithTx(func(tx store.Store) error {
+		err := tx.Tokens.DeleteAllForUser(store.ScopeActivation, user.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrRecordNotFound): // ok
+			default:
+				return err
+			}
+		}
+		token, err = tx.Tokens.New(user.ID, us.activationTTL(), store.ScopeActivation)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Append(user.ID, store.AuditActivationResent, nil)
+	})
 	if err != nil {
 		return store.User{}, "", err
 	}
@@ -126,24 +185,37 @@ func (us *UsersService) ActivateUser(ctx context.Context, token string) (store.U
 
 	user.Activated = true
 
-	user, err = us.Store.Users.Update(user)
-	if err != nil {
-		switch {
-		case errors.Is(err, store.ErrRecordNotFound):
-			return store.User{}, store.ErrEditConflict
-		default:
-			return store.User{}, err
+	// The activation tokens are consumed first, in the same transaction of the activation.
+	// Concurrent requests with the same token are serialized by the row locks taken by the
+	// delete: once the first one commits, the others find no token left to delete and
+	// fail as if the token was invalid, so the user is activated exactly once.
+	err = us.Store.WithTx(func(tx store.Store) error {
+		err := tx.Tokens.DeleteAllForUser(store.ScopeActivation, user.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrRecordNotFound):
+				v := validator.New()
+				v.AddError("token", "invalid or expired activation token")
+				return v
+			default:
+				return err
+			}
 		}
-	}
 
-	// Delete all tokens with activation scope.
-	err = us.Store.Tokens.DeleteAllForUser(store.ScopeActivation, user.ID)
-	if err != nil {
-		switch {
-		case errors.Is(err, store.ErrRecordNotFound): // ok
-		default:
-			return store.User{}, err
+		user, err = tx.Users.Update(user)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrRecordNotFound):
+				return store.ErrEditConflict
+			default:
+				return err
+			}
 		}
+
+		return tx.Audit.Append(user.ID, store.AuditUserActivated, nil)
+	})
+	if err != nil {
+		return store.User{}, err
 	}
 
 	return user, nil
@@ -157,6 +229,9 @@ func (us *UsersService) GenKeyRecoveryToken(ctx context.Context, email, password
 	if err != nil {
 		switch {
 		case errors.Is(err, store.ErrRecordNotFound):
+			// Spend the same time of a password check, so that the response
+			// time doesn't reveal whether the email is registered.
+			_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
 			return "", auth.ErrUnauthenticated
 		default:
 			return "", err
@@ -175,7 +250,15 @@ func (us *UsersService) GenKeyRecoveryToken(ctx context.Context, email, password
 	}
 
 	// Create a new key recovery token.
-	recoverKeysToken, err := us.Store.Tokens.New(user.ID, time.Hour*3, store.ScopeRecoverMainKeys)
+	var recoverKeysToken store.Token
+	err = us.Store.WithTx(func(tx store.Store) error {
+		recoverKeysToken, err = tx.Tokens.New(user.ID, us.recoveryTTL(), store.ScopeRecoverMainKeys)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Append(user.ID, store.AuditKeyRecoveryStarted, nil)
+	})
 	if err != nil {
 		return "", err
 	}
@@ -186,104 +269,206 @@ func (us *UsersService) GenKeyRecoveryToken(ctx context.Context, email, password
 // Regenerate the main auth key using the provided key recovery token. The auth key
 // must be delivered somehow to the user, since we don't store the plain text version.
 func (us *UsersService) RegenerateMainKey(ctx context.Context, token string) (store.Keys, error) {
+	var key store.Keys
+	err := us.Store.WithTx(func(tx store.Store) error {
+		// The recovery token is consumed first, in the same transaction of the key
+		// regeneration. Concurrent requests with the same token are serialized by the
+		// row lock taken by the delete: once the first one commits, the others find no
+		// token left and fail as if the token was invalid, so the key is regenerated
+		// exactly once.
+		userID, err := tx.Tokens.Consume(store.ScopeRecoverMainKeys, token)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrRecordNotFound):
+				v := validator.New()
+				v.AddError("token", "invalid or expired recovery token")
+				return v
+			default:
+				return err
+			}
+		}
 
-	user, err := us.Store.Users.GetForToken(store.ScopeRecoverMainKeys, token)
-	if err != nil {
-		switch {
-		case errors.Is(err, store.ErrRecordNotFound):
-			v := validator.New()
-			v.AddError("token", "invalid or expired activation token")
-			return store.Keys{}, v
-		default:
-			return store.Keys{}, err
+		// Other recovery tokens of the user are invalidated too, there could be none.
+		err = tx.Tokens.DeleteAllForUser(store.ScopeRecoverMainKeys, userID)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrRecordNotFound): // ok
+			default:
+				return err
+			}
 		}
-	}
 
-	// Retrieve all the user auth keys and search the main one. If found, delete it.
-	keys, err := us.Store.Keys.GetAllForUser(user.ID)
-	if err != nil {
-		return store.Keys{}, nil
-	}
-	for _, key := range keys {
-		perms, err := us.Store.Permissions.GetAllForKey(key.AuthKeyHash, true)
+		// Retrieve all the user auth keys and search the main one. If found, delete it.
+		// The admin permission, granted with the CLI, is carried over to the new key.
+		keys, err := tx.Keys.GetAllForUser(userID)
 		if err != nil {
-			return store.Keys{}, err
+			return err
 		}
-		if !perms.Include(store.PermissionMain) {
-			continue
+		deletedKeyIDs := []int64{}
+		permissions := store.Permissions{store.PermissionMain}
+		for _, k := range keys {
+			perms, err := tx.Permissions.GetAllForKey(k.AuthKeyHash, true)
+			if err != nil {
+				return err
+			}
+			if !perms.Include(store.PermissionMain) {
+				continue
+			}
+			if perms.Include(store.PermissionAdmin) && !permissions.Include(store.PermissionAdmin) {
+				permissions = append(permissions, store.PermissionAdmin)
+			}
+			err = tx.Keys.DeleteKey(k.ID, userID)
+			if err != nil {
+				return err
+			}
+			deletedKeyIDs = append(deletedKeyIDs, k.ID)
 		}
-		err = us.Store.Keys.DeleteKey(key.ID, user.ID)
+
+		// Regenerate the auth key. The plan text version of the key is returned
+		// and must be delivered to the user, since it is not store anywhere.
+		key, err = tx.Keys.New(userID)
 		if err != nil {
-			return store.Keys{}, err
+			return err
+		}
+		err = tx.Permissions.ReplaceForKey(key.ID, permissions...)
+		if err != nil {
+			return err
 		}
-	}
 
-	// Regenerate the auth key. The plan text version of the key is returned
-	// and must be delivered to the user, since it is not store anywhere.
-	key, err := us.Store.Keys.New(user.ID)
+		return tx.Audit.Append(userID, store.AuditMainKeyRegenerated, map[string]interface{}{
+			"key_id":          key.ID,
+			"deleted_key_ids": deletedKeyIDs,
+			"permissions":     permissions,
+		})
+	})
 	if err != nil {
 		return store.Keys{}, err
 	}
-	err = us.Store.Permissions.ReplaceForKey(key.ID, store.PermissionMain)
+
+	return key, nil
+}
+
+// List the auth keys of the user, along with their permissions. The listing is paginated.
+// If a target permissions set is provided, each key reports also the permissions granted,
+// missing and extra with respect to the target.
+func (us *UsersService) ListUserKeys(ctx context.Context, filter filters.Input, target store.Permissions) ([]KeysList, filters.Meta, error) {
+	authData, err := auth.ContextGetAuth(ctx)
 	if err != nil {
-		return store.Keys{}, err
+		return nil, filters.Meta{}, err
 	}
 
-	// Clean recovery key tokens for the user.
-	err = us.Store.Tokens.DeleteAllForUser(store.ScopeRecoverMainKeys, user.ID)
+	keys, metadata, err := us.Store.Keys.GetPageForUser(authData.User.ID, filter)
 	if err != nil {
-		switch {
-		case errors.Is(err, store.ErrRecordNotFound): // ok
-		default:
-			return store.Keys{}, err
-		}
+		return nil, filters.Meta{}, err
 	}
 
-	return key, nil
-}
-
-// List all the auth keys of the user.
-func (us *UsersService) ListUserKeys(ctx context.Context) ([]KeysList, error) {
-	authData := auth.MustContextGetAuth(ctx)
-
-	keys, err := us.Store.Keys.GetAllForUser(authData.User.ID)
+	// Enrich the response with keys permissions, retrieved
+	// for all the keys of the page at once.
+	keyIDs := make([]int64, 0, len(keys))
+	for _, key := range keys {
+		keyIDs = append(keyIDs, key.ID)
+	}
+	permissions, err := us.Store.Permissions.GetAllForKeys(keyIDs)
 	if err != nil {
-		return nil, err
+		return nil, filters.Meta{}, err
 	}
 
-	// Enrich the response with keys permissions.
-	var keysList []KeysList
+	keysList := []KeysList{}
 	for _, key := range keys {
-		permissions, err := us.Store.Permissions.GetAllForKey(key.AuthKeyHash, true)
-		if err != nil {
-			return nil, err
+		keyPermissions := permissions[key.ID]
+		if keyPermissions == nil {
+			keyPermissions = store.Permissions{}
 		}
-		keysList = append(keysList, KeysList{
+		keyList := KeysList{
 			AuthKeyID:   key.ID,
 			CreatedAt:   key.CreatedAt,
-			Permissions: permissions,
-		})
+			Permissions: keyPermissions,
+		}
+		if target != nil {
+			keyList.Diff = diffPermissions(keyPermissions, target)
+		}
+		keysList = append(keysList, keyList)
 	}
 
-	return keysList, nil
+	return keysList, metadata, nil
 }
 
 type KeysList struct {
 	AuthKeyID   int64             `json:"auth_key_id"`
 	CreatedAt   time.Time         `json:"created_at"`
 	Permissions store.Permissions `json:"permissions"`
+	Diff        *PermissionsDiff  `json:"diff,omitempty"`
+}
+
+// The difference between the permissions of a key and a target set.
+type PermissionsDiff struct {
+	Granted store.Permissions `json:"granted"`
+	Missing store.Permissions `json:"missing"`
+	Extra   store.Permissions `json:"extra"`
+}
+
+// Compute the difference between the key permissions and the target set. A main key
+// implicitly holds every permission, so nothing is reported as missing or extra.
+func diffPermissions(permissions, target store.Permissions) *PermissionsDiff {
+	diff := PermissionsDiff{
+		Granted: store.Permissions{},
+		Missing: store.Permissions{},
+		Extra:   store.Permissions{},
+	}
+	if permissions.Include(store.PermissionMain) {
+		diff.Granted = append(diff.Granted, target.Union(nil)...)
+		return &diff
+	}
+	missing, extra := permissions.Diff(target)
+	diff.Granted = append(diff.Granted, target.Intersect(permissions)...)
+	diff.Missing = append(diff.Missing, missing...)
+	diff.Extra = append(diff.Extra, extra...)
+	return &diff
 }
 
 // Create a new auth key for the authenticated user with the provided permissions.
 func (us *UsersService) AddUserKey(ctx context.Context, permissions store.Permissions) (store.Keys, error) {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Keys{}, err
+	}
 
-	keys, err := us.Store.Keys.New(authData.User.ID)
+	err = checkNotMainPermission(permissions)
 	if err != nil {
 		return store.Keys{}, err
 	}
 
-	err = us.Store.Permissions.ReplaceForKey(keys.ID, permissions...)
+	// The plain text version of the key is kept outside the transaction,
+	// it is returned to the caller once the key creation is committed.
+	var keys store.Keys
+	err = us.Store.WithTx(func(tx store.Store) error {
+		// Lock the user row, so concurrent requests can't both pass
+		// the limit check and exceed the limit once committed.
+		err := tx.Users.Lock(authData.User.ID)
+		if err != nil {
+			return err
+		}
+		err = us.checkKeysLimit(tx, authData.User.ID)
+		if err != nil {
+			return err
+		}
+
+		keys, err = tx.Keys.New(authData.User.ID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Permissions.ReplaceForKey(keys.ID, permissions...)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Append(authData.User.ID, store.AuditKeyCreated, map[string]interface{}{
+			"key_id":      keys.ID,
+			"permissions": permissions,
+			"by_key_id":   authData.Keys.ID,
+		})
+	})
 	if err != nil {
 		return store.Keys{}, err
 	}
@@ -291,10 +476,55 @@ func (us *UsersService) AddUserKey(ctx context.Context, permissions store.Permis
 	return keys, nil
 }
 
+// Return ErrTooManyKeys if the user already reached the maximum number of auth keys.
+// The keys are counted with the provided store, bound to the transaction creating
+// the new key.
+func (us *UsersService) checkKeysLimit(tx store.Store, userID int64) error {
+	if us.MaxKeys <= 0 {
+		return nil
+	}
+
+	userKeys, err := tx.Keys.GetAllForUser(userID)
+	if err != nil {
+		return err
+	}
+	count := len(userKeys)
+
+	// Exclude the main key from the count, recognized by its permission.
+	if !us.MaxKeysIncludeMain {
+		keyIDs := make([]int64, 0, len(userKeys))
+		for _, k := range userKeys {
+			keyIDs = append(keyIDs, k.ID)
+		}
+		permissions, err := tx.Permissions.GetAllForKeys(keyIDs)
+		if err != nil {
+			return err
+		}
+		for _, perms := range permissions {
+			if perms.Include(store.PermissionMain) {
+				count--
+			}
+		}
+	}
+
+	if count >= us.MaxKeys {
+		return ErrTooManyKeys
+	}
+	return nil
+}
+
 // Edit an existing auth key for the authenticated user with the provided permissions.
 // The main auth key for the account cannot be edited.
 func (us *UsersService) EditUserKey(ctx context.Context, keyID int64, permissions store.Permissions) (store.Keys, store.Permissions, error) {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Keys{}, store.Permissions{}, err
+	}
+
+	err = checkNotMainPermission(permissions)
+	if err != nil {
+		return store.Keys{}, store.Permissions{}, err
+	}
 
 	// Search the specified auth key.
 	var targetKeys *store.Keys
@@ -321,7 +551,19 @@ func (us *UsersService) EditUserKey(ctx context.Context, keyID int64, permission
 	}
 
 	// Replace old permissions with new permissions.
-	err = us.Store.Permissions.ReplaceForKey(targetKeys.ID, permissions...)
+	err = us.Store.WithTx(func(tx store.Store) error {
+		err := tx.Permissions.ReplaceForKey(targetKeys.ID, permissions...)
+		if err != nil {
+			return err
+		}
+
+		return tx.Audit.Append(authData.User.ID, store.AuditKeyEdited, map[string]interface{}{
+			"key_id":          targetKeys.ID,
+			"old_permissions": oldPermissions,
+			"permissions":     permissions,
+			"by_key_id":       authData.Keys.ID,
+		})
+	})
 	if err != nil {
 		return store.Keys{}, store.Permissions{}, err
 	}
@@ -332,7 +574,10 @@ func (us *UsersService) EditUserKey(ctx context.Context, keyID int64, permission
 // Delete an existing auth key for the authenticated user. The main auth key for the account
 // cannot be deleted.
 func (us *UsersService) DeleteUserKey(ctx context.Context, keyID int64) error {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return err
+	}
 
 	var targetKeys *store.Keys
 	userKeys, err := us.Store.Keys.GetAllForUser(authData.User.ID)
@@ -357,17 +602,22 @@ func (us *UsersService) DeleteUserKey(ctx context.Context, keyID int64) error {
 		return ErrMainKeysEdit
 	}
 
-	err = us.Store.Keys.DeleteKey(targetKeys.ID, targetKeys.UserID)
-	if err != nil {
-		switch {
-		case errors.Is(err, store.ErrRecordNotFound):
-			return store.ErrEditConflict
-		default:
-			return err
+	return us.Store.WithTx(func(tx store.Store) error {
+		err := tx.Keys.DeleteKey(targetKeys.ID, targetKeys.UserID)
+		if err != nil {
+			switch {
+			case errors.Is(err, store.ErrRecordNotFound):
+				return store.ErrEditConflict
+			default:
+				return err
+			}
 		}
-	}
 
-	return nil
+		return tx.Audit.Append(authData.User.ID, store.AuditKeyDeleted, map[string]interface{}{
+			"key_id":    targetKeys.ID,
+			"by_key_id": authData.Keys.ID,
+		})
+	})
 }
 
 // Retrieve the authentication data about the authenticated user.
@@ -377,7 +627,10 @@ func (us *UsersService) GetMe(ctx context.Context) (auth.Auth, error) {
 
 // Retrieve statistics about the user.
 func (us *UsersService) GetStats(ctx context.Context) (store.Stats, error) {
-	authData := auth.MustContextGetAuth(ctx)
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return store.Stats{}, err
+	}
 
 	stats, err := us.Store.Stats.GetForUser(authData.User.ID)
 	if err != nil {
@@ -386,3 +639,36 @@ func (us *UsersService) GetStats(ctx context.Context) (store.Stats, error) {
 
 	return stats, nil
 }
+
+// Retrieve the audit log entries of the authenticated user.
+func (us *UsersService) ListAudit(ctx context.Context, filter filters.Input) ([]store.AuditEntry, filters.Meta, error) {
+	authData, err := auth.ContextGetAuth(ctx)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+
+	entries, metadata, err := us.Store.Audit.GetAllForUser(authData.User.ID, filter)
+	if err != nil {
+		return nil, filters.Meta{}, err
+	}
+
+	return entries, metadata, nil
+}
+
+// Returns a filtered and paginated list of all the users, for administration.
+func (us *UsersService) ListAll(ctx context.Context, filter filters.Input) ([]store.User, filters.Meta, error) {
+	return us.Store.Users.GetAll(filter)
+}
+
+// The main permission is reserved to the main key created at registration. It is
+// rejected explicitly here, regardless of the validation performed upstream, since
+// the permissions store would accept any code present in the database and granting
+// it would escalate a secondary key to a main one.
+func checkNotMainPermission(permissions store.Permissions) error {
+	if permissions.Include(store.PermissionMain) {
+		v := validator.New()
+		v.AddError("permissions", "the main permission cannot be granted")
+		return v
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anBertoli/snap-vault/pkg/auth"
+	"github.com/anBertoli/snap-vault/pkg/store"
+	"github.com/anBertoli/snap-vault/pkg/store/storetest"
+	"github.com/anBertoli/snap-vault/pkg/validator"
+)
+
+// A new activation token can be requested even if the old ones were all
+// removed by the cleanup of the expired tokens.
+func TestRegenerateActivationTokenAfterCleanup(t *testing.T) {
+	s, _ := storetest.New(t)
+	us := &UsersService{Store: s}
+
+	email := storetest.Email("resend")
+	user, _, _, err := us.RegisterUser(context.Background(), "Test User", email, "pa55word-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Tokens.DeleteAllForUser(store.ScopeActivation, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, token, err := us.RegenerateActivationToken(context.Background(), email, "pa55word-test")
+	if err != nil {
+		t.Fatalf("regenerating token: %v", err)
+	}
+	activated, err := us.ActivateUser(context.Background(), token)
+	if err != nil {
+		t.Fatalf("activating with the new token: %v", err)
+	}
+	if !activated.Activated {
+		t.Fatal("user not activated")
+	}
+}
+
+// If the insert of the activation token fails, the registration is rolled back
+// and the user row is not left behind.
+func TestRegisterUserTokenFailure(t *testing.T) {
+	s, db := storetest.New(t)
+	us := &UsersService{Store: s}
+	storetest.FailWrites(t, db, "tokens", "INSERT", "fail-token", "true")
+
+	email := storetest.Email("fail-token")
+	_, _, _, err := us.RegisterUser(context.Background(), "Test User", email, "pa55word-test")
+	if err == nil {
+		t.Fatal("expected the registration to fail")
+	}
+
+	_, err = s.Users.GetForEmail(email)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected the user to be rolled back, got %v", err)
+	}
+}
+
+// The tokens are created with the configured lifetimes, and they are
+// rejected once expired.
+func TestTokenTTL(t *testing.T) {
+	s, _ := storetest.New(t)
+	us := &UsersService{Store: s, ActivationTTL: time.Second, RecoveryTTL: time.Second}
+
+	email := storetest.Email("ttl")
+	_, _, activationToken, err := us.RegisterUser(context.Background(), "Test User", email, "pa55word-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recoveryToken, err := us.GenKeyRecoveryToken(context.Background(), email, "pa55word-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := map[string]string{
+		store.ScopeActivation:      activationToken,
+		store.ScopeRecoverMainKeys: recoveryToken,
+	}
+	for scope, token := range tokens {
+		_, err := s.Users.GetForToken(scope, token)
+		if err != nil {
+			t.Fatalf("%s token rejected before its expiry: %v", scope, err)
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+	for scope, token := range tokens {
+		_, err := s.Users.GetForToken(scope, token)
+		if !errors.Is(err, store.ErrRecordNotFound) {
+			t.Fatalf("expected the expired %s token to be rejected, got %v", scope, err)
+		}
+	}
+}
+
+// Concurrent activations with the same token activate the user exactly once, the
+// other requests fail as with an invalid token.
+func TestActivateUserConcurrent(t *testing.T) {
+	s, _ := storetest.New(t)
+	us := &UsersService{Store: s}
+
+	email := storetest.Email("activate")
+	_, _, token, err := us.RegisterUser(context.Background(), "Test User", email, "pa55word-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 5
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		activated int
+	)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := us.ActivateUser(context.Background(), token)
+			var v validator.Validator
+			switch {
+			case err == nil && user.Activated:
+				mu.Lock()
+				activated++
+				mu.Unlock()
+			case !errors.As(err, &v) || v["token"] == "":
+				t.Errorf("unexpected result: %+v, %v", user, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if activated != 1 {
+		t.Fatalf("expected exactly one activation, got %d", activated)
+	}
+}
+
+// Concurrent requests creating keys can't exceed the limit of keys per user.
+func TestAddUserKeyConcurrentLimit(t *testing.T) {
+	s, _ := storetest.New(t)
+	us := &UsersService{Store: s, MaxKeys: 2}
+	user := storetest.NewUser(t, s, "keys-limit")
+	ctx := storetest.AuthContext(t, s, user)
+
+	const requests = 5
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created int
+	)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := us.AddUserKey(ctx, store.Permissions{store.PermissionListKeys})
+			switch {
+			case err == nil:
+				mu.Lock()
+				created++
+				mu.Unlock()
+			case !errors.Is(err, ErrTooManyKeys):
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if created != us.MaxKeys {
+		t.Fatalf("expected %d keys created, got %d", us.MaxKeys, created)
+	}
+}
+
+// Keys can be created up to the limit, the main key is counted only if configured,
+// and the next creation fails with ErrTooManyKeys.
+func TestAddUserKeyLimit(t *testing.T) {
+	s, _ := storetest.New(t)
+
+	tests := []struct {
+		name        string
+		includeMain bool
+		created     int
+	}{
+		{name: "main key excluded", created: 3},
+		{name: "main key included", includeMain: true, created: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := &UsersService{Store: s, MaxKeys: 3, MaxKeysIncludeMain: tt.includeMain}
+			user := storetest.NewUser(t, s, "keys-limit")
+			ctx := storetest.AuthContext(t, s, user)
+
+			for i := 0; i < tt.created; i++ {
+				_, err := us.AddUserKey(ctx, store.Permissions{store.PermissionListKeys})
+				if err != nil {
+					t.Fatalf("key %d: %v", i, err)
+				}
+			}
+			_, err := us.AddUserKey(ctx, store.Permissions{store.PermissionListKeys})
+			if !errors.Is(err, ErrTooManyKeys) {
+				t.Fatalf("expected ErrTooManyKeys over the limit, got %v", err)
+			}
+		})
+	}
+}
+
+// The admin permission of the main key is carried over to the regenerated one.
+func TestRegenerateMainKeyKeepsAdmin(t *testing.T) {
+	s, _ := storetest.New(t)
+	us := &UsersService{Store: s}
+
+	email := storetest.Email("admin")
+	user, keys, _, err := us.RegisterUser(context.Background(), "Test User", email, "pa55word-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Permissions.GrantForKey(keys.ID, store.PermissionAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.Tokens.New(user.ID, time.Hour, store.ScopeRecoverMainKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKeys, err := us.RegenerateMainKey(context.Background(), token.Plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	perms, err := s.Permissions.GetAllForKey(newKeys.AuthKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !perms.Include(store.PermissionMain) || !perms.Include(store.PermissionAdmin) {
+		t.Fatalf("expected main and admin permissions, got %v", perms)
+	}
+	_, err = s.Keys.GetForPlainKey(keys.AuthKey)
+	if !errors.Is(err, store.ErrRecordNotFound) {
+		t.Fatalf("expected the old main key to be deleted, got %v", err)
+	}
+}
+
+// The main key is recovered through the full chain of middlewares, as wired in the
+// API. The recovery token is consumed: it can't be used again, also by concurrent
+// requests, and the old main key stops working.
+func TestRecoverMainKeyChain(t *testing.T) {
+	s, _ := storetest.New(t)
+	var service Service = &UsersService{Store: s}
+	service = &ValidationMiddleware{Service: service}
+	service = &LockoutMiddleware{Service: service, MaxAttempts: 5, Window: time.Minute}
+	service = &AuthMiddleware{Service: service, Auth: auth.Authenticator{Store: s}}
+
+	email := storetest.Email("recover")
+	_, keys, _, err := service.RegisterUser(context.Background(), "Test User", email, "pa55word-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := service.GenKeyRecoveryToken(context.Background(), email, "pa55word-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const requests = 5
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		newKeys []store.Keys
+	)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			k, err := service.RegenerateMainKey(context.Background(), token)
+			var v validator.Validator
+			switch {
+			case err == nil:
+				mu.Lock()
+				newKeys = append(newKeys, k)
+				mu.Unlock()
+			case !errors.As(err, &v) || v["token"] == "":
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(newKeys) != 1 {
+		t.Fatalf("expected exactly one regenerated key, got %d", len(newKeys))
+	}
+
+	// The new key authenticates the user, the old one doesn't.
+	ctx := auth.ContextSetKey(context.Background(), newKeys[0].AuthKey)
+	me, err := service.GetMe(ctx)
+	if err != nil {
+		t.Fatalf("authenticating with the new key: %v", err)
+	}
+	if me.User.Email != email || !me.Perms.Include(store.PermissionMain) {
+		t.Fatalf("unexpected auth data: %+v", me)
+	}
+	ctx = auth.ContextSetKey(context.Background(), keys.AuthKey)
+	_, err = service.GetMe(ctx)
+	if !errors.Is(err, auth.ErrUnauthenticated) {
+		t.Fatalf("expected the old key to be rejected, got %v", err)
+	}
+
+	_, err = service.RegenerateMainKey(context.Background(), "not-a-token")
+	var v validator.Validator
+	if !errors.As(err, &v) || v["token"] == "" {
+		t.Fatalf("expected a token validation error, got %v", err)
+	}
+}
+
+// The permissions of a key are compared with the target set, a main key
+// holds all of them.
+func TestDiffPermissions(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions store.Permissions
+		target      store.Permissions
+		want        PermissionsDiff
+	}{
+		{
+			name:        "granted, missing and extra",
+			permissions: store.Permissions{store.PermissionListKeys, store.PermissionListImages},
+			target:      store.Permissions{store.PermissionListImages, store.PermissionCreateImage},
+			want: PermissionsDiff{
+				Granted: store.Permissions{store.PermissionListImages},
+				Missing: store.Permissions{store.PermissionCreateImage},
+				Extra:   store.Permissions{store.PermissionListKeys},
+			},
+		},
+		{
+			name:        "all granted",
+			permissions: store.Permissions{store.PermissionListImages, store.PermissionCreateImage},
+			target:      store.Permissions{store.PermissionCreateImage, store.PermissionListImages},
+			want: PermissionsDiff{
+				Granted: store.Permissions{store.PermissionCreateImage, store.PermissionListImages},
+				Missing: store.Permissions{},
+				Extra:   store.Permissions{},
+			},
+		},
+		{
+			name:        "no permissions",
+			permissions: store.Permissions{},
+			target:      store.Permissions{store.PermissionListImages},
+			want: PermissionsDiff{
+				Granted: store.Permissions{},
+				Missing: store.Permissions{store.PermissionListImages},
+				Extra:   store.Permissions{},
+			},
+		},
+		{
+			name:        "main key",
+			permissions: store.Permissions{store.PermissionMain},
+			target:      store.Permissions{store.PermissionListImages, store.PermissionDeleteKeys, store.PermissionListImages},
+			want: PermissionsDiff{
+				Granted: store.Permissions{store.PermissionListImages, store.PermissionDeleteKeys},
+				Missing: store.Permissions{},
+				Extra:   store.Permissions{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := diffPermissions(tt.permissions, tt.target)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, *got)
+			}
+		})
+	}
+}
+
+// The main permission can't be granted to other keys.
+func TestCheckNotMainPermission(t *testing.T) {
+	err := checkNotMainPermission(store.Permissions{store.PermissionListKeys, store.PermissionMain})
+	var v validator.Validator
+	if !errors.As(err, &v) || v["permissions"] == "" {
+		t.Fatalf("expected a permissions validation error, got %v", err)
+	}
+	err = checkNotMainPermission(store.Permissions{store.PermissionListKeys, store.PermissionAdmin})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = checkNotMainPermission(nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}